@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// apiKeyPrefix starts every API key, so that leaked keys are easy to
+// recognise (for example by secret scanners).
+const apiKeyPrefix = "cak_"
+
+// validateAPIKey is the part of validateTokenMiddleware that handles
+// Authorization: ApiKey headers. A valid key is resolved to the user who
+// created it, just as a Bearer token is.
+func (env *Env) validateAPIKey(w http.ResponseWriter, r *http.Request, keyString string, next http.HandlerFunc) {
+	key, err := env.db.UseAPIKey(hashToken(keyString), time.Now())
+	if err != nil {
+		sendAuthFail(w)
+		return
+	}
+
+	// unlike tokens, keys can only belong to registered users
+	user, err := env.db.GetUserByID(key.UserID)
+	if err != nil || user == nil {
+		sendAuthFail(w)
+		return
+	}
+	if !allowUserStatus(w, user) {
+		return
+	}
+
+	ti := &tokenInfo{
+		Email:    user.Email,
+		MFA:      key.MFA,
+		Scopes:   env.userScopes(user),
+		APIKeyID: key.ID,
+	}
+	if key.Expires != nil {
+		ti.Expires = *key.Expires
+	}
+
+	// good to go! set context and move on
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), ti)
+	next(w, r.WithContext(ctx))
+}
+
+// usingAPIKey reports whether the current request was authenticated with
+// an API key rather than a token.
+func usingAPIKey(r *http.Request) bool {
+	ti, ok := r.Context().Value(tokenContextKey(0)).(*tokenInfo)
+	return ok && ti.APIKeyID != ""
+}
+
+func (env *Env) getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	keys, err := env.db.GetAPIKeysForUserID(user.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(keys)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+type newAPIKeyReq struct {
+	Name string `json:"name"`
+	// optional lifetime, as a Go duration string such as "720h"
+	ExpiresIn string `json:"expires_in"`
+}
+
+// newAPIKeyResp is the JSON body returned when a key is created. This is
+// the only time that the key itself is shown.
+type newAPIKeyResp struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+func (env *Env) newAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// a leaked key shouldn't be usable to mint more keys
+	if usingAPIKey(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "API keys cannot be used to create API keys"}`)
+		return
+	}
+
+	// extract JSON content
+	var req newAPIKeyReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply name for API key"}`)
+		return
+	}
+
+	now := time.Now()
+	key := &models.APIKey{
+		UserID:  user.ID,
+		Name:    req.Name,
+		MFA:     tokenHasMFA(r),
+		Created: now,
+	}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "expires_in must be a positive duration, such as 720h"}`)
+			return
+		}
+		expires := now.Add(d)
+		key.Expires = &expires
+	}
+
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	key.ID = hex.EncodeToString(b)
+	secret, err := generateRandomToken()
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	keyString := apiKeyPrefix + secret
+	key.KeyHash = hashToken(keyString)
+
+	err = env.db.AddAPIKey(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving API key"}`)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	js, err := json.Marshal(&newAPIKeyResp{APIKey: key, Key: keyString})
+	if err != nil {
+		// created resource, but some problem with marshalling the JSON
+		// response; just return empty in this case
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	id := mux.Vars(r)["keyid"]
+	err := env.db.DeleteAPIKey(user.ID, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "API key not found"}`)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status": "revoked API key %s"}`, id)
+}
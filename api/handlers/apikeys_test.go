@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// createTestAPIKey creates a key for the given user through the handler,
+// and returns the response.
+func createTestAPIKey(t *testing.T, env *Env, email string, mfa bool, body string) *newAPIKeyResp {
+	rec := requestAsUser(t, env, "POST", "/", env.newAPIKeyHandler, "", email, mfa, nil, body)
+	if 201 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 201, rec.Code)
+	}
+	resp := &newAPIKeyResp{}
+	err := json.Unmarshal(rec.Body.Bytes(), resp)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return resp
+}
+
+func TestCanCreateAPIKey(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	resp := createTestAPIKey(t, env, "janedoe@example.com", true, `{"name": "ci", "expires_in": "24h"}`)
+	if !strings.HasPrefix(resp.Key, apiKeyPrefix) {
+		t.Errorf("expected key with prefix %s, got %s", apiKeyPrefix, resp.Key)
+	}
+	if resp.Name != "ci" {
+		t.Errorf("expected %v, got %v", "ci", resp.Name)
+	}
+	if resp.Expires == nil {
+		t.Errorf("expected expiry, got nil")
+	}
+
+	// only the hash is stored
+	saved, ok := db.apiKeys[resp.ID]
+	if !ok {
+		t.Fatalf("expected key to be saved, but it wasn't")
+	}
+	if saved.KeyHash != hashToken(resp.Key) {
+		t.Errorf("expected %v, got %v", hashToken(resp.Key), saved.KeyHash)
+	}
+	if !saved.MFA {
+		t.Errorf("expected %v, got %v", true, saved.MFA)
+	}
+}
+
+func TestCannotCreateAPIKeyWithoutName(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newAPIKeyHandler, "", "janedoe@example.com", false, nil, `{"expires_in": "24h"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func TestCanListAPIKeysWithoutSecrets(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", false, `{"name": "ci"}`)
+	createTestAPIKey(t, env, "johndoe@example.com", false, `{"name": "other"}`)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me/apikeys", nil)
+	user, _ := db.GetUserByEmail("janedoe@example.com")
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey(0), user))
+	http.HandlerFunc(env.getAPIKeysHandler).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	if strings.Contains(rec.Body.String(), resp.Key) || strings.Contains(rec.Body.String(), hashToken(resp.Key)) {
+		t.Errorf("expected no key or hash in listing, got %s", rec.Body.String())
+	}
+	var keys []*models.APIKey
+	err := json.Unmarshal(rec.Body.Bytes(), &keys)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(keys))
+	}
+	if keys[0].ID != resp.ID {
+		t.Errorf("expected %v, got %v", resp.ID, keys[0].ID)
+	}
+}
+
+func callWithAPIKey(env *Env, key string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/users", nil)
+	req.Header.Set("Authorization", "ApiKey "+key)
+	http.HandlerFunc(env.validateTokenMiddleware(env.getUsersHandler)).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanValidateAPIKey(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", true, `{"name": "ci"}`)
+
+	rec := callWithAPIKey(env, resp.Key)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	if db.apiKeys[resp.ID].LastUsed == nil {
+		t.Errorf("expected last used time to be recorded, got nil")
+	}
+}
+
+func TestAPIKeyWithoutMFACannotAccessAdmin(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", false, `{"name": "ci"}`)
+
+	rec := callWithAPIKey(env, resp.Key)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestCannotValidateUnknownOrExpiredAPIKey(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", true, `{"name": "ci"}`)
+	expired := time.Now().Add(-time.Minute)
+	db.apiKeys[resp.ID].Expires = &expired
+
+	for _, key := range []string{resp.Key, "cak_unknown"} {
+		rec := callWithAPIKey(env, key)
+		if 401 != rec.Code {
+			t.Errorf("Expected %d, got %d", 401, rec.Code)
+		}
+	}
+}
+
+func TestCannotCreateAPIKeyWithAPIKey(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", true, `{"name": "ci"}`)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/me/apikeys", strings.NewReader(`{"name": "another"}`))
+	req.Header.Set("Authorization", "ApiKey "+resp.Key)
+	http.HandlerFunc(env.validateTokenMiddleware(env.newAPIKeyHandler)).ServeHTTP(rec, req)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestCanRevokeOwnAPIKeyOnly(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", true, `{"name": "ci"}`)
+
+	revoke := func(email string) int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/me/apikeys/"+resp.ID+"/revoke", nil)
+		req = mux.SetURLVars(req, map[string]string{"keyid": resp.ID})
+		user, _ := db.GetUserByEmail(email)
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey(0), user))
+		http.HandlerFunc(env.revokeAPIKeyHandler).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := revoke("johndoe@example.com"); 404 != code {
+		t.Errorf("Expected %d, got %d", 404, code)
+	}
+	if code := revoke("janedoe@example.com"); 200 != code {
+		t.Errorf("Expected %d, got %d", 200, code)
+	}
+	if rec := callWithAPIKey(env, resp.Key); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestAPIKeyFailsAfterRevokingAllTokens(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring(), revocations: newRevocationCache(time.Minute)}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", true, `{"name": "ci"}`)
+
+	rec := requestAsUser(t, env, "POST", "/admin/users/914611345/revoke", env.revokeUserTokensHandler, "users:write", "janedoe@example.com", true, map[string]string{"id": "914611345"}, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	if rec := callWithAPIKey(env, resp.Key); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
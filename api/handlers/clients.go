@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// clientSecretPrefix starts every client secret, so that leaked secrets
+// are easy to recognise (for example by secret scanners).
+const clientSecretPrefix = "ccs_"
+
+// oauthTokenResponse is the JSON body returned by the OAuth2 token
+// endpoint, as described in RFC 6749 section 5.1.
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// sendOAuthError writes an error response from the OAuth2 token endpoint,
+// using one of the error codes from RFC 6749 section 5.2.
+func sendOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": "%s", "error_description": "%s"}`, code, description)
+}
+
+// clientCredentials returns the client ID and secret that a request to
+// the token endpoint authenticated with, either with HTTP Basic auth or
+// in the form body, and whether Basic auth was used. Both ways at once
+// are not allowed, and give an error.
+func clientCredentials(r *http.Request) (string, string, bool, error) {
+	formID := r.PostForm.Get("client_id")
+	formSecret := r.PostForm.Get("client_secret")
+
+	basicID, basicSecret, ok := r.BasicAuth()
+	if !ok {
+		return formID, formSecret, false, nil
+	}
+	if formSecret != "" {
+		return "", "", true, fmt.Errorf("client credentials sent in more than one way")
+	}
+
+	// RFC 6749 section 2.3.1 has the ID and secret form-encoded before
+	// they are put in the header
+	id, err := url.QueryUnescape(basicID)
+	if err != nil {
+		return "", "", true, err
+	}
+	secret, err := url.QueryUnescape(basicSecret)
+	if err != nil {
+		return "", "", true, err
+	}
+	return id, secret, true, nil
+}
+
+// authenticateClient returns the client with the given ID, if the secret
+// is the one it was registered with.
+func (env *Env) authenticateClient(id string, secret string) (*models.Client, bool) {
+	secretHash := hashToken(secret)
+	c, err := env.db.GetClient(id)
+	if err != nil || c == nil {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(secretHash), []byte(c.SecretHash)) != 1 {
+		return nil, false
+	}
+	return c, true
+}
+
+// oauthTokenHandler is a token endpoint following RFC 6749, for the
+// client_credentials grant. Users log in through /oauth/getToken instead.
+func (env *Env) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses, which must not be cached since they contain
+	// tokens
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// get form values
+	err := r.ParseForm()
+	if err != nil {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_request", "Couldn't parse form")
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+	case "":
+		sendOAuthError(w, http.StatusBadRequest, "invalid_request", "Must supply grant_type")
+		return
+	default:
+		sendOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the client_credentials grant is supported")
+		return
+	}
+
+	id, secret, basic, err := clientCredentials(r)
+	if err != nil {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_request", "Couldn't read client credentials")
+		return
+	}
+	c, ok := env.authenticateClient(id, secret)
+	var owner *models.User
+	if ok {
+		owner, err = env.db.GetUserByID(c.UserID)
+		ok = err == nil && owner != nil
+	}
+	if !ok {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		sendOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	// clients can ask for a narrower scope than they were registered with,
+	// but not a wider one
+	scopes, err := parseScope(r.PostForm.Get("scope"))
+	if err != nil {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_scope", err.Error())
+		return
+	}
+	scope := strings.Join(scopes, " ")
+	if scope == "" {
+		scope = c.Scope
+	} else if !scopeWithin(scope, c.Scope) {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope exceeds that of client")
+		return
+	}
+
+	// clients act as the admin who registered them, who will have passed
+	// a second factor to do so; and nothing more than that admin could
+	ttl := lifetime(env.accessTokenTTL, defaultAccessTokenTTL)
+	granted := env.grantScope(owner.Email, scope)
+	tknString, err := env.signToken(&tokenParams{
+		email:    owner.Email,
+		audience: env.tokenAudience(),
+		clientID: c.ID,
+		scope:    granted,
+		mfa:      true,
+		expires:  time.Now().Add(ttl),
+	})
+	if err != nil {
+		sendOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't create token")
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(&oauthTokenResponse{
+		AccessToken: tknString,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ttl.Seconds()),
+		Scope:       granted,
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) getClientsHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	clients, err := env.db.GetAllClients()
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(clients)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+type newClientReq struct {
+	Name string `json:"name"`
+	// space-separated scopes that the client can be granted
+	Scope string `json:"scope"`
+}
+
+// newClientResp is the JSON body returned when a client is registered.
+// This is the only time that its secret is shown.
+type newClientResp struct {
+	*models.Client
+	Secret string `json:"client_secret"`
+}
+
+func (env *Env) newClientHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	// extract JSON content
+	var req newClientReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply name for client"}`)
+		return
+	}
+	scopes, err := parseScope(req.Scope)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%s"}`, err)
+		return
+	}
+	if len(scopes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply scope for client"}`)
+		return
+	}
+	scope := strings.Join(scopes, " ")
+	if !scopeWithin(scope, strings.Join(env.userScopes(user), " ")) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "clients can't be given scopes that their owner doesn't have"}`)
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	secret, err := generateRandomToken()
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	secret = clientSecretPrefix + secret
+	c := &models.Client{
+		ID:         hex.EncodeToString(b),
+		UserID:     user.ID,
+		Name:       req.Name,
+		SecretHash: hashToken(secret),
+		Scope:      scope,
+		Created:    time.Now(),
+	}
+
+	err = env.db.AddClient(c)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving client"}`)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	js, err := json.Marshal(&newClientResp{Client: c, Secret: secret})
+	if err != nil {
+		// created resource, but some problem with marshalling the JSON
+		// response; just return empty in this case
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) revokeClientHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	// tokens already issued to the client stop working too, since
+	// validateTokenMiddleware checks that their client still exists
+	id := mux.Vars(r)["clientid"]
+	err := env.db.DeleteClient(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "client not found"}`)
+		return
+	}
+	env.revocations.recordClientRevoked(id, time.Now())
+
+	fmt.Fprintf(w, `{"status": "revoked client %s"}`, id)
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func registerTestClient(t *testing.T, env *Env, body string) *newClientResp {
+	rec := requestAsUser(t, env, "POST", "/", env.newClientHandler, "", "janedoe@example.com", true, nil, body)
+	if 201 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 201, rec.Code)
+	}
+	resp := &newClientResp{}
+	err := json.Unmarshal(rec.Body.Bytes(), resp)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return resp
+}
+
+// postOAuthToken posts a token request with the given form values, and
+// with HTTP Basic client authentication if basicID is not empty.
+func postOAuthToken(env *Env, values map[string]string, basicID string, basicSecret string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	for k, v := range values {
+		data.Set(k, v)
+	}
+	req, _ := http.NewRequest("POST", "/oauth/token", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicID != "" {
+		req.SetBasicAuth(basicID, basicSecret)
+	}
+	http.HandlerFunc(env.oauthTokenHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeOAuthResponse(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	var rj map[string]interface{}
+	err := json.Unmarshal(rec.Body.Bytes(), &rj)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return rj
+}
+
+func TestCanGetTokenWithClientCredentials(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	c := registerTestClient(t, env, `{"name": "reports", "scope": "history:read users:read"}`)
+	if db.clients[c.ID].SecretHash == c.Secret || !strings.HasPrefix(c.Secret, clientSecretPrefix) {
+		t.Errorf("expected hashed secret to be stored")
+	}
+
+	// with Basic auth, and with credentials in the body
+	for _, basic := range []bool{true, false} {
+		values := map[string]string{"grant_type": "client_credentials"}
+		var rec *httptest.ResponseRecorder
+		if basic {
+			rec = postOAuthToken(env, values, c.ID, c.Secret)
+		} else {
+			values["client_id"] = c.ID
+			values["client_secret"] = c.Secret
+			rec = postOAuthToken(env, values, "", "")
+		}
+		if 200 != rec.Code {
+			t.Fatalf("Expected %d, got %d", 200, rec.Code)
+		}
+		if rec.Result().Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("expected %v, got %v", "no-store", rec.Result().Header.Get("Cache-Control"))
+		}
+		rj := decodeOAuthResponse(t, rec)
+		if rj["token_type"] != "Bearer" {
+			t.Errorf("expected %v, got %v", "Bearer", rj["token_type"])
+		}
+		if rj["scope"] != "history:read users:read" {
+			t.Errorf("expected %v, got %v", "history:read users:read", rj["scope"])
+		}
+		if _, ok := rj["refresh_token"]; ok {
+			t.Errorf("expected no refresh token, got one")
+		}
+
+		// and the token can be used on routes within its scope
+		tkn := rj["access_token"].(string)
+		if claims := parseTestToken(t, tkn); claims["client_id"] != c.ID {
+			t.Errorf("expected %v, got %v", c.ID, claims["client_id"])
+		}
+		rec = callWithToken(env, requireScopes(env.getUsersHandler, scopeUsersRead), "GET", tkn, nil)
+		if 200 != rec.Code {
+			t.Errorf("Expected %d, got %d", 200, rec.Code)
+		}
+		rec = callWithToken(env, requireScopes(env.newUserHandler, scopeUsersWrite), "POST", tkn, nil)
+		if 403 != rec.Code {
+			t.Errorf("Expected %d, got %d", 403, rec.Code)
+		}
+	}
+}
+
+func TestOAuthTokenErrors(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	c := registerTestClient(t, env, `{"name": "reports", "scope": "history:read"}`)
+
+	tests := []struct {
+		name   string
+		values map[string]string
+		basic  bool
+		secret string
+		code   int
+		err    string
+	}{
+		{"no grant type", map[string]string{}, true, c.Secret, 400, "invalid_request"},
+		{"password grant", map[string]string{"grant_type": "password"}, true, c.Secret, 400, "unsupported_grant_type"},
+		{"wrong secret", map[string]string{"grant_type": "client_credentials"}, true, "ccs_wrong", 401, "invalid_client"},
+		{"no credentials", map[string]string{"grant_type": "client_credentials"}, false, "", 401, "invalid_client"},
+		{"two ways", map[string]string{"grant_type": "client_credentials", "client_secret": c.Secret}, true, c.Secret, 400, "invalid_request"},
+		{"wider scope", map[string]string{"grant_type": "client_credentials", "scope": "users:write"}, true, c.Secret, 400, "invalid_scope"},
+		{"unknown scope", map[string]string{"grant_type": "client_credentials", "scope": "everything"}, true, c.Secret, 400, "invalid_scope"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			basicID := ""
+			if tc.basic {
+				basicID = c.ID
+			}
+			rec := postOAuthToken(env, tc.values, basicID, tc.secret)
+			if tc.code != rec.Code {
+				t.Errorf("Expected %d, got %d", tc.code, rec.Code)
+			}
+			if rj := decodeOAuthResponse(t, rec); rj["error"] != tc.err {
+				t.Errorf("expected %v, got %v", tc.err, rj["error"])
+			}
+		})
+	}
+}
+
+func TestRevokedClientTokensStopWorking(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), revocations: newRevocationCache(time.Minute)}
+	c := registerTestClient(t, env, `{"name": "reports", "scope": "history:read"}`)
+	rec := postOAuthToken(env, map[string]string{"grant_type": "client_credentials"}, c.ID, c.Secret)
+	tkn := decodeOAuthResponse(t, rec)["access_token"].(string)
+
+	// the client is cached as active once its token has been used, but
+	// revoking it here takes effect right away
+	if rec = callWithToken(env, env.testHandler, "GET", tkn, nil); 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/clients/"+c.ID+"/revoke", nil)
+	req = mux.SetURLVars(req, map[string]string{"clientid": c.ID})
+	admin, _ := env.createToken("janedoe@example.com", "", "clients:write", true)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	http.HandlerFunc(env.validateTokenMiddleware(requireScopes(env.revokeClientHandler, scopeClientsWrite))).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	if rec = callWithToken(env, env.testHandler, "GET", tkn, nil); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+	rec = postOAuthToken(env, map[string]string{"grant_type": "client_credentials"}, c.ID, c.Secret)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestClientStatusIsCached(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring(), revocations: newRevocationCache(time.Minute)}
+	c := registerTestClient(t, env, `{"name": "reports", "scope": "history:read"}`)
+	rec := postOAuthToken(env, map[string]string{"grant_type": "client_credentials"}, c.ID, c.Secret)
+	tkn := decodeOAuthResponse(t, rec)["access_token"].(string)
+
+	if rec = callWithToken(env, env.testHandler, "GET", tkn, nil); 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// a client deleted by another replica is still taken as active until
+	// the cached answer expires
+	delete(db.clients, c.ID)
+	if rec = callWithToken(env, env.testHandler, "GET", tkn, nil); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+	env.revocations.prune(time.Now().Add(time.Minute))
+	if rec = callWithToken(env, env.testHandler, "GET", tkn, nil); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotRegisterClientWithoutScope(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	for _, body := range []string{`{"name": "reports"}`, `{"name": "reports", "scope": "everything"}`, `{"scope": "history:read"}`} {
+		rec := requestAsUser(t, env, "POST", "/", env.newClientHandler, "", "janedoe@example.com", true, nil, body)
+		if 400 != rec.Code {
+			t.Errorf("%s: Expected %d, got %d", body, 400, rec.Code)
+		}
+	}
+}
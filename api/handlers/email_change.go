@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/swinslow/containerapp/api/mailer"
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// actions recorded in the audit log
+const (
+	auditEmailChangeRequested = "email_change_requested"
+	auditEmailChanged         = "email_changed"
+)
+
+// audit adds an event to the audit log for a change that the actor made
+// to the target user.
+func (env *Env) audit(actorID uint32, targetID uint32, action string, details string) error {
+	return env.db.AddAuditEvent(&models.AuditEvent{
+		Date:     time.Now(),
+		ActorID:  actorID,
+		TargetID: targetID,
+		Action:   action,
+		Details:  details,
+	})
+}
+
+type emailChangeReq struct {
+	Email string `json:"email"`
+}
+
+// requestEmailChange handles a request by the given user to change the
+// email address of the target user, who may be the same user. Nothing is
+// changed until the new address is confirmed: a link to do that is sent
+// to it through the mailer.
+func (env *Env) requestEmailChange(w http.ResponseWriter, r *http.Request, user *models.User, target *models.User) {
+	// extract JSON content
+	var req emailChangeReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply email"}`)
+		return
+	}
+	email := normalizedEmail(w, req.Email)
+	if email == "" {
+		return
+	}
+	if email == target.Email {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "user %d already has email %s"}`, target.ID, email)
+		return
+	}
+	if userCheck, err := env.db.GetUserByEmail(email); err == nil && userCheck != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user with email %s already exists"}`, email)
+		return
+	}
+
+	// without a mail server, the new address can't be confirmed
+	if env.mailer == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "email can't be changed without a mail server to confirm the new address"}`)
+		return
+	}
+
+	token, err := generateRandomToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create email change"}`)
+		return
+	}
+	ttl := defaultEmailChangeTTL
+	err = env.db.AddEmailChange(&models.EmailChange{
+		TokenHash:   hashToken(token),
+		UserID:      target.ID,
+		NewEmail:    email,
+		RequestedBy: user.ID,
+		Expires:     time.Now().Add(ttl),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create email change"}`)
+		return
+	}
+	err = env.audit(user.ID, target.ID, auditEmailChangeRequested, fmt.Sprintf("%s to %s", target.Email, email))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error writing audit log"}`)
+		return
+	}
+
+	msg := &mailer.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Use this link to confirm that this is your new email address. It will expire in %s and can only be used once.\n\n%s?token=%s\n\nIf you didn't ask for this change, you can ignore this message.\n",
+			ttl, env.emailChangeURL, url.QueryEscape(token)),
+	}
+	err = env.mailer.Send(msg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't send confirmation"}`)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, `{"status": "confirmation sent to %s"}`, email)
+}
+
+func (env *Env) changeMyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	env.requestEmailChange(w, r, user, user)
+}
+
+func (env *Env) changeUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractManagedUser(w, r, user)
+	if target == nil {
+		return
+	}
+
+	env.requestEmailChange(w, r, user, target)
+}
+
+// confirmEmailHandler completes an email change. It doesn't need a token,
+// since following the link sent to the new address is what proves that
+// it belongs to the user.
+func (env *Env) confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// get form values
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Couldn't parse form"}`)
+		return
+	}
+	token := r.Form.Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply token in confirm request"}`)
+		return
+	}
+
+	ec, err := env.db.ConsumeEmailChange(hashToken(token), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired email change"}`)
+		return
+	}
+	target, err := env.db.GetUserByID(ec.UserID)
+	if err != nil || target == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "user %d not found"}`, ec.UserID)
+		return
+	}
+
+	// someone else may have registered with the address in the meantime
+	oldEmail := target.Email
+	err = env.db.UpdateUser(target.ID, ec.NewEmail, target.Name)
+	if _, ok := err.(*models.DuplicateEmailError); ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user with email %s already exists"}`, ec.NewEmail)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving user"}`)
+		return
+	}
+
+	// tokens name the user by email, so those issued under the old one
+	// mustn't be usable by whoever registers with it next; target still
+	// has the old one here
+	err = env.revokeAllTokens(target)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error revoking tokens"}`)
+		return
+	}
+
+	// the change has been made by now, so a failure to record it or to
+	// tell the old address about it is only logged
+	err = env.audit(ec.RequestedBy, target.ID, auditEmailChanged, fmt.Sprintf("%s to %s", oldEmail, ec.NewEmail))
+	if err != nil {
+		log.Printf("error writing audit log: %v", err)
+	}
+	if env.mailer != nil {
+		err = env.mailer.Send(&mailer.Message{
+			To:      oldEmail,
+			Subject: "Your email address was changed",
+			Body:    fmt.Sprintf("The email address for your account was changed to %s. If you didn't expect this, contact an administrator.\n", ec.NewEmail),
+		})
+		if err != nil {
+			log.Printf("error sending email change notice: %v", err)
+		}
+	}
+
+	fmt.Fprintf(w, `{"status": "email changed to %s"}`, ec.NewEmail)
+}
+
+func (env *Env) getUserAuditHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractPathUser(w, r)
+	if target == nil {
+		return
+	}
+
+	events, err := env.db.GetAuditEventsForUserID(target.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/swinslow/containerapp/api/mailer"
+	"github.com/swinslow/containerapp/api/models"
+)
+
+func extractEmailChangeToken(t *testing.T, body string) string {
+	i := strings.Index(body, "?token=")
+	if i == -1 {
+		t.Fatalf("couldn't find email change token in %q", body)
+	}
+	token := body[i+len("?token="):]
+	if j := strings.Index(token, "\n"); j != -1 {
+		token = token[:j]
+	}
+	token, err := url.QueryUnescape(token)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return token
+}
+
+func postConfirmEmail(env *Env, token string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("token", token)
+	req := httptest.NewRequest("POST", "/email/confirm", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.confirmEmailHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanChangeOwnEmailAfterConfirming(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m, emailChangeURL: "http://localhost:3000/confirmEmail"}
+
+	rec := requestAsUser(t, env, "POST", "/", env.changeMyEmailHandler, scopeAccount, "johndoe@example.com", true, nil, `{"email": "john@example.com"}`)
+	if 202 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 202, rec.Code)
+	}
+
+	// nothing changes until the new address is confirmed
+	user, _ := db.GetUserByID(91461)
+	if user.Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", user.Email)
+	}
+	msgs := m.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(msgs))
+	}
+	if msgs[0].To != "john@example.com" {
+		t.Errorf("expected %v, got %v", "john@example.com", msgs[0].To)
+	}
+	token := extractEmailChangeToken(t, msgs[0].Body)
+
+	rec = postConfirmEmail(env, token)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	user, _ = db.GetUserByID(91461)
+	if user.Email != "john@example.com" {
+		t.Errorf("expected %v, got %v", "john@example.com", user.Email)
+	}
+
+	// tokens for the old email are revoked, and the old address is told
+	if _, ok := db.revokedBefore["johndoe@example.com"]; !ok {
+		t.Errorf("expected tokens to be revoked, but they weren't")
+	}
+	msgs = m.Messages()
+	if len(msgs) != 2 || msgs[1].To != "johndoe@example.com" {
+		t.Errorf("expected notice to %v, got %v", "johndoe@example.com", msgs)
+	}
+
+	// and the link only works once
+	rec = postConfirmEmail(env, token)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestAdminCanChangeUserEmailAndSeeAuditLog(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+	vars := map[string]string{"id": "91461"}
+
+	rec := requestAsUser(t, env, "POST", "/", env.changeUserEmailHandler, scopeUsersWrite, "janedoe@example.com", true, vars, `{"email": "john@example.com"}`)
+	if 202 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 202, rec.Code)
+	}
+	rec = postConfirmEmail(env, extractEmailChangeToken(t, m.Messages()[0].Body))
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	rec = requestAsUser(t, env, "GET", "/", env.getUserAuditHandler, scopeUsersRead, "janedoe@example.com", true, vars, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var events []*models.AuditEvent
+	err := json.Unmarshal(rec.Body.Bytes(), &events)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(events))
+	}
+	if events[0].Action != auditEmailChanged || events[1].Action != auditEmailChangeRequested {
+		t.Errorf("expected %v then %v, got %v then %v", auditEmailChanged, auditEmailChangeRequested, events[0].Action, events[1].Action)
+	}
+	if events[0].ActorID != 914611345 || events[0].TargetID != 91461 {
+		t.Errorf("expected change by 914611345 to 91461, got by %d to %d", events[0].ActorID, events[0].TargetID)
+	}
+	wantDetails := "johndoe@example.com to john@example.com"
+	if events[0].Details != wantDetails {
+		t.Errorf("expected %v, got %v", wantDetails, events[0].Details)
+	}
+}
+
+func TestCannotChangeEmailToExistingUsersEmail(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+
+	rec := requestAsUser(t, env, "POST", "/", env.changeMyEmailHandler, scopeAccount, "johndoe@example.com", true, nil, `{"email": "JaneDoe@Example.com"}`)
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+	if len(m.Messages()) != 0 {
+		t.Errorf("expected no messages, got %v", m.Messages())
+	}
+}
+
+func TestCannotConfirmEmailChangeIfAddressTakenSince(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+
+	rec := requestAsUser(t, env, "POST", "/", env.changeMyEmailHandler, scopeAccount, "johndoe@example.com", true, nil, `{"email": "john@example.com"}`)
+	if 202 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 202, rec.Code)
+	}
+	db.users = append(db.registeredUsers(), &models.User{ID: 7, Email: "john@example.com", Name: "John Smith", Status: models.UserActive})
+
+	rec = postConfirmEmail(env, extractEmailChangeToken(t, m.Messages()[0].Body))
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+}
+
+func TestCannotConfirmEmailChangeWithInvalidToken(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), mailer: mailer.NewMemoryMailer()}
+
+	rec := postConfirmEmail(env, "not-a-real-token")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotChangeEmailWithoutMailer(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.changeMyEmailHandler, scopeAccount, "johndoe@example.com", true, nil, `{"email": "john@example.com"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+	if len(db.emailChanges) != 0 {
+		t.Errorf("expected no pending email changes, got %v", db.emailChanges)
+	}
+}
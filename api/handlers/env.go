@@ -3,18 +3,128 @@ package handlers
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/swinslow/containerapp/api/mailer"
 	"github.com/swinslow/containerapp/api/models"
+	"github.com/swinslow/containerapp/api/ratelimit"
+)
+
+// default lifetimes for codes and tokens, if the environment does not
+// say otherwise
+const (
+	defaultLoginCodeTTL    = 15 * time.Minute
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	defaultEmailChangeTTL  = 24 * time.Hour
+	defaultInvitationTTL   = 7 * 24 * time.Hour
+)
+
+// default iss and aud claims for issued tokens, if the environment does
+// not say otherwise
+const (
+	defaultTokenIssuer   = "containerapp"
+	defaultTokenAudience = "containerapp"
 )
 
 // Env is the environment for the web handlers.
 type Env struct {
 	db           models.Datastore
-	jwtSecretKey string
+	keys         *keyring
+	mailer       mailer.Mailer
+	loginURL     string
+	loginCodeTTL time.Duration
+	// where links to confirm a new email address, or to accept an
+	// invitation, point
+	emailChangeURL string
+	invitationURL  string
+	// lifetimes of issued access and refresh tokens
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	// iss and aud claims for the tokens this service issues and accepts
+	// (if empty, the defaults are used), and the other audiences that
+	// tokens can be exchanged for
+	issuer            string
+	audience          string
+	exchangeAudiences []string
+	// cache of revocation lookups; may be nil
+	revocations *revocationCache
+	// OpenID Connect identity providers, keyed by name
+	oidcProviders map[string]*oidcProvider
+	// rules for new passwords, and the bcrypt cost to hash them with
+	// (if zero, the defaults are used)
+	passwordPolicy passwordPolicy
+	bcryptCost     int
+	// name shown for accounts in authenticator apps
+	totpIssuer string
+	// rate limits on login requests, by IP address and by email address;
+	// either may be nil
+	ipLimiter    ratelimit.Limiter
+	emailLimiter ratelimit.Limiter
+	// how many failed logins within lockoutWindow lock an account out,
+	// and for how long (if zero, the defaults are used)
+	lockoutThreshold int
+	lockoutWindow    time.Duration
+	lockoutDuration  time.Duration
+	// whether issued tokens are set as HttpOnly cookies for browsers,
+	// rather than returned in the response body
+	sessionMode bool
+}
+
+// durationFromEnv returns the duration in the named environment
+// variable, or def if it is not set.
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't parse %s: %v", name, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive; got %s", name, val)
+	}
+	return d, nil
+}
+
+// intFromEnv returns the non-negative integer in the named environment
+// variable, or def if it is not set.
+func intFromEnv(name string, def int) (int, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't parse %s: %v", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative; got %s", name, val)
+	}
+	return n, nil
+}
+
+// tokenIssuer returns the iss claim for issued tokens.
+func (env *Env) tokenIssuer() string {
+	if env.issuer == "" {
+		return defaultTokenIssuer
+	}
+	return env.issuer
+}
+
+// tokenAudience returns the aud claim for tokens to be used with this
+// service.
+func (env *Env) tokenAudience() string {
+	if env.audience == "" {
+		return defaultTokenAudience
+	}
+	return env.audience
 }
 
 // SetupEnv sets up systems (such as the data store) and variables
-// (such as the JWT signing key) that are used across web requests.
+// (such as the JWT signing keys) that are used across web requests.
 func SetupEnv() (*Env, error) {
 	// set up datastore
 	db, err := models.NewDB("host=db sslmode=disable dbname=dev user=postgres-dev")
@@ -27,15 +137,158 @@ func SetupEnv() (*Env, error) {
 		return nil, err
 	}
 
-	// set up JWT secret key (from environment)
-	JWTSECRETKEY := os.Getenv("JWTSECRETKEY")
-	if JWTSECRETKEY == "" {
-		return nil, fmt.Errorf("No secret key found; set environment variable JWTSECRETKEY before starting")
+	// set up JWT signing and verification keys (from environment)
+	keys, err := loadKeyringFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// set up mailer for login codes (from environment); deployments
+	// that only use passwords or identity providers can leave it unset
+	var m mailer.Mailer
+	SMTPHOST := os.Getenv("SMTPHOST")
+	if SMTPHOST != "" {
+		SMTPPORT := os.Getenv("SMTPPORT")
+		if SMTPPORT == "" {
+			SMTPPORT = "25"
+		}
+		SMTPFROM := os.Getenv("SMTPFROM")
+		if SMTPFROM == "" {
+			return nil, fmt.Errorf("No sender address found; set environment variable SMTPFROM before starting")
+		}
+		m = mailer.NewSMTPMailer(SMTPHOST, SMTPPORT, os.Getenv("SMTPUSERNAME"), os.Getenv("SMTPPASSWORD"), SMTPFROM)
+	}
+
+	// the login link in emails points back at the webapp, which passes
+	// the code on to /oauth/verify
+	LOGINURL := os.Getenv("LOGINURL")
+	if LOGINURL == "" {
+		LOGINURL = "http://localhost:3000/verify"
+	}
+
+	// and so does the link to confirm a new email address, with the
+	// token to pass on to /email/confirm
+	EMAILCHANGEURL := os.Getenv("EMAILCHANGEURL")
+	if EMAILCHANGEURL == "" {
+		EMAILCHANGEURL = "http://localhost:3000/confirmEmail"
+	}
+
+	// as does the link to accept an invitation, with the token to pass
+	// on to /invitations/accept
+	INVITATIONURL := os.Getenv("INVITATIONURL")
+	if INVITATIONURL == "" {
+		INVITATIONURL = "http://localhost:3000/acceptInvitation"
+	}
+
+	// set up code and token lifetimes (from environment)
+	loginCodeTTL, err := durationFromEnv("LOGINCODETTL", defaultLoginCodeTTL)
+	if err != nil {
+		return nil, err
+	}
+	accessTokenTTL, err := durationFromEnv("ACCESSTOKENTTL", defaultAccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	refreshTokenTTL, err := durationFromEnv("REFRESHTOKENTTL", defaultRefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// set up token issuer and audiences (from environment)
+	TOKENISSUER := os.Getenv("TOKENISSUER")
+	if TOKENISSUER == "" {
+		TOKENISSUER = defaultTokenIssuer
+	}
+	TOKENAUDIENCE := os.Getenv("TOKENAUDIENCE")
+	if TOKENAUDIENCE == "" {
+		TOKENAUDIENCE = defaultTokenAudience
+	}
+	exchangeAudiences := SplitList(os.Getenv("EXCHANGEAUDIENCES"))
+
+	// set up password policy (from environment)
+	minLength, err := intFromEnv("PASSWORDMINLENGTH", defaultPasswordMinLength)
+	if err != nil {
+		return nil, err
+	}
+	minClasses, err := intFromEnv("PASSWORDMINCLASSES", defaultPasswordMinClasses)
+	if err != nil {
+		return nil, err
+	}
+	policy := passwordPolicy{minLength: minLength, minClasses: minClasses}
+	if err = policy.validate(); err != nil {
+		return nil, err
+	}
+
+	// name shown for accounts in authenticator apps
+	TOTPISSUER := os.Getenv("TOTPISSUER")
+	if TOTPISSUER == "" {
+		TOTPISSUER = defaultTOTPIssuer
+	}
+
+	// set up rate limits and lockouts (from environment)
+	ipLimiter, emailLimiter, err := loadLimitersFromEnv(db)
+	if err != nil {
+		return nil, err
+	}
+	lockoutThreshold, err := intFromEnv("LOCKOUTTHRESHOLD", defaultLockoutThreshold)
+	if err != nil {
+		return nil, err
+	}
+	lockoutWindow, err := durationFromEnv("LOCKOUTWINDOW", defaultLockoutWindow)
+	if err != nil {
+		return nil, err
+	}
+	lockoutDuration, err := durationFromEnv("LOCKOUTDURATION", defaultLockoutDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	// in session mode, tokens are kept in cookies (from environment)
+	sessionMode := false
+	if SESSIONMODE := os.Getenv("SESSIONMODE"); SESSIONMODE != "" {
+		sessionMode, err = strconv.ParseBool(SESSIONMODE)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse SESSIONMODE: %v", err)
+		}
+	}
+
+	// set up OpenID Connect identity providers, if any are configured
+	oidcProviders := make(map[string]*oidcProvider)
+	if OIDCCONFIGFILE := os.Getenv("OIDCCONFIGFILE"); OIDCCONFIGFILE != "" {
+		oidcProviders, err = loadOIDCProviders(OIDCCONFIGFILE)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	env := &Env{
-		db:           db,
-		jwtSecretKey: JWTSECRETKEY,
+		db:                db,
+		keys:              keys,
+		mailer:            m,
+		loginURL:          LOGINURL,
+		emailChangeURL:    EMAILCHANGEURL,
+		invitationURL:     INVITATIONURL,
+		loginCodeTTL:      loginCodeTTL,
+		accessTokenTTL:    accessTokenTTL,
+		refreshTokenTTL:   refreshTokenTTL,
+		issuer:            TOKENISSUER,
+		audience:          TOKENAUDIENCE,
+		exchangeAudiences: exchangeAudiences,
+		revocations:       newRevocationCache(defaultRevocationCacheTTL),
+		oidcProviders:     oidcProviders,
+		passwordPolicy:    policy,
+		totpIssuer:        TOTPISSUER,
+		ipLimiter:         ipLimiter,
+		emailLimiter:      emailLimiter,
+		lockoutThreshold:  lockoutThreshold,
+		lockoutWindow:     lockoutWindow,
+		lockoutDuration:   lockoutDuration,
+		sessionMode:       sessionMode,
 	}
+
+	// clean up expired revocation records in the background
+	env.startRevocationGC(10 * time.Minute)
+	env.startRateLimitGC(10 * time.Minute)
+
 	return env, nil
 }
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exchangeResponse is the JSON body returned when a token is exchanged
+// for one to be used with another service.
+type exchangeResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int64  `json:"expires_in"`
+	Scope     string `json:"scope"`
+	Audience  string `json:"audience"`
+}
+
+// canExchangeFor reports whether tokens can be exchanged for ones to be
+// used with the given audience.
+func (env *Env) canExchangeFor(audience string) bool {
+	for _, aud := range env.exchangeAudiences {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeTokenHandler trades the token used for the request for a token
+// to be used with another service that shares this one's identity. The
+// new token has at most the scopes of the old one, expires no later than
+// it does, and comes without a refresh token.
+func (env *Env) exchangeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// pull token details from context
+	ti, ok := r.Context().Value(tokenContextKey(0)).(*tokenInfo)
+	if !ok {
+		sendAuthFail(w)
+		return
+	}
+
+	// get form values
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Couldn't parse form"}`)
+		return
+	}
+	audience := r.Form.Get("audience")
+	if audience == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply audience in exchange request"}`)
+		return
+	}
+	if !env.canExchangeFor(audience) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "invalid_target", "error_description": "tokens can't be exchanged for audience %s"}`, audience)
+		return
+	}
+	scope, ok := requestedScope(w, r)
+	if !ok {
+		return
+	}
+	if scope == "" {
+		scope = strings.Join(ti.Scopes, " ")
+	} else if len(ti.Scopes) == 0 || !scopeWithin(scope, strings.Join(ti.Scopes, " ")) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "invalid_scope", "error_description": "scope exceeds that of token"}`)
+		return
+	}
+
+	// the new token can't outlive the one it was exchanged for
+	expires := time.Now().Add(lifetime(env.accessTokenTTL, defaultAccessTokenTTL))
+	if !ti.Expires.IsZero() && ti.Expires.Before(expires) {
+		expires = ti.Expires
+	}
+
+	// the other service has no record of this one's sessions, so the new
+	// token isn't tied to one
+	tknString, err := env.signToken(&tokenParams{
+		email:    ti.Email,
+		audience: audience,
+		scope:    scope,
+		mfa:      ti.MFA,
+		expires:  expires,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(&exchangeResponse{
+		Token:     tknString,
+		TokenType: "Bearer",
+		ExpiresIn: int64(time.Until(expires).Seconds()),
+		Scope:     scope,
+		Audience:  audience,
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
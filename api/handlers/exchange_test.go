@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestCannotValidateTokenForOtherIssuerOrAudience(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		val  interface{}
+	}{
+		{"other issuer", "iss", "someone-else"},
+		{"no issuer", "iss", nil},
+		{"other audience", "aud", "reports"},
+		{"no audience", "aud", nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := validClaims("janedoe@example.com")
+			if tc.val == nil {
+				delete(claims, tc.key)
+			} else {
+				claims[tc.key] = tc.val
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+			tokenString, err := token.SignedString([]byte("keyForTesting"))
+			if err != nil {
+				t.Fatalf("couldn't create token for testing: %v", err)
+			}
+
+			env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+			rec := callWithToken(env, env.testHandler, "GET", tokenString, nil)
+			confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+		})
+	}
+}
+
+func TestCanValidateTokenForConfiguredIssuerAndAudience(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), issuer: "id.example.com", audience: "api.example.com"}
+	tokenString, err := env.createToken("janedoe@example.com", "", "", false)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	claims := parseTestToken(t, tokenString)
+	if claims["iss"] != "id.example.com" {
+		t.Errorf("expected %v, got %v", "id.example.com", claims["iss"])
+	}
+	if claims["aud"] != "api.example.com" {
+		t.Errorf("expected %v, got %v", "api.example.com", claims["aud"])
+	}
+
+	if rec := callWithToken(env, env.testHandler, "GET", tokenString, nil); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// but another deployment with a different audience won't take it
+	other := &Env{db: &mockDB{}, keys: newTestKeyring(), issuer: "id.example.com", audience: "reports.example.com"}
+	if rec := callWithToken(other, other.testHandler, "GET", tokenString, nil); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func postExchange(env *Env, tkn string, audience string, scope string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("audience", audience)
+	data.Set("scope", scope)
+	req, _ := http.NewRequest("POST", "/oauth/exchange", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+tkn)
+	http.HandlerFunc(env.validateTokenMiddleware(env.exchangeTokenHandler)).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanExchangeTokenForOtherAudience(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), exchangeAudiences: []string{"reports"}}
+	tr := decodeTokenResponse(t, verifyWithScope(env, "janedoe@example.com", ""))
+
+	rec := postExchange(env, tr.Token, "reports", "history:read")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var er exchangeResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &er)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	claims := parseTestToken(t, er.Token)
+	if claims["aud"] != "reports" {
+		t.Errorf("expected %v, got %v", "reports", claims["aud"])
+	}
+	if claims["scope"] != "history:read" {
+		t.Errorf("expected %v, got %v", "history:read", claims["scope"])
+	}
+	if _, ok := claims["sid"]; ok {
+		t.Errorf("expected no sid claim, got %v", claims["sid"])
+	}
+	if claims["exp"].(float64) > parseTestToken(t, tr.Token)["exp"].(float64) {
+		t.Errorf("expected exchanged token not to outlive original")
+	}
+
+	// and the exchanged token isn't accepted here
+	if rec = callWithToken(env, env.testHandler, "GET", er.Token, nil); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotExchangeTokenForUnknownAudienceOrWiderScope(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), exchangeAudiences: []string{"reports"}}
+	tr := decodeTokenResponse(t, verifyWithScope(env, "janedoe@example.com", "history:read"))
+
+	if rec := postExchange(env, tr.Token, "billing", ""); 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+	if rec := postExchange(env, tr.Token, "reports", "users:write"); 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+	if rec := postExchange(env, tr.Token, "", ""); 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
@@ -15,11 +15,63 @@ import (
 // specified router, for the given environment.
 func (env *Env) RegisterHandlers(router *mux.Router) {
 	router.HandleFunc("/favicon.ico", env.ignoreHandler).Methods("GET")
-	router.HandleFunc("/oauth/getToken", env.createTokenHandler).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", env.jwksHandler).Methods("GET")
+	router.HandleFunc("/oauth/getToken", env.rateLimitMiddleware(env.createTokenHandler)).Methods("POST")
+	router.HandleFunc("/oauth/verify", env.rateLimitMiddleware(env.verifyLoginCodeHandler)).Methods("POST")
+	router.HandleFunc("/oauth/mfa", env.rateLimitMiddleware(env.mfaHandler)).Methods("POST")
+	router.HandleFunc("/oauth/token", env.rateLimitMiddleware(env.oauthTokenHandler)).Methods("POST")
+	router.HandleFunc("/oauth/refresh", env.rateLimitMiddleware(env.refreshTokenHandler)).Methods("POST")
+	router.HandleFunc("/oauth/logout", env.validateTokenMiddleware(env.logoutHandler)).Methods("POST")
+	router.HandleFunc("/oauth/exchange", env.validateTokenMiddleware(env.exchangeTokenHandler)).Methods("POST")
+	router.HandleFunc("/oauth/login/{provider}", env.oidcLoginHandler).Methods("GET")
+	router.HandleFunc("/oauth/callback/{provider}", env.oidcCallbackHandler).Methods("GET")
+	router.HandleFunc("/email/confirm", env.rateLimitMiddleware(env.confirmEmailHandler)).Methods("POST")
+	router.HandleFunc("/invitations/accept", env.rateLimitMiddleware(env.acceptInvitationHandler)).Methods("POST")
+	router.HandleFunc("/me", env.validateTokenMiddleware(requireScopes(env.getMeHandler, scopeAccount))).Methods("GET")
+	router.HandleFunc("/me", env.validateTokenMiddleware(requireScopes(env.updateMeHandler, scopeAccount))).Methods("PATCH")
+	router.HandleFunc("/me/history", env.validateTokenMiddleware(requireScopes(env.getMyHistoryHandler, scopeAccount))).Methods("GET")
+	router.HandleFunc("/me/email", env.validateTokenMiddleware(requireScopes(env.changeMyEmailHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/password", env.validateTokenMiddleware(requireScopes(env.changePasswordHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/totp", env.validateTokenMiddleware(requireScopes(env.enrollTOTPHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/totp/confirm", env.validateTokenMiddleware(requireScopes(env.confirmTOTPHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/totp/recoveryCodes", env.validateTokenMiddleware(requireScopes(env.regenerateRecoveryCodesHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/totp/disable", env.validateTokenMiddleware(requireScopes(env.disableTOTPHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/apikeys", env.validateTokenMiddleware(requireScopes(env.getAPIKeysHandler, scopeAccount))).Methods("GET")
+	router.HandleFunc("/me/apikeys", env.validateTokenMiddleware(requireScopes(env.newAPIKeyHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/apikeys/{keyid}/revoke", env.validateTokenMiddleware(requireScopes(env.revokeAPIKeyHandler, scopeAccount))).Methods("POST")
+	router.HandleFunc("/me/sessions", env.validateTokenMiddleware(requireScopes(env.getSessionsHandler, scopeAccount))).Methods("GET")
+	router.HandleFunc("/me/sessions/{sessionid}/revoke", env.validateTokenMiddleware(requireScopes(env.revokeSessionHandler, scopeAccount))).Methods("POST")
 	router.HandleFunc("/landing", env.validateTokenMiddleware(env.landingHandler)).Methods("GET")
-	router.HandleFunc("/admin/history", env.validateTokenMiddleware(env.historyHandler)).Methods("GET")
-	router.HandleFunc("/admin/users", env.validateTokenMiddleware(env.getUsersHandler)).Methods("GET")
-	router.HandleFunc("/admin/users", env.validateTokenMiddleware(env.newUserHandler)).Methods("POST")
+	router.HandleFunc("/admin/history", env.validateTokenMiddleware(env.requirePermissions(env.historyHandler, scopeHistoryRead))).Methods("GET")
+	router.HandleFunc("/admin/users", env.validateTokenMiddleware(env.requirePermissions(env.getUsersHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/users", env.validateTokenMiddleware(env.requirePermissions(env.newUserHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/import", env.validateTokenMiddleware(env.requirePermissions(env.importUsersHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/export", env.validateTokenMiddleware(env.requirePermissions(env.exportUsersHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/users/{id}", env.validateTokenMiddleware(env.requirePermissions(env.getUserHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/users/{id}", env.validateTokenMiddleware(env.requirePermissions(env.updateUserHandler, scopeUsersWrite))).Methods("PUT", "PATCH")
+	router.HandleFunc("/admin/users/{id}", env.validateTokenMiddleware(env.requirePermissions(env.deleteUserHandler, scopeUsersWrite))).Methods("DELETE")
+	router.HandleFunc("/admin/users/{id}/suspend", env.validateTokenMiddleware(env.requirePermissions(env.suspendUserHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/reactivate", env.validateTokenMiddleware(env.requirePermissions(env.reactivateUserHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/deactivate", env.validateTokenMiddleware(env.requirePermissions(env.deactivateUserHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/email", env.validateTokenMiddleware(env.requirePermissions(env.changeUserEmailHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/audit", env.validateTokenMiddleware(env.requirePermissions(env.getUserAuditHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/users/{id}/revokeTokens", env.validateTokenMiddleware(env.requirePermissions(env.revokeUserTokensHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/password", env.validateTokenMiddleware(env.requirePermissions(env.resetPasswordHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/sessions", env.validateTokenMiddleware(env.requirePermissions(env.getUserSessionsHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/users/{id}/sessions/{sessionid}/revoke", env.validateTokenMiddleware(env.requirePermissions(env.revokeUserSessionHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/roles", env.validateTokenMiddleware(env.requirePermissions(env.getUserRolesHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/users/{id}/roles", env.validateTokenMiddleware(env.requirePermissions(env.assignRoleHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/users/{id}/roles/{role}/revoke", env.validateTokenMiddleware(env.requirePermissions(env.revokeRoleHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/invitations", env.validateTokenMiddleware(env.requirePermissions(env.getInvitationsHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/invitations", env.validateTokenMiddleware(env.requirePermissions(env.newInvitationHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/invitations/{inviteid}/resend", env.validateTokenMiddleware(env.requirePermissions(env.resendInvitationHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/invitations/{inviteid}/revoke", env.validateTokenMiddleware(env.requirePermissions(env.revokeInvitationHandler, scopeUsersWrite))).Methods("POST")
+	router.HandleFunc("/admin/roles", env.validateTokenMiddleware(env.requirePermissions(env.getRolesHandler, scopeUsersRead))).Methods("GET")
+	router.HandleFunc("/admin/keys", env.validateTokenMiddleware(env.requirePermissions(env.getKeysHandler, scopeKeysRead))).Methods("GET")
+	router.HandleFunc("/admin/keys/reload", env.validateTokenMiddleware(env.requirePermissions(env.reloadKeysHandler, scopeKeysWrite))).Methods("POST")
+	router.HandleFunc("/admin/clients", env.validateTokenMiddleware(env.requirePermissions(env.getClientsHandler, scopeClientsRead))).Methods("GET")
+	router.HandleFunc("/admin/clients", env.validateTokenMiddleware(env.requirePermissions(env.newClientHandler, scopeClientsWrite))).Methods("POST")
+	router.HandleFunc("/admin/clients/{clientid}/revoke", env.validateTokenMiddleware(env.requirePermissions(env.revokeClientHandler, scopeClientsWrite))).Methods("POST")
 	router.HandleFunc("/{rest:.*}", env.validateTokenMiddleware(env.rootHandler)).Methods("GET")
 }
 
@@ -1,19 +1,25 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
 
 	"github.com/swinslow/containerapp/api/models"
 )
 
-// extractAdminUser takes a Request and extracts and returns the User object,
-// confirming that it is an admin User. If the User cannot be extracted,
-// is unknown, or is not an admin, the appropriate HTTP headers and content
-// are written and nil is returned (presumably to flag that no further
-// processing should occur).
+// extractAdminUser takes a Request and extracts and returns the User object
+// for an admin route. If the User cannot be extracted or is unknown, the
+// appropriate HTTP headers and content are written and nil is returned
+// (presumably to flag that no further processing should occur). Whether
+// the User may use the route is decided by the permissions that it
+// requires (see requirePermissions), but admin access also requires a
+// token from a login that passed a second authentication factor.
 func extractAdminUser(w http.ResponseWriter, r *http.Request) *models.User {
 	// pull User from context
 	ctxCheck := r.Context().Value(userContextKey(0))
@@ -31,16 +37,86 @@ func extractAdminUser(w http.ResponseWriter, r *http.Request) *models.User {
 		return nil
 	}
 
-	// admin access required for this resource
-	if !user.IsAdmin {
+	// and the admin must have logged in with a second factor
+	if !tokenHasMFA(r) {
 		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintf(w, `{"error": "admin access required"}`)
+		fmt.Fprintf(w, `{"error": "two-factor authentication required for admin access"}`)
 		return nil
 	}
 
 	return user
 }
 
+// extractPathUser looks up the User whose ID is given in the "id" path
+// variable. If the ID is invalid or the User is not found, the appropriate
+// HTTP headers and content are written and nil is returned.
+func (env *Env) extractPathUser(w http.ResponseWriter, r *http.Request) *models.User {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil || id == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "invalid user ID"}`)
+		return nil
+	}
+
+	target, err := env.db.GetUserByID(uint32(id))
+	if err != nil || target == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "user %d not found"}`, id)
+		return nil
+	}
+
+	return target
+}
+
+// extractManagedUser looks up the User whose ID is given in the "id" path
+// variable, as extractPathUser does, for a change that the given admin
+// user is making to them. Admins may only change users whose roles they
+// could manage (see canManageRole), so that they can't take over the
+// account of someone with more access than they have. If that isn't so,
+// or the User can't be looked up, the appropriate HTTP headers and content
+// are written and nil is returned.
+func (env *Env) extractManagedUser(w http.ResponseWriter, r *http.Request, user *models.User) *models.User {
+	target := env.extractPathUser(w, r)
+	if target == nil {
+		return nil
+	}
+
+	roles, err := env.db.GetRolesForUserID(target.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return nil
+	}
+	for _, role := range roles {
+		if !env.canManageRole(user, role) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": "can't change user %d, who has role %s with permissions that you don't have"}`, target.ID, role.Name)
+			return nil
+		}
+	}
+
+	return target
+}
+
+// normalizedEmail returns the given email as it is stored for users (see
+// models.NormalizeEmail). If it isn't a valid email, the appropriate HTTP
+// headers and content are written and an empty string is returned.
+func normalizedEmail(w http.ResponseWriter, email string) string {
+	normalized, err := models.NormalizeEmail(email)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "invalid email address %s"}`, email)
+		return ""
+	}
+	return normalized
+}
+
+// sameEmail reports whether the given email is the same as a user's
+// stored one, once normalized.
+func sameEmail(email string, stored string) bool {
+	normalized, err := models.NormalizeEmail(email)
+	return err == nil && normalized == stored
+}
+
 func (env *Env) historyHandler(w http.ResponseWriter, r *http.Request) {
 	// send JSON responses
 	w.Header().Set("Content-Type", "application/json")
@@ -72,6 +148,92 @@ func (env *Env) historyHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(js))
 }
 
+// page sizes for listing users
+const (
+	defaultUsersPageSize = 100
+	maxUsersPageSize     = 1000
+)
+
+// userQuery returns the query for a page of users described by the query
+// parameters: "status", to list only users with that status, since
+// deactivated users are only listed if asked for; "admin", to list only
+// admins or
+// non-admins; "q", to search names and emails; "sort", by "id" (the
+// default), "name" or "email", and "order", "asc" (the default) or "desc";
+// "limit", for the page size; and "cursor", the X-Next-Cursor header from
+// the previous page. If any of them are invalid, the appropriate HTTP
+// headers and content are written and nil is returned.
+func userQuery(w http.ResponseWriter, r *http.Request) *models.UserQuery {
+	params := r.URL.Query()
+	q := &models.UserQuery{
+		Search: params.Get("q"),
+		Sort:   models.UserSortID,
+		Limit:  defaultUsersPageSize,
+	}
+
+	switch status := params.Get("status"); status {
+	case "", models.UserActive, models.UserSuspended, models.UserDeactivated:
+		q.Status = status
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "unknown status %s"}`, status)
+		return nil
+	}
+	if admin := params.Get("admin"); admin != "" {
+		isAdmin, err := strconv.ParseBool(admin)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "admin must be true or false"}`)
+			return nil
+		}
+		q.IsAdmin = &isAdmin
+	}
+	switch sort := params.Get("sort"); sort {
+	case "":
+	case models.UserSortID, models.UserSortName, models.UserSortEmail:
+		q.Sort = sort
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "can't sort by %s; use id, name or email"}`, sort)
+		return nil
+	}
+	switch order := params.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "order must be asc or desc"}`)
+		return nil
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxUsersPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "limit must be from 1 to %d"}`, maxUsersPageSize)
+			return nil
+		}
+		q.Limit = n
+	}
+
+	// the cursor is only meaningful with the same sort order as the page
+	// that it came from, but that's up to the client
+	if cursor := params.Get("cursor"); cursor != "" {
+		js, err := base64.RawURLEncoding.DecodeString(cursor)
+		after := &models.UserCursor{}
+		if err == nil {
+			err = json.Unmarshal(js, after)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "invalid cursor"}`)
+			return nil
+		}
+		q.After = after
+	}
+	return q
+}
+
 func (env *Env) getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	// send JSON responses
 	w.Header().Set("Content-Type", "application/json")
@@ -88,13 +250,36 @@ func (env *Env) getUsersHandler(w http.ResponseWriter, r *http.Request) {
 
 	// once we're here, we're talking to an admin user
 
-	// return list of all users
-	users, err := env.db.GetAllUsers()
+	q := userQuery(w, r)
+	if q == nil {
+		return
+	}
+	total, err := env.db.CountUsers(q)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	// ask for one more user than fits on the page, to tell whether
+	// there's another page after it
+	limit := q.Limit
+	q.Limit++
+	users, err := env.db.QueryUsers(q)
 	if err != nil {
 		http.Error(w, http.StatusText(500), 500)
 		return
 	}
 
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if len(users) > limit {
+		users = users[:limit]
+		cursor, err := json.Marshal(q.CursorFor(users[limit-1]))
+		if err != nil {
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+		w.Header().Set("X-Next-Cursor", base64.RawURLEncoding.EncodeToString(cursor))
+	}
+
 	// output as JSON
 	js, err := json.Marshal(users)
 	if err != nil {
@@ -109,32 +294,6 @@ type newUserReq struct {
 	Email string `json:"email"`
 }
 
-func (env *Env) generateIDForNewUser() uint32 {
-	// generate random new, non-zero, currently-unused ID within permitted range
-	// FIXME note that this process for finding an unused ID will get decreasingly
-	// FIXME usable if you have a massive number of users.
-	var newID uint32
-	for newID == 0 {
-		testID := rand.Int31()
-		// make it a positive, non-negative number
-		if testID == 0 {
-			continue
-		}
-		if testID < 0 {
-			testID = -testID
-		}
-		utestID := uint32(testID)
-		// check this ID doesn't already exist in database
-		if userCheck, err := env.db.GetUserByID(utestID); err == nil && userCheck != nil {
-			continue
-		}
-		// if we get here, it's good to use
-		newID = utestID
-	}
-
-	return newID
-}
-
 func (env *Env) newUserHandler(w http.ResponseWriter, r *http.Request) {
 	// send JSON responses
 	w.Header().Set("Content-Type", "application/json")
@@ -160,23 +319,19 @@ func (env *Env) newUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// make sure this user doesn't already exist in database
-	if userCheck, err := env.db.GetUserByEmail(newUser.Email); err == nil && userCheck != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "user with email %s already exists"}`, newUser.Email)
+	email := normalizedEmail(w, newUser.Email)
+	if email == "" {
 		return
 	}
 
-	// generate new ID for new user
-	newID := env.generateIDForNewUser()
-
-	// create and save new user
-	// FIXME note that the new ID selection is NOT safe across multiple
-	// FIXME requests. two separate requests could both claim the same
-	// FIXME ID as available above, and then both try to save them here.
-	// FIXME This will be prevented by the database, presumably, but it
-	// FIXME should be addressed in a real production system.
-	err = env.db.AddUser(newID, newUser.Email, newUser.Name, false)
+	// create and save new user; the database gives them a new ID, and
+	// makes sure this user doesn't already exist
+	newID, err := env.db.AddUser(email, newUser.Name)
+	if _, ok := err.(*models.DuplicateEmailError); ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user with email %s already exists"}`, email)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"error": "server error saving new user, please check values and try again"}`)
@@ -186,9 +341,10 @@ func (env *Env) newUserHandler(w http.ResponseWriter, r *http.Request) {
 	// success!
 	finalUser := models.User{
 		ID:      newID,
-		Email:   newUser.Email,
+		Email:   email,
 		Name:    newUser.Name,
 		IsAdmin: false,
+		Status:  models.UserActive,
 	}
 	w.WriteHeader(http.StatusCreated)
 	js, err := json.Marshal(finalUser)
@@ -199,3 +355,322 @@ func (env *Env) newUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Fprintf(w, string(js))
 }
+
+func (env *Env) revokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractManagedUser(w, r, user)
+	if target == nil {
+		return
+	}
+
+	err := env.revokeAllTokens(target)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error revoking tokens"}`)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status": "revoked all tokens for user %d"}`, target.ID)
+}
+
+// revokeAllTokens revokes every access token issued up to now for the
+// given user's email address, and deletes its refresh tokens, sessions
+// and the user's API keys.
+func (env *Env) revokeAllTokens(target *models.User) error {
+	email := target.Email
+	now := time.Now()
+	err := env.db.RevokeTokensForEmail(email, now)
+	if err != nil {
+		return err
+	}
+	env.revocations.recordTokensRevokedBefore(email, now, now)
+
+	err = env.db.DeleteRefreshTokensForEmail(email)
+	if err != nil {
+		return err
+	}
+	err = env.db.DeleteSessionsForEmail(email)
+	if err != nil {
+		return err
+	}
+	return env.db.DeleteAPIKeysForUserID(target.ID)
+}
+
+func (env *Env) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractPathUser(w, r)
+	if target == nil {
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(target)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+// updateUserReq is the JSON body for PUT and PATCH requests to a user.
+// PUT must supply every field, while PATCH leaves out fields that
+// shouldn't change. Email can't be changed here, since the new address
+// has to be confirmed first.
+type updateUserReq struct {
+	Email   *string `json:"email"`
+	Name    *string `json:"name"`
+	IsAdmin *bool   `json:"is_admin"`
+}
+
+func (env *Env) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take PUT and PATCH requests
+	if r.Method != "PUT" && r.Method != "PATCH" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractManagedUser(w, r, user)
+	if target == nil {
+		return
+	}
+
+	// extract JSON content
+	var req updateUserReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if r.Method == "PUT" && (req.Email == nil || req.Name == nil || req.IsAdmin == nil) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply email, name and is_admin"}`)
+		return
+	}
+
+	// a new email has to be confirmed first, through /admin/users/{id}/email
+	if req.Email != nil && !sameEmail(*req.Email, target.Email) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "email can only be changed through /admin/users/%d/email, which verifies the new address"}`, target.ID)
+		return
+	}
+	name := target.Name
+	if req.Name != nil {
+		name = *req.Name
+	}
+
+	// being an admin means holding the superadmin role, so the same rules
+	// apply as for assigning or revoking it
+	changeAdmin := req.IsAdmin != nil && *req.IsAdmin != target.IsAdmin
+	if changeAdmin {
+		role, err := env.findRole(models.RoleSuperadmin)
+		if err != nil || role == nil {
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+		if !env.canManageRole(user, role) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": "only admins with every permission can change is_admin"}`)
+			return
+		}
+
+		// the last admin can't stop being one, which RevokeRole checks;
+		// this is done first so that nothing else has changed if it
+		// refuses
+		if *req.IsAdmin {
+			err = env.db.AssignRole(target.ID, models.RoleSuperadmin)
+		} else {
+			err = env.db.RevokeRole(target.ID, models.RoleSuperadmin)
+		}
+		if _, ok := err.(*models.LastAdminError); ok {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"error": "user %d is the last admin"}`, target.ID)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "server error saving user, please check values and try again"}`)
+			return
+		}
+	}
+
+	err = env.db.UpdateUser(target.ID, target.Email, name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving user, please check values and try again"}`)
+		return
+	}
+
+	updated, err := env.db.GetUserByID(target.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(updated)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take DELETE requests
+	if r.Method != "DELETE" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractManagedUser(w, r, user)
+	if target == nil {
+		return
+	}
+
+	// unlike deactivating, this leaves the user's visit history without
+	// anyone to attribute it to; and the last admin can't be deleted
+	err := env.db.DeleteUser(target.ID)
+	if _, ok := err.(*models.LastAdminError); ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user %d is the last admin"}`, target.ID)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error deleting user"}`)
+		return
+	}
+	err = env.revokeAllTokens(target)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error revoking tokens"}`)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status": "deleted user %d"}`, target.ID)
+}
+
+// setUserStatus handles requests to change the status of the user whose ID
+// is given in the "id" path variable.
+func (env *Env) setUserStatus(w http.ResponseWriter, r *http.Request, status string) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractManagedUser(w, r, user)
+	if target == nil {
+		return
+	}
+
+	// the last admin can't be suspended or deactivated
+	err := env.db.SetUserStatus(target.ID, status, time.Now())
+	if _, ok := err.(*models.LastAdminError); ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user %d is the last admin"}`, target.ID)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving user status"}`)
+		return
+	}
+
+	// suspended users' tokens are refused until they are reactivated, but
+	// deactivated users would have to log in again anyway
+	if status == models.UserDeactivated {
+		err = env.revokeAllTokens(target)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "server error revoking tokens"}`)
+			return
+		}
+	}
+
+	updated, err := env.db.GetUserByID(target.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(updated)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) suspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	env.setUserStatus(w, r, models.UserSuspended)
+}
+
+func (env *Env) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	env.setUserStatus(w, r, models.UserActive)
+}
+
+func (env *Env) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	env.setUserStatus(w, r, models.UserDeactivated)
+}
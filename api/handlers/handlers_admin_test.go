@@ -9,6 +9,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/mailer"
 	"github.com/swinslow/containerapp/api/models"
 )
 
@@ -22,7 +25,7 @@ func TestAdminCanGetHistory(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	// add admin User to context (assumes validation has already occurred)
 	user, err := db.GetUserByEmail("janedoe@example.com")
 	if err != nil {
@@ -30,6 +33,7 @@ func TestAdminCanGetHistory(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
 	http.HandlerFunc(env.historyHandler).ServeHTTP(rec, req)
 
@@ -90,7 +94,7 @@ func TestCannotGetHistoryWithNoUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	// not adding any User to context
 	http.HandlerFunc(env.historyHandler).ServeHTTP(rec, req)
 
@@ -105,7 +109,7 @@ func TestCannotGetHistoryWithoutValidUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User with ID 0 to context (unknown user)
 	user := &models.User{
@@ -116,6 +120,7 @@ func TestCannotGetHistoryWithoutValidUserInContext(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
 	http.HandlerFunc(env.historyHandler).ServeHTTP(rec, req)
 
@@ -130,7 +135,7 @@ func TestCannotGetHistoryWithoutAdminUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User with ID 0 to context (unknown user)
 	user, err := db.GetUserByEmail("johndoe@example.com")
@@ -139,8 +144,9 @@ func TestCannotGetHistoryWithoutAdminUserInContext(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
-	http.HandlerFunc(env.historyHandler).ServeHTTP(rec, req)
+	http.HandlerFunc(requireScopes(env.historyHandler, scopeHistoryRead)).ServeHTTP(rec, req)
 
 	// check that we got a 403 (Forbidden)
 	if 403 != rec.Code {
@@ -154,7 +160,7 @@ func TestCannotGetHistoryWithoutAdminUserInContext(t *testing.T) {
 	}
 
 	// check that the right "error" JSON string was returned
-	wantString := `{"error": "admin access required"}`
+	wantString := `{"error": "token requires scope history:read"}`
 	if rec.Body.String() != wantString {
 		t.Fatalf("expected %s, got %s", wantString, rec.Body.String())
 	}
@@ -168,7 +174,7 @@ func TestCannotPostHistoryHandler(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	http.HandlerFunc(env.rootHandler).ServeHTTP(rec, req)
 
 	// check that we got a 405
@@ -185,7 +191,7 @@ func TestIgnoreHandler(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	http.HandlerFunc(env.ignoreHandler).ServeHTTP(rec, req)
 
 	// check that we got a 404
@@ -204,7 +210,7 @@ func TestAdminCanGetAllUsers(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	// add admin User to context (assumes validation has already occurred)
 	user, err := db.GetUserByEmail("janedoe@example.com")
 	if err != nil {
@@ -212,6 +218,7 @@ func TestAdminCanGetAllUsers(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
 	http.HandlerFunc(env.getUsersHandler).ServeHTTP(rec, req)
 
@@ -276,7 +283,7 @@ func TestCannotGetAllUsersWithNoUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	// not adding any User to context
 	http.HandlerFunc(env.getUsersHandler).ServeHTTP(rec, req)
 
@@ -291,7 +298,7 @@ func TestCannotGetUsersWithoutValidUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User with ID 0 to context (unknown user)
 	user := &models.User{
@@ -302,6 +309,7 @@ func TestCannotGetUsersWithoutValidUserInContext(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
 	http.HandlerFunc(env.getUsersHandler).ServeHTTP(rec, req)
 
@@ -316,7 +324,7 @@ func TestCannotGetUsersWithoutAdminUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User with ID 0 to context (unknown user)
 	user, err := db.GetUserByEmail("johndoe@example.com")
@@ -325,8 +333,9 @@ func TestCannotGetUsersWithoutAdminUserInContext(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
-	http.HandlerFunc(env.getUsersHandler).ServeHTTP(rec, req)
+	http.HandlerFunc(requireScopes(env.getUsersHandler, scopeUsersRead)).ServeHTTP(rec, req)
 
 	// check that we got a 403 (Forbidden)
 	if 403 != rec.Code {
@@ -340,7 +349,7 @@ func TestCannotGetUsersWithoutAdminUserInContext(t *testing.T) {
 	}
 
 	// check that the right "error" JSON string was returned
-	wantString := `{"error": "admin access required"}`
+	wantString := `{"error": "token requires scope users:read"}`
 	if rec.Body.String() != wantString {
 		t.Fatalf("expected %s, got %s", wantString, rec.Body.String())
 	}
@@ -357,7 +366,7 @@ func TestAdminCanPostNewUser(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	// add admin User to context (assumes validation has already occurred)
 	user, err := db.GetUserByEmail("janedoe@example.com")
 	if err != nil {
@@ -365,6 +374,7 @@ func TestAdminCanPostNewUser(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
 	http.HandlerFunc(env.newUserHandler).ServeHTTP(rec, req)
 
@@ -387,10 +397,9 @@ func TestAdminCanPostNewUser(t *testing.T) {
 		t.Fatalf("got non-nil error: %v", err)
 	}
 
-	// don't check exact ID since it will be randomly generated
-	// just make sure it's greater than 0
-	if newUser.ID == 0 {
-		t.Errorf("expected non-zero ID, got 0")
+	// the ID is the one that the database gave out
+	if newUser.ID != 1 {
+		t.Errorf("expected %v, got %v", 1, newUser.ID)
 	}
 	if newUser.Email != "steve@example.com" {
 		t.Errorf("expected %v, got %v", "steve@example.com", newUser.Email)
@@ -431,7 +440,7 @@ func TestAdminCannotPostNewUserWithExistingEmail(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	// add admin User to context (assumes validation has already occurred)
 	user, err := db.GetUserByEmail("janedoe@example.com")
 	if err != nil {
@@ -439,12 +448,13 @@ func TestAdminCannotPostNewUserWithExistingEmail(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
 	http.HandlerFunc(env.newUserHandler).ServeHTTP(rec, req)
 
-	// check that we got a 400 (Bad Request)
-	if 400 != rec.Code {
-		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	// check that we got a 409 (Conflict)
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
 	}
 
 	// check that content type was application/json
@@ -460,6 +470,30 @@ func TestAdminCannotPostNewUserWithExistingEmail(t *testing.T) {
 	}
 }
 
+func TestAdminCannotPostNewUserWithExistingEmailInOtherCase(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newUserHandler, scopeUsersWrite, "janedoe@example.com", true, nil,
+		`{"email": "  JohnDoe@EXAMPLE.com ", "name": "oops John Doe Redux"}`)
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+	wantString := `{"error": "user with email johndoe@example.com already exists"}`
+	if rec.Body.String() != wantString {
+		t.Errorf("expected %s, got %s", wantString, rec.Body.String())
+	}
+}
+
+func TestAdminCannotPostNewUserWithInvalidEmail(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newUserHandler, scopeUsersWrite, "janedoe@example.com", true, nil,
+		`{"email": "johndoe", "name": "John Doe"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
 func TestCannotPostNewUserWithNoUserInContext(t *testing.T) {
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("POST", "/admin/users", nil)
@@ -468,7 +502,7 @@ func TestCannotPostNewUserWithNoUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	// not adding any User to context
 	http.HandlerFunc(env.newUserHandler).ServeHTTP(rec, req)
 
@@ -483,7 +517,7 @@ func TestCannotPostNewUserWithoutValidUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User with ID 0 to context (unknown user)
 	user := &models.User{
@@ -494,6 +528,7 @@ func TestCannotPostNewUserWithoutValidUserInContext(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
 	http.HandlerFunc(env.newUserHandler).ServeHTTP(rec, req)
 
@@ -508,7 +543,7 @@ func TestCannotPostNewUserWithoutAdminUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User with ID 0 to context (unknown user)
 	user, err := db.GetUserByEmail("johndoe@example.com")
@@ -517,8 +552,9 @@ func TestCannotPostNewUserWithoutAdminUserInContext(t *testing.T) {
 	}
 	ctx := req.Context()
 	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
 	req = req.WithContext(ctx)
-	http.HandlerFunc(env.newUserHandler).ServeHTTP(rec, req)
+	http.HandlerFunc(requireScopes(env.newUserHandler, scopeUsersWrite)).ServeHTTP(rec, req)
 
 	// check that we got a 403 (Forbidden)
 	if 403 != rec.Code {
@@ -532,8 +568,503 @@ func TestCannotPostNewUserWithoutAdminUserInContext(t *testing.T) {
 	}
 
 	// check that the right "error" JSON string was returned
-	wantString := `{"error": "admin access required"}`
+	wantString := `{"error": "token requires scope users:write"}`
 	if rec.Body.String() != wantString {
 		t.Fatalf("expected %s, got %s", wantString, rec.Body.String())
 	}
 }
+
+// ===== /admin/users/{id}/revokeTokens POST route =====
+
+func TestAdminCanRevokeTokensForUser(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/users/91461/revokeTokens", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": "91461"})
+
+	db := &mockDB{}
+	db.AddRefreshToken(hashToken("rt1"), "family1", "johndoe@example.com", "", false, time.Now().Add(time.Hour))
+	db.AddRefreshToken(hashToken("rt2"), "family2", "janedoe@example.com", "", false, time.Now().Add(time.Hour))
+	env := Env{db: db, keys: newTestKeyring()}
+	// add admin User to context (assumes validation has already occurred)
+	user, err := db.GetUserByEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(env.revokeUserTokensHandler).ServeHTTP(rec, req)
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// check that a cutoff was recorded for the user's email
+	if _, ok := db.revokedBefore["johndoe@example.com"]; !ok {
+		t.Errorf("expected cutoff for johndoe@example.com, got none")
+	}
+
+	// and that only that user's refresh tokens were deleted
+	if _, ok := db.refreshTokens[hashToken("rt1")]; ok {
+		t.Errorf("expected refresh token to be deleted, but it remains")
+	}
+	if _, ok := db.refreshTokens[hashToken("rt2")]; !ok {
+		t.Errorf("expected other user's refresh token to remain, but it was deleted")
+	}
+}
+
+func TestAdminCannotRevokeTokensForUnknownUser(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/users/12345/revokeTokens", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": "12345"})
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	// add admin User to context (assumes validation has already occurred)
+	user, err := db.GetUserByEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(env.revokeUserTokensHandler).ServeHTTP(rec, req)
+
+	// check that we got a 404 (Not Found)
+	if 404 != rec.Code {
+		t.Errorf("Expected %d, got %d", 404, rec.Code)
+	}
+}
+
+func TestCannotRevokeTokensWithoutAdminUserInContext(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/users/914611345/revokeTokens", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": "914611345"})
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	user, err := db.GetUserByEmail("johndoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(requireScopes(env.revokeUserTokensHandler, scopeUsersWrite)).ServeHTTP(rec, req)
+
+	// check that we got a 403 (Forbidden)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+
+	// and that nothing was revoked
+	if len(db.revokedBefore) != 0 {
+		t.Errorf("expected len %d, got %d", 0, len(db.revokedBefore))
+	}
+}
+
+// requestAsUser calls handler at the given URL, which may have a query
+// string, as the given user, with a token that carries all of the user's
+// scopes and is from a login that did or didn't pass MFA. If permission
+// isn't empty, the handler is called through requirePermissions.
+func requestAsUser(t *testing.T, env *Env, method string, url string, handler http.HandlerFunc, permission string, email string, mfa bool, vars map[string]string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req = mux.SetURLVars(req, vars)
+	user, err := env.db.GetUserByEmail(email)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := context.WithValue(req.Context(), userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{Email: email, MFA: mfa, Scopes: env.userScopes(user)})
+	req = req.WithContext(ctx)
+	if permission != "" {
+		handler = env.requirePermissions(handler, permission)
+	}
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeUser(t *testing.T, rec *httptest.ResponseRecorder) *models.User {
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	user := &models.User{}
+	err := json.Unmarshal(rec.Body.Bytes(), user)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return user
+}
+
+func TestAdminCanGetUser(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "GET", "/", env.getUserHandler, scopeUsersRead, "janedoe@example.com", true, map[string]string{"id": "91461"}, "")
+	user := decodeUser(t, rec)
+	if user.Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", user.Email)
+	}
+
+	rec = requestAsUser(t, env, "GET", "/", env.getUserHandler, scopeUsersRead, "janedoe@example.com", true, map[string]string{"id": "12345"}, "")
+	if 404 != rec.Code {
+		t.Errorf("Expected %d, got %d", 404, rec.Code)
+	}
+}
+
+func TestAdminCanPatchUserName(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"name": "John Q. Doe"}`)
+	user := decodeUser(t, rec)
+	if user.Name != "John Q. Doe" {
+		t.Errorf("expected %v, got %v", "John Q. Doe", user.Name)
+	}
+	if user.Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", user.Email)
+	}
+}
+
+func TestPutUserMustSupplyEveryField(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "PUT", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"name": "John Q. Doe"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func TestAdminCanPromoteUser(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "PUT", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"email": "johndoe@example.com", "name": "John Doe", "is_admin": true}`)
+	user := decodeUser(t, rec)
+	if !user.IsAdmin {
+		t.Errorf("expected user to be admin")
+	}
+}
+
+func TestAdminCannotChangeEmailDirectly(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"email": "john@example.com"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+	user, _ := db.GetUserByID(91461)
+	if user.Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", user.Email)
+	}
+}
+
+func TestCannotChangeEmailToExistingEmail(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"email": "janedoe@example.com"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func TestCannotRemoveLastAdmin(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	vars := map[string]string{"id": "914611345"}
+
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true, vars, `{"is_admin": false}`)
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+	rec = requestAsUser(t, env, "DELETE", "/", env.deleteUserHandler, scopeUsersWrite, "janedoe@example.com", true, vars, "")
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+	rec = requestAsUser(t, env, "POST", "/", env.revokeRoleHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "914611345", "role": "superadmin"}, "")
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+
+	// but once there is another admin, she can step down
+	rec = requestAsUser(t, env, "PATCH", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"is_admin": true}`)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	rec = requestAsUser(t, env, "PATCH", "/", env.updateUserHandler, scopeUsersWrite, "janedoe@example.com", true, vars, `{"is_admin": false}`)
+	if user := decodeUser(t, rec); user.IsAdmin {
+		t.Errorf("expected user not to be admin")
+	}
+}
+
+func TestUserManagerCannotPromoteToAdmin(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	db.AssignRole(91461, "user-manager")
+
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateUserHandler, scopeUsersWrite, "johndoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"is_admin": true}`)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestUserManagerCannotChangeSuperadmin(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring(), mailer: mailer.NewMemoryMailer()}
+	db.AssignRole(91461, "user-manager")
+	vars := map[string]string{"id": "914611345"}
+
+	for _, tc := range []struct {
+		method  string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"POST", env.resetPasswordHandler, `{"password": "correct horse battery staple"}`},
+		{"POST", env.changeUserEmailHandler, `{"email": "john@example.com"}`},
+		{"DELETE", env.deleteUserHandler, ""},
+		{"POST", env.suspendUserHandler, ""},
+		{"POST", env.deactivateUserHandler, ""},
+		{"PATCH", env.updateUserHandler, `{"email": "john@example.com"}`},
+		{"POST", env.revokeUserTokensHandler, ""},
+		{"POST", env.revokeUserSessionHandler, `{"id": "abc"}`},
+	} {
+		rec := requestAsUser(t, env, tc.method, "/", tc.handler, scopeUsersWrite, "johndoe@example.com", true, vars, tc.body)
+		if 403 != rec.Code {
+			t.Errorf("Expected %d, got %d: %s", 403, rec.Code, rec.Body.String())
+		}
+	}
+	if user, _ := db.GetUserByID(914611345); user.Email != "janedoe@example.com" || user.Status != models.UserActive {
+		t.Errorf("expected superadmin to be unchanged, got %+v", user)
+	}
+
+	// but users without roles are still theirs to manage
+	addTestUsers(db)
+	rec := requestAsUser(t, env, "POST", "/", env.suspendUserHandler, scopeUsersWrite, "johndoe@example.com", true, map[string]string{"id": "1"}, "")
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d: %s", 200, rec.Code, rec.Body.String())
+	}
+}
+
+func TestAdminCanDeleteUser(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "DELETE", "/", env.deleteUserHandler, scopeUsersWrite, "janedoe@example.com", true, map[string]string{"id": "91461"}, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	if _, err := db.GetUserByID(91461); err == nil {
+		t.Errorf("expected user to be deleted")
+	}
+	if _, ok := db.revokedBefore["johndoe@example.com"]; !ok {
+		t.Errorf("expected tokens to be revoked, but they weren't")
+	}
+}
+
+func getUsersWithStatus(t *testing.T, env *Env, status string) []*models.User {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/users?status="+status, nil)
+	user, err := env.db.GetUserByEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := context.WithValue(req.Context(), userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(env.getUsersHandler).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var users []*models.User
+	err = json.Unmarshal(rec.Body.Bytes(), &users)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return users
+}
+
+func TestSuspendedUserIsRejectedUntilReactivated(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	tr := decodeTokenResponse(t, verifyWithScope(env, "johndoe@example.com", ""))
+	vars := map[string]string{"id": "91461"}
+
+	rec := requestAsUser(t, env, "POST", "/", env.suspendUserHandler, scopeUsersWrite, "janedoe@example.com", true, vars, "")
+	user := decodeUser(t, rec)
+	if user.Status != models.UserSuspended || user.SuspendedAt == nil {
+		t.Errorf("expected suspended user, got %v", user)
+	}
+	rec = callWithToken(env, env.testHandler, "GET", tr.Token, nil)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+
+	// suspended users are still listed
+	if users := getUsersWithStatus(t, env, ""); len(users) != 2 {
+		t.Errorf("expected len %d, got %d", 2, len(users))
+	}
+
+	rec = requestAsUser(t, env, "POST", "/", env.reactivateUserHandler, scopeUsersWrite, "janedoe@example.com", true, vars, "")
+	if user := decodeUser(t, rec); user.Status != models.UserActive || user.SuspendedAt != nil {
+		t.Errorf("expected active user, got %v", user)
+	}
+	rec = callWithToken(env, env.testHandler, "GET", tr.Token, nil)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+}
+
+func TestDeactivatedUserIsHiddenButNotDeleted(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	tr := decodeTokenResponse(t, verifyWithScope(env, "johndoe@example.com", ""))
+
+	rec := requestAsUser(t, env, "POST", "/", env.deactivateUserHandler, scopeUsersWrite, "janedoe@example.com", true, map[string]string{"id": "91461"}, "")
+	if user := decodeUser(t, rec); user.Status != models.UserDeactivated || user.DeactivatedAt == nil {
+		t.Errorf("expected deactivated user, got %v", user)
+	}
+	if _, ok := db.revokedBefore["johndoe@example.com"]; !ok {
+		t.Errorf("expected tokens to be revoked, but they weren't")
+	}
+
+	users := getUsersWithStatus(t, env, "")
+	if len(users) != 1 || users[0].ID != 914611345 {
+		t.Errorf("expected only janedoe@example.com, got %v", users)
+	}
+	users = getUsersWithStatus(t, env, models.UserDeactivated)
+	if len(users) != 1 || users[0].ID != 91461 {
+		t.Errorf("expected only johndoe@example.com, got %v", users)
+	}
+
+	// the user can still be found by ID, so their history stays
+	// attributable to them
+	if _, err := db.GetUserByID(91461); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+
+	rec = callWithToken(env, env.testHandler, "GET", tr.Token, nil)
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+func TestCannotSuspendOrDeactivateLastAdmin(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	vars := map[string]string{"id": "914611345"}
+
+	for _, handler := range []http.HandlerFunc{env.suspendUserHandler, env.deactivateUserHandler} {
+		rec := requestAsUser(t, env, "POST", "/", handler, scopeUsersWrite, "janedoe@example.com", true, vars, "")
+		if 409 != rec.Code {
+			t.Errorf("Expected %d, got %d", 409, rec.Code)
+		}
+	}
+}
+
+// addTestUsers adds users named Alice, Bob and Carol to the mock's
+// registered users, after johndoe and janedoe.
+func addTestUsers(db *mockDB) {
+	db.users = append(db.registeredUsers(),
+		&models.User{ID: 3, Email: "carol@example.com", Name: "Carol", Status: models.UserActive},
+		&models.User{ID: 1, Email: "alice@example.com", Name: "Alice", Status: models.UserActive},
+		&models.User{ID: 2, Email: "bob@example.org", Name: "Bob", Status: models.UserSuspended},
+	)
+}
+
+func decodeUsers(t *testing.T, rec *httptest.ResponseRecorder) []*models.User {
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d: %s", 200, rec.Code, rec.Body.String())
+	}
+	var users []*models.User
+	err := json.Unmarshal(rec.Body.Bytes(), &users)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return users
+}
+
+func TestAdminCanPageThroughUsersByName(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	addTestUsers(db)
+
+	var names []string
+	query := "sort=name&limit=2"
+	for pages := 1; ; pages++ {
+		rec := requestAsUser(t, env, "GET", "/?"+query, env.getUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+		for _, user := range decodeUsers(t, rec) {
+			names = append(names, user.Name)
+		}
+		if rec.Header().Get("X-Total-Count") != "5" {
+			t.Errorf("expected total count %v, got %v", "5", rec.Header().Get("X-Total-Count"))
+		}
+		cursor := rec.Header().Get("X-Next-Cursor")
+		if cursor == "" {
+			if pages != 3 {
+				t.Errorf("expected %d pages, got %d", 3, pages)
+			}
+			break
+		}
+		query = "sort=name&limit=2&cursor=" + cursor
+	}
+
+	want := "Alice,Bob,Carol,Jane Doe,John Doe"
+	if strings.Join(names, ",") != want {
+		t.Errorf("expected %v, got %v", want, strings.Join(names, ","))
+	}
+}
+
+func TestAdminCanFilterAndSortUsers(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	addTestUsers(db)
+
+	rec := requestAsUser(t, env, "GET", "/?q=EXAMPLE.COM&admin=false&sort=email&order=desc", env.getUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	users := decodeUsers(t, rec)
+	var emails []string
+	for _, user := range users {
+		emails = append(emails, user.Email)
+	}
+	want := "johndoe@example.com,carol@example.com,alice@example.com"
+	if strings.Join(emails, ",") != want {
+		t.Errorf("expected %v, got %v", want, strings.Join(emails, ","))
+	}
+	if rec.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("expected total count %v, got %v", "3", rec.Header().Get("X-Total-Count"))
+	}
+	if rec.Header().Get("X-Next-Cursor") != "" {
+		t.Errorf("expected no next cursor, got %v", rec.Header().Get("X-Next-Cursor"))
+	}
+
+	rec = requestAsUser(t, env, "GET", "/?admin=true", env.getUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	users = decodeUsers(t, rec)
+	if len(users) != 1 || users[0].ID != 914611345 {
+		t.Errorf("expected only janedoe@example.com, got %v", users)
+	}
+}
+
+func TestCannotListUsersWithInvalidQuery(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	for _, query := range []string{"sort=password_hash", "order=up", "limit=0", "limit=1001", "admin=maybe", "cursor=!!!", "status=gone"} {
+		rec := requestAsUser(t, env, "GET", "/?"+query, env.getUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+		if 400 != rec.Code {
+			t.Errorf("%s: Expected %d, got %d", query, 400, rec.Code)
+		}
+	}
+}
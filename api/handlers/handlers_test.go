@@ -2,10 +2,13 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,30 +20,152 @@ import (
 type mockDB struct {
 	addedVPs   []*models.VisitedPath
 	addedUsers []*models.User
+	// registered users; see registeredUsers
+	users []*models.User
+	// preferences, keyed by user ID
+	preferences map[uint32]string
+	loginCodes  map[string]*mockLoginCode
+	// refresh tokens, keyed by hash
+	refreshTokens map[string]*models.RefreshToken
+	// revoked token IDs and their expiry, and per-email cutoffs
+	revokedTokens     map[string]time.Time
+	revokedBefore     map[string]time.Time
+	revocationLookups int
+	// password hashes, keyed by user ID
+	passwordHashes map[uint32]string
+	// pending OpenID Connect logins, keyed by state hash
+	oidcStates map[string]*models.OIDCState
+	// TOTP enrollments keyed by user ID, recovery codes keyed by hash,
+	// and MFA challenges keyed by hash
+	totpSecrets   map[uint32]*models.TOTPSecret
+	recoveryCodes map[string]uint32
+	mfaChallenges map[string]*mockLoginCode
+	// API keys, keyed by ID
+	apiKeys map[string]*models.APIKey
+	// failed logins, keyed by email
+	authFailures map[string]*mockAuthFailure
+	// sessions, keyed by ID, and how many times they've been touched
+	sessions       map[string]*models.Session
+	sessionTouches int
+	// OAuth2 clients, keyed by ID
+	clients map[string]*models.Client
+	// names of roles held, keyed by user ID; until a role is assigned or
+	// revoked, janedoe@example.com is the only superadmin
+	userRoles map[uint32][]string
+	// pending email changes, keyed by token hash
+	emailChanges map[string]*models.EmailChange
+	// audit log, oldest first
+	auditEvents []*models.AuditEvent
+	// pending invitations, keyed by ID
+	invitations map[string]*models.Invitation
+}
+
+type mockAuthFailure struct {
+	failures     int
+	firstFailure time.Time
+	lockedUntil  time.Time
+}
+
+type mockLoginCode struct {
+	email   string
+	expires time.Time
+}
+
+// registeredUsers returns the registered users, who start out as
+// johndoe@example.com and janedoe@example.com.
+func (mdb *mockDB) registeredUsers() []*models.User {
+	if mdb.users == nil {
+		mdb.users = []*models.User{
+			{
+				ID:     91461,
+				Email:  "johndoe@example.com",
+				Name:   "John Doe",
+				Status: models.UserActive,
+			},
+			{
+				ID:     914611345,
+				Email:  "janedoe@example.com",
+				Name:   "Jane Doe",
+				Status: models.UserActive,
+			},
+		}
+	}
+	return mdb.users
+}
+
+// usersWithStatus returns copies of the registered users who have one of
+// the given statuses.
+func (mdb *mockDB) usersWithStatus(statuses ...string) []*models.User {
+	users := make([]*models.User, 0)
+	for _, u := range mdb.registeredUsers() {
+		user := *u
+		// as in the database, admins are the users with the superadmin role
+		for _, role := range mdb.rolesByUserID()[user.ID] {
+			if role == models.RoleSuperadmin {
+				user.IsAdmin = true
+			}
+		}
+		for _, status := range statuses {
+			if user.Status == status {
+				users = append(users, &user)
+			}
+		}
+	}
+	return users
 }
 
 func (mdb *mockDB) GetAllUsers() ([]*models.User, error) {
+	return mdb.usersWithStatus(models.UserActive, models.UserSuspended), nil
+}
+
+// matchingUsers filters users as the database does for QueryUsers and
+// CountUsers.
+func (mdb *mockDB) matchingUsers(q *models.UserQuery) []*models.User {
+	statuses := []string{models.UserActive, models.UserSuspended}
+	if q.Status != "" {
+		statuses = []string{q.Status}
+	}
+	search := strings.ToLower(q.Search)
 	users := make([]*models.User, 0)
-	users = append(users, &models.User{
-		ID:      91461,
-		Email:   "johndoe@example.com",
-		Name:    "John Doe",
-		IsAdmin: false,
-	})
-	users = append(users, &models.User{
-		ID:      914611345,
-		Email:   "janedoe@example.com",
-		Name:    "Jane Doe",
-		IsAdmin: true,
-	})
+	for _, user := range mdb.usersWithStatus(statuses...) {
+		if q.IsAdmin != nil && user.IsAdmin != *q.IsAdmin {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(user.Name), search) && !strings.Contains(strings.ToLower(user.Email), search) {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+func (mdb *mockDB) QueryUsers(q *models.UserQuery) ([]*models.User, error) {
+	// before reports whether position a comes before position b
+	before := func(a, b *models.UserCursor) bool {
+		if a.Value != b.Value {
+			return (a.Value < b.Value) != q.Desc
+		}
+		return (a.ID < b.ID) != q.Desc
+	}
+	users := make([]*models.User, 0)
+	for _, user := range mdb.matchingUsers(q) {
+		if q.After == nil || before(q.After, q.CursorFor(user)) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return before(q.CursorFor(users[i]), q.CursorFor(users[j])) })
+	if q.Limit > 0 && len(users) > q.Limit {
+		users = users[:q.Limit]
+	}
 	return users, nil
 }
 
+func (mdb *mockDB) CountUsers(q *models.UserQuery) (int, error) {
+	return len(mdb.matchingUsers(q)), nil
+}
+
 func (mdb *mockDB) GetUserByID(id uint32) (*models.User, error) {
-	users, err := mdb.GetAllUsers()
-	if err != nil {
-		return nil, err
-	}
+	users := mdb.usersWithStatus(models.UserActive, models.UserSuspended, models.UserDeactivated)
 	for _, user := range users {
 		if user.ID == id {
 			return user, nil
@@ -51,12 +176,13 @@ func (mdb *mockDB) GetUserByID(id uint32) (*models.User, error) {
 }
 
 func (mdb *mockDB) GetUserByEmail(email string) (*models.User, error) {
-	users, err := mdb.GetAllUsers()
+	normalized, err := models.NormalizeEmail(email)
 	if err != nil {
 		return nil, err
 	}
+	users := mdb.usersWithStatus(models.UserActive, models.UserSuspended, models.UserDeactivated)
 	for _, user := range users {
-		if user.Email == email {
+		if user.Email == normalized {
 			return user, nil
 		}
 	}
@@ -64,19 +190,181 @@ func (mdb *mockDB) GetUserByEmail(email string) (*models.User, error) {
 	return nil, fmt.Errorf("user not found")
 }
 
-func (mdb *mockDB) AddUser(id uint32, email string, name string, isAdmin bool) error {
+// AddUser gives out IDs in order, starting from 1, as the users_id_seq
+// sequence would in the database.
+func (mdb *mockDB) AddUser(email string, name string) (uint32, error) {
+	normalized, err := models.NormalizeEmail(email)
+	if err != nil {
+		return 0, err
+	}
+	if user, err := mdb.GetUserByEmail(normalized); err == nil && user != nil {
+		return 0, &models.DuplicateEmailError{Email: normalized}
+	}
 	if mdb.addedUsers == nil {
 		mdb.addedUsers = make([]*models.User, 0)
 	}
+	id := uint32(len(mdb.addedUsers) + 1)
 	mdb.addedUsers = append(mdb.addedUsers, &models.User{
-		ID:      id,
-		Email:   email,
-		Name:    name,
-		IsAdmin: isAdmin,
+		ID:    id,
+		Email: normalized,
+		Name:  name,
 	})
+	return id, nil
+}
+
+func (mdb *mockDB) GetUsersByEmails(emails []string) ([]*models.User, error) {
+	users := make([]*models.User, 0)
+	for _, email := range emails {
+		if user, err := mdb.GetUserByEmail(email); err == nil && user != nil {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (mdb *mockDB) AddUsers(users []*models.User) error {
+	// check them all first, so that none are added if any can't be
+	for _, user := range users {
+		normalized, err := models.NormalizeEmail(user.Email)
+		if err != nil {
+			return err
+		}
+		if u, err := mdb.GetUserByEmail(normalized); err == nil && u != nil {
+			return &models.DuplicateEmailError{Email: normalized}
+		}
+	}
+	for _, user := range users {
+		id, err := mdb.AddUser(user.Email, user.Name)
+		if err != nil {
+			return err
+		}
+		user.ID = id
+		user.Email, _ = models.NormalizeEmail(user.Email)
+		user.Status = models.UserActive
+	}
 	return nil
 }
 
+func (mdb *mockDB) UpdateUser(id uint32, email string, name string) error {
+	normalized, err := models.NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	if user, err := mdb.GetUserByEmail(normalized); err == nil && user != nil && user.ID != id {
+		return &models.DuplicateEmailError{Email: normalized}
+	}
+	for _, user := range mdb.registeredUsers() {
+		if user.ID == id {
+			user.Email = normalized
+			user.Name = name
+			return nil
+		}
+	}
+	return fmt.Errorf("user not found")
+}
+
+// refuseLastAdmin returns a LastAdminError if the user with the given ID
+// is the only active admin, as the database does.
+func (mdb *mockDB) refuseLastAdmin(id uint32) error {
+	isAdmin := true
+	admins := mdb.matchingUsers(&models.UserQuery{Status: models.UserActive, IsAdmin: &isAdmin})
+	if len(admins) == 1 && admins[0].ID == id {
+		return &models.LastAdminError{ID: id}
+	}
+	return nil
+}
+
+func (mdb *mockDB) DeleteUser(id uint32) error {
+	if err := mdb.refuseLastAdmin(id); err != nil {
+		return err
+	}
+	for i, user := range mdb.registeredUsers() {
+		if user.ID == id {
+			mdb.users = append(mdb.users[:i:i], mdb.users[i+1:]...)
+			delete(mdb.rolesByUserID(), id)
+			return nil
+		}
+	}
+	return fmt.Errorf("user not found")
+}
+
+func (mdb *mockDB) SetUserStatus(id uint32, status string, at time.Time) error {
+	if status != models.UserActive {
+		if err := mdb.refuseLastAdmin(id); err != nil {
+			return err
+		}
+	}
+	for _, user := range mdb.registeredUsers() {
+		if user.ID == id {
+			user.Status = status
+			switch status {
+			case models.UserActive:
+				user.SuspendedAt = nil
+				user.DeactivatedAt = nil
+			case models.UserSuspended:
+				user.SuspendedAt = &at
+			case models.UserDeactivated:
+				user.DeactivatedAt = &at
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("user not found")
+}
+
+func (mdb *mockDB) GetPasswordHash(email string) (string, error) {
+	user, err := mdb.GetUserByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	return mdb.passwordHashes[user.ID], nil
+}
+
+func (mdb *mockDB) SetPasswordHash(id uint32, hash string) error {
+	if _, err := mdb.GetUserByID(id); err != nil {
+		return err
+	}
+	if mdb.passwordHashes == nil {
+		mdb.passwordHashes = make(map[uint32]string)
+	}
+	mdb.passwordHashes[id] = hash
+	return nil
+}
+
+func (mdb *mockDB) GetPreferences(id uint32) (string, error) {
+	if _, err := mdb.GetUserByID(id); err != nil {
+		return "", err
+	}
+	if prefs, ok := mdb.preferences[id]; ok {
+		return prefs, nil
+	}
+	return "{}", nil
+}
+
+func (mdb *mockDB) UpdateProfile(id uint32, name string, update func(string) (string, error)) error {
+	if update != nil {
+		prefs, err := mdb.GetPreferences(id)
+		if err != nil {
+			return err
+		}
+		prefs, err = update(prefs)
+		if err != nil {
+			return err
+		}
+		if mdb.preferences == nil {
+			mdb.preferences = make(map[uint32]string)
+		}
+		mdb.preferences[id] = prefs
+	}
+	for _, user := range mdb.registeredUsers() {
+		if user.ID == id {
+			user.Name = name
+			return nil
+		}
+	}
+	return fmt.Errorf("user not found")
+}
+
 func (mdb *mockDB) GetAllVisitedPaths() ([]*models.VisitedPath, error) {
 	vps := make([]*models.VisitedPath, 0)
 	vps = append(vps, &models.VisitedPath{
@@ -114,8 +402,620 @@ func (mdb *mockDB) AddVisitedPath(p string, ti time.Time, userID uint32) error {
 	return nil
 }
 
+func (mdb *mockDB) AddLoginCode(codeHash string, email string, expires time.Time) error {
+	if mdb.loginCodes == nil {
+		mdb.loginCodes = make(map[string]*mockLoginCode)
+	}
+	mdb.loginCodes[codeHash] = &mockLoginCode{email: email, expires: expires}
+	return nil
+}
+
+func (mdb *mockDB) ConsumeLoginCode(codeHash string, now time.Time) (string, error) {
+	lc, ok := mdb.loginCodes[codeHash]
+	if !ok {
+		return "", fmt.Errorf("login code not found")
+	}
+	delete(mdb.loginCodes, codeHash)
+	if !now.Before(lc.expires) {
+		return "", fmt.Errorf("login code expired")
+	}
+	return lc.email, nil
+}
+
+func (mdb *mockDB) DeleteExpiredLoginCodes(now time.Time) error {
+	for codeHash, lc := range mdb.loginCodes {
+		if !now.Before(lc.expires) {
+			delete(mdb.loginCodes, codeHash)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) AddRefreshToken(tokenHash string, familyID string, email string, scope string, mfa bool, expires time.Time) error {
+	if mdb.refreshTokens == nil {
+		mdb.refreshTokens = make(map[string]*models.RefreshToken)
+	}
+	mdb.refreshTokens[tokenHash] = &models.RefreshToken{
+		TokenHash: tokenHash,
+		FamilyID:  familyID,
+		Email:     email,
+		Scope:     scope,
+		MFA:       mfa,
+		Expires:   expires,
+	}
+	return nil
+}
+
+func (mdb *mockDB) GetRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+	rt, ok := mdb.refreshTokens[tokenHash]
+	if !ok {
+		return nil, fmt.Errorf("refresh token not found")
+	}
+	rtCopy := *rt
+	return &rtCopy, nil
+}
+
+func (mdb *mockDB) UseRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+	rt, ok := mdb.refreshTokens[tokenHash]
+	if !ok || rt.Used {
+		return nil, fmt.Errorf("refresh token not found")
+	}
+	rt.Used = true
+	rtCopy := *rt
+	return &rtCopy, nil
+}
+
+func (mdb *mockDB) DeleteRefreshTokenFamily(familyID string) error {
+	for h, rt := range mdb.refreshTokens {
+		if rt.FamilyID == familyID {
+			delete(mdb.refreshTokens, h)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) DeleteRefreshTokensForEmail(email string) error {
+	for h, rt := range mdb.refreshTokens {
+		if rt.Email == email {
+			delete(mdb.refreshTokens, h)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) DeleteExpiredRefreshTokens(now time.Time) error {
+	live := make(map[string]bool)
+	for _, rt := range mdb.refreshTokens {
+		if now.Before(rt.Expires) {
+			live[rt.FamilyID] = true
+		}
+	}
+	for h, rt := range mdb.refreshTokens {
+		if !live[rt.FamilyID] {
+			delete(mdb.refreshTokens, h)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) AddRevokedToken(jti string, expires time.Time) error {
+	if mdb.revokedTokens == nil {
+		mdb.revokedTokens = make(map[string]time.Time)
+	}
+	mdb.revokedTokens[jti] = expires
+	return nil
+}
+
+func (mdb *mockDB) IsTokenRevoked(jti string) (bool, error) {
+	mdb.revocationLookups++
+	_, ok := mdb.revokedTokens[jti]
+	return ok, nil
+}
+
+func (mdb *mockDB) RevokeTokensForEmail(email string, before time.Time) error {
+	if mdb.revokedBefore == nil {
+		mdb.revokedBefore = make(map[string]time.Time)
+	}
+	if prev, ok := mdb.revokedBefore[email]; !ok || before.After(prev) {
+		mdb.revokedBefore[email] = before
+	}
+	return nil
+}
+
+func (mdb *mockDB) GetTokensRevokedBefore(email string) (time.Time, error) {
+	return mdb.revokedBefore[email], nil
+}
+
+func (mdb *mockDB) DeleteExpiredRevocations(now time.Time, maxTokenAge time.Duration) error {
+	for jti, expires := range mdb.revokedTokens {
+		if expires.Before(now) {
+			delete(mdb.revokedTokens, jti)
+		}
+	}
+	for email, before := range mdb.revokedBefore {
+		if before.Before(now.Add(-maxTokenAge)) {
+			delete(mdb.revokedBefore, email)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) AddOIDCState(stateHash string, provider string, nonce string, codeVerifier string, expires time.Time) error {
+	if mdb.oidcStates == nil {
+		mdb.oidcStates = make(map[string]*models.OIDCState)
+	}
+	mdb.oidcStates[stateHash] = &models.OIDCState{
+		StateHash:    stateHash,
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		Expires:      expires,
+	}
+	return nil
+}
+
+func (mdb *mockDB) ConsumeOIDCState(stateHash string, now time.Time) (*models.OIDCState, error) {
+	st, ok := mdb.oidcStates[stateHash]
+	if !ok {
+		return nil, fmt.Errorf("Login state not found")
+	}
+	delete(mdb.oidcStates, stateHash)
+	if !now.Before(st.Expires) {
+		return nil, fmt.Errorf("Login state expired")
+	}
+	return st, nil
+}
+
+func (mdb *mockDB) DeleteExpiredOIDCStates(now time.Time) error {
+	for stateHash, st := range mdb.oidcStates {
+		if !now.Before(st.Expires) {
+			delete(mdb.oidcStates, stateHash)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) GetTOTPSecret(userID uint32) (*models.TOTPSecret, error) {
+	return mdb.totpSecrets[userID], nil
+}
+
+func (mdb *mockDB) SetTOTPSecret(userID uint32, secret string) error {
+	if mdb.totpSecrets == nil {
+		mdb.totpSecrets = make(map[uint32]*models.TOTPSecret)
+	}
+	mdb.totpSecrets[userID] = &models.TOTPSecret{UserID: userID, Secret: secret}
+	return nil
+}
+
+func (mdb *mockDB) ConfirmTOTPSecret(userID uint32) error {
+	if ts, ok := mdb.totpSecrets[userID]; ok {
+		ts.Confirmed = true
+	}
+	return nil
+}
+
+func (mdb *mockDB) UseTOTPStep(userID uint32, step int64) (bool, error) {
+	ts, ok := mdb.totpSecrets[userID]
+	if !ok || ts.LastStep >= step {
+		return false, nil
+	}
+	ts.LastStep = step
+	return true, nil
+}
+
+func (mdb *mockDB) DeleteTOTPSecret(userID uint32) error {
+	delete(mdb.totpSecrets, userID)
+	for h, id := range mdb.recoveryCodes {
+		if id == userID {
+			delete(mdb.recoveryCodes, h)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) SetRecoveryCodes(userID uint32, codeHashes []string) error {
+	if mdb.recoveryCodes == nil {
+		mdb.recoveryCodes = make(map[string]uint32)
+	}
+	for h, id := range mdb.recoveryCodes {
+		if id == userID {
+			delete(mdb.recoveryCodes, h)
+		}
+	}
+	for _, h := range codeHashes {
+		mdb.recoveryCodes[h] = userID
+	}
+	return nil
+}
+
+func (mdb *mockDB) UseRecoveryCode(userID uint32, codeHash string) (bool, error) {
+	id, ok := mdb.recoveryCodes[codeHash]
+	if !ok || id != userID {
+		return false, nil
+	}
+	delete(mdb.recoveryCodes, codeHash)
+	return true, nil
+}
+
+func (mdb *mockDB) AddMFAChallenge(tokenHash string, email string, expires time.Time) error {
+	if mdb.mfaChallenges == nil {
+		mdb.mfaChallenges = make(map[string]*mockLoginCode)
+	}
+	mdb.mfaChallenges[tokenHash] = &mockLoginCode{email: email, expires: expires}
+	return nil
+}
+
+func (mdb *mockDB) ConsumeMFAChallenge(tokenHash string, now time.Time) (string, error) {
+	mc, ok := mdb.mfaChallenges[tokenHash]
+	if !ok {
+		return "", fmt.Errorf("MFA challenge not found")
+	}
+	delete(mdb.mfaChallenges, tokenHash)
+	if !now.Before(mc.expires) {
+		return "", fmt.Errorf("MFA challenge expired")
+	}
+	return mc.email, nil
+}
+
+func (mdb *mockDB) DeleteExpiredMFAChallenges(now time.Time) error {
+	for tokenHash, mc := range mdb.mfaChallenges {
+		if !now.Before(mc.expires) {
+			delete(mdb.mfaChallenges, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) GetAPIKeysForUserID(userID uint32) ([]*models.APIKey, error) {
+	keys := make([]*models.APIKey, 0)
+	for _, key := range mdb.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (mdb *mockDB) AddAPIKey(key *models.APIKey) error {
+	if mdb.apiKeys == nil {
+		mdb.apiKeys = make(map[string]*models.APIKey)
+	}
+	mdb.apiKeys[key.ID] = key
+	return nil
+}
+
+func (mdb *mockDB) UseAPIKey(keyHash string, now time.Time) (*models.APIKey, error) {
+	for _, key := range mdb.apiKeys {
+		if key.KeyHash == keyHash {
+			if key.Expires != nil && !now.Before(*key.Expires) {
+				break
+			}
+			key.LastUsed = &now
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("API key not found")
+}
+
+func (mdb *mockDB) DeleteAPIKey(userID uint32, id string) error {
+	key, ok := mdb.apiKeys[id]
+	if !ok || key.UserID != userID {
+		return fmt.Errorf("API key not found")
+	}
+	delete(mdb.apiKeys, id)
+	return nil
+}
+
+func (mdb *mockDB) DeleteAPIKeysForUserID(userID uint32) error {
+	for id, key := range mdb.apiKeys {
+		if key.UserID == userID {
+			delete(mdb.apiKeys, id)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) RecordAuthFailure(email string, now time.Time, window time.Duration, maxFailures int, lockout time.Duration) (time.Time, error) {
+	if mdb.authFailures == nil {
+		mdb.authFailures = make(map[string]*mockAuthFailure)
+	}
+	af, ok := mdb.authFailures[email]
+	if !ok || af.firstFailure.Before(now.Add(-window)) {
+		af = &mockAuthFailure{firstFailure: now, lockedUntil: af.lockedUntilOrZero()}
+		mdb.authFailures[email] = af
+	}
+	af.failures++
+	if af.failures >= maxFailures {
+		af.lockedUntil = now.Add(lockout)
+	}
+	return af.lockedUntil, nil
+}
+
+func (af *mockAuthFailure) lockedUntilOrZero() time.Time {
+	if af == nil {
+		return time.Time{}
+	}
+	return af.lockedUntil
+}
+
+func (mdb *mockDB) GetLockedUntil(email string) (time.Time, error) {
+	return mdb.authFailures[email].lockedUntilOrZero(), nil
+}
+
+func (mdb *mockDB) ClearAuthFailures(email string) error {
+	delete(mdb.authFailures, email)
+	return nil
+}
+
+func (mdb *mockDB) GetSessionsForEmail(email string) ([]*models.Session, error) {
+	sessions := make([]*models.Session, 0)
+	for _, s := range mdb.sessions {
+		if s.Email == email {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func (mdb *mockDB) SetSession(s *models.Session) error {
+	if mdb.sessions == nil {
+		mdb.sessions = make(map[string]*models.Session)
+	}
+	if prev, ok := mdb.sessions[s.ID]; ok {
+		prev.UserAgent = s.UserAgent
+		prev.IP = s.IP
+		prev.LastSeen = s.LastSeen
+		prev.Expires = s.Expires
+		return nil
+	}
+	mdb.sessions[s.ID] = s
+	return nil
+}
+
+func (mdb *mockDB) TouchSession(id string, now time.Time) (bool, error) {
+	mdb.sessionTouches++
+	s, ok := mdb.sessions[id]
+	if !ok || !now.Before(s.Expires) {
+		return false, nil
+	}
+	s.LastSeen = now
+	return true, nil
+}
+
+func (mdb *mockDB) DeleteSession(email string, id string) error {
+	s, ok := mdb.sessions[id]
+	if !ok || s.Email != email {
+		return fmt.Errorf("Session not found")
+	}
+	delete(mdb.sessions, id)
+	return nil
+}
+
+func (mdb *mockDB) DeleteSessionsForEmail(email string) error {
+	for id, s := range mdb.sessions {
+		if s.Email == email {
+			delete(mdb.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) DeleteExpiredSessions(now time.Time) error {
+	for id, s := range mdb.sessions {
+		if !now.Before(s.Expires) {
+			delete(mdb.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) GetAllClients() ([]*models.Client, error) {
+	clients := make([]*models.Client, 0)
+	for _, c := range mdb.clients {
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+func (mdb *mockDB) GetClient(id string) (*models.Client, error) {
+	c, ok := mdb.clients[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (mdb *mockDB) AddClient(c *models.Client) error {
+	if mdb.clients == nil {
+		mdb.clients = make(map[string]*models.Client)
+	}
+	mdb.clients[c.ID] = c
+	return nil
+}
+
+func (mdb *mockDB) DeleteClient(id string) error {
+	if _, ok := mdb.clients[id]; !ok {
+		return fmt.Errorf("client not found")
+	}
+	delete(mdb.clients, id)
+	return nil
+}
+
+func (mdb *mockDB) GetAllRoles() ([]*models.Role, error) {
+	return models.BuiltinRoles, nil
+}
+
+func (mdb *mockDB) rolesByUserID() map[uint32][]string {
+	if mdb.userRoles == nil {
+		mdb.userRoles = map[uint32][]string{914611345: {models.RoleSuperadmin}}
+	}
+	return mdb.userRoles
+}
+
+func (mdb *mockDB) GetRolesForUserID(userID uint32) ([]*models.Role, error) {
+	roles := make([]*models.Role, 0)
+	for _, name := range mdb.rolesByUserID()[userID] {
+		for _, role := range models.BuiltinRoles {
+			if role.Name == name {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles, nil
+}
+
+func (mdb *mockDB) AssignRole(userID uint32, role string) error {
+	for _, name := range mdb.rolesByUserID()[userID] {
+		if name == role {
+			return nil
+		}
+	}
+	mdb.userRoles[userID] = append(mdb.userRoles[userID], role)
+	return nil
+}
+
+func (mdb *mockDB) RevokeRole(userID uint32, role string) error {
+	if role == models.RoleSuperadmin {
+		if err := mdb.refuseLastAdmin(userID); err != nil {
+			return err
+		}
+	}
+	names := mdb.rolesByUserID()[userID]
+	for i, name := range names {
+		if name == role {
+			mdb.userRoles[userID] = append(names[:i:i], names[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("role not held")
+}
+
+func (mdb *mockDB) AddEmailChange(ec *models.EmailChange) error {
+	if mdb.emailChanges == nil {
+		mdb.emailChanges = make(map[string]*models.EmailChange)
+	}
+	mdb.emailChanges[ec.TokenHash] = ec
+	return nil
+}
+
+func (mdb *mockDB) ConsumeEmailChange(tokenHash string, now time.Time) (*models.EmailChange, error) {
+	ec, ok := mdb.emailChanges[tokenHash]
+	if !ok {
+		return nil, fmt.Errorf("email change not found")
+	}
+	delete(mdb.emailChanges, tokenHash)
+	if !now.Before(ec.Expires) {
+		return nil, fmt.Errorf("email change expired")
+	}
+	return ec, nil
+}
+
+func (mdb *mockDB) DeleteExpiredEmailChanges(now time.Time) error {
+	for tokenHash, ec := range mdb.emailChanges {
+		if !now.Before(ec.Expires) {
+			delete(mdb.emailChanges, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (mdb *mockDB) GetAuditEventsForUserID(targetID uint32) ([]*models.AuditEvent, error) {
+	events := make([]*models.AuditEvent, 0)
+	for i := len(mdb.auditEvents) - 1; i >= 0; i-- {
+		if mdb.auditEvents[i].TargetID == targetID {
+			events = append(events, mdb.auditEvents[i])
+		}
+	}
+	return events, nil
+}
+
+func (mdb *mockDB) AddAuditEvent(ev *models.AuditEvent) error {
+	mdb.auditEvents = append(mdb.auditEvents, ev)
+	return nil
+}
+
+func (mdb *mockDB) GetAllInvitations() ([]*models.Invitation, error) {
+	invs := make([]*models.Invitation, 0)
+	for _, inv := range mdb.invitations {
+		invs = append(invs, inv)
+	}
+	sort.Slice(invs, func(i, j int) bool { return invs[i].Created.Before(invs[j].Created) })
+	return invs, nil
+}
+
+func (mdb *mockDB) GetInvitation(id string) (*models.Invitation, error) {
+	inv, ok := mdb.invitations[id]
+	if !ok {
+		return nil, fmt.Errorf("invitation not found")
+	}
+	return inv, nil
+}
+
+func (mdb *mockDB) AddInvitation(inv *models.Invitation) error {
+	if mdb.invitations == nil {
+		mdb.invitations = make(map[string]*models.Invitation)
+	}
+	mdb.invitations[inv.ID] = inv
+	return nil
+}
+
+func (mdb *mockDB) RenewInvitation(id string, tokenHash string, expires time.Time) error {
+	inv, ok := mdb.invitations[id]
+	if !ok {
+		return fmt.Errorf("invitation not found")
+	}
+	inv.TokenHash = tokenHash
+	inv.Expires = expires
+	return nil
+}
+
+func (mdb *mockDB) DeleteInvitation(id string) error {
+	if _, ok := mdb.invitations[id]; !ok {
+		return fmt.Errorf("invitation not found")
+	}
+	delete(mdb.invitations, id)
+	return nil
+}
+
+func (mdb *mockDB) AcceptInvitation(tokenHash string, name string, now time.Time) (*models.Invitation, uint32, error) {
+	for id, inv := range mdb.invitations {
+		if inv.TokenHash == tokenHash {
+			if !now.Before(inv.Expires) {
+				delete(mdb.invitations, id)
+				return nil, 0, &models.InvalidInvitationError{Reason: "invitation expired"}
+			}
+			// as in the database, the invitation is kept if the user
+			// can't be added
+			userID, err := mdb.AddUser(inv.Email, name)
+			if err != nil {
+				return nil, 0, err
+			}
+			delete(mdb.invitations, id)
+			if inv.Role != "" {
+				mdb.AssignRole(userID, inv.Role)
+			}
+			return inv, userID, nil
+		}
+	}
+	return nil, 0, &models.InvalidInvitationError{Reason: "invitation not found"}
+}
+
+func (mdb *mockDB) DeleteExpiredInvitations(before time.Time) error {
+	for id, inv := range mdb.invitations {
+		if !before.Before(inv.Expires) {
+			delete(mdb.invitations, id)
+		}
+	}
+	return nil
+}
+
 // ===== helpers for tests
 
+// newTestKeyring returns a keyring that signs with the HMAC testing key.
+func newTestKeyring() *keyring {
+	return newKeyring(newHMACKey("keyForTesting"))
+}
+
 func confirmRecWasInvalidAuth(t *testing.T, rec *httptest.ResponseRecorder, es string) {
 	// check that we got a 401 (Unauthorized)
 	if 401 != rec.Code {
@@ -153,7 +1053,7 @@ func TestCanGetRootHandler(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User to context (assumes validation has already occurred)
 	user, err := db.GetUserByEmail("janedoe@example.com")
@@ -210,7 +1110,7 @@ func TestCannotGetRootHandlerWithoutValidUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User with ID 0 to context (unknown user)
 	user := &models.User{
@@ -240,7 +1140,7 @@ func TestCannotGetRootHandlerWithNoUserInContext(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// not adding any User to context
 	http.HandlerFunc(env.rootHandler).ServeHTTP(rec, req)
@@ -261,7 +1161,7 @@ func TestCannotPostRootHandler(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	http.HandlerFunc(env.rootHandler).ServeHTTP(rec, req)
 
 	// check that we got a 405
@@ -285,7 +1185,7 @@ func TestCanGetLandingHandler(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 
 	// add User to context (assumes validation has already occurred)
 	user, err := db.GetUserByEmail("janedoe@example.com")
@@ -337,7 +1237,7 @@ func TestCannotPostLandingHandler(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	http.HandlerFunc(env.landingHandler).ServeHTTP(rec, req)
 
 	// check that we got a 405
@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// formats for importing and exporting users, chosen with the "format"
+// query parameter
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+)
+
+// limits on how many users, and how large a body, can be imported in one
+// request
+const (
+	maxImportUsers = 1000
+	maxImportBytes = 1 << 20
+)
+
+// exportColumns are the CSV columns written by exportUsersHandler. Only
+// email and name are read back in by importUsersHandler, so an export
+// from one server can be imported into another. is_admin is whether the
+// user holds the superadmin role.
+var exportColumns = []string{"id", "email", "name", "is_admin", "status", "suspended_at", "deactivated_at"}
+
+// importRow is a user to be imported, along with the line that it came
+// from.
+type importRow struct {
+	line int
+	user newUserReq
+}
+
+// importError describes why the user on one line couldn't be imported.
+type importError struct {
+	Line  int    `json:"line"`
+	Email string `json:"email"`
+	Error string `json:"error"`
+}
+
+// importResp is the JSON body returned after an import. Users are only
+// listed once they have been created.
+type importResp struct {
+	DryRun bool           `json:"dry_run"`
+	Valid  int            `json:"valid"`
+	Errors []*importError `json:"errors"`
+	Users  []*models.User `json:"users,omitempty"`
+}
+
+// importFormat returns the format asked for in the "format" query
+// parameter, defaulting to JSON Lines. If it's unknown, the appropriate
+// HTTP headers and content are written and an empty string is returned.
+func importFormat(w http.ResponseWriter, r *http.Request) string {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", formatJSONL:
+		return formatJSONL
+	case formatCSV:
+		return formatCSV
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "unknown format %s"}`, format)
+		return ""
+	}
+}
+
+// readError describes an error from reading the body of an import.
+func readError(err error, format string) error {
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return fmt.Errorf("can't import more than %d bytes at once", maxImportBytes)
+	}
+	return fmt.Errorf("couldn't read %s", format)
+}
+
+// readImportCSV reads users from CSV with a header row, which must have an
+// email column and may have a name column; other columns are ignored. It
+// stops once it has read more than max users.
+func readImportCSV(body io.Reader, max int) ([]*importRow, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return nil, readError(err, "CSV")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CSV header")
+	}
+	emailCol, nameCol := -1, -1
+	for i, col := range header {
+		switch strings.ToLower(strings.TrimSpace(col)) {
+		case "email":
+			emailCol = i
+		case "name":
+			nameCol = i
+		}
+	}
+	if emailCol == -1 {
+		return nil, fmt.Errorf("CSV header has no email column")
+	}
+
+	rows := make([]*importRow, 0)
+	for len(rows) <= max {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if pe, ok := err.(*csv.ParseError); ok {
+			return nil, fmt.Errorf("couldn't parse CSV on line %d", pe.Line)
+		}
+		if err != nil {
+			return nil, readError(err, "CSV")
+		}
+		line, _ := cr.FieldPos(0)
+		row := &importRow{line: line}
+		if emailCol < len(record) {
+			row.user.Email = record[emailCol]
+		}
+		if nameCol != -1 && nameCol < len(record) {
+			row.user.Name = record[nameCol]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// readImportJSONL reads users from JSON Lines, with one object per line
+// in the same form as for POST /admin/users. Blank lines are skipped. It
+// stops once it has read more than max users.
+func readImportJSONL(body io.Reader, max int) ([]*importRow, error) {
+	rows := make([]*importRow, 0)
+	scanner := bufio.NewScanner(body)
+	// a line can be as long as the whole import
+	scanner.Buffer(nil, maxImportBytes+1)
+	line := 0
+	for len(rows) <= max && scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := &importRow{line: line}
+		err := json.Unmarshal([]byte(text), &row.user)
+		if err != nil {
+			// the last line is cut short if the body couldn't be read
+			if err := scanner.Err(); err != nil {
+				return nil, readError(err, "JSON Lines")
+			}
+			return nil, fmt.Errorf("couldn't parse JSON on line %d", line)
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, readError(err, "JSON Lines")
+	}
+	return rows, nil
+}
+
+// validateImport checks each row in the same way as newUserHandler would,
+// and also that no two rows have the same email. It returns the users to
+// be added and the errors found, or an error if existing users can't be
+// looked up.
+func (env *Env) validateImport(rows []*importRow) ([]*models.User, []*importError, error) {
+	// look up every user who already exists at once, rather than row by row
+	emails := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if email, err := models.NormalizeEmail(row.user.Email); err == nil {
+			emails = append(emails, email)
+		}
+	}
+	existing, err := env.db.GetUsersByEmails(emails)
+	if err != nil {
+		return nil, nil, err
+	}
+	exists := make(map[string]bool)
+	for _, user := range existing {
+		exists[user.Email] = true
+	}
+
+	users := make([]*models.User, 0)
+	errs := make([]*importError, 0)
+	seen := make(map[string]int)
+	for _, row := range rows {
+		email, err := models.NormalizeEmail(row.user.Email)
+		if err != nil {
+			errs = append(errs, &importError{Line: row.line, Email: row.user.Email, Error: "invalid email address"})
+			continue
+		}
+		if line, ok := seen[email]; ok {
+			errs = append(errs, &importError{Line: row.line, Email: email, Error: fmt.Sprintf("same email as line %d", line)})
+			continue
+		}
+		seen[email] = row.line
+		if exists[email] {
+			errs = append(errs, &importError{Line: row.line, Email: email, Error: "user with this email already exists"})
+			continue
+		}
+		users = append(users, &models.User{Email: email, Name: row.user.Name})
+	}
+	return users, errs, nil
+}
+
+func (env *Env) importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	format := importFormat(w, r)
+	if format == "" {
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var rows []*importRow
+	var err error
+	if format == formatCSV {
+		rows, err = readImportCSV(r.Body, maxImportUsers)
+	} else {
+		rows, err = readImportJSONL(r.Body, maxImportUsers)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%s"}`, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "no users to import"}`)
+		return
+	}
+	if len(rows) > maxImportUsers {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "can't import more than %d users at once"}`, maxImportUsers)
+		return
+	}
+
+	users, errs, err := env.validateImport(rows)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	resp := &importResp{DryRun: dryRun, Valid: len(users), Errors: errs}
+
+	// users are only added if every row is valid, and then all at once
+	code := http.StatusOK
+	if len(errs) > 0 {
+		code = http.StatusBadRequest
+	} else if !dryRun {
+		err = env.db.AddUsers(users)
+		if dupErr, ok := err.(*models.DuplicateEmailError); ok {
+			// someone else added the user since we checked
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"error": "user with email %s already exists"}`, dupErr.Email)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "server error saving new users, please check values and try again"}`)
+			return
+		}
+		resp.Users = users
+		code = http.StatusCreated
+	}
+
+	// output as JSON
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.WriteHeader(code)
+	fmt.Fprintf(w, string(js))
+}
+
+// formatTime returns t for a CSV export, or an empty string if it's nil.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// formatCell returns val for a CSV export, with a ' in front if it starts
+// with a character that spreadsheet apps would take as the start of a
+// formula, so that a user's name or email can't run one when the export
+// is opened.
+func formatCell(val string) string {
+	if val != "" && strings.ContainsAny(val[:1], "=+-@\t\r") {
+		return "'" + val
+	}
+	return val
+}
+
+func (env *Env) exportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses, until we know that the export will succeed
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	format := importFormat(w, r)
+	if format == "" {
+		return
+	}
+	// the export takes the same filters and sort order as listing users,
+	// but isn't split into pages
+	q := userQuery(w, r)
+	if q == nil {
+		return
+	}
+	q.Limit = 0
+	users, err := env.db.QueryUsers(q)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	if format == formatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		for _, u := range users {
+			cw.Write([]string{
+				strconv.FormatUint(uint64(u.ID), 10),
+				formatCell(u.Email),
+				formatCell(u.Name),
+				strconv.FormatBool(u.IsAdmin),
+				u.Status,
+				formatTime(u.SuspendedAt),
+				formatTime(u.DeactivatedAt),
+			})
+		}
+		cw.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.jsonl"`)
+	enc := json.NewEncoder(w)
+	for _, u := range users {
+		enc.Encode(u)
+	}
+}
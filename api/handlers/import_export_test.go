@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+func decodeImportResp(t *testing.T, rec *httptest.ResponseRecorder, code int) *importResp {
+	if code != rec.Code {
+		t.Fatalf("Expected %d, got %d: %s", code, rec.Code, rec.Body.String())
+	}
+	resp := &importResp{}
+	err := json.Unmarshal(rec.Body.Bytes(), resp)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return resp
+}
+
+func TestAdminCanImportUsersFromCSV(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	body := "email,name\nsteve@example.com,Steve\n\"Alice@Example.com\",\"Smith, Alice\"\n"
+	rec := requestAsUser(t, env, "POST", "/?format=csv", env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, body)
+	resp := decodeImportResp(t, rec, 201)
+	if len(resp.Users) != 2 || len(resp.Errors) != 0 {
+		t.Fatalf("expected 2 users and no errors, got %v and %v", resp.Users, resp.Errors)
+	}
+	if resp.Users[1].Email != "alice@example.com" || resp.Users[1].Name != "Smith, Alice" {
+		t.Errorf("expected alice@example.com named Smith, Alice, got %v named %v", resp.Users[1].Email, resp.Users[1].Name)
+	}
+	if len(db.addedUsers) != 2 {
+		t.Errorf("expected %d added users, got %d", 2, len(db.addedUsers))
+	}
+}
+
+func TestAdminCanDryRunImportOfUsersFromJSONL(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	body := `{"email": "steve@example.com", "name": "Steve"}` + "\n\n" + `{"email": "alice@example.com", "name": "Alice"}` + "\n"
+	rec := requestAsUser(t, env, "POST", "/?format=jsonl&dry_run=true", env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, body)
+	resp := decodeImportResp(t, rec, 200)
+	if !resp.DryRun || resp.Valid != 2 || len(resp.Errors) != 0 {
+		t.Errorf("expected dry run with 2 valid users, got %+v", resp)
+	}
+	if len(db.addedUsers) != 0 {
+		t.Errorf("expected no added users, got %d", len(db.addedUsers))
+	}
+}
+
+func TestImportReportsErrorsForEachRowAndAddsNoUsers(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	body := "name,email\nSteve,steve@example.com\nJohn,JohnDoe@example.com\nNobody,nobody\nSteve again,STEVE@example.com\n"
+	rec := requestAsUser(t, env, "POST", "/?format=csv", env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, body)
+	resp := decodeImportResp(t, rec, 400)
+	if len(resp.Errors) != 3 {
+		t.Fatalf("expected %d errors, got %v", 3, resp.Errors)
+	}
+	wantLines := []int{3, 4, 5}
+	for i, e := range resp.Errors {
+		if e.Line != wantLines[i] {
+			t.Errorf("expected error on line %d, got line %d: %v", wantLines[i], e.Line, e.Error)
+		}
+	}
+	if resp.Errors[2].Error != "same email as line 2" {
+		t.Errorf("expected %v, got %v", "same email as line 2", resp.Errors[2].Error)
+	}
+	if len(db.addedUsers) != 0 {
+		t.Errorf("expected no added users, got %d", len(db.addedUsers))
+	}
+}
+
+func TestCannotImportCSVWithoutEmailColumn(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/?format=csv", env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, "name\nSteve\n")
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+	wantString := `{"error": "CSV header has no email column"}`
+	if rec.Body.String() != wantString {
+		t.Errorf("expected %s, got %s", wantString, rec.Body.String())
+	}
+}
+
+func TestCannotImportTooManyUsersOrTooLargeBody(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	var rows strings.Builder
+	rows.WriteString("email\n")
+	for i := 0; i <= maxImportUsers; i++ {
+		fmt.Fprintf(&rows, "user%d@example.com\n", i)
+	}
+	rec := requestAsUser(t, env, "POST", "/?format=csv&dry_run=true", env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, rows.String())
+	wantString := fmt.Sprintf(`{"error": "can't import more than %d users at once"}`, maxImportUsers)
+	if rec.Body.String() != wantString {
+		t.Errorf("expected %s, got %s", wantString, rec.Body.String())
+	}
+
+	wantString = fmt.Sprintf(`{"error": "can't import more than %d bytes at once"}`, maxImportBytes)
+	for format, body := range map[string]string{
+		"csv":   "email,name\nsteve@example.com," + strings.Repeat("x", maxImportBytes) + "\n",
+		"jsonl": `{"email": "steve@example.com", "name": "` + strings.Repeat("x", maxImportBytes) + `"}`,
+	} {
+		rec = requestAsUser(t, env, "POST", "/?dry_run=true&format="+format, env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, body)
+		if rec.Body.String() != wantString {
+			t.Errorf("%s: expected %s, got %s", format, wantString, rec.Body.String())
+		}
+	}
+}
+
+func TestCanImportLongJSONLines(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	body := `{"email": "steve@example.com", "name": "` + strings.Repeat("x", 100000) + `"}` + "\n"
+	rec := requestAsUser(t, env, "POST", "/?format=jsonl&dry_run=true", env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, body)
+	resp := decodeImportResp(t, rec, 200)
+	if resp.Valid != 1 {
+		t.Errorf("expected %d valid users, got %+v", 1, resp)
+	}
+}
+
+func TestAdminCanExportUsersAsCSV(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "GET", "/?format=csv", env.exportUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "text/csv" {
+		t.Errorf("expected %v, got %v", "text/csv", rec.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected header and 2 users, got %v", records)
+	}
+	want := []string{"914611345", "janedoe@example.com", "Jane Doe", "true", "active", "", ""}
+	if strings.Join(records[2], ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, records[2])
+	}
+
+	// and the export can be read back in by an import, which finds that
+	// these users already exist
+	body := strings.Join(records[0], ",") + "\n" + strings.Join(records[1], ",") + "\n"
+	rec = requestAsUser(t, env, "POST", "/?format=csv&dry_run=true", env.importUsersHandler, scopeUsersWrite, "janedoe@example.com", true, nil, body)
+	resp := decodeImportResp(t, rec, 400)
+	if len(resp.Errors) != 1 || resp.Errors[0].Error != "user with this email already exists" {
+		t.Errorf("expected one existing user, got %v", resp.Errors)
+	}
+}
+
+func TestExportedCSVCellsCantStartFormulas(t *testing.T) {
+	db := &mockDB{}
+	db.registeredUsers()
+	for _, name := range []string{"=1+2", "+1", "-1", "@SUM(A1)", "\tx", "\rx"} {
+		db.users = append(db.users, &models.User{ID: uint32(len(db.users) + 1), Email: name[1:] + "@example.com", Name: name, Status: models.UserActive})
+	}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "GET", "/?format=csv", env.exportUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	for _, record := range records[1:] {
+		if record[2] != "John Doe" && record[2] != "Jane Doe" && !strings.HasPrefix(record[2], "'") {
+			t.Errorf("expected name %q to be escaped", record[2])
+		}
+	}
+}
+
+func TestAdminCanExportUsersAsJSONL(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "GET", "/", env.exportUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected %d lines, got %v", 2, lines)
+	}
+	user := &models.User{}
+	err := json.Unmarshal([]byte(lines[0]), user)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if user.Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", user.Email)
+	}
+}
+
+func TestExportTakesListFiltersButIsntPaged(t *testing.T) {
+	db := &mockDB{}
+	db.registeredUsers()
+	for i := 0; i < defaultUsersPageSize; i++ {
+		db.users = append(db.users, &models.User{ID: uint32(i + 1), Email: fmt.Sprintf("user%d@example.com", i), Name: "User", Status: models.UserActive})
+	}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "GET", "/", env.exportUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != defaultUsersPageSize+2 {
+		t.Errorf("expected %d lines, got %d", defaultUsersPageSize+2, len(lines))
+	}
+
+	rec = requestAsUser(t, env, "GET", "/?admin=true", env.exportUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	lines = strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "janedoe@example.com") {
+		t.Errorf("expected only janedoe, got %v", lines)
+	}
+
+	rec = requestAsUser(t, env, "GET", "/?sort=password", env.exportUsersHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
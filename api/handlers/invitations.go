@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/mailer"
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// auditInvitationAccepted is recorded in the audit log, as an action of
+// the admin who sent the invitation, when an invited user accepts it.
+const auditInvitationAccepted = "invitation_accepted"
+
+type newInvitationReq struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// sendInvitation gives the invitation a new token and expiry, saving
+// them with save, and emails a link with the token to the invited
+// address.
+func (env *Env) sendInvitation(inv *models.Invitation, save func(*models.Invitation) error) error {
+	token, err := generateRandomToken()
+	if err != nil {
+		return err
+	}
+	ttl := defaultInvitationTTL
+	inv.TokenHash = hashToken(token)
+	inv.Expires = time.Now().Add(ttl)
+	err = save(inv)
+	if err != nil {
+		return err
+	}
+
+	return env.mailer.Send(&mailer.Message{
+		To:      inv.Email,
+		Subject: "You've been invited",
+		Body: fmt.Sprintf("You've been invited to create an account. Use this link to accept. It will expire in %s and can only be used once.\n\n%s?token=%s\n",
+			ttl, env.invitationURL, url.QueryEscape(token)),
+	})
+}
+
+func (env *Env) getInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	invs, err := env.db.GetAllInvitations()
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(invs)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) newInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	// extract JSON content
+	var req newInvitationReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	email := normalizedEmail(w, req.Email)
+	if email == "" {
+		return
+	}
+	if userCheck, err := env.db.GetUserByEmail(email); err == nil && userCheck != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user with email %s already exists"}`, email)
+		return
+	}
+	invs, err := env.db.GetAllInvitations()
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	for _, inv := range invs {
+		if inv.Email == email {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"error": "%s has already been invited; resend or revoke invitation %s instead"}`, email, inv.ID)
+			return
+		}
+	}
+
+	// as when assigning a role, admins can't invite someone with more
+	// access than they have themselves
+	if req.Role != "" {
+		role, err := env.findRole(req.Role)
+		if err != nil {
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+		if role == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "unknown role %s"}`, req.Role)
+			return
+		}
+		if !env.canManageRole(user, role) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": "can't invite with role %s with permissions that you don't have"}`, role.Name)
+			return
+		}
+	}
+
+	// without a mail server, nobody can be told about the invitation
+	if env.mailer == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "can't invite users without a mail server to send invitations"}`)
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	inv := &models.Invitation{
+		ID:        hex.EncodeToString(b),
+		Email:     email,
+		Role:      req.Role,
+		InvitedBy: user.ID,
+		Created:   time.Now(),
+	}
+	err = env.sendInvitation(inv, env.db.AddInvitation)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error sending invitation"}`)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	js, err := json.Marshal(inv)
+	if err != nil {
+		// created resource, but some problem with marshalling the JSON
+		// response; just return empty in this case
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) resendInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	id := mux.Vars(r)["inviteid"]
+	inv, err := env.db.GetInvitation(id)
+	if err != nil || inv == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "invitation %s not found"}`, id)
+		return
+	}
+
+	// the invitation may have been made by an admin with more access, so
+	// the check made when inviting is made again for this admin
+	if inv.Role != "" {
+		role, err := env.findRole(inv.Role)
+		if err != nil {
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+		if role == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "unknown role %s"}`, inv.Role)
+			return
+		}
+		if !env.canManageRole(user, role) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": "can't resend invitation with role %s with permissions that you don't have"}`, role.Name)
+			return
+		}
+	}
+	if env.mailer == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "can't invite users without a mail server to send invitations"}`)
+		return
+	}
+
+	// the new link replaces the old one, which may have expired
+	err = env.sendInvitation(inv, func(inv *models.Invitation) error {
+		return env.db.RenewInvitation(inv.ID, inv.TokenHash, inv.Expires)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error sending invitation"}`)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(inv)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	id := mux.Vars(r)["inviteid"]
+	err := env.db.DeleteInvitation(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "invitation %s not found"}`, id)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status": "revoked invitation %s"}`, id)
+}
+
+// acceptInvitationHandler creates the user for an invitation, and logs
+// them in. As with login codes, following the link sent to the invited
+// address is what proves that it belongs to them, so no token is needed.
+func (env *Env) acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// get form values
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Couldn't parse form"}`)
+		return
+	}
+	token := r.Form.Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply token in accept request"}`)
+		return
+	}
+	name := r.Form.Get("name")
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply name"}`)
+		return
+	}
+	scope, ok := requestedScope(w, r)
+	if !ok {
+		return
+	}
+
+	// the invitation is only used up if the user is added
+	inv, id, err := env.db.AcceptInvitation(hashToken(token), name, time.Now())
+	if _, ok := err.(*models.InvalidInvitationError); ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired invitation"}`)
+		return
+	}
+	if e, ok := err.(*models.DuplicateEmailError); ok {
+		// someone else created the user since the invitation was sent
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user with email %s already exists"}`, e.Email)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving new user"}`)
+		return
+	}
+
+	// the user exists by now, so a failure to record the invitation in
+	// the audit log is only logged
+	err = env.audit(inv.InvitedBy, id, auditInvitationAccepted, fmt.Sprintf("invitation %s for %s", inv.ID, inv.Email))
+	if err != nil {
+		log.Printf("error writing audit log: %v", err)
+	}
+
+	env.completeLogin(w, r, inv.Email, scope)
+}
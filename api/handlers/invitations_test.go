@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/swinslow/containerapp/api/mailer"
+	"github.com/swinslow/containerapp/api/models"
+)
+
+func postAcceptInvitation(env *Env, token string, name string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("token", token)
+	data.Set("name", name)
+	req := httptest.NewRequest("POST", "/invitations/accept", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.acceptInvitationHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeInvitation(t *testing.T, rec *httptest.ResponseRecorder, code int) *models.Invitation {
+	if code != rec.Code {
+		t.Fatalf("Expected %d, got %d: %s", code, rec.Code, rec.Body.String())
+	}
+	inv := &models.Invitation{}
+	err := json.Unmarshal(rec.Body.Bytes(), inv)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return inv
+}
+
+func TestInvitedUserCanAcceptWithRole(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m, invitationURL: "http://localhost:3000/acceptInvitation"}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "Steve@Example.com", "role": "auditor"}`)
+	inv := decodeInvitation(t, rec, 201)
+	if inv.Email != "steve@example.com" || inv.Role != "auditor" || inv.InvitedBy != 914611345 {
+		t.Errorf("expected steve@example.com as auditor invited by 914611345, got %+v", inv)
+	}
+
+	// nobody is created until the invitation is accepted
+	if len(db.addedUsers) != 0 {
+		t.Fatalf("expected no added users, got %d", len(db.addedUsers))
+	}
+	msgs := m.Messages()
+	if len(msgs) != 1 || msgs[0].To != "steve@example.com" {
+		t.Fatalf("expected invitation to %v, got %v", "steve@example.com", msgs)
+	}
+	if !strings.Contains(msgs[0].Body, "http://localhost:3000/acceptInvitation?token=") {
+		t.Errorf("expected link to accept invitation, got %q", msgs[0].Body)
+	}
+	token := extractEmailChangeToken(t, msgs[0].Body)
+
+	rec = postAcceptInvitation(env, token, "Steve")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d: %s", 200, rec.Code, rec.Body.String())
+	}
+	if len(db.addedUsers) != 1 {
+		t.Fatalf("expected %d added users, got %d", 1, len(db.addedUsers))
+	}
+	user := db.addedUsers[0]
+	if user.Email != "steve@example.com" || user.Name != "Steve" {
+		t.Errorf("expected steve@example.com named Steve, got %v named %v", user.Email, user.Name)
+	}
+	roles, _ := db.GetRolesForUserID(user.ID)
+	if len(roles) != 1 || roles[0].Name != "auditor" {
+		t.Errorf("expected auditor role, got %v", roles)
+	}
+	if len(db.auditEvents) != 1 || db.auditEvents[0].Action != auditInvitationAccepted || db.auditEvents[0].ActorID != 914611345 {
+		t.Errorf("expected acceptance of 914611345's invitation in audit log, got %v", db.auditEvents)
+	}
+
+	// and the link only works once
+	rec = postAcceptInvitation(env, token, "Steve")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotAcceptInvitationWithInvalidToken(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := postAcceptInvitation(env, "notAToken", "Steve")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+	if len(db.addedUsers) != 0 {
+		t.Errorf("expected no added users, got %d", len(db.addedUsers))
+	}
+}
+
+func TestCannotAcceptInvitationWithoutName(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+
+	requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	token := extractEmailChangeToken(t, m.Messages()[0].Body)
+
+	rec := postAcceptInvitation(env, token, "")
+	if 400 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 400, rec.Code)
+	}
+	if len(db.addedUsers) != 0 {
+		t.Fatalf("expected no added users, got %d", len(db.addedUsers))
+	}
+
+	// and the invitation can still be accepted
+	rec = postAcceptInvitation(env, token, "Steve")
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d: %s", 200, rec.Code, rec.Body.String())
+	}
+}
+
+func TestInvitationIsKeptIfUserCannotBeAdded(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+
+	requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	token := extractEmailChangeToken(t, m.Messages()[0].Body)
+
+	// someone else creates the user before the invitation is accepted
+	db.registeredUsers()
+	db.users = append(db.users, &models.User{ID: 3, Email: "steve@example.com", Name: "Steve", Status: models.UserActive})
+
+	rec := postAcceptInvitation(env, token, "Steve")
+	if 409 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 409, rec.Code)
+	}
+	if len(db.invitations) != 1 {
+		t.Errorf("expected invitation to be kept, got %v", db.invitations)
+	}
+}
+
+func TestAdminCanListInvitations(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring(), mailer: mailer.NewMemoryMailer()}
+
+	requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	rec := requestAsUser(t, env, "GET", "/", env.getInvitationsHandler, scopeUsersRead, "janedoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var invs []*models.Invitation
+	err := json.Unmarshal(rec.Body.Bytes(), &invs)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(invs) != 1 || invs[0].Email != "steve@example.com" {
+		t.Errorf("expected invitation for %v, got %v", "steve@example.com", invs)
+	}
+
+	// token hashes are never sent out
+	if strings.Contains(rec.Body.String(), "token") {
+		t.Errorf("expected no token hash, got %s", rec.Body.String())
+	}
+}
+
+func TestResendingInvitationReplacesOldLink(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	inv := decodeInvitation(t, rec, 201)
+	oldToken := extractEmailChangeToken(t, m.Messages()[0].Body)
+
+	vars := map[string]string{"inviteid": inv.ID}
+	rec = requestAsUser(t, env, "POST", "/", env.resendInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, vars, "")
+	decodeInvitation(t, rec, 200)
+	msgs := m.Messages()
+	if len(msgs) != 2 || msgs[1].To != "steve@example.com" {
+		t.Fatalf("expected second invitation to %v, got %v", "steve@example.com", msgs)
+	}
+	newToken := extractEmailChangeToken(t, msgs[1].Body)
+
+	rec = postAcceptInvitation(env, oldToken, "Steve")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+	rec = postAcceptInvitation(env, newToken, "Steve")
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+}
+
+func TestAdminCanRevokeInvitation(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	inv := decodeInvitation(t, rec, 201)
+
+	vars := map[string]string{"inviteid": inv.ID}
+	rec = requestAsUser(t, env, "POST", "/", env.revokeInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, vars, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	rec = postAcceptInvitation(env, extractEmailChangeToken(t, m.Messages()[0].Body), "Steve")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+
+	// and it's gone
+	rec = requestAsUser(t, env, "POST", "/", env.revokeInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, vars, "")
+	if 404 != rec.Code {
+		t.Errorf("Expected %d, got %d", 404, rec.Code)
+	}
+}
+
+func TestCannotInviteExistingUserOrInviteTwice(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), mailer: mailer.NewMemoryMailer()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "JohnDoe@example.com"}`)
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+
+	rec = requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	inv := decodeInvitation(t, rec, 201)
+	rec = requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	if 409 != rec.Code {
+		t.Errorf("Expected %d, got %d", 409, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), inv.ID) {
+		t.Errorf("expected pointer to invitation %s, got %s", inv.ID, rec.Body.String())
+	}
+}
+
+func TestCannotInviteWithRoleBeyondOwnPermissions(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring(), mailer: mailer.NewMemoryMailer()}
+	db.rolesByUserID()[91461] = []string{"user-manager"}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "johndoe@example.com", true, nil, `{"email": "steve@example.com", "role": "superadmin"}`)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	rec = requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "johndoe@example.com", true, nil, `{"email": "steve@example.com", "role": "nonexistent"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+	if len(db.invitations) != 0 {
+		t.Errorf("expected no invitations, got %v", db.invitations)
+	}
+}
+
+func TestCannotResendInvitationWithRoleBeyondOwnPermissions(t *testing.T) {
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := &Env{db: db, keys: newTestKeyring(), mailer: m}
+	db.rolesByUserID()[91461] = []string{"user-manager"}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com", "role": "superadmin"}`)
+	inv := decodeInvitation(t, rec, 201)
+
+	vars := map[string]string{"inviteid": inv.ID}
+	rec = requestAsUser(t, env, "POST", "/", env.resendInvitationHandler, scopeUsersWrite, "johndoe@example.com", true, vars, "")
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	if len(m.Messages()) != 1 {
+		t.Errorf("expected only the first invitation to be sent, got %v", m.Messages())
+	}
+}
+
+func TestCannotInviteWithoutMailer(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.newInvitationHandler, scopeUsersWrite, "janedoe@example.com", true, nil, `{"email": "steve@example.com"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+	if len(db.invitations) != 0 {
+		t.Errorf("expected no invitations, got %v", db.invitations)
+	}
+}
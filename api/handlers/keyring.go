@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyring holds the current signing key, plus any older keys that are
+// still accepted when verifying tokens. This lets keys be rotated without
+// logging everyone out: a new key takes over signing, while tokens signed
+// by the old one stay valid until they expire.
+type keyring struct {
+	mu      sync.RWMutex
+	current *signingKey
+	// all keys, including current, keyed by key ID
+	keys map[string]*signingKey
+}
+
+// newKeyring returns a keyring that signs with current and also verifies
+// with any of others.
+func newKeyring(current *signingKey, others ...*signingKey) *keyring {
+	kr := &keyring{current: current, keys: make(map[string]*signingKey)}
+	for _, k := range others {
+		kr.keys[k.id] = k
+	}
+	kr.keys[current.id] = current
+	return kr
+}
+
+// signing returns the key used to sign new tokens.
+func (kr *keyring) signing() *signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current
+}
+
+// lookup returns the key with the given ID, or nil if not found.
+func (kr *keyring) lookup(kid string) *signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[kid]
+}
+
+// all returns every key, with the current signing key first and the rest
+// sorted by key ID.
+func (kr *keyring) all() []*signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	others := make([]*signingKey, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		if k != kr.current {
+			others = append(others, k)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].id < others[j].id })
+	return append([]*signingKey{kr.current}, others...)
+}
+
+// replace swaps in the keys from other, so that the change is seen by
+// every holder of kr.
+func (kr *keyring) replace(other *keyring) {
+	other.mu.RLock()
+	current, keys := other.current, other.keys
+	other.mu.RUnlock()
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.current = current
+	kr.keys = keys
+}
+
+// SplitList splits a comma-separated environment variable value,
+// dropping empty entries.
+func SplitList(val string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// loadSecretsFromFile reads HMAC secrets from the given file, one per
+// line, skipping blank lines.
+func loadSecretsFromFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("No secrets found in %s", path)
+	}
+	return secrets, nil
+}
+
+// loadKeyringFromEnv builds a keyring from environment variables:
+//
+//	JWTSIGNINGKEYFILE  PEM file with the current RSA or EC private key
+//	JWTSECRETKEYFILE   file with HMAC secrets, one per line; the first
+//	                   is used as JWTSECRETKEY is, and the rest as
+//	                   JWTOLDSECRETKEYS are
+//	JWTSECRETKEY       HMAC secret; current if JWTSIGNINGKEYFILE is unset,
+//	                   otherwise still accepted for verification
+//	JWTVERIFYKEYFILES  comma-separated PEM files or glob patterns with
+//	                   older keys (private or public) still accepted
+//	JWTOLDSECRETKEYS   comma-separated older HMAC secrets still accepted
+//
+// Files are re-read each time this is called, so keys can be rotated by
+// replacing the files and reloading. Environment variables can't change
+// while the process is running, so HMAC secrets that are to be rotated
+// without a restart must be given in JWTSECRETKEYFILE rather than in
+// JWTSECRETKEY and JWTOLDSECRETKEYS.
+func loadKeyringFromEnv() (*keyring, error) {
+	var current *signingKey
+	others := make([]*signingKey, 0)
+
+	JWTSECRETKEY := os.Getenv("JWTSECRETKEY")
+	oldSecrets := SplitList(os.Getenv("JWTOLDSECRETKEYS"))
+	JWTSECRETKEYFILE := os.Getenv("JWTSECRETKEYFILE")
+	if JWTSECRETKEYFILE != "" {
+		secrets, err := loadSecretsFromFile(JWTSECRETKEYFILE)
+		if err != nil {
+			return nil, err
+		}
+		JWTSECRETKEY = secrets[0]
+		oldSecrets = append(secrets[1:], oldSecrets...)
+	}
+
+	JWTSIGNINGKEYFILE := os.Getenv("JWTSIGNINGKEYFILE")
+	if JWTSIGNINGKEYFILE != "" {
+		key, err := loadKeyFromPEM(JWTSIGNINGKEYFILE)
+		if err != nil {
+			return nil, err
+		}
+		if key.signKey == nil {
+			return nil, fmt.Errorf("JWTSIGNINGKEYFILE must contain a private key")
+		}
+		current = key
+		if JWTSECRETKEY != "" {
+			others = append(others, newHMACKey(JWTSECRETKEY))
+		}
+	} else if JWTSECRETKEY != "" {
+		current = newHMACKey(JWTSECRETKEY)
+	} else {
+		return nil, fmt.Errorf("No signing key found; set environment variable JWTSIGNINGKEYFILE, JWTSECRETKEYFILE or JWTSECRETKEY before starting")
+	}
+
+	for _, pattern := range SplitList(os.Getenv("JWTVERIFYKEYFILES")) {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q in JWTVERIFYKEYFILES: %v", pattern, err)
+		}
+		for _, path := range paths {
+			key, err := loadKeyFromPEM(path)
+			if err != nil {
+				return nil, err
+			}
+			others = append(others, key)
+		}
+	}
+
+	for _, secret := range oldSecrets {
+		others = append(others, newHMACKey(secret))
+	}
+
+	return newKeyring(current, others...), nil
+}
+
+// reloadKeys re-reads the keyring configuration and swaps it in. If the
+// new configuration can't be loaded, the existing keys stay in place.
+func (env *Env) reloadKeys() error {
+	kr, err := loadKeyringFromEnv()
+	if err != nil {
+		return err
+	}
+	env.keys.replace(kr)
+	return nil
+}
+
+// ReloadKeysOnSignal reloads the JWT keyring each time one of the given
+// signals (typically SIGHUP) is received, until the process exits.
+func (env *Env) ReloadKeysOnSignal(sig ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+	go func() {
+		for range c {
+			if err := env.reloadKeys(); err != nil {
+				log.Printf("error reloading JWT keys, keeping existing keys: %v", err)
+				continue
+			}
+			log.Printf("reloaded JWT keys; now signing with %s", env.keys.signing().id)
+		}
+	}()
+}
+
+// keyInfo describes a key in the keyring, for admin listings. It never
+// includes key material.
+type keyInfo struct {
+	ID      string `json:"kid"`
+	Alg     string `json:"alg"`
+	Current bool   `json:"current"`
+	CanSign bool   `json:"can_sign"`
+}
+
+// writeKeyList writes the keyring's key list to the response as JSON.
+func (env *Env) writeKeyList(w http.ResponseWriter) {
+	current := env.keys.signing()
+	infos := make([]*keyInfo, 0)
+	for _, k := range env.keys.all() {
+		infos = append(infos, &keyInfo{
+			ID:      k.id,
+			Alg:     k.method.Alg(),
+			Current: k == current,
+			CanSign: k.signKey != nil,
+		})
+	}
+
+	// output as JSON
+	js, err := json.Marshal(infos)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) getKeysHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	env.writeKeyList(w)
+}
+
+func (env *Env) reloadKeysHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	if err := env.reloadKeys(); err != nil {
+		log.Printf("error reloading JWT keys, keeping existing keys: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "couldn't reload keys; existing keys kept"}`)
+		return
+	}
+
+	env.writeKeyList(w)
+}
@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setTestEnv sets environment variables for the duration of a test, and
+// returns a function that restores their previous values.
+func setTestEnv(vals map[string]string) func() {
+	prev := make(map[string]string)
+	for k, v := range vals {
+		prev[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range prev {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+func TestCanValidateTokenSignedWithOlderKey(t *testing.T) {
+	oldKey := newHMACKey("oldKeyForTesting")
+	db := &mockDB{}
+
+	// issue a token while the old key is current
+	oldEnv := Env{db: db, keys: newKeyring(oldKey)}
+	tokenString, err := oldEnv.createToken("janedoe@example.com", "", "", false)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	// then rotate to a new current key, keeping the old one for verifying
+	env := Env{db: db, keys: newKeyring(newHMACKey("keyForTesting"), oldKey)}
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/testRoute", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	http.HandlerFunc(env.validateTokenMiddleware(env.testHandler)).ServeHTTP(rec, req)
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// but once the old key is dropped, the token is rejected
+	env = Env{db: db, keys: newKeyring(newHMACKey("keyForTesting"))}
+	rec = httptest.NewRecorder()
+	http.HandlerFunc(env.validateTokenMiddleware(env.testHandler)).ServeHTTP(rec, req)
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+func TestNewTokensAreSignedWithCurrentKey(t *testing.T) {
+	current := newHMACKey("keyForTesting")
+	env := Env{db: &mockDB{}, keys: newKeyring(current, newHMACKey("oldKeyForTesting"))}
+
+	tokenString, err := env.createToken("janedoe@example.com", "", "", false)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	claims := parseTestToken(t, tokenString)
+	if claims["email"] != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", claims["email"])
+	}
+}
+
+func TestCanLoadKeyringFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	priv := newTestECKey(t)
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	current := writeTestPEM(t, dir, "current.pem", "EC PRIVATE KEY", der)
+	oldPriv := newTestRSAKey(t)
+	os.Mkdir(filepath.Join(dir, "old"), 0700)
+	writeTestPEM(t, filepath.Join(dir, "old"), "1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(oldPriv))
+
+	defer setTestEnv(map[string]string{
+		"JWTSIGNINGKEYFILE": current,
+		"JWTSECRETKEYFILE":  "",
+		"JWTSECRETKEY":      "keyForTesting",
+		"JWTVERIFYKEYFILES": filepath.Join(dir, "old", "*.pem"),
+		"JWTOLDSECRETKEYS":  "older1, older2",
+	})()
+
+	kr, err := loadKeyringFromEnv()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if kr.signing().method.Alg() != "ES256" {
+		t.Errorf("expected %v, got %v", "ES256", kr.signing().method.Alg())
+	}
+	// current EC key, RSA key from glob, and three HMAC secrets
+	if len(kr.all()) != 5 {
+		t.Fatalf("expected len %d, got %d", 5, len(kr.all()))
+	}
+	if kr.all()[0] != kr.signing() {
+		t.Errorf("expected current key to be listed first")
+	}
+	if kr.lookup(newHMACKey("keyForTesting").id) == nil {
+		t.Errorf("expected JWTSECRETKEY to be kept for verifying, but it wasn't")
+	}
+	if kr.lookup(newHMACKey("older2").id) == nil {
+		t.Errorf("expected JWTOLDSECRETKEYS to be kept for verifying, but they weren't")
+	}
+}
+
+func TestCannotLoadKeyringFromEnvWithoutSigningKey(t *testing.T) {
+	defer setTestEnv(map[string]string{
+		"JWTSIGNINGKEYFILE": "",
+		"JWTSECRETKEYFILE":  "",
+		"JWTSECRETKEY":      "",
+	})()
+
+	_, err := loadKeyringFromEnv()
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
+
+func TestJWKSIncludesOlderAsymmetricKeys(t *testing.T) {
+	ecPriv := newTestECKey(t)
+	current, err := newECKey(ecPriv, &ecPriv.PublicKey)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	rsaPriv := newTestRSAKey(t)
+	old := newRSAKey(nil, &rsaPriv.PublicKey)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	env := Env{db: &mockDB{}, keys: newKeyring(current, old, newHMACKey("keyForTesting"))}
+	http.HandlerFunc(env.jwksHandler).ServeHTTP(rec, req)
+
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal([]byte(rec.Body.String()), &jwks)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	// HMAC keys are never published
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(jwks.Keys))
+	}
+	if jwks.Keys[0].Kid != current.id {
+		t.Errorf("expected %v, got %v", current.id, jwks.Keys[0].Kid)
+	}
+	if jwks.Keys[1].Kid != old.id {
+		t.Errorf("expected %v, got %v", old.id, jwks.Keys[1].Kid)
+	}
+}
+
+// ===== /admin/keys routes =====
+
+func TestCanLoadHMACSecretsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	secrets := filepath.Join(dir, "secrets")
+	if err := ioutil.WriteFile(secrets, []byte("keyForTesting\n"), 0600); err != nil {
+		t.Fatalf("couldn't write secrets file: %v", err)
+	}
+
+	defer setTestEnv(map[string]string{
+		"JWTSIGNINGKEYFILE": "",
+		"JWTSECRETKEYFILE":  secrets,
+		"JWTSECRETKEY":      "ignoredKey",
+		"JWTVERIFYKEYFILES": "",
+		"JWTOLDSECRETKEYS":  "",
+	})()
+
+	kr, err := loadKeyringFromEnv()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if kr.signing().id != newHMACKey("keyForTesting").id {
+		t.Errorf("expected to sign with secret from file")
+	}
+
+	// the file is re-read on each load, so the secret can be rotated
+	if err := ioutil.WriteFile(secrets, []byte("newKeyForTesting\n\nkeyForTesting\n"), 0600); err != nil {
+		t.Fatalf("couldn't write secrets file: %v", err)
+	}
+	kr, err = loadKeyringFromEnv()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if kr.signing().id != newHMACKey("newKeyForTesting").id {
+		t.Errorf("expected to sign with new secret from file")
+	}
+	if len(kr.all()) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(kr.all()))
+	}
+	if kr.lookup(newHMACKey("keyForTesting").id) == nil {
+		t.Errorf("expected older secret from file to be kept for verifying, but it wasn't")
+	}
+}
+
+func TestAdminCanReloadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	secrets := filepath.Join(dir, "secrets")
+	if err := ioutil.WriteFile(secrets, []byte("newKeyForTesting\nkeyForTesting\n"), 0600); err != nil {
+		t.Fatalf("couldn't write secrets file: %v", err)
+	}
+
+	defer setTestEnv(map[string]string{
+		"JWTSIGNINGKEYFILE": "",
+		"JWTSECRETKEYFILE":  secrets,
+		"JWTSECRETKEY":      "",
+		"JWTVERIFYKEYFILES": "",
+		"JWTOLDSECRETKEYS":  "",
+	})()
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/keys/reload", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	// add admin User to context (assumes validation has already occurred)
+	user, err := db.GetUserByEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(env.reloadKeysHandler).ServeHTTP(rec, req)
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// check that the new key is now current, and the old one still listed
+	var infos []*keyInfo
+	err = json.Unmarshal([]byte(rec.Body.String()), &infos)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(infos))
+	}
+	if infos[0].ID != newHMACKey("newKeyForTesting").id || !infos[0].Current {
+		t.Errorf("expected new key to be current, got %v", infos[0])
+	}
+	if infos[1].ID != newHMACKey("keyForTesting").id || infos[1].Current {
+		t.Errorf("expected old key to be kept for verifying, got %v", infos[1])
+	}
+	if env.getSigningKey().id != newHMACKey("newKeyForTesting").id {
+		t.Errorf("expected env to sign with new key")
+	}
+}
+
+func TestFailedReloadKeepsExistingKeys(t *testing.T) {
+	defer setTestEnv(map[string]string{
+		"JWTSIGNINGKEYFILE": "/nonexistent/key.pem",
+	})()
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/keys/reload", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	user, err := db.GetUserByEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(env.reloadKeysHandler).ServeHTTP(rec, req)
+
+	// check that we got a 500 (Internal Server Error)
+	if 500 != rec.Code {
+		t.Errorf("Expected %d, got %d", 500, rec.Code)
+	}
+	if env.getSigningKey().id != newHMACKey("keyForTesting").id {
+		t.Errorf("expected env to keep signing with existing key")
+	}
+}
+
+func TestCannotReloadKeysWithoutAdminUserInContext(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/keys/reload", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	user, err := db.GetUserByEmail("johndoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(requireScopes(env.reloadKeysHandler, scopeKeysWrite)).ServeHTTP(rec, req)
+
+	// check that we got a 403 (Forbidden)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestAdminCanGetKeys(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/admin/keys", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newKeyring(newHMACKey("keyForTesting"), newHMACKey("oldKeyForTesting"))}
+	user, err := db.GetUserByEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(env.getKeysHandler).ServeHTTP(rec, req)
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	var infos []*keyInfo
+	err = json.Unmarshal([]byte(rec.Body.String()), &infos)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(infos))
+	}
+	if !infos[0].Current || !infos[0].CanSign || infos[0].Alg != "HS256" {
+		t.Errorf("unexpected current key info %v", infos[0])
+	}
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// signingKey is a key used to sign and/or verify JWTs, identified by the
+// key ID (kid) that is placed in the header of each token it signs.
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	// private key or HMAC secret; nil if the key can only verify
+	signKey interface{}
+	// public key or HMAC secret
+	verifyKey interface{}
+}
+
+// jsonWebKey is the public part of a signingKey in JWK (RFC 7517) form.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// newHMACKey returns an HS256 signingKey for the given shared secret. Its
+// key ID is derived from the secret, so that it stays the same across
+// restarts without revealing the secret.
+func newHMACKey(secret string) *signingKey {
+	sum := sha256.Sum256([]byte("containerapp kid:" + secret))
+	return &signingKey{
+		id:        "hs256-" + hex.EncodeToString(sum[:8]),
+		method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+// newRSAKey returns an RS256 signingKey. priv may be nil for a key that
+// can only verify.
+func newRSAKey(priv *rsa.PrivateKey, pub *rsa.PublicKey) *signingKey {
+	k := &signingKey{method: jwt.SigningMethodRS256, verifyKey: pub}
+	if priv != nil {
+		k.signKey = priv
+	}
+	k.id = jwkThumbprint(k.jwk())
+	return k
+}
+
+// newECKey returns an ES256 signingKey. priv may be nil for a key that
+// can only verify.
+func newECKey(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey) (*signingKey, error) {
+	if pub.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("Only P-256 EC keys are supported for ES256")
+	}
+	k := &signingKey{method: jwt.SigningMethodES256, verifyKey: pub}
+	if priv != nil {
+		k.signKey = priv
+	}
+	k.id = jwkThumbprint(k.jwk())
+	return k, nil
+}
+
+// loadKeyFromPEM reads an RSA or P-256 EC key from a PEM file. A private
+// key can be used for signing and verifying; a public key only for
+// verifying.
+func loadKeyFromPEM(path string) (*signingKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if priv, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return newRSAKey(priv, &priv.PublicKey), nil
+	}
+	if priv, err := jwt.ParseECPrivateKeyFromPEM(data); err == nil {
+		return newECKey(priv, &priv.PublicKey)
+	}
+	if pub, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return newRSAKey(nil, pub), nil
+	}
+	if pub, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return newECKey(nil, pub)
+	}
+	return nil, fmt.Errorf("Couldn't parse an RSA or EC key from %s", path)
+}
+
+// jwk returns the public part of the key in JWK form, or nil for HMAC
+// keys, which must never be published.
+func (k *signingKey) jwk() *jsonWebKey {
+	switch pub := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return &jsonWebKey{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: k.method.Alg(),
+			Kid: k.id,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		// coordinates are padded to the full size of the curve
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return &jsonWebKey{
+			Kty: "EC",
+			Use: "sig",
+			Alg: k.method.Alg(),
+			Kid: k.id,
+			Crv: pub.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(padBytes(pub.X.Bytes(), size)),
+			Y:   base64.RawURLEncoding.EncodeToString(padBytes(pub.Y.Bytes(), size)),
+		}
+	}
+	return nil
+}
+
+// verifyOnlyKey converts a JWK published by someone else (such as an
+// identity provider) into a signingKey that can only verify, keeping
+// the publisher's key ID.
+func (k *jsonWebKey) verifyOnlyKey() (*signingKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		key := newRSAKey(nil, pub)
+		key.id = k.Kid
+		return key, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported EC curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		key, err := newECKey(nil, pub)
+		if err != nil {
+			return nil, err
+		}
+		key.id = k.Kid
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of the key, for use as
+// its key ID.
+func jwkThumbprint(k *jsonWebKey) string {
+	var members string
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Crv, k.X, k.Y)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// getSigningKey returns the key used to sign new tokens.
+func (env *Env) getSigningKey() *signingKey {
+	return env.keys.signing()
+}
+
+// getVerificationKey is the jwt.Keyfunc used when parsing tokens. It picks
+// the key named by the token's kid header, falling back to the current
+// key for tokens issued before key IDs were added. It only accepts tokens
+// signed with that key's algorithm, so that a public key can never be
+// misused as an HMAC secret.
+func (env *Env) getVerificationKey(tkn *jwt.Token) (interface{}, error) {
+	key := env.keys.signing()
+	if kid, ok := tkn.Header["kid"].(string); ok {
+		key = env.keys.lookup(kid)
+		if key == nil {
+			return nil, fmt.Errorf("Unknown key ID %s", kid)
+		}
+	}
+	if tkn.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method %s", tkn.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+func (env *Env) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// publish every asymmetric key that is still accepted, so that other
+	// services can verify tokens signed before the last rotation
+	keys := make([]*jsonWebKey, 0)
+	for _, key := range env.keys.all() {
+		if k := key.jwk(); k != nil {
+			keys = append(keys, k)
+		}
+	}
+
+	// output as JSON
+	js, err := json.Marshal(map[string][]*jsonWebKey{"keys": keys})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
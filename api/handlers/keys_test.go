@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// writeTestPEM writes a PEM block to a new file in dir and returns its path.
+func writeTestPEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("couldn't write key file: %v", err)
+	}
+	return path
+}
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate RSA key: %v", err)
+	}
+	return priv
+}
+
+func newTestECKey(t *testing.T) *ecdsa.PrivateKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate EC key: %v", err)
+	}
+	return priv
+}
+
+func TestCanLoadRSAPrivateKeyFromPEM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	priv := newTestRSAKey(t)
+	path := writeTestPEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv))
+
+	key, err := loadKeyFromPEM(path)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if key.method.Alg() != "RS256" {
+		t.Errorf("expected %v, got %v", "RS256", key.method.Alg())
+	}
+	if key.signKey == nil {
+		t.Errorf("expected private key for signing, got nil")
+	}
+	if key.id == "" {
+		t.Errorf("expected non-empty key ID, got empty string")
+	}
+}
+
+func TestCanLoadECPublicKeyFromPEM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	priv := newTestECKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	path := writeTestPEM(t, dir, "ec.pub", "PUBLIC KEY", der)
+
+	key, err := loadKeyFromPEM(path)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if key.method.Alg() != "ES256" {
+		t.Errorf("expected %v, got %v", "ES256", key.method.Alg())
+	}
+	if key.signKey != nil {
+		t.Errorf("expected verify-only key, got private key")
+	}
+
+	// the key ID depends only on the public key
+	fromPriv, err := newECKey(priv, &priv.PublicKey)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if key.id != fromPriv.id {
+		t.Errorf("expected %v, got %v", fromPriv.id, key.id)
+	}
+}
+
+func TestCannotLoadKeyFromNonKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTestPEM(t, dir, "junk.pem", "CERTIFICATE", []byte("not a key"))
+	_, err = loadKeyFromPEM(path)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
+
+func TestJWKThumbprintMatchesRFC7638Example(t *testing.T) {
+	k := &jsonWebKey{
+		Kty: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn" +
+			"64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91" +
+			"CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E: "AQAB",
+	}
+	want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+	if got := jwkThumbprint(k); got != want {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestCanValidateTokenSignedWithAsymmetricKeys(t *testing.T) {
+	rsaPriv := newTestRSAKey(t)
+	ecPriv := newTestECKey(t)
+	ecKey, err := newECKey(ecPriv, &ecPriv.PublicKey)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	for _, key := range []*signingKey{newRSAKey(rsaPriv, &rsaPriv.PublicKey), ecKey} {
+		t.Run(key.method.Alg(), func(t *testing.T) {
+			db := &mockDB{}
+			env := Env{db: db, keys: newKeyring(key)}
+
+			tokenString, err := env.createToken("janedoe@example.com", "", "", false)
+			if err != nil {
+				t.Fatalf("got non-nil error: %v", err)
+			}
+
+			// check that the token header names the key
+			token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+			if err != nil {
+				t.Fatalf("got non-nil error: %v", err)
+			}
+			if token.Header["kid"] != key.id {
+				t.Errorf("expected %v, got %v", key.id, token.Header["kid"])
+			}
+			if token.Header["alg"] != key.method.Alg() {
+				t.Errorf("expected %v, got %v", key.method.Alg(), token.Header["alg"])
+			}
+
+			rec := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/testRoute", nil)
+			if err != nil {
+				t.Fatalf("got non-nil error: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tokenString)
+			http.HandlerFunc(env.validateTokenMiddleware(env.testHandler)).ServeHTTP(rec, req)
+
+			// check that we got a 200 (OK)
+			if 200 != rec.Code {
+				t.Errorf("Expected %d, got %d", 200, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCannotValidateHMACTokenUsingPublicKeyAsSecret(t *testing.T) {
+	rsaPriv := newTestRSAKey(t)
+	key := newRSAKey(rsaPriv, &rsaPriv.PublicKey)
+	db := &mockDB{}
+	env := Env{db: db, keys: newKeyring(key)}
+
+	// sign an HS256 token with the (public) RSA key bytes as the secret
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaPriv.PublicKey)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("janedoe@example.com"))
+	token.Header["kid"] = key.id
+	tokenString, err := token.SignedString(pubDER)
+	if err != nil {
+		t.Fatalf("couldn't create token for testing: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/testRoute", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	http.HandlerFunc(env.validateTokenMiddleware(env.testHandler)).ServeHTTP(rec, req)
+
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+// ===== Route: GET /.well-known/jwks.json =====
+
+func TestCanGetJWKS(t *testing.T) {
+	ecPriv := newTestECKey(t)
+	key, err := newECKey(ecPriv, &ecPriv.PublicKey)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newKeyring(key)}
+	http.HandlerFunc(env.jwksHandler).ServeHTTP(rec, req)
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// check that the published key matches ours
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal([]byte(rec.Body.String()), &jwks)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(jwks.Keys))
+	}
+	jwk := jwks.Keys[0]
+	if jwk.Kid != key.id {
+		t.Errorf("expected %v, got %v", key.id, jwk.Kid)
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" || jwk.Alg != "ES256" {
+		t.Errorf("expected EC P-256 ES256 key, got %v %v %v", jwk.Kty, jwk.Crv, jwk.Alg)
+	}
+	if jwkThumbprint(jwk) != key.id {
+		t.Errorf("expected thumbprint to match key ID")
+	}
+}
+
+func TestJWKSDoesNotPublishHMACKey(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	http.HandlerFunc(env.jwksHandler).ServeHTTP(rec, req)
+
+	wantBody := `{"keys":[]}`
+	if rec.Body.String() != wantBody {
+		t.Errorf("expected %s, got %s", wantBody, rec.Body.String())
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// maxPreferencesLength limits the size of a user's preferences, as stored
+// in JSON.
+const maxPreferencesLength = 4096
+
+// meResp is the JSON body returned for the logged-in user's profile.
+type meResp struct {
+	*models.User
+	Preferences json.RawMessage `json:"preferences"`
+}
+
+// updateMeReq is the JSON body for PATCH /me. Preferences are merged into
+// those already saved, with a null value removing a preference. Email and
+// is_admin can't be changed here, but are decoded so that requests trying
+// to change them are refused rather than silently ignored.
+type updateMeReq struct {
+	Name        *string                    `json:"name"`
+	Preferences map[string]json.RawMessage `json:"preferences"`
+	Email       *string                    `json:"email"`
+	IsAdmin     *bool                      `json:"is_admin"`
+}
+
+// writeMe writes out the profile of the given user as JSON.
+func (env *Env) writeMe(w http.ResponseWriter, user *models.User) {
+	prefs, err := env.db.GetPreferences(user.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(&meResp{User: user, Preferences: json.RawMessage(prefs)})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) getMeHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	env.writeMe(w, user)
+}
+
+func (env *Env) updateMeHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take PATCH requests
+	if r.Method != "PATCH" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// extract JSON content
+	var req updateMeReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if req.IsAdmin != nil && *req.IsAdmin != user.IsAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "users can't change whether they are an admin"}`)
+		return
+	}
+	if req.Email != nil && !sameEmail(*req.Email, user.Email) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "email can only be changed through /me/email, which verifies the new address"}`)
+		return
+	}
+	if req.Name != nil && *req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply name"}`)
+		return
+	}
+
+	name := user.Name
+	if req.Name != nil {
+		name = *req.Name
+	}
+
+	// the preferences are merged with those saved in the same transaction
+	// as the name is saved, so that neither is saved without the other and
+	// updates made at the same time don't undo each other
+	var merge func(string) (string, error)
+	tooLong := false
+	if req.Preferences != nil {
+		merge = func(current string) (string, error) {
+			prefs := make(map[string]json.RawMessage)
+			if err := json.Unmarshal([]byte(current), &prefs); err != nil {
+				return "", err
+			}
+			for k, v := range req.Preferences {
+				if string(v) == "null" {
+					delete(prefs, k)
+				} else {
+					prefs[k] = v
+				}
+			}
+			js, err := json.Marshal(prefs)
+			if err != nil {
+				return "", err
+			}
+			if len(js) > maxPreferencesLength {
+				tooLong = true
+				return "", fmt.Errorf("preferences too long")
+			}
+			return string(js), nil
+		}
+	}
+
+	err = env.db.UpdateProfile(user.ID, name, merge)
+	if tooLong {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "preferences can't be longer than %d bytes"}`, maxPreferencesLength)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving profile"}`)
+		return
+	}
+
+	updated, err := env.db.GetUserByID(user.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	env.writeMe(w, updated)
+}
+
+func (env *Env) getMyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// get this user's prior visited paths
+	vpaths, err := env.db.GetAllVisitedPathsForUserID(user.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(vpaths)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+func decodeMe(t *testing.T, rec *httptest.ResponseRecorder) (*models.User, map[string]interface{}) {
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var resp struct {
+		*models.User
+		Preferences map[string]interface{} `json:"preferences"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return resp.User, resp.Preferences
+}
+
+func TestCanGetOwnProfile(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "GET", "/", env.getMeHandler, scopeAccount, "johndoe@example.com", true, nil, "")
+	user, prefs := decodeMe(t, rec)
+	if user.Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", user.Email)
+	}
+	if len(prefs) != 0 {
+		t.Errorf("expected no preferences, got %v", prefs)
+	}
+}
+
+func TestCanPatchOwnNameAndPreferences(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateMeHandler, scopeAccount, "johndoe@example.com", true, nil,
+		`{"name": "Johnny", "preferences": {"theme": "dark", "pageSize": 50}}`)
+	user, prefs := decodeMe(t, rec)
+	if user.Name != "Johnny" {
+		t.Errorf("expected %v, got %v", "Johnny", user.Name)
+	}
+	if prefs["theme"] != "dark" || prefs["pageSize"] != float64(50) {
+		t.Errorf("expected theme and pageSize, got %v", prefs)
+	}
+
+	// preferences are merged, and null removes one
+	rec = requestAsUser(t, env, "PATCH", "/", env.updateMeHandler, scopeAccount, "johndoe@example.com", true, nil,
+		`{"preferences": {"theme": null, "lang": "en"}}`)
+	user, prefs = decodeMe(t, rec)
+	if user.Name != "Johnny" {
+		t.Errorf("expected %v, got %v", "Johnny", user.Name)
+	}
+	if _, ok := prefs["theme"]; ok || prefs["lang"] != "en" || prefs["pageSize"] != float64(50) {
+		t.Errorf("expected lang and pageSize, got %v", prefs)
+	}
+}
+
+func TestPatchWithTooLongPreferencesChangesNothing(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	body := `{"name": "Johnny", "preferences": {"notes": "` + strings.Repeat("x", maxPreferencesLength) + `"}}`
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateMeHandler, scopeAccount, "johndoe@example.com", true, nil, body)
+	if 400 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 400, rec.Code)
+	}
+
+	rec = requestAsUser(t, env, "GET", "/", env.getMeHandler, scopeAccount, "johndoe@example.com", true, nil, "")
+	user, prefs := decodeMe(t, rec)
+	if user.Name != "John Doe" {
+		t.Errorf("expected %v, got %v", "John Doe", user.Name)
+	}
+	if len(prefs) != 0 {
+		t.Errorf("expected no preferences, got %v", prefs)
+	}
+}
+
+func TestCannotPatchOwnAdminFlagOrEmail(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "PATCH", "/", env.updateMeHandler, scopeAccount, "johndoe@example.com", true, nil, `{"is_admin": true}`)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	rec = requestAsUser(t, env, "PATCH", "/", env.updateMeHandler, scopeAccount, "johndoe@example.com", true, nil, `{"email": "john@example.com"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+
+	// sending the current values back unchanged is fine
+	rec = requestAsUser(t, env, "PATCH", "/", env.updateMeHandler, scopeAccount, "johndoe@example.com", true, nil,
+		`{"email": "johndoe@example.com", "is_admin": false}`)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+}
+
+func TestCanGetOwnHistory(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "GET", "/", env.getMyHistoryHandler, scopeAccount, "johndoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var vpaths []*models.VisitedPath
+	err := json.Unmarshal(rec.Body.Bytes(), &vpaths)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(vpaths) != 1 || vpaths[0].Path != "/path1" {
+		t.Errorf("expected one visit to /path1, got %v", vpaths)
+	}
+}
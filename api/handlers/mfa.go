@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/swinslow/containerapp/api/models"
+	"github.com/swinslow/containerapp/api/totp"
+)
+
+// mfaChallengeTTL is how long a user has after the first step of logging
+// in to enter a code from their authenticator app.
+const mfaChallengeTTL = 5 * time.Minute
+
+// totpSkew is how many time steps either side of now a TOTP code is
+// accepted for, to allow for clock drift.
+const totpSkew = 1
+
+// recoveryCodeCount is how many recovery codes are issued at a time.
+const recoveryCodeCount = 10
+
+// defaultTOTPIssuer is the name that authenticator apps show for the
+// account, if the environment does not say otherwise.
+const defaultTOTPIssuer = "containerapp"
+
+// mfaChallengeResponse is the JSON body returned instead of tokens when a
+// login needs a second factor to complete.
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// tokenHasMFA reports whether the token for the current request came from
+// a login that passed a second authentication factor.
+func tokenHasMFA(r *http.Request) bool {
+	ti, ok := r.Context().Value(tokenContextKey(0)).(*tokenInfo)
+	return ok && ti.MFA
+}
+
+// completeLogin finishes a login for the given email address once its
+// first factor has been checked. Users who have enrolled in TOTP get an
+// MFA challenge token to exchange at /oauth/mfa; everyone else gets
+// tokens straight away, narrowed to scope if it is not empty.
+func (env *Env) completeLogin(w http.ResponseWriter, r *http.Request, email string, scope string) {
+	user, err := env.db.GetUserByEmail(email)
+	if err != nil || user == nil {
+		// unknown users can't have enrolled
+		env.writeTokens(w, r, email, "", scope, false)
+		return
+	}
+	ts, err := env.db.GetTOTPSecret(user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+	if ts == nil || !ts.Confirmed {
+		env.writeTokens(w, r, email, "", scope, false)
+		return
+	}
+
+	mfaToken, err := generateRandomToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+	err = env.db.AddMFAChallenge(hashToken(mfaToken), email, time.Now().Add(mfaChallengeTTL))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(&mfaChallengeResponse{MFARequired: true, MFAToken: mfaToken})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+// generateRecoveryCode returns a new random recovery code, formatted in
+// groups so that it is easy to write down.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// normalizeRecoveryCode strips the formatting from a recovery code as
+// entered by a user, so that it can be hashed and compared.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+// writeRecoveryCodes replaces the user's recovery codes with new ones and
+// writes them to the response. This is the only time they are shown.
+func (env *Env) writeRecoveryCodes(w http.ResponseWriter, user *models.User) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "Couldn't create recovery codes"}`)
+			return
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	err := env.db.SetRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create recovery codes"}`)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(map[string][]string{"recovery_codes": codes})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) mfaHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// get form values
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Couldn't parse form"}`)
+		return
+	}
+	mfaToken := r.Form.Get("mfa_token")
+	code := r.Form.Get("code")
+	recoveryCode := r.Form.Get("recovery_code")
+	if mfaToken == "" || (code == "" && recoveryCode == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply mfa_token and either code or recovery_code in MFA request"}`)
+		return
+	}
+	// tokens are only narrowed if the scope is given here, at the step
+	// that issues them
+	scope, ok := requestedScope(w, r)
+	if !ok {
+		return
+	}
+
+	// each challenge allows a single attempt, so that codes can't be
+	// guessed by trying again and again
+	email, err := env.db.ConsumeMFAChallenge(hashToken(mfaToken), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired MFA token"}`)
+		return
+	}
+	user, err := env.db.GetUserByEmail(email)
+	if err != nil || user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired MFA token"}`)
+		return
+	}
+
+	if !env.checkLockout(w, email) {
+		return
+	}
+
+	if code != "" {
+		ok = env.checkTOTPCode(user.ID, code)
+	} else {
+		ok, err = env.db.UseRecoveryCode(user.ID, hashToken(normalizeRecoveryCode(recoveryCode)))
+		ok = ok && err == nil
+	}
+	if !ok {
+		env.recordAuthFailure(email)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid authentication code"}`)
+		return
+	}
+	env.clearAuthFailures(email)
+
+	env.writeTokens(w, r, email, "", scope, true)
+}
+
+// checkTOTPCode reports whether code is currently valid for the user's
+// TOTP enrollment and hasn't been used before.
+func (env *Env) checkTOTPCode(userID uint32, code string) bool {
+	ts, err := env.db.GetTOTPSecret(userID)
+	if err != nil || ts == nil {
+		return false
+	}
+	step, ok := totp.Validate(ts.Secret, code, time.Now(), totpSkew)
+	if !ok {
+		return false
+	}
+	ok, err = env.db.UseTOTPStep(userID, step)
+	return ok && err == nil
+}
+
+// totpEnrollmentResponse is the JSON body returned when a user starts
+// enrolling in TOTP.
+type totpEnrollmentResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"otpauth_uri"`
+}
+
+func (env *Env) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// replacing a confirmed enrollment needs the current second factor,
+	// so that a stolen token can't be used to take it over
+	ts, err := env.db.GetTOTPSecret(user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error checking enrollment"}`)
+		return
+	}
+	if ts != nil && ts.Confirmed && !tokenHasMFA(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "two-factor authentication required to change enrollment"}`)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error creating secret"}`)
+		return
+	}
+	err = env.db.SetTOTPSecret(user.ID, secret)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error creating secret"}`)
+		return
+	}
+
+	issuer := env.totpIssuer
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
+	js, err := json.Marshal(&totpEnrollmentResponse{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(issuer, user.Email, secret),
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, string(js))
+}
+
+type totpCodeReq struct {
+	Code string `json:"code"`
+}
+
+func (env *Env) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// extract JSON content
+	var req totpCodeReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	ts, err := env.db.GetTOTPSecret(user.ID)
+	if err != nil || ts == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "no TOTP enrollment in progress"}`)
+		return
+	}
+	if ts.Confirmed {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "TOTP enrollment already confirmed"}`)
+		return
+	}
+
+	// the user proves that their authenticator app has the secret
+	if !env.checkTOTPCode(user.ID, req.Code) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid authentication code"}`)
+		return
+	}
+	err = env.db.ConfirmTOTPSecret(user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error confirming enrollment"}`)
+		return
+	}
+
+	env.writeRecoveryCodes(w, user)
+}
+
+func (env *Env) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+	if !tokenHasMFA(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "two-factor authentication required to replace recovery codes"}`)
+		return
+	}
+
+	env.writeRecoveryCodes(w, user)
+}
+
+func (env *Env) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+	if !tokenHasMFA(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "two-factor authentication required to disable it"}`)
+		return
+	}
+
+	err := env.db.DeleteTOTPSecret(user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error disabling two-factor authentication"}`)
+		return
+	}
+	fmt.Fprintf(w, `{"status": "two-factor authentication disabled"}`)
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swinslow/containerapp/api/totp"
+)
+
+// janedoe@example.com is an admin in the mock database
+const testMFAUserID = 914611345
+
+func newTestMFAEnv() (*mockDB, *Env, string) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	secret, _ := totp.GenerateSecret()
+	db.SetTOTPSecret(testMFAUserID, secret)
+	db.ConfirmTOTPSecret(testMFAUserID)
+	return db, env, secret
+}
+
+// loginForMFAToken logs in with an emailed code, and returns the MFA
+// token from the response.
+func loginForMFAToken(t *testing.T, db *mockDB, env *Env) string {
+	db.AddLoginCode(hashToken("abcdef"), "janedoe@example.com", time.Now().Add(time.Minute))
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "abcdef")
+	req, _ := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	var rj mfaChallengeResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &rj)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if !rj.MFARequired || rj.MFAToken == "" {
+		t.Fatalf("expected MFA challenge, got %s", rec.Body.String())
+	}
+	return rj.MFAToken
+}
+
+func postMFA(env *Env, values map[string]string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	for k, v := range values {
+		data.Set(k, v)
+	}
+	req, _ := http.NewRequest("POST", "/oauth/mfa", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.mfaHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginForEnrolledUserRequiresTOTPCode(t *testing.T) {
+	db, env, secret := newTestMFAEnv()
+
+	mfaToken := loginForMFAToken(t, db, env)
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	rec := postMFA(env, map[string]string{"mfa_token": mfaToken, "code": code})
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	rj := decodeTokenResponse(t, rec)
+	claims := parseTestToken(t, rj.Token)
+	if claims["mfa"] != true {
+		t.Errorf("expected %v, got %v", true, claims["mfa"])
+	}
+
+	// the refresh token carries the second factor through to new tokens
+	rec = postRefreshToken(env, rj.RefreshToken)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	claims = parseTestToken(t, decodeTokenResponse(t, rec).Token)
+	if claims["mfa"] != true {
+		t.Errorf("expected %v, got %v", true, claims["mfa"])
+	}
+
+	// but the same TOTP code can't be used again
+	mfaToken = loginForMFAToken(t, db, env)
+	rec = postMFA(env, map[string]string{"mfa_token": mfaToken, "code": code})
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestLoginForUnenrolledUserHasNoMFAClaim(t *testing.T) {
+	db, env, _ := newTestMFAEnv()
+	db.DeleteTOTPSecret(testMFAUserID)
+
+	db.AddLoginCode(hashToken("abcdef"), "janedoe@example.com", time.Now().Add(time.Minute))
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "abcdef")
+	req, _ := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+
+	claims := parseTestToken(t, decodeTokenResponse(t, rec).Token)
+	if _, ok := claims["mfa"]; ok {
+		t.Errorf("expected no mfa claim, got %v", claims["mfa"])
+	}
+}
+
+func TestMFAChallengeAllowsOneAttempt(t *testing.T) {
+	db, env, secret := newTestMFAEnv()
+
+	mfaToken := loginForMFAToken(t, db, env)
+	rec := postMFA(env, map[string]string{"mfa_token": mfaToken, "code": "000000"})
+	if 401 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 401, rec.Code)
+	}
+
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	rec = postMFA(env, map[string]string{"mfa_token": mfaToken, "code": code})
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCanCompleteMFAWithRecoveryCodeOnce(t *testing.T) {
+	db, env, _ := newTestMFAEnv()
+	db.SetRecoveryCodes(testMFAUserID, []string{hashToken("abcdefghijklmnop")})
+
+	mfaToken := loginForMFAToken(t, db, env)
+	rec := postMFA(env, map[string]string{"mfa_token": mfaToken, "recovery_code": "ABCD-EFGH-IJKL-MNOP"})
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	mfaToken = loginForMFAToken(t, db, env)
+	rec = postMFA(env, map[string]string{"mfa_token": mfaToken, "recovery_code": "abcd-efgh-ijkl-mnop"})
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCanEnrollAndConfirmTOTP(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.enrollTOTPHandler, "", "johndoe@example.com", false, nil, "")
+	if 201 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 201, rec.Code)
+	}
+	var enrollment totpEnrollmentResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &enrollment)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/containerapp:johndoe@example.com?") {
+		t.Errorf("unexpected provisioning URI %s", enrollment.ProvisioningURI)
+	}
+
+	// not used for logins until confirmed
+	if db.totpSecrets[91461].Confirmed {
+		t.Errorf("expected unconfirmed enrollment, got confirmed")
+	}
+
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	rec = requestAsUser(t, env, "POST", "/", env.confirmTOTPHandler, "", "johndoe@example.com", false, nil, `{"code": "`+code+`"}`)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var rj map[string][]string
+	err = json.Unmarshal(rec.Body.Bytes(), &rj)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(rj["recovery_codes"]) != recoveryCodeCount {
+		t.Errorf("expected len %d, got %d", recoveryCodeCount, len(rj["recovery_codes"]))
+	}
+	if len(db.recoveryCodes) != recoveryCodeCount {
+		t.Errorf("expected len %d, got %d", recoveryCodeCount, len(db.recoveryCodes))
+	}
+	if !db.totpSecrets[91461].Confirmed {
+		t.Errorf("expected confirmed enrollment, got unconfirmed")
+	}
+}
+
+func TestCannotConfirmTOTPWithWrongCode(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	db.SetTOTPSecret(91461, "JBSWY3DPEHPK3PXP")
+
+	rec := requestAsUser(t, env, "POST", "/", env.confirmTOTPHandler, "", "johndoe@example.com", false, nil, `{"code": "000000"}`)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestChangingConfirmedTOTPRequiresMFA(t *testing.T) {
+	_, env, _ := newTestMFAEnv()
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"enroll":  env.enrollTOTPHandler,
+		"disable": env.disableTOTPHandler,
+		"codes":   env.regenerateRecoveryCodesHandler,
+	} {
+		rec := requestAsUser(t, env, "POST", "/", handler, "", "janedoe@example.com", false, nil, "")
+		if 403 != rec.Code {
+			t.Errorf("%s: Expected %d, got %d", name, 403, rec.Code)
+		}
+	}
+
+	rec := requestAsUser(t, env, "POST", "/", env.disableTOTPHandler, "", "janedoe@example.com", true, nil, "")
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+}
+
+func TestAdminWithoutMFACannotGetAllUsers(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/admin/users", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	user, err := db.GetUserByEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: false})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(env.getUsersHandler).ServeHTTP(rec, req)
+
+	// check that we got a 403 (Forbidden)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
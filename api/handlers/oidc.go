@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// oidcStateTTL is how long a user has to complete a login at an
+// identity provider before the pending state is no longer accepted.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcProviderConfig holds the settings for one OpenID Connect identity
+// provider, as read from the file named by OIDCCONFIGFILE.
+type oidcProviderConfig struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+// oidcProvider is an OpenID Connect identity provider that users can log
+// in through. Its endpoints and keys are discovered from the issuer the
+// first time they are needed.
+type oidcProvider struct {
+	config oidcProviderConfig
+	client *http.Client
+
+	mu sync.Mutex
+	// from the issuer's discovery document
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+	// the issuer's signing keys, keyed by key ID
+	keys map[string]*signingKey
+}
+
+func newOIDCProvider(config oidcProviderConfig, client *http.Client) *oidcProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email"}
+	}
+	return &oidcProvider{config: config, client: client}
+}
+
+// loadOIDCProviders reads identity provider settings from a JSON file of
+// the form {"providers": [{"name": ..., "issuer": ..., ...}]}.
+func loadOIDCProviders(path string) (map[string]*oidcProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Providers []oidcProviderConfig `json:"providers"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse %s: %v", path, err)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	providers := make(map[string]*oidcProvider)
+	for _, pc := range config.Providers {
+		if pc.Name == "" || pc.Issuer == "" || pc.ClientID == "" || pc.RedirectURL == "" {
+			return nil, fmt.Errorf("Provider %q in %s needs name, issuer, client_id and redirect_url", pc.Name, path)
+		}
+		if _, ok := providers[pc.Name]; ok {
+			return nil, fmt.Errorf("Duplicate provider %q in %s", pc.Name, path)
+		}
+		providers[pc.Name] = newOIDCProvider(pc, client)
+	}
+	return providers, nil
+}
+
+// getJSON fetches a URL and decodes its JSON body into v.
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Got status %d from %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the issuer's discovery document, if that hasn't been
+// done yet. The caller must hold p.mu.
+func (p *oidcProvider) discover() error {
+	if p.tokenEndpoint != "" {
+		return nil
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	err := p.getJSON(strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return err
+	}
+	if doc.Issuer != p.config.Issuer {
+		return fmt.Errorf("Discovery document issuer %q doesn't match configured issuer %q", doc.Issuer, p.config.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return fmt.Errorf("Discovery document for %s is missing endpoints", p.config.Issuer)
+	}
+
+	p.authorizationEndpoint = doc.AuthorizationEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.jwksURI = doc.JWKSURI
+	return nil
+}
+
+// getAuthorizationEndpoint returns the URL that users are sent to in
+// order to log in.
+func (p *oidcProvider) getAuthorizationEndpoint() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+	return p.authorizationEndpoint, nil
+}
+
+// getKey returns the issuer's key with the given ID. The issuer's key set
+// is fetched again if the key isn't known yet, since issuers rotate keys.
+func (p *oidcProvider) getKey(kid string) (*signingKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*signingKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// skip key types we can't use, rather than failing on them
+		if key, err := jwk.verifyOnlyKey(); err == nil {
+			keys[key.id] = key
+		}
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key ID %s from %s", kid, p.config.Issuer)
+	}
+	return key, nil
+}
+
+// exchangeCode trades an authorization code for the provider's tokens,
+// and returns the ID token.
+func (p *oidcProvider) exchangeCode(code string, codeVerifier string) (string, error) {
+	p.mu.Lock()
+	err := p.discover()
+	tokenEndpoint := p.tokenEndpoint
+	p.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", p.config.RedirectURL)
+	data.Set("client_id", p.config.ClientID)
+	data.Set("code_verifier", codeVerifier)
+	if p.config.ClientSecret != "" {
+		data.Set("client_secret", p.config.ClientSecret)
+	}
+	resp, err := p.client.PostForm(tokenEndpoint, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Got status %d from token endpoint", resp.StatusCode)
+	}
+
+	var tr struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return "", err
+	}
+	if tr.IDToken == "" {
+		return "", fmt.Errorf("No id_token in token endpoint response")
+	}
+	return tr.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature and claims, and returns
+// the verified email address it asserts.
+func (p *oidcProvider) verifyIDToken(idToken string, nonce string) (string, error) {
+	token, err := jwt.Parse(idToken, func(tkn *jwt.Token) (interface{}, error) {
+		kid, _ := tkn.Header["kid"].(string)
+		key, err := p.getKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		if tkn.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method %s", tkn.Method.Alg())
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", fmt.Errorf("Invalid ID token")
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return "", fmt.Errorf("ID token expired or missing exp")
+	}
+	if !claims.VerifyIssuer(p.config.Issuer, true) {
+		return "", fmt.Errorf("ID token has wrong issuer")
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) && !audienceListContains(claims["aud"], p.config.ClientID) {
+		return "", fmt.Errorf("ID token has wrong audience")
+	}
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return "", fmt.Errorf("ID token has wrong nonce")
+	}
+
+	// only trust addresses that the provider says it has verified
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return "", fmt.Errorf("ID token email is not verified")
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return "", fmt.Errorf("ID token has no email")
+	}
+	return email, nil
+}
+
+// audienceListContains checks for an audience in the array form of the
+// aud claim, which jwt-go's VerifyAudience doesn't handle.
+func audienceListContains(aud interface{}, want string) bool {
+	list, ok := aud.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, a := range list {
+		if s, ok := a.(string); ok && s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// pkceChallenge returns the S256 PKCE code challenge for a code verifier.
+func pkceChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (env *Env) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	name := mux.Vars(r)["provider"]
+	p, ok := env.oidcProviders[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "unknown identity provider"}`)
+		return
+	}
+
+	authEndpoint, err := p.getAuthorizationEndpoint()
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, `{"error": "couldn't reach identity provider"}`)
+		return
+	}
+
+	// state ties the callback to this request; nonce ties the ID token to
+	// it; and the PKCE verifier ties the code exchange to it
+	state, err1 := generateRandomToken()
+	nonce, err2 := generateRandomToken()
+	codeVerifier, err3 := generateRandomToken()
+	if err1 != nil || err2 != nil || err3 != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "couldn't start login"}`)
+		return
+	}
+	err = env.db.AddOIDCState(hashToken(state), name, nonce, codeVerifier, time.Now().Add(oidcStateTTL))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "couldn't start login"}`)
+		return
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(authEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, authEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func (env *Env) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	name := mux.Vars(r)["provider"]
+	p, ok := env.oidcProviders[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "unknown identity provider"}`)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "identity provider returned an error"}`)
+		return
+	}
+	state := q.Get("state")
+	code := q.Get("code")
+	if state == "" || code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply state and code in callback"}`)
+		return
+	}
+
+	st, err := env.db.ConsumeOIDCState(hashToken(state), time.Now())
+	if err != nil || st.Provider != name {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired login state"}`)
+		return
+	}
+
+	idToken, err := p.exchangeCode(code, st.CodeVerifier)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "couldn't exchange code with identity provider"}`)
+		return
+	}
+	email, err := p.verifyIDToken(idToken, st.Nonce)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "invalid ID token from identity provider"}`)
+		return
+	}
+
+	// only registered users can log in through an identity provider
+	user, err := env.db.GetUserByEmail(email)
+	if err != nil || user == nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "no registered user for this identity"}`)
+		return
+	}
+
+	env.completeLogin(w, r, user.Email, "")
+}
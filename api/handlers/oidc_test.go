@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// testIssuer is a stand-in OpenID Connect identity provider.
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// set by the test from the login redirect
+	challenge string
+	nonce     string
+	// claims to override in the issued ID token
+	overrides jwt.MapClaims
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	ti := &testIssuer{key: newTestRSAKey(t)}
+	mx := http.NewServeMux()
+	mx.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": "%s", "authorization_endpoint": "%s/authorize", "token_endpoint": "%s/token", "jwks_uri": "%s/jwks"}`,
+			ti.server.URL, ti.server.URL, ti.server.URL, ti.server.URL)
+	})
+	mx.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk := newRSAKey(nil, &ti.key.PublicKey).jwk()
+		jwk.Kid = "idp-key"
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []*jsonWebKey{jwk}})
+	})
+	mx.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("code") != "good-code" || pkceChallenge(r.PostForm.Get("code_verifier")) != ti.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":            ti.server.URL,
+			"aud":            "test-client",
+			"exp":            time.Now().Add(5 * time.Minute).Unix(),
+			"nonce":          ti.nonce,
+			"email":          "johndoe@example.com",
+			"email_verified": true,
+		}
+		for k, v := range ti.overrides {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "idp-key"
+		idToken, _ := token.SignedString(ti.key)
+		fmt.Fprintf(w, `{"access_token": "x", "token_type": "Bearer", "id_token": "%s"}`, idToken)
+	})
+	ti.server = httptest.NewServer(mx)
+	return ti
+}
+
+func newTestOIDCEnv(ti *testIssuer) *Env {
+	db := &mockDB{}
+	p := newOIDCProvider(oidcProviderConfig{
+		Name:        "test",
+		Issuer:      ti.server.URL,
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost:3000/oauth/callback/test",
+	}, ti.server.Client())
+	return &Env{db: db, keys: newTestKeyring(), oidcProviders: map[string]*oidcProvider{"test": p}}
+}
+
+// startTestOIDCLogin calls the login handler and returns the state from
+// the redirect, recording the nonce and challenge with the issuer.
+func startTestOIDCLogin(t *testing.T, env *Env, ti *testIssuer) string {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth/login/test", nil)
+	req = mux.SetURLVars(req, map[string]string{"provider": "test"})
+	http.HandlerFunc(env.oidcLoginHandler).ServeHTTP(rec, req)
+	if 302 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 302, rec.Code)
+	}
+
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("couldn't parse redirect: %v", err)
+	}
+	q := loc.Query()
+	if loc.Path != "/authorize" {
+		t.Errorf("expected %v, got %v", "/authorize", loc.Path)
+	}
+	if q.Get("client_id") != "test-client" {
+		t.Errorf("expected %v, got %v", "test-client", q.Get("client_id"))
+	}
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("expected %v, got %v", "S256", q.Get("code_challenge_method"))
+	}
+	ti.challenge = q.Get("code_challenge")
+	ti.nonce = q.Get("nonce")
+	return q.Get("state")
+}
+
+func callTestOIDCCallback(env *Env, state string, code string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	v := url.Values{}
+	v.Set("state", state)
+	v.Set("code", code)
+	req, _ := http.NewRequest("GET", "/oauth/callback/test?"+v.Encode(), nil)
+	req = mux.SetURLVars(req, map[string]string{"provider": "test"})
+	http.HandlerFunc(env.oidcCallbackHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanLogInThroughOIDCProvider(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.server.Close()
+	env := newTestOIDCEnv(ti)
+
+	state := startTestOIDCLogin(t, env, ti)
+	rec := callTestOIDCCallback(env, state, "good-code")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d: %s", 200, rec.Code, rec.Body.String())
+	}
+
+	tr := decodeTokenResponse(t, rec)
+	claims := parseTestToken(t, tr.Token)
+	if claims["email"] != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", claims["email"])
+	}
+	if tr.RefreshToken == "" {
+		t.Errorf("expected refresh token, got empty string")
+	}
+
+	// the state can't be used a second time
+	rec = callTestOIDCCallback(env, state, "good-code")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.server.Close()
+	env := newTestOIDCEnv(ti)
+
+	startTestOIDCLogin(t, env, ti)
+	rec := callTestOIDCCallback(env, "not-a-state", "good-code")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsFailedCodeExchange(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.server.Close()
+	env := newTestOIDCEnv(ti)
+
+	state := startTestOIDCLogin(t, env, ti)
+	rec := callTestOIDCCallback(env, state, "bad-code")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsBadIDTokenClaims(t *testing.T) {
+	cases := map[string]jwt.MapClaims{
+		"wrong nonce":    {"nonce": "something-else"},
+		"wrong audience": {"aud": "other-client"},
+		"wrong issuer":   {"iss": "https://evil.example.com"},
+		"expired":        {"exp": time.Now().Add(-time.Minute).Unix()},
+		"unverified":     {"email_verified": false},
+	}
+	for name, overrides := range cases {
+		ti := newTestIssuer(t)
+		env := newTestOIDCEnv(ti)
+		ti.overrides = overrides
+
+		state := startTestOIDCLogin(t, env, ti)
+		rec := callTestOIDCCallback(env, state, "good-code")
+		if 401 != rec.Code {
+			t.Errorf("%s: Expected %d, got %d", name, 401, rec.Code)
+		}
+		ti.server.Close()
+	}
+}
+
+func TestOIDCCallbackRejectsUnregisteredUser(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.server.Close()
+	env := newTestOIDCEnv(ti)
+	ti.overrides = jwt.MapClaims{"email": "stranger@example.com"}
+
+	state := startTestOIDCLogin(t, env, ti)
+	rec := callTestOIDCCallback(env, state, "good-code")
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestOIDCLoginRejectsUnknownProvider(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth/login/nope", nil)
+	req = mux.SetURLVars(req, map[string]string{"provider": "nope"})
+	http.HandlerFunc(env.oidcLoginHandler).ServeHTTP(rec, req)
+	if 404 != rec.Code {
+		t.Errorf("Expected %d, got %d", 404, rec.Code)
+	}
+}
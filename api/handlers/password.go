@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// default password policy, if the environment does not say otherwise
+const (
+	defaultPasswordMinLength  = 12
+	defaultPasswordMinClasses = 1
+)
+
+// bcrypt only looks at the first 72 bytes of a password, so longer ones
+// are refused rather than silently truncated.
+const maxPasswordBytes = 72
+
+// dummyPasswordHash is compared against when a login names a user with
+// no password, so that the response takes as long as for a real user.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("containerapp dummy password"), bcrypt.DefaultCost)
+
+// passwordPolicy holds the rules that new passwords must meet.
+type passwordPolicy struct {
+	// minimum length, in characters
+	minLength int
+	// minimum number of character classes (lower case, upper case,
+	// digits, and everything else) that must appear
+	minClasses int
+}
+
+// validate checks that the policy itself can be satisfied.
+func (p passwordPolicy) validate() error {
+	if p.minLength > maxPasswordBytes {
+		return fmt.Errorf("Minimum password length cannot be greater than %d; got %d", maxPasswordBytes, p.minLength)
+	}
+	if p.minClasses > 4 {
+		return fmt.Errorf("Minimum password character classes cannot be greater than 4; got %d", p.minClasses)
+	}
+	return nil
+}
+
+// check returns an error describing why the password doesn't meet the
+// policy, or nil if it does. A zero policy uses the defaults.
+func (p passwordPolicy) check(password string) error {
+	minLength := p.minLength
+	if minLength == 0 {
+		minLength = defaultPasswordMinLength
+	}
+	if len([]rune(password)) < minLength {
+		return fmt.Errorf("password must be at least %d characters", minLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.minClasses {
+		return fmt.Errorf("password must use at least %d of: lower case letters, upper case letters, digits, symbols", p.minClasses)
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of a password.
+func (env *Env) hashPassword(password string) (string, error) {
+	cost := env.bcryptCost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether password is the one set for the user
+// with the given email. It is false if the user is unknown or has no
+// password set.
+func (env *Env) checkPassword(email string, password string) bool {
+	hash, err := env.db.GetPasswordHash(email)
+	if err != nil || hash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// passwordLogin issues tokens in response to a token request with an
+// email address and password, narrowed to scope if it is not empty.
+func (env *Env) passwordLogin(w http.ResponseWriter, r *http.Request, email string, password string, scope string) {
+	if !env.checkLockout(w, email) {
+		return
+	}
+	if !env.checkPassword(email, password) {
+		env.recordAuthFailure(email)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid email or password"}`)
+		return
+	}
+	env.clearAuthFailures(email)
+	env.completeLogin(w, r, email, scope)
+}
+
+// extractKnownUser takes a Request and extracts and returns the User
+// object, confirming that it is a registered User. If not, the
+// appropriate HTTP headers and content are written and nil is returned.
+func extractKnownUser(w http.ResponseWriter, r *http.Request) *models.User {
+	// pull User from context
+	ctxCheck := r.Context().Value(userContextKey(0))
+	if ctxCheck == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Authorization header with valid Bearer token required"}`)
+		return nil
+	}
+	user := ctxCheck.(*models.User)
+	if user.ID == 0 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "unknown user %s"}`, user.Email)
+		return nil
+	}
+	return user
+}
+
+type changePasswordReq struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func (env *Env) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// extract JSON content
+	var req changePasswordReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	// a user who already has a password must confirm it before changing
+	// it; one who doesn't can set it using just their current token
+	hash, err := env.db.GetPasswordHash(user.Email)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error checking password"}`)
+		return
+	}
+	if hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.CurrentPassword)) != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "current password is incorrect"}`)
+		return
+	}
+
+	if !env.setPassword(w, user, req.NewPassword) {
+		return
+	}
+	fmt.Fprintf(w, `{"status": "password changed"}`)
+}
+
+type resetPasswordReq struct {
+	Password string `json:"password"`
+}
+
+func (env *Env) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractManagedUser(w, r, user)
+	if target == nil {
+		return
+	}
+
+	// extract JSON content
+	var req resetPasswordReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	if !env.setPassword(w, target, req.Password) {
+		return
+	}
+
+	// anyone who was logged in as the user with the old password is
+	// logged out
+	err = env.revokeAllTokens(target)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "password reset, but server error revoking tokens"}`)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status": "password reset for user %d"}`, target.ID)
+}
+
+// setPassword checks a new password against the policy and saves it for
+// the user. If that fails, the appropriate HTTP headers and content are
+// written and false is returned.
+func (env *Env) setPassword(w http.ResponseWriter, user *models.User, password string) bool {
+	if err := env.passwordPolicy.check(password); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%s"}`, err.Error())
+		return false
+	}
+
+	hash, err := env.hashPassword(password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving password"}`)
+		return false
+	}
+	err = env.db.SetPasswordHash(user.ID, hash)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error saving password"}`)
+		return false
+	}
+	return true
+}
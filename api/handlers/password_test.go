@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestPasswordEnv(t *testing.T) (*mockDB, *Env) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring(), bcryptCost: bcrypt.MinCost}
+	hash, err := env.hashPassword("correct horse battery")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	// johndoe@example.com
+	db.SetPasswordHash(91461, hash)
+	return db, env
+}
+
+func postPasswordLogin(env *Env, email string, password string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("email", email)
+	data.Set("password", password)
+	req, _ := http.NewRequest("POST", "/oauth/getToken", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.createTokenHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanLogInWithPassword(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postPasswordLogin(env, "johndoe@example.com", "correct horse battery")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	rj := decodeTokenResponse(t, rec)
+	claims := parseTestToken(t, rj.Token)
+	if claims["email"] != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", claims["email"])
+	}
+}
+
+func TestCannotLogInWithWrongPassword(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postPasswordLogin(env, "johndoe@example.com", "incorrect horse battery")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotLogInWithPasswordForUserWithoutOne(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	for _, email := range []string{"janedoe@example.com", "stranger@example.com"} {
+		rec := postPasswordLogin(env, email, "correct horse battery")
+		if 401 != rec.Code {
+			t.Errorf("%s: Expected %d, got %d", email, 401, rec.Code)
+		}
+	}
+}
+
+func TestCannotRequestLoginCodeWithoutMailer(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postPasswordLogin(env, "johndoe@example.com", "")
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := passwordPolicy{minLength: 8, minClasses: 3}
+	for pw, ok := range map[string]bool{
+		"short1A":                 false,
+		"alllowercase":            false,
+		"lowerUPPER":              false,
+		"lowerUPPER123":           true,
+		"lower123!!!":             true,
+		strings.Repeat("aA1", 25): false,
+	} {
+		err := p.check(pw)
+		if ok && err != nil {
+			t.Errorf("%s: expected nil error, got %v", pw, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: expected non-nil error, got nil", pw)
+		}
+	}
+
+	if err := (passwordPolicy{minClasses: 5}).validate(); err == nil {
+		t.Errorf("expected non-nil error, got nil")
+	}
+}
+
+func postChangePassword(t *testing.T, env *Env, email string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/me/password", strings.NewReader(body))
+	user, err := env.db.GetUserByEmail(email)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey(0), user))
+	http.HandlerFunc(env.changePasswordHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanChangeOwnPassword(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postChangePassword(t, env, "johndoe@example.com",
+		`{"current_password": "correct horse battery", "new_password": "a brand new password"}`)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	if rec := postPasswordLogin(env, "johndoe@example.com", "a brand new password"); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+	if rec := postPasswordLogin(env, "johndoe@example.com", "correct horse battery"); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCanSetFirstPasswordWithoutCurrentPassword(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postChangePassword(t, env, "janedoe@example.com", `{"new_password": "a brand new password"}`)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+}
+
+func TestCannotChangeOwnPasswordWithWrongCurrentPassword(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postChangePassword(t, env, "johndoe@example.com",
+		`{"current_password": "wrong", "new_password": "a brand new password"}`)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestCannotChangeOwnPasswordToOneFailingPolicy(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postChangePassword(t, env, "johndoe@example.com",
+		`{"current_password": "correct horse battery", "new_password": "short"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func postResetPassword(t *testing.T, env *Env, adminEmail string, id string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/users/"+id+"/password", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	user, err := env.db.GetUserByEmail(adminEmail)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ctx := context.WithValue(req.Context(), userContextKey(0), user)
+	ctx = context.WithValue(ctx, tokenContextKey(0), &tokenInfo{MFA: true, Scopes: env.userScopes(user)})
+	req = req.WithContext(ctx)
+	http.HandlerFunc(requireScopes(env.resetPasswordHandler, scopeUsersWrite)).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminCanResetPassword(t *testing.T) {
+	db, env := newTestPasswordEnv(t)
+
+	rec := postResetPassword(t, env, "janedoe@example.com", "91461", `{"password": "reset by an admin"}`)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	if rec := postPasswordLogin(env, "johndoe@example.com", "reset by an admin"); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// and the user's existing tokens are revoked
+	if _, ok := db.revokedBefore["johndoe@example.com"]; !ok {
+		t.Errorf("expected tokens to be revoked, but they weren't")
+	}
+}
+
+func TestNonAdminCannotResetPassword(t *testing.T) {
+	_, env := newTestPasswordEnv(t)
+
+	rec := postResetPassword(t, env, "johndoe@example.com", "914611345", `{"password": "reset by an admin"}`)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
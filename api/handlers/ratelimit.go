@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/swinslow/containerapp/api/models"
+	"github.com/swinslow/containerapp/api/ratelimit"
+)
+
+// default rate limits and lockout settings, if the environment does not
+// say otherwise
+var (
+	defaultIPRate    = ratelimit.Rate{Limit: 20, Period: time.Minute}
+	defaultEmailRate = ratelimit.Rate{Limit: 5, Period: 15 * time.Minute}
+)
+
+const (
+	defaultLockoutThreshold = 5
+	defaultLockoutWindow    = 15 * time.Minute
+	defaultLockoutDuration  = 15 * time.Minute
+)
+
+// rateFromEnv returns the rate in the named environment variable, or def
+// if it is not set.
+func rateFromEnv(name string, def ratelimit.Rate) (ratelimit.Rate, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return def, nil
+	}
+	rate, err := ratelimit.ParseRate(val)
+	if err != nil {
+		return ratelimit.Rate{}, fmt.Errorf("Couldn't parse %s: %v", name, err)
+	}
+	return rate, nil
+}
+
+// loadLimitersFromEnv sets up the per-IP and per-email rate limiters.
+// If RATELIMITSTORE is "postgres", the limits are kept in the database
+// so that they hold across several api replicas; otherwise they are
+// kept in memory.
+func loadLimitersFromEnv(db *models.DB) (ratelimit.Limiter, ratelimit.Limiter, error) {
+	ipRate, err := rateFromEnv("RATELIMITIP", defaultIPRate)
+	if err != nil {
+		return nil, nil, err
+	}
+	emailRate, err := rateFromEnv("RATELIMITEMAIL", defaultEmailRate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch RATELIMITSTORE := os.Getenv("RATELIMITSTORE"); RATELIMITSTORE {
+	case "", "memory":
+		return ratelimit.NewMemoryLimiter(ipRate), ratelimit.NewMemoryLimiter(emailRate), nil
+	case "postgres":
+		return ratelimit.NewStoreLimiter(db, ipRate, "ip:"), ratelimit.NewStoreLimiter(db, emailRate, "email:"), nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown RATELIMITSTORE %q; must be memory or postgres", RATELIMITSTORE)
+	}
+}
+
+// clientIP returns the IP address that the request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ceilSeconds returns d in whole seconds, rounded up, for use in headers.
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// allowRequest takes a token from the limiter's bucket for key, and sets
+// the RateLimit-* headers. If the request is over the limit, a 429
+// response is written and false is returned. A nil limiter allows
+// everything.
+func allowRequest(w http.ResponseWriter, limiter ratelimit.Limiter, key string) bool {
+	if limiter == nil {
+		return true
+	}
+	res, err := limiter.Allow(key, time.Now())
+	if err != nil {
+		// don't lock everyone out just because the limiter's store
+		// is unavailable
+		log.Printf("error checking rate limit: %v", err)
+		return true
+	}
+
+	w.Header().Set("RateLimit-Limit", fmt.Sprintf("%d", res.Limit))
+	w.Header().Set("RateLimit-Remaining", fmt.Sprintf("%d", res.Remaining))
+	w.Header().Set("RateLimit-Reset", fmt.Sprintf("%d", ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", ceilSeconds(res.RetryAfter)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, `{"error": "too many requests; try again later"}`)
+		return false
+	}
+	return true
+}
+
+// rateLimitMiddleware limits how often each IP address can call the
+// wrapped handler.
+func (env *Env) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !allowRequest(w, env.ipLimiter, clientIP(r)) {
+			return
+		}
+		next(w, r)
+	})
+}
+
+// emailRateKey returns the key used to rate limit requests about the
+// given email address.
+func emailRateKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLockout checks whether the given email address is locked out
+// after too many failed logins. If so, a 429 response is written and
+// false is returned.
+func (env *Env) checkLockout(w http.ResponseWriter, email string) bool {
+	lockedUntil, err := env.db.GetLockedUntil(emailRateKey(email))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error checking account"}`)
+		return false
+	}
+	now := time.Now()
+	if now.Before(lockedUntil) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", ceilSeconds(lockedUntil.Sub(now))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, `{"error": "too many failed login attempts; try again later"}`)
+		return false
+	}
+	return true
+}
+
+// recordAuthFailure counts a failed login for the given email address,
+// which locks it out once there have been too many.
+func (env *Env) recordAuthFailure(email string) {
+	threshold := env.lockoutThreshold
+	if threshold == 0 {
+		threshold = defaultLockoutThreshold
+	}
+	window := lifetime(env.lockoutWindow, defaultLockoutWindow)
+	duration := lifetime(env.lockoutDuration, defaultLockoutDuration)
+	_, err := env.db.RecordAuthFailure(emailRateKey(email), time.Now(), window, threshold, duration)
+	if err != nil {
+		log.Printf("error recording failed login: %v", err)
+	}
+}
+
+// clearAuthFailures forgets the failed logins for the given email
+// address, after a successful one.
+func (env *Env) clearAuthFailures(email string) {
+	if err := env.db.ClearAuthFailures(emailRateKey(email)); err != nil {
+		log.Printf("error clearing failed logins: %v", err)
+	}
+}
+
+// startRateLimitGC periodically forgets rate limit buckets that have
+// refilled, until the process exits.
+func (env *Env) startRateLimitGC(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, limiter := range []ratelimit.Limiter{env.ipLimiter, env.emailLimiter} {
+				if err := limiter.Prune(now); err != nil {
+					log.Printf("error pruning rate limits: %v", err)
+				}
+			}
+		}
+	}()
+}
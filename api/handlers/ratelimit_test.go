@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/mailer"
+	"github.com/swinslow/containerapp/api/ratelimit"
+)
+
+func postTokenRequest(env *Env, remoteAddr string, email string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("email", email)
+	req, _ := http.NewRequest("POST", "/oauth/getToken", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+	http.HandlerFunc(env.rateLimitMiddleware(env.createTokenHandler)).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTokenRequestsAreRateLimitedByIP(t *testing.T) {
+	env := &Env{
+		db:        &mockDB{},
+		keys:      newTestKeyring(),
+		mailer:    mailer.NewMemoryMailer(),
+		ipLimiter: ratelimit.NewMemoryLimiter(ratelimit.Rate{Limit: 2, Period: time.Minute}),
+	}
+
+	for i, email := range []string{"a@example.com", "b@example.com"} {
+		rec := postTokenRequest(env, "1.2.3.4:5678", email)
+		if 202 != rec.Code {
+			t.Fatalf("request %d: Expected %d, got %d", i, 202, rec.Code)
+		}
+		if rec.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("expected %v, got %v", "2", rec.Header().Get("RateLimit-Limit"))
+		}
+	}
+	rec := postTokenRequest(env, "1.2.3.4:5678", "c@example.com")
+	if 429 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 429, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("expected %v, got %v", "30", rec.Header().Get("Retry-After"))
+	}
+	if rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("expected %v, got %v", "0", rec.Header().Get("RateLimit-Remaining"))
+	}
+
+	// other addresses aren't affected
+	if rec := postTokenRequest(env, "5.6.7.8:5678", "c@example.com"); 202 != rec.Code {
+		t.Errorf("Expected %d, got %d", 202, rec.Code)
+	}
+}
+
+func TestTokenIssuingRoutesAreRateLimitedByIP(t *testing.T) {
+	env := &Env{
+		db:        &mockDB{},
+		keys:      newTestKeyring(),
+		ipLimiter: ratelimit.NewMemoryLimiter(ratelimit.Rate{Limit: 1, Period: time.Minute}),
+	}
+	router := mux.NewRouter()
+	env.RegisterHandlers(router)
+
+	paths := []string{"/oauth/getToken", "/oauth/verify", "/oauth/mfa", "/oauth/token", "/oauth/refresh", "/email/confirm", "/invitations/accept"}
+	for i, path := range paths {
+		// each path is called from its own address, after a first request
+		// from it that uses up the limit
+		remoteAddr := fmt.Sprintf("10.0.0.%d:5678", i+1)
+		for j := 0; j < 2; j++ {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", path, strings.NewReader(""))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = remoteAddr
+			router.ServeHTTP(rec, req)
+			if j == 1 && 429 != rec.Code {
+				t.Errorf("%s: Expected %d, got %d", path, 429, rec.Code)
+			}
+		}
+	}
+}
+
+func TestTokenRequestsAreRateLimitedByEmail(t *testing.T) {
+	env := &Env{
+		db:           &mockDB{},
+		keys:         newTestKeyring(),
+		mailer:       mailer.NewMemoryMailer(),
+		emailLimiter: ratelimit.NewMemoryLimiter(ratelimit.Rate{Limit: 1, Period: time.Minute}),
+	}
+
+	if rec := postTokenRequest(env, "1.2.3.4:5678", "janedoe@example.com"); 202 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 202, rec.Code)
+	}
+	// from anywhere, and however the address is written
+	if rec := postTokenRequest(env, "5.6.7.8:5678", "JaneDoe@Example.com"); 429 != rec.Code {
+		t.Errorf("Expected %d, got %d", 429, rec.Code)
+	}
+}
+
+func TestRepeatedFailedPasswordsLockAccountOut(t *testing.T) {
+	db, env := newTestPasswordEnv(t)
+	env.lockoutThreshold = 3
+
+	for i := 0; i < 3; i++ {
+		if rec := postPasswordLogin(env, "johndoe@example.com", "wrong"); 401 != rec.Code {
+			t.Fatalf("attempt %d: Expected %d, got %d", i, 401, rec.Code)
+		}
+	}
+
+	// now even the right password is refused until the lockout ends
+	rec := postPasswordLogin(env, "johndoe@example.com", "correct horse battery")
+	if 429 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 429, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected Retry-After header, got none")
+	}
+
+	db.authFailures["johndoe@example.com"].lockedUntil = time.Now().Add(-time.Second)
+	if rec := postPasswordLogin(env, "johndoe@example.com", "correct horse battery"); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+	if _, ok := db.authFailures["johndoe@example.com"]; ok {
+		t.Errorf("expected failures to be cleared after login, but they weren't")
+	}
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// defaultRevocationCacheTTL is how long a "not revoked" answer from the
+// datastore is trusted before it is looked up again. This bounds how
+// long it takes for a revocation made by another api replica to take
+// effect here.
+const defaultRevocationCacheTTL = 30 * time.Second
+
+// revocationCache remembers the results of revocation, session and OAuth2
+// client lookups, so that validateTokenMiddleware doesn't need to query the
+// datastore on every request. A nil *revocationCache is valid and always
+// queries the datastore.
+type revocationCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	// keyed by token ID (jti)
+	tokens map[string]*cachedTokenStatus
+	// keyed by email address
+	cutoffs map[string]*cachedCutoff
+	// keyed by session ID
+	sessions map[string]*cachedSession
+	// keyed by client ID
+	clients map[string]*cachedClient
+}
+
+type cachedTokenStatus struct {
+	revoked bool
+	// for revoked tokens, when the token itself expires; for others,
+	// when the answer should be looked up again
+	until time.Time
+}
+
+type cachedCutoff struct {
+	revokedBefore time.Time
+	checked       time.Time
+}
+
+type cachedSession struct {
+	active  bool
+	checked time.Time
+}
+
+type cachedClient struct {
+	active  bool
+	checked time.Time
+}
+
+func newRevocationCache(ttl time.Duration) *revocationCache {
+	return &revocationCache{
+		ttl:      ttl,
+		tokens:   make(map[string]*cachedTokenStatus),
+		cutoffs:  make(map[string]*cachedCutoff),
+		sessions: make(map[string]*cachedSession),
+		clients:  make(map[string]*cachedClient),
+	}
+}
+
+// isRevoked returns whether the token with the given ID, issued to email
+// at issuedAt and expiring at expires, has been revoked either
+// individually or as one of all tokens for that email address.
+func (rc *revocationCache) isRevoked(db models.Datastore, jti string, email string, issuedAt time.Time, expires time.Time, now time.Time) (bool, error) {
+	if rc == nil {
+		revoked, err := db.IsTokenRevoked(jti)
+		if err != nil || revoked {
+			return revoked, err
+		}
+		before, err := db.GetTokensRevokedBefore(email)
+		if err != nil {
+			return false, err
+		}
+		return isIssuedBefore(issuedAt, before), nil
+	}
+
+	revoked, err := rc.isTokenRevoked(db, jti, expires, now)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	before, err := rc.getTokensRevokedBefore(db, email, now)
+	if err != nil {
+		return false, err
+	}
+	return isIssuedBefore(issuedAt, before), nil
+}
+
+// isIssuedBefore returns whether a token issued at issuedAt falls at or
+// before the revocation cutoff. Token times only have one-second
+// precision, so a token issued in the same second as the cutoff counts
+// as revoked.
+func isIssuedBefore(issuedAt time.Time, before time.Time) bool {
+	if before.IsZero() {
+		return false
+	}
+	return issuedAt.Unix() <= before.Unix()
+}
+
+func (rc *revocationCache) isTokenRevoked(db models.Datastore, jti string, expires time.Time, now time.Time) (bool, error) {
+	rc.mu.Lock()
+	status, ok := rc.tokens[jti]
+	rc.mu.Unlock()
+	if ok && now.Before(status.until) {
+		return status.revoked, nil
+	}
+
+	revoked, err := db.IsTokenRevoked(jti)
+	if err != nil {
+		return false, err
+	}
+
+	// a revocation can't be undone, so it can be remembered for as long
+	// as the token would otherwise have been valid
+	until := now.Add(rc.ttl)
+	if revoked {
+		until = expires
+	}
+	rc.mu.Lock()
+	rc.tokens[jti] = &cachedTokenStatus{revoked: revoked, until: until}
+	rc.mu.Unlock()
+	return revoked, nil
+}
+
+func (rc *revocationCache) getTokensRevokedBefore(db models.Datastore, email string, now time.Time) (time.Time, error) {
+	rc.mu.Lock()
+	cutoff, ok := rc.cutoffs[email]
+	rc.mu.Unlock()
+	if ok && now.Before(cutoff.checked.Add(rc.ttl)) {
+		return cutoff.revokedBefore, nil
+	}
+
+	before, err := db.GetTokensRevokedBefore(email)
+	if err != nil {
+		return time.Time{}, err
+	}
+	rc.mu.Lock()
+	rc.cutoffs[email] = &cachedCutoff{revokedBefore: before, checked: now}
+	rc.mu.Unlock()
+	return before, nil
+}
+
+// recordRevokedToken notes a token revoked by this process, so that it is
+// rejected immediately without waiting for the cache to expire.
+func (rc *revocationCache) recordRevokedToken(jti string, expires time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.tokens[jti] = &cachedTokenStatus{revoked: true, until: expires}
+}
+
+// recordTokensRevokedBefore notes a per-address cutoff set by this
+// process, so that it takes effect immediately.
+func (rc *revocationCache) recordTokensRevokedBefore(email string, before time.Time, now time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if cutoff, ok := rc.cutoffs[email]; ok && cutoff.revokedBefore.After(before) {
+		before = cutoff.revokedBefore
+	}
+	rc.cutoffs[email] = &cachedCutoff{revokedBefore: before, checked: now}
+}
+
+// isSessionActive returns whether the session with the given ID is still
+// active. Looking a session up in the datastore also records it as last
+// seen now, so caching the answer means that its last seen time is only
+// written once per ttl, rather than on every request.
+func (rc *revocationCache) isSessionActive(db models.Datastore, id string, now time.Time) (bool, error) {
+	if rc == nil {
+		return db.TouchSession(id, now)
+	}
+
+	rc.mu.Lock()
+	session, ok := rc.sessions[id]
+	rc.mu.Unlock()
+	if ok && now.Before(session.checked.Add(rc.ttl)) {
+		return session.active, nil
+	}
+
+	active, err := db.TouchSession(id, now)
+	if err != nil {
+		return false, err
+	}
+	rc.mu.Lock()
+	rc.sessions[id] = &cachedSession{active: active, checked: now}
+	rc.mu.Unlock()
+	return active, nil
+}
+
+// recordSessionEnded notes a session ended by this process, so that its
+// tokens are rejected immediately.
+func (rc *revocationCache) recordSessionEnded(id string, now time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.sessions[id] = &cachedSession{active: false, checked: now}
+}
+
+// isClientActive returns whether the OAuth2 client with the given ID still
+// exists, so that tokens issued to it are still valid.
+func (rc *revocationCache) isClientActive(db models.Datastore, id string, now time.Time) (bool, error) {
+	if rc == nil {
+		return getClientActive(db, id)
+	}
+
+	rc.mu.Lock()
+	client, ok := rc.clients[id]
+	rc.mu.Unlock()
+	if ok && now.Before(client.checked.Add(rc.ttl)) {
+		return client.active, nil
+	}
+
+	active, err := getClientActive(db, id)
+	if err != nil {
+		return false, err
+	}
+	rc.mu.Lock()
+	rc.clients[id] = &cachedClient{active: active, checked: now}
+	rc.mu.Unlock()
+	return active, nil
+}
+
+// getClientActive looks up whether the OAuth2 client with the given ID
+// still exists in the datastore.
+func getClientActive(db models.Datastore, id string) (bool, error) {
+	_, err := db.GetClient(id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordClientRevoked notes a client revoked by this process, so that
+// its tokens are rejected immediately.
+func (rc *revocationCache) recordClientRevoked(id string, now time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.clients[id] = &cachedClient{active: false, checked: now}
+}
+
+// prune drops cache entries that are no longer useful as of now.
+func (rc *revocationCache) prune(now time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for jti, status := range rc.tokens {
+		if !now.Before(status.until) {
+			delete(rc.tokens, jti)
+		}
+	}
+	for email, cutoff := range rc.cutoffs {
+		if !now.Before(cutoff.checked.Add(rc.ttl)) {
+			delete(rc.cutoffs, email)
+		}
+	}
+	for id, session := range rc.sessions {
+		if !now.Before(session.checked.Add(rc.ttl)) {
+			delete(rc.sessions, id)
+		}
+	}
+	for id, client := range rc.clients {
+		if !now.Before(client.checked.Add(rc.ttl)) {
+			delete(rc.clients, id)
+		}
+	}
+}
+
+// startRevocationGC periodically deletes expired records, such as
+// revocations, sessions and unused codes and tokens, from the datastore
+// and the cache, until the process exits.
+func (env *Env) startRevocationGC(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			maxTokenAge := lifetime(env.accessTokenTTL, defaultAccessTokenTTL)
+			if err := env.db.DeleteExpiredRevocations(now, maxTokenAge); err != nil {
+				log.Printf("error deleting expired revocations: %v", err)
+			}
+			if err := env.db.DeleteExpiredSessions(now); err != nil {
+				log.Printf("error deleting expired sessions: %v", err)
+			}
+			if err := env.db.DeleteExpiredRefreshTokens(now); err != nil {
+				log.Printf("error deleting expired refresh tokens: %v", err)
+			}
+			if err := env.db.DeleteExpiredLoginCodes(now); err != nil {
+				log.Printf("error deleting expired login codes: %v", err)
+			}
+			if err := env.db.DeleteExpiredOIDCStates(now); err != nil {
+				log.Printf("error deleting expired login states: %v", err)
+			}
+			if err := env.db.DeleteExpiredMFAChallenges(now); err != nil {
+				log.Printf("error deleting expired MFA challenges: %v", err)
+			}
+			if err := env.db.DeleteExpiredEmailChanges(now); err != nil {
+				log.Printf("error deleting expired email changes: %v", err)
+			}
+			// expired invitations are kept for a while longer, so that
+			// admins can still see and resend them
+			if err := env.db.DeleteExpiredInvitations(now.Add(-defaultInvitationTTL)); err != nil {
+				log.Printf("error deleting expired invitations: %v", err)
+			}
+			env.revocations.prune(now)
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+func TestRevocationCacheAvoidsRepeatedLookups(t *testing.T) {
+	db := &mockDB{}
+	rc := newRevocationCache(time.Minute)
+	now := time.Now()
+	issued := now.Add(-time.Minute)
+	expires := now.Add(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		revoked, err := rc.isRevoked(db, "jti1", "janedoe@example.com", issued, expires, now)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if revoked {
+			t.Fatalf("expected not revoked, got revoked")
+		}
+	}
+
+	if db.revocationLookups != 1 {
+		t.Errorf("expected %d lookup, got %d", 1, db.revocationLookups)
+	}
+
+	// once the ttl has passed, the datastore is asked again and sees a
+	// revocation made elsewhere
+	db.AddRevokedToken("jti1", expires)
+	revoked, err := rc.isRevoked(db, "jti1", "janedoe@example.com", issued, expires, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !revoked {
+		t.Errorf("expected revoked, got not revoked")
+	}
+	if db.revocationLookups != 2 {
+		t.Errorf("expected %d lookups, got %d", 2, db.revocationLookups)
+	}
+}
+
+func TestRevocationCacheRecordsLocalRevocations(t *testing.T) {
+	db := &mockDB{}
+	rc := newRevocationCache(time.Minute)
+	now := time.Now()
+	issued := now.Add(-time.Minute)
+	expires := now.Add(time.Hour)
+
+	rc.recordRevokedToken("jti1", expires)
+	revoked, err := rc.isRevoked(db, "jti1", "janedoe@example.com", issued, expires, now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !revoked {
+		t.Errorf("expected revoked, got not revoked")
+	}
+
+	rc.recordTokensRevokedBefore("johndoe@example.com", now, now)
+	revoked, err = rc.isRevoked(db, "jti2", "johndoe@example.com", issued, expires, now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !revoked {
+		t.Errorf("expected revoked, got not revoked")
+	}
+
+	// but a token issued after the cutoff is fine
+	revoked, err = rc.isRevoked(db, "jti3", "johndoe@example.com", now.Add(time.Second), expires, now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if revoked {
+		t.Errorf("expected not revoked, got revoked")
+	}
+}
+
+func TestRevocationCacheThrottlesSessionTouches(t *testing.T) {
+	db := &mockDB{}
+	rc := newRevocationCache(time.Minute)
+	now := time.Now()
+	db.SetSession(&models.Session{ID: "sid1", Email: "janedoe@example.com", Created: now, LastSeen: now, Expires: now.Add(time.Hour)})
+
+	for i := 0; i < 3; i++ {
+		active, err := rc.isSessionActive(db, "sid1", now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if !active {
+			t.Fatalf("expected active, got not active")
+		}
+	}
+	if db.sessionTouches != 1 {
+		t.Errorf("expected %d touch, got %d", 1, db.sessionTouches)
+	}
+
+	// once the ttl has passed, the session is touched again
+	later := now.Add(2 * time.Minute)
+	rc.isSessionActive(db, "sid1", later)
+	if db.sessionTouches != 2 {
+		t.Errorf("expected %d touches, got %d", 2, db.sessionTouches)
+	}
+	if !db.sessions["sid1"].LastSeen.Equal(later) {
+		t.Errorf("expected last seen %v, got %v", later, db.sessions["sid1"].LastSeen)
+	}
+
+	// and a session ended here is inactive straight away
+	rc.recordSessionEnded("sid1", later)
+	active, err := rc.isSessionActive(db, "sid1", later)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if active {
+		t.Errorf("expected not active, got active")
+	}
+}
+
+func TestRevocationCachePrunesExpiredEntries(t *testing.T) {
+	rc := newRevocationCache(time.Minute)
+	now := time.Now()
+
+	rc.recordRevokedToken("jti1", now.Add(time.Hour))
+	rc.recordRevokedToken("jti2", now.Add(time.Second))
+	rc.recordTokensRevokedBefore("janedoe@example.com", now, now)
+	rc.recordSessionEnded("sid1", now)
+
+	rc.prune(now.Add(2 * time.Minute))
+
+	if _, ok := rc.tokens["jti1"]; !ok {
+		t.Errorf("expected unexpired entry to remain, but it was pruned")
+	}
+	if _, ok := rc.tokens["jti2"]; ok {
+		t.Errorf("expected expired entry to be pruned, but it remains")
+	}
+	if _, ok := rc.cutoffs["janedoe@example.com"]; ok {
+		t.Errorf("expected stale cutoff to be pruned, but it remains")
+	}
+	if _, ok := rc.sessions["sid1"]; ok {
+		t.Errorf("expected stale session to be pruned, but it remains")
+	}
+}
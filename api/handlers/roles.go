@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// findRole returns the role with the given name, or nil if there isn't
+// one.
+func (env *Env) findRole(name string) (*models.Role, error) {
+	roles, err := env.db.GetAllRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if role.Name == name {
+			return role, nil
+		}
+	}
+	return nil, nil
+}
+
+// canManageRole reports whether the given admin user may assign or revoke
+// the given role: only if they have every permission that it grants, so
+// that admins can't give out more access than they have themselves.
+func (env *Env) canManageRole(user *models.User, role *models.Role) bool {
+	return scopeWithin(role.Permissions, strings.Join(env.userScopes(user), " "))
+}
+
+// writeUserRoles writes out the roles held by the given user as JSON.
+func (env *Env) writeUserRoles(w http.ResponseWriter, target *models.User) {
+	roles, err := env.db.GetRolesForUserID(target.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(roles)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) getRolesHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	roles, err := env.db.GetAllRoles()
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(roles)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+func (env *Env) getUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractPathUser(w, r)
+	if target == nil {
+		return
+	}
+
+	env.writeUserRoles(w, target)
+}
+
+type assignRoleReq struct {
+	Role string `json:"role"`
+}
+
+func (env *Env) assignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractPathUser(w, r)
+	if target == nil {
+		return
+	}
+
+	// extract JSON content
+	var req assignRoleReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	role, err := env.findRole(req.Role)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	if role == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "unknown role %s"}`, req.Role)
+		return
+	}
+	if !env.canManageRole(user, role) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "can't assign role %s with permissions that you don't have"}`, role.Name)
+		return
+	}
+
+	err = env.db.AssignRole(target.ID, role.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error assigning role"}`)
+		return
+	}
+
+	env.writeUserRoles(w, target)
+}
+
+func (env *Env) revokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractPathUser(w, r)
+	if target == nil {
+		return
+	}
+
+	name := mux.Vars(r)["role"]
+	role, err := env.findRole(name)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	if role == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "unknown role %s"}`, name)
+		return
+	}
+	if !env.canManageRole(user, role) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "can't revoke role %s with permissions that you don't have"}`, role.Name)
+		return
+	}
+
+	// the user's tokens may still carry the role's scopes, but
+	// requirePermissions checks their roles again on every request; and
+	// the last admin can't stop being one
+	err = env.db.RevokeRole(target.ID, role.Name)
+	if _, ok := err.(*models.LastAdminError); ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "user %d is the last admin"}`, target.ID)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "user %d does not have role %s"}`, target.ID, role.Name)
+		return
+	}
+
+	env.writeUserRoles(w, target)
+}
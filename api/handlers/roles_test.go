@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+func getRoleNames(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var roles []*models.Role
+	err := json.Unmarshal(rec.Body.Bytes(), &roles)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	names := make([]string, 0)
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+func TestAdminCanAssignRole(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.assignRoleHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"role": "auditor"}`)
+	if names := getRoleNames(t, rec); len(names) != 1 || names[0] != "auditor" {
+		t.Errorf("expected %v, got %v", []string{"auditor"}, names)
+	}
+
+	// and the user can now be granted the role's permissions
+	tr := decodeTokenResponse(t, verifyWithScope(env, "johndoe@example.com", ""))
+	want := "account history:read users:read keys:read clients:read"
+	if tr.Scope != want {
+		t.Errorf("expected %q, got %q", want, tr.Scope)
+	}
+}
+
+func TestCannotAssignUnknownRole(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.assignRoleHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"role": "overlord"}`)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func TestCannotAssignRoleWithPermissionsNotHeld(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	db.AssignRole(91461, "user-manager")
+
+	// a user manager can't make themselves a superadmin
+	rec := requestAsUser(t, env, "POST", "/", env.assignRoleHandler, scopeUsersWrite, "johndoe@example.com", true,
+		map[string]string{"id": "91461"}, `{"role": "superadmin"}`)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	// or take the role away from one
+	rec = requestAsUser(t, env, "POST", "/", env.revokeRoleHandler, scopeUsersWrite, "johndoe@example.com", true,
+		map[string]string{"id": "914611345", "role": "superadmin"}, "")
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestRevokedRoleTakesEffectBeforeTokenExpires(t *testing.T) {
+	db := &mockDB{}
+	env := &Env{db: db, keys: newTestKeyring()}
+	db.AssignRole(91461, "auditor")
+	tr := decodeTokenResponse(t, verifyWithScope(env, "johndoe@example.com", ""))
+
+	handler := env.requirePermissions(env.testHandler, scopeHistoryRead)
+	if rec := callWithToken(env, handler, "GET", tr.Token, nil); 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	rec := requestAsUser(t, env, "POST", "/", env.revokeRoleHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461", "role": "auditor"}, "")
+	if names := getRoleNames(t, rec); len(names) != 0 {
+		t.Errorf("expected no roles, got %v", names)
+	}
+
+	rec = callWithToken(env, handler, "GET", tr.Token, nil)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	wantString := `{"error": "user does not have permission history:read"}`
+	if rec.Body.String() != wantString {
+		t.Errorf("expected %s, got %s", wantString, rec.Body.String())
+	}
+}
+
+func TestCannotRevokeRoleNotHeld(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	rec := requestAsUser(t, env, "POST", "/", env.revokeRoleHandler, scopeUsersWrite, "janedoe@example.com", true,
+		map[string]string{"id": "91461", "role": "auditor"}, "")
+	if 404 != rec.Code {
+		t.Errorf("Expected %d, got %d", 404, rec.Code)
+	}
+}
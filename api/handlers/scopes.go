@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// scopes that a token can carry, each of which grants access to a group
+// of routes
+const (
+	// managing one's own account, under /me; every registered user may be
+	// granted this
+	scopeAccount = "account"
+	// admin routes, which users may be granted if one of their roles has
+	// the permission of the same name
+	scopeHistoryRead  = "history:read"
+	scopeUsersRead    = "users:read"
+	scopeUsersWrite   = "users:write"
+	scopeKeysRead     = "keys:read"
+	scopeKeysWrite    = "keys:write"
+	scopeClientsRead  = "clients:read"
+	scopeClientsWrite = "clients:write"
+)
+
+// allScopes lists every known scope, in the order that they are written
+// in tokens.
+var allScopes = []string{
+	scopeAccount,
+	scopeHistoryRead,
+	scopeUsersRead,
+	scopeUsersWrite,
+	scopeKeysRead,
+	scopeKeysWrite,
+	scopeClientsRead,
+	scopeClientsWrite,
+}
+
+// parseScope splits a space-separated scope string, as sent by clients to
+// request a narrowed token, and checks that every scope is known. An empty
+// string gives a nil slice, meaning that no narrowing was requested.
+func parseScope(scope string) ([]string, error) {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !isKnownScope(s) {
+			return nil, fmt.Errorf("unknown scope %s", s)
+		}
+		scopes = append(scopes, s)
+	}
+	return scopes, nil
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range allScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeWithin reports whether every scope in the space-separated string
+// requested is also in the space-separated string limit. An empty limit
+// doesn't restrict anything.
+func scopeWithin(requested string, limit string) bool {
+	if limit == "" {
+		return true
+	}
+	allowed := strings.Fields(limit)
+	for _, s := range strings.Fields(requested) {
+		if !containsScope(allowed, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// userScopes returns the scopes that the given user may be granted: the
+// account scope, and the permissions of the roles that the user holds.
+// Users who aren't registered yet don't get any.
+func (env *Env) userScopes(user *models.User) []string {
+	scopes := make([]string, 0)
+	if user == nil || user.ID == 0 {
+		return scopes
+	}
+	roles, err := env.db.GetRolesForUserID(user.ID)
+	if err != nil {
+		roles = nil
+	}
+	var permissions []string
+	for _, role := range roles {
+		permissions = append(permissions, strings.Fields(role.Permissions)...)
+	}
+	for _, s := range allScopes {
+		if s == scopeAccount || containsScope(permissions, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// grantScope returns the space-separated scopes to put in a token for the
+// given email address: those that the user may be granted, narrowed to
+// the space-separated scopes requested if that isn't empty.
+func (env *Env) grantScope(email string, requested string) string {
+	user, err := env.db.GetUserByEmail(email)
+	if err != nil {
+		user = nil
+	}
+	granted := make([]string, 0)
+	for _, s := range env.userScopes(user) {
+		if requested == "" || containsScope(strings.Fields(requested), s) {
+			granted = append(granted, s)
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+// tokenHasScopes reports whether the token for the current request
+// carries all of the given scopes.
+func tokenHasScopes(r *http.Request, scopes ...string) bool {
+	ti, ok := r.Context().Value(tokenContextKey(0)).(*tokenInfo)
+	if !ok {
+		return false
+	}
+	for _, s := range scopes {
+		if !containsScope(ti.Scopes, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// requireScopes wraps a handler for a route that needs the given scopes,
+// and must itself be wrapped by validateTokenMiddleware. Requests whose
+// token lacks any of the scopes are rejected.
+func requireScopes(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokenHasScopes(r, scopes...) {
+			sendInsufficientScope(w, scopes)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func sendInsufficientScope(w http.ResponseWriter, scopes []string) {
+	scope := strings.Join(scopes, " ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `{"error": "token requires scope %s"}`, scope)
+}
+
+// requirePermissions wraps a handler for a route that needs the given
+// permissions, and must itself be wrapped by validateTokenMiddleware. As
+// with requireScopes, the token must carry a scope for each permission;
+// and the user must still hold a role granting it, so that taking a role
+// away takes effect before the user's tokens expire.
+func (env *Env) requirePermissions(next http.HandlerFunc, permissions ...string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokenHasScopes(r, permissions...) {
+			sendInsufficientScope(w, permissions)
+			return
+		}
+		user, _ := r.Context().Value(userContextKey(0)).(*models.User)
+		held := env.userScopes(user)
+		for _, p := range permissions {
+			if !containsScope(held, p) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `{"error": "user does not have permission %s"}`, p)
+				return
+			}
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyWithScope logs in as the given user through /oauth/verify,
+// asking for the given scope.
+func verifyWithScope(env *Env, email string, scope string) *httptest.ResponseRecorder {
+	env.db.AddLoginCode(hashToken("abcdef"), email, time.Now().Add(time.Minute))
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "abcdef")
+	data.Set("scope", scope)
+	req, _ := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginGrantsScopesForUser(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"johndoe@example.com", "account"},
+		{"janedoe@example.com", "account history:read users:read users:write keys:read keys:write clients:read clients:write"},
+		{"unknown@example.com", ""},
+	}
+	for _, tc := range tests {
+		rec := verifyWithScope(env, tc.email, "")
+		if 200 != rec.Code {
+			t.Fatalf("Expected %d, got %d", 200, rec.Code)
+		}
+		tr := decodeTokenResponse(t, rec)
+		if tr.Scope != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.email, tc.want, tr.Scope)
+		}
+		if got := parseTestToken(t, tr.Token)["scope"]; got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.email, tc.want, got)
+		}
+	}
+}
+
+func TestCanRequestNarrowedToken(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	rec := verifyWithScope(env, "janedoe@example.com", "history:read")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	tr := decodeTokenResponse(t, rec)
+	if tr.Scope != "history:read" {
+		t.Errorf("expected %q, got %q", "history:read", tr.Scope)
+	}
+
+	if rec = callWithToken(env, requireScopes(env.testHandler, scopeHistoryRead), "GET", tr.Token, nil); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+	rec = callWithToken(env, requireScopes(env.testHandler, scopeUsersRead), "GET", tr.Token, nil)
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	wantHeader := `Bearer error="insufficient_scope", scope="users:read"`
+	if got := rec.Result().Header.Get("WWW-Authenticate"); got != wantHeader {
+		t.Errorf("expected %v, got %v", wantHeader, got)
+	}
+	if rec = callWithToken(env, requireScopes(env.testHandler, scopeAccount), "GET", tr.Token, nil); 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
+
+func TestNonAdminIsNotGrantedAdminScopes(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	rec := verifyWithScope(env, "johndoe@example.com", "account users:write")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	tr := decodeTokenResponse(t, rec)
+	if tr.Scope != "account" {
+		t.Errorf("expected %q, got %q", "account", tr.Scope)
+	}
+}
+
+func TestCannotRequestUnknownScope(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	rec := verifyWithScope(env, "janedoe@example.com", "history:read everything")
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func postRefreshTokenWithScope(env *Env, rtString string, scope string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("refresh_token", rtString)
+	data.Set("scope", scope)
+	req, _ := http.NewRequest("POST", "/oauth/refresh", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.refreshTokenHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRefreshCanNarrowButNotWidenScope(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	tr := decodeTokenResponse(t, verifyWithScope(env, "janedoe@example.com", ""))
+
+	// narrow a full token on refresh
+	rec := postRefreshTokenWithScope(env, tr.RefreshToken, "history:read users:read")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	tr = decodeTokenResponse(t, rec)
+	if tr.Scope != "history:read users:read" {
+		t.Errorf("expected %q, got %q", "history:read users:read", tr.Scope)
+	}
+
+	// the family stays narrowed when refreshed without a scope
+	rec = postRefreshTokenWithScope(env, tr.RefreshToken, "")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	tr = decodeTokenResponse(t, rec)
+	if tr.Scope != "history:read users:read" {
+		t.Errorf("expected %q, got %q", "history:read users:read", tr.Scope)
+	}
+
+	// and can't be widened again, without using up the refresh token
+	rec = postRefreshTokenWithScope(env, tr.RefreshToken, "users:write")
+	if 400 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 400, rec.Code)
+	}
+	rec = postRefreshTokenWithScope(env, tr.RefreshToken, "history:read")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+}
+
+func TestAPIKeyGetsUserScopes(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	resp := createTestAPIKey(t, env, "janedoe@example.com", true, `{"name": "ci"}`)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/users", nil)
+	req.Header.Set("Authorization", "ApiKey "+resp.Key)
+	http.HandlerFunc(env.validateTokenMiddleware(requireScopes(env.getUsersHandler, scopeUsersRead))).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// names of the cookies and header used in session mode
+const (
+	accessCookieName  = "access_token"
+	refreshCookieName = "refresh_token"
+	csrfCookieName    = "csrf_token"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// refreshCookiePath limits the refresh token cookie to the endpoints that
+// use it, so that it isn't sent with every request.
+const refreshCookiePath = "/oauth"
+
+// sessionResponse is the JSON body returned instead of tokenResponse in
+// session mode, where the tokens themselves are only sent in HttpOnly
+// cookies that scripts can't read.
+type sessionResponse struct {
+	TokenType string `json:"token_type"`
+	ExpiresIn int64  `json:"expires_in"`
+	CSRFToken string `json:"csrf_token"`
+}
+
+// writeSessionCookies sets the access token, refresh token and CSRF token
+// cookies, and writes the session response.
+func writeSessionCookies(w http.ResponseWriter, tknString string, tknTTL time.Duration, rtString string, rtTTL time.Duration) {
+	csrfToken, err := generateRandomToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookieName,
+		Value:    tknString,
+		Path:     "/",
+		MaxAge:   int(tknTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    rtString,
+		Path:     refreshCookiePath,
+		MaxAge:   int(rtTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// the CSRF token is deliberately readable by scripts, which send it
+	// back in the X-CSRF-Token header; other sites can't read it
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   int(rtTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// output as JSON
+	js, err := json.Marshal(&sessionResponse{
+		TokenType: "Cookie",
+		ExpiresIn: int64(tknTTL.Seconds()),
+		CSRFToken: csrfToken,
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+// clearSessionCookies tells the browser to delete the session cookies.
+func clearSessionCookies(w http.ResponseWriter) {
+	for name, path := range map[string]string{
+		accessCookieName:  "/",
+		refreshCookieName: refreshCookiePath,
+		csrfCookieName:    "/",
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     path,
+			MaxAge:   -1,
+			HttpOnly: name != csrfCookieName,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// isSafeMethod reports whether the HTTP method is one that doesn't change
+// state, and so doesn't need CSRF protection.
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// checkCSRF reports whether a request authenticated by cookie may go
+// ahead: either it uses a safe method, or its X-CSRF-Token header matches
+// the CSRF cookie (a "double-submit" token), which a cross-site request
+// can't arrange.
+func checkCSRF(r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(csrfHeaderName)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+// sendCSRFFail writes the response for a request that failed the CSRF
+// check.
+func sendCSRFFail(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `{"error": "missing or invalid CSRF token"}`)
+}
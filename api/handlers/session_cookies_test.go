@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loginWithSessionCookies logs in through /oauth/verify in session mode,
+// and returns the cookies that were set.
+func loginWithSessionCookies(t *testing.T, env *Env) map[string]*http.Cookie {
+	env.db.AddLoginCode(hashToken("abcdef"), "johndoe@example.com", time.Now().Add(time.Minute))
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "abcdef")
+	req, _ := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// the tokens themselves aren't in the body
+	var rj map[string]interface{}
+	err := json.Unmarshal(rec.Body.Bytes(), &rj)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if _, ok := rj["token"]; ok {
+		t.Errorf("expected no token key, got token")
+	}
+	if _, ok := rj["refresh_token"]; ok {
+		t.Errorf("expected no refresh_token key, got refresh_token")
+	}
+
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	if rj["csrf_token"] != cookies[csrfCookieName].Value {
+		t.Errorf("expected %v, got %v", cookies[csrfCookieName].Value, rj["csrf_token"])
+	}
+	return cookies
+}
+
+func TestSessionModeSetsCookies(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), sessionMode: true}
+	cookies := loginWithSessionCookies(t, env)
+
+	for _, name := range []string{accessCookieName, refreshCookieName, csrfCookieName} {
+		c, ok := cookies[name]
+		if !ok {
+			t.Fatalf("expected %s cookie, got none", name)
+		}
+		if !c.Secure {
+			t.Errorf("%s: expected Secure cookie", name)
+		}
+		if c.SameSite != http.SameSiteStrictMode {
+			t.Errorf("%s: expected %v, got %v", name, http.SameSiteStrictMode, c.SameSite)
+		}
+		// only the CSRF token can be read by scripts
+		if c.HttpOnly != (name != csrfCookieName) {
+			t.Errorf("%s: expected HttpOnly %v, got %v", name, name != csrfCookieName, c.HttpOnly)
+		}
+	}
+	if cookies[refreshCookieName].Path != refreshCookiePath {
+		t.Errorf("expected %v, got %v", refreshCookiePath, cookies[refreshCookieName].Path)
+	}
+}
+
+func callWithCookies(env *Env, method string, cookies map[string]*http.Cookie, csrfHeader string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, "/landing", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if csrfHeader != "" {
+		req.Header.Set(csrfHeaderName, csrfHeader)
+	}
+	http.HandlerFunc(env.validateTokenMiddleware(env.testHandler)).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanValidateSessionCookie(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), sessionMode: true}
+	cookies := loginWithSessionCookies(t, env)
+
+	// safe methods don't need the CSRF header
+	if rec := callWithCookies(env, "GET", cookies, ""); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// but others do, and it must match the cookie
+	if rec := callWithCookies(env, "POST", cookies, ""); 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	if rec := callWithCookies(env, "POST", cookies, "wrong"); 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+	if rec := callWithCookies(env, "POST", cookies, cookies[csrfCookieName].Value); 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+}
+
+func TestCannotUseSessionCookieOutsideSessionMode(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), sessionMode: true}
+	cookies := loginWithSessionCookies(t, env)
+
+	env.sessionMode = false
+	if rec := callWithCookies(env, "GET", cookies, ""); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCanRefreshWithSessionCookie(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring(), sessionMode: true}
+	cookies := loginWithSessionCookies(t, env)
+
+	refresh := func(csrfHeader string) int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/oauth/refresh", strings.NewReader(""))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookies[refreshCookieName])
+		req.AddCookie(cookies[csrfCookieName])
+		if csrfHeader != "" {
+			req.Header.Set(csrfHeaderName, csrfHeader)
+		}
+		http.HandlerFunc(env.refreshTokenHandler).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := refresh(""); 403 != code {
+		t.Errorf("Expected %d, got %d", 403, code)
+	}
+	if code := refresh(cookies[csrfCookieName].Value); 200 != code {
+		t.Errorf("Expected %d, got %d", 200, code)
+	}
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/containerapp/api/models"
+)
+
+// maxUserAgentLength is how much of a User-Agent header is kept for a
+// session.
+const maxUserAgentLength = 256
+
+// recordSession records the device that the request came from as the
+// session with the given ID, or updates it if the session already exists.
+func (env *Env) recordSession(r *http.Request, id string, email string, now time.Time, expires time.Time) error {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return env.db.SetSession(&models.Session{
+		ID:        id,
+		Email:     email,
+		UserAgent: userAgent,
+		IP:        clientIP(r),
+		Created:   now,
+		LastSeen:  now,
+		Expires:   expires,
+	})
+}
+
+// sessionResp is the JSON form of a session, as listed to its user or to
+// an admin.
+type sessionResp struct {
+	*models.Session
+	// whether this is the session making the request
+	Current bool `json:"current"`
+}
+
+// writeSessions writes the sessions for the given email address to the
+// response as JSON.
+func (env *Env) writeSessions(w http.ResponseWriter, r *http.Request, email string) {
+	sessions, err := env.db.GetSessionsForEmail(email)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	var currentID string
+	if ti, ok := r.Context().Value(tokenContextKey(0)).(*tokenInfo); ok {
+		currentID = ti.SessionID
+	}
+	resp := make([]*sessionResp, 0, len(sessions))
+	for _, s := range sessions {
+		resp = append(resp, &sessionResp{Session: s, Current: currentID != "" && s.ID == currentID})
+	}
+
+	// output as JSON
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
+// revokeSession ends the session given in the "sessionid" path variable,
+// if it belongs to the given email address, so that neither its refresh
+// tokens nor its access tokens can be used any more.
+func (env *Env) revokeSession(w http.ResponseWriter, r *http.Request, email string) {
+	id := mux.Vars(r)["sessionid"]
+	err := env.db.DeleteSession(email, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "session not found"}`)
+		return
+	}
+	env.revocations.recordSessionEnded(id, time.Now())
+
+	err = env.db.DeleteRefreshTokenFamily(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "server error revoking session"}`)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status": "revoked session %s"}`, id)
+}
+
+func (env *Env) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	env.writeSessions(w, r, user.Email)
+}
+
+func (env *Env) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractKnownUser(w, r)
+	if user == nil {
+		return
+	}
+
+	env.revokeSession(w, r, user.Email)
+}
+
+func (env *Env) getUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractPathUser(w, r)
+	if target == nil {
+		return
+	}
+
+	env.writeSessions(w, r, target.Email)
+}
+
+func (env *Env) revokeUserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	user := extractAdminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// once we're here, we're talking to an admin user
+
+	target := env.extractManagedUser(w, r, user)
+	if target == nil {
+		return
+	}
+
+	env.revokeSession(w, r, target.Email)
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// loginFromDevice logs in as johndoe through /oauth/verify, from the given
+// user agent, and returns the issued tokens.
+func loginFromDevice(t *testing.T, env *Env, userAgent string) *tokenResponse {
+	env.db.AddLoginCode(hashToken("abcdef"), "johndoe@example.com", time.Now().Add(time.Minute))
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "abcdef")
+	req, _ := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	req.RemoteAddr = "192.0.2.1:54321"
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	return decodeTokenResponse(t, rec)
+}
+
+// callWithToken calls handler through validateTokenMiddleware with the
+// given access token and path variables.
+func callWithToken(env *Env, handler http.HandlerFunc, method string, tkn string, vars map[string]string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tkn)
+	req = mux.SetURLVars(req, vars)
+	http.HandlerFunc(env.validateTokenMiddleware(handler)).ServeHTTP(rec, req)
+	return rec
+}
+
+func getSessionList(t *testing.T, rec *httptest.ResponseRecorder) []*sessionResp {
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	var sessions []*sessionResp
+	err := json.Unmarshal(rec.Body.Bytes(), &sessions)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return sessions
+}
+
+func TestLoginRecordsSession(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	tr := loginFromDevice(t, env, "Firefox")
+
+	claims := parseTestToken(t, tr.Token)
+	sid, ok := claims["sid"].(string)
+	if !ok || sid == "" {
+		t.Fatalf("expected sid claim, got %v", claims["sid"])
+	}
+
+	sessions := getSessionList(t, callWithToken(env, env.getSessionsHandler, "GET", tr.Token, nil))
+	if len(sessions) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(sessions))
+	}
+	s := sessions[0]
+	if s.ID != sid {
+		t.Errorf("expected %v, got %v", sid, s.ID)
+	}
+	if s.UserAgent != "Firefox" {
+		t.Errorf("expected %v, got %v", "Firefox", s.UserAgent)
+	}
+	if s.IP != "192.0.2.1" {
+		t.Errorf("expected %v, got %v", "192.0.2.1", s.IP)
+	}
+	if !s.Current {
+		t.Errorf("expected current session, got false")
+	}
+}
+
+func TestRefreshKeepsSession(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	tr := loginFromDevice(t, env, "Firefox")
+
+	rec := postRefreshToken(env, tr.RefreshToken)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	newTr := decodeTokenResponse(t, rec)
+	if parseTestToken(t, newTr.Token)["sid"] != parseTestToken(t, tr.Token)["sid"] {
+		t.Errorf("expected refreshed token to keep its session")
+	}
+
+	sessions := getSessionList(t, callWithToken(env, env.getSessionsHandler, "GET", newTr.Token, nil))
+	if len(sessions) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(sessions))
+	}
+}
+
+func TestCanRevokeOwnSession(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	laptop := loginFromDevice(t, env, "Firefox")
+	phone := loginFromDevice(t, env, "Safari")
+	phoneID := parseTestToken(t, phone.Token)["sid"].(string)
+
+	rec := callWithToken(env, env.revokeSessionHandler, "POST", laptop.Token, map[string]string{"sessionid": phoneID})
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// the revoked session's tokens no longer work, but the other's do
+	rec = callWithToken(env, env.getSessionsHandler, "GET", phone.Token, nil)
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+	if rec = postRefreshToken(env, phone.RefreshToken); 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+	sessions := getSessionList(t, callWithToken(env, env.getSessionsHandler, "GET", laptop.Token, nil))
+	if len(sessions) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(sessions))
+	}
+
+	// and an unknown session can't be revoked
+	rec = callWithToken(env, env.revokeSessionHandler, "POST", laptop.Token, map[string]string{"sessionid": "nosession"})
+	if 404 != rec.Code {
+		t.Errorf("Expected %d, got %d", 404, rec.Code)
+	}
+}
+
+func TestAdminCanListAndRevokeUserSessions(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	tr := loginFromDevice(t, env, "Firefox")
+	sid := parseTestToken(t, tr.Token)["sid"].(string)
+
+	adminToken, err := env.createToken("janedoe@example.com", "", "", true)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	vars := map[string]string{"id": "91461"}
+
+	sessions := getSessionList(t, callWithToken(env, env.getUserSessionsHandler, "GET", adminToken, vars))
+	if len(sessions) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(sessions))
+	}
+	if sessions[0].Current {
+		t.Errorf("expected other user's session not to be current")
+	}
+
+	vars["sessionid"] = sid
+	rec := callWithToken(env, env.revokeUserSessionHandler, "POST", adminToken, vars)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	rec = callWithToken(env, env.getSessionsHandler, "GET", tr.Token, nil)
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+func TestNonAdminCannotListUserSessions(t *testing.T) {
+	env := &Env{db: &mockDB{}, keys: newTestKeyring()}
+	tr := loginFromDevice(t, env, "Firefox")
+
+	rec := callWithToken(env, requireScopes(env.getUserSessionsHandler, scopeUsersRead), "GET", tr.Token, map[string]string{"id": "914611345"})
+	if 403 != rec.Code {
+		t.Errorf("Expected %d, got %d", 403, rec.Code)
+	}
+}
@@ -2,14 +2,198 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/swinslow/containerapp/api/mailer"
 	"github.com/swinslow/containerapp/api/models"
 )
 
+// generateRandomToken returns a new random string suitable for use as a
+// single-use code or other secret, encoded so that it is URL-safe.
+func generateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash of a random token, as stored in the database
+// in place of the token itself.
+func hashToken(tkn string) string {
+	sum := sha256.Sum256([]byte(tkn))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenResponse is the JSON body returned whenever tokens are issued.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// lifetime returns d, or def if d has not been set.
+func lifetime(d time.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// requestedScope returns the scope form value, which clients send to ask
+// for a token narrowed to those scopes. If it names an unknown scope, the
+// appropriate HTTP headers and content are written and false is returned.
+func requestedScope(w http.ResponseWriter, r *http.Request) (string, bool) {
+	scopes, err := parseScope(r.Form.Get("scope"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "invalid_scope", "error_description": "%s"}`, err)
+		return "", false
+	}
+	return strings.Join(scopes, " "), true
+}
+
+// tokenParams describes an access token to be issued.
+type tokenParams struct {
+	email    string
+	audience string
+	// the session or client that the token was issued for, if any
+	sessionID string
+	clientID  string
+	// space-separated scopes that the token grants
+	scope string
+	// whether the login passed a second authentication factor
+	mfa     bool
+	expires time.Time
+}
+
+// createToken creates and signs a short-lived JWT for the given email
+// address, as part of the session with the given ID, carrying the given
+// space-separated scopes. If mfa is true, the token records that the login
+// passed a second authentication factor.
+func (env *Env) createToken(email string, sessionID string, scope string, mfa bool) (string, error) {
+	return env.signToken(&tokenParams{
+		email:     email,
+		audience:  env.tokenAudience(),
+		sessionID: sessionID,
+		scope:     scope,
+		mfa:       mfa,
+		expires:   time.Now().Add(lifetime(env.accessTokenTTL, defaultAccessTokenTTL)),
+	})
+}
+
+// signToken creates and signs a JWT with the given parameters.
+func (env *Env) signToken(p *tokenParams) (string, error) {
+	jti, err := generateRandomToken()
+	if err != nil {
+		return "", err
+	}
+
+	// create token using current signing key
+	key := env.getSigningKey()
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   env.tokenIssuer(),
+		"aud":   p.audience,
+		"email": p.email,
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   p.expires.Unix(),
+		"jti":   jti,
+		"scope": p.scope,
+	}
+	if p.sessionID != "" {
+		claims["sid"] = p.sessionID
+	}
+	if p.clientID != "" {
+		claims["client_id"] = p.clientID
+	}
+	if p.mfa {
+		claims["mfa"] = true
+	}
+	tkn := jwt.NewWithClaims(key.method, claims)
+	tkn.Header["kid"] = key.id
+	return tkn.SignedString(key.signKey)
+}
+
+// writeTokens creates a new access token and refresh token for the given
+// email address, and writes them to the response as JSON. The refresh
+// token joins the given family, or starts a new one if familyID is empty;
+// either way, the request's device is recorded as the family's session.
+// If scope is not empty, the tokens are narrowed to those scopes.
+func (env *Env) writeTokens(w http.ResponseWriter, r *http.Request, email string, familyID string, scope string, mfa bool) {
+	var err error
+	if familyID == "" {
+		familyID, err = generateRandomToken()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+			return
+		}
+	}
+	rtString, err := generateRandomToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+	now := time.Now()
+	rtExpires := now.Add(lifetime(env.refreshTokenTTL, defaultRefreshTokenTTL))
+	err = env.db.AddRefreshToken(hashToken(rtString), familyID, email, scope, mfa, rtExpires)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+	err = env.recordSession(r, familyID, email, now, rtExpires)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+
+	granted := env.grantScope(email, scope)
+	tknString, err := env.createToken(email, familyID, granted, mfa)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		return
+	}
+
+	// in session mode, the tokens go in cookies rather than the body
+	if env.sessionMode {
+		writeSessionCookies(w, tknString, lifetime(env.accessTokenTTL, defaultAccessTokenTTL),
+			rtString, lifetime(env.refreshTokenTTL, defaultRefreshTokenTTL))
+		return
+	}
+
+	// output as JSON
+	js, err := json.Marshal(&tokenResponse{
+		Token:        tknString,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(lifetime(env.accessTokenTTL, defaultAccessTokenTTL).Seconds()),
+		RefreshToken: rtString,
+		Scope:        granted,
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	fmt.Fprintf(w, string(js))
+}
+
 func (env *Env) createTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// send JSON responses
 	w.Header().Set("Content-Type", "application/json")
@@ -35,20 +219,245 @@ func (env *Env) createTokenHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Must supply login email address in token request"}`)
 		return
 	}
+	// tokens, login codes and rate limits all go by the stored form
+	email = normalizedEmail(w, email)
+	if email == "" {
+		return
+	}
 
-	// create token using JWT secret key
-	tkn := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": email,
-	})
-	tknString, err := tkn.SignedString([]byte(env.jwtSecretKey))
+	// limit how often each address can be tried, whether for passwords
+	// or for login codes
+	if !allowRequest(w, env.emailLimiter, emailRateKey(email)) {
+		return
+	}
+
+	// users with a password can log in with it directly
+	if password := r.Form.Get("password"); password != "" {
+		scope, ok := requestedScope(w, r)
+		if !ok {
+			return
+		}
+		env.passwordLogin(w, r, email, password, scope)
+		return
+	}
+
+	// without a mail server, there's no other way to log in here
+	if env.mailer == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply password in token request"}`)
+		return
+	}
+
+	// rather than issuing a token right away, send a single-use login
+	// code to the address so that the caller has to prove they own it
+	code, err := generateRandomToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create login code"}`)
+		return
+	}
+	ttl := lifetime(env.loginCodeTTL, defaultLoginCodeTTL)
+	err = env.db.AddLoginCode(hashToken(code), email, time.Now().Add(ttl))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't create login code"}`)
+		return
+	}
+
+	msg := &mailer.Message{
+		To:      email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Use this link to log in. It will expire in %s and can only be used once.\n\n%s?code=%s\n",
+			ttl, env.loginURL, url.QueryEscape(code)),
+	}
+	err = env.mailer.Send(msg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't send login code"}`)
+		return
+	}
+
+	// the same response is sent whether or not the email address
+	// belongs to a registered user
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, `{"status": "login code sent"}`)
+}
+
+func (env *Env) verifyLoginCodeHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// get form values
+	err := r.ParseForm()
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "Couldn't create token"}`)
+		fmt.Fprintf(w, `{"error": "Couldn't parse form"}`)
+		return
+	}
+	code := r.Form.Get("code")
+	if code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply login code in verify request"}`)
+		return
+	}
+	scope, ok := requestedScope(w, r)
+	if !ok {
 		return
 	}
 
-	// output as JSON
-	fmt.Fprintf(w, `{"token": "%s"}`, tknString)
+	// exchange the code for the email address it was sent to
+	email, err := env.db.ConsumeLoginCode(hashToken(code), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired login code"}`)
+		return
+	}
+
+	env.completeLogin(w, r, email, scope)
+}
+
+func (env *Env) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// get form values
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Couldn't parse form"}`)
+		return
+	}
+	rtString := r.Form.Get("refresh_token")
+	if rtString == "" && env.sessionMode {
+		// browsers send the refresh token as a cookie instead, which
+		// needs the same CSRF protection as any other cookie
+		if cookie, err := r.Cookie(refreshCookieName); err == nil {
+			if !checkCSRF(r) {
+				sendCSRFFail(w)
+				return
+			}
+			rtString = cookie.Value
+		}
+	}
+	if rtString == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Must supply refresh_token in refresh request"}`)
+		return
+	}
+	scope, ok := requestedScope(w, r)
+	if !ok {
+		return
+	}
+
+	// a refreshed token can be narrowed further, but never widened beyond
+	// what its family was narrowed to; check before using up the token
+	rtHash := hashToken(rtString)
+	if prev, err := env.db.GetRefreshToken(rtHash); err == nil && !scopeWithin(scope, prev.Scope) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "invalid_scope", "error_description": "scope exceeds that of refresh token"}`)
+		return
+	}
+
+	// each refresh token can be used exactly once
+	rt, err := env.db.UseRefreshToken(rtHash)
+	if err != nil {
+		// if the token was already used, then it has been replayed and may
+		// have been stolen, so revoke every token descended from its login
+		if prev, err := env.db.GetRefreshToken(rtHash); err == nil && prev.Used {
+			env.db.DeleteRefreshTokenFamily(prev.FamilyID)
+			env.db.DeleteSession(prev.Email, prev.FamilyID)
+			env.revocations.recordSessionEnded(prev.FamilyID, time.Now())
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired refresh token"}`)
+		return
+	}
+	if !time.Now().Before(rt.Expires) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error": "Invalid or expired refresh token"}`)
+		return
+	}
+
+	// rotate: issue a new refresh token in the same family
+	if scope == "" {
+		scope = rt.Scope
+	}
+	env.writeTokens(w, r, rt.Email, rt.FamilyID, scope, rt.MFA)
+}
+
+func (env *Env) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	// send JSON responses
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// pull token details from context
+	ctxCheck := r.Context().Value(tokenContextKey(0))
+	if ctxCheck == nil {
+		sendAuthFail(w)
+		return
+	}
+	ti := ctxCheck.(*tokenInfo)
+	if ti.APIKeyID != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "API keys are revoked through /me/apikeys, not logged out"}`)
+		return
+	}
+
+	// revoke the token that was used for this request
+	err := env.db.AddRevokedToken(ti.ID, ti.Expires)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Couldn't revoke token"}`)
+		return
+	}
+	env.revocations.recordRevokedToken(ti.ID, ti.Expires)
+
+	// end the session that the token belongs to, so that its refresh
+	// tokens can't be used to log back in
+	if ti.SessionID != "" {
+		env.db.DeleteRefreshTokenFamily(ti.SessionID)
+		env.db.DeleteSession(ti.Email, ti.SessionID)
+		env.revocations.recordSessionEnded(ti.SessionID, time.Now())
+	}
+
+	// if the caller also sent their refresh token, revoke its family too
+	// so that it can't be used to log back in
+	var rtString string
+	if err = r.ParseForm(); err == nil {
+		rtString = r.Form.Get("refresh_token")
+	}
+	if cookie, err := r.Cookie(refreshCookieName); err == nil && rtString == "" {
+		rtString = cookie.Value
+	}
+	if rtString != "" {
+		if rt, err := env.db.GetRefreshToken(hashToken(rtString)); err == nil && rt.Email == ti.Email {
+			env.db.DeleteRefreshTokenFamily(rt.FamilyID)
+			env.db.DeleteSession(rt.Email, rt.FamilyID)
+			env.revocations.recordSessionEnded(rt.FamilyID, time.Now())
+		}
+	}
+	if env.sessionMode {
+		clearSessionCookies(w)
+	}
+
+	fmt.Fprintf(w, `{"status": "logged out"}`)
 }
 
 func sendAuthFail(w http.ResponseWriter) {
@@ -58,17 +467,89 @@ func sendAuthFail(w http.ResponseWriter) {
 	fmt.Fprintf(w, `{"error": "Authorization header with valid Bearer token required"}`)
 }
 
+// allowUserStatus checks that a registered user hasn't been suspended or
+// deactivated. If they have, the appropriate HTTP headers and content are
+// written and false is returned.
+func allowUserStatus(w http.ResponseWriter, user *models.User) bool {
+	switch user.Status {
+	case models.UserSuspended:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "user %s is suspended"}`, user.Email)
+		return false
+	case models.UserDeactivated:
+		// deactivated users' tokens were revoked, so treat any that are
+		// left over the same way
+		sendAuthFail(w)
+		return false
+	}
+	return true
+}
+
 type userContextKey int
 
+// tokenInfo holds details of the validated token for the current request.
+type tokenInfo struct {
+	ID       string
+	Email    string
+	IssuedAt time.Time
+	Expires  time.Time
+	// whether the login passed a second authentication factor
+	MFA bool
+	// scopes that the token grants
+	Scopes []string
+	// the session that the token was issued for; empty for API keys
+	SessionID string
+	// the OAuth2 client that the token was issued to, if any
+	ClientID string
+	// set instead of ID if the request used an API key
+	APIKeyID string
+}
+
+type tokenContextKey int
+
+// claimTime returns the time in the named numeric claim, or the zero
+// time if the claim is missing.
+func claimTime(claims jwt.MapClaims, name string) time.Time {
+	switch v := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0)
+	case json.Number:
+		n, err := v.Int64()
+		if err == nil {
+			return time.Unix(n, 0)
+		}
+	}
+	return time.Time{}
+}
+
 func (env *Env) validateTokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// look for and extract the token from header
 		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" && env.sessionMode {
+			// in session mode, browsers send the token as a cookie
+			// instead, which needs CSRF protection since the browser
+			// sends it automatically
+			if cookie, err := r.Cookie(accessCookieName); err == nil && cookie.Value != "" {
+				if !checkCSRF(r) {
+					sendCSRFFail(w)
+					return
+				}
+				authHeader = "Bearer " + cookie.Value
+			}
+		}
 		if authHeader == "" {
 			sendAuthFail(w)
 			return
 		}
 
+		// API keys for automation are checked separately
+		if strings.HasPrefix(authHeader, "ApiKey ") {
+			env.validateAPIKey(w, r, strings.TrimPrefix(authHeader, "ApiKey "), next)
+			return
+		}
+
 		// check that the auth header has the expected format
 		// e.g. Authorization: Bearer ....
 		if !strings.HasPrefix(authHeader, "Bearer ") {
@@ -78,22 +559,78 @@ func (env *Env) validateTokenMiddleware(next http.HandlerFunc) http.HandlerFunc
 		remainder := strings.TrimPrefix(authHeader, "Bearer ")
 
 		// decrypt and validate the token
-		token, err := jwt.Parse(remainder, func(tkn *jwt.Token) (interface{}, error) {
-			// should this be HMAC when token was signed with HS256?
-			if _, ok := tkn.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Couldn't parse token method")
-			}
-			return []byte(env.jwtSecretKey), nil
-		})
+		token, err := jwt.Parse(remainder, env.getVerificationKey)
 		if err != nil {
 			sendAuthFail(w)
 			return
 		}
 
-		var email string
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			email, ok = claims["email"].(string)
-			if !ok {
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok || !token.Valid {
+			sendAuthFail(w)
+			return
+		}
+
+		// jwt.Parse only checks exp and nbf if they are present, but
+		// every token we issue has them, so require them here
+		now := time.Now().Unix()
+		if !claims.VerifyExpiresAt(now, true) || !claims.VerifyNotBefore(now, true) {
+			sendAuthFail(w)
+			return
+		}
+
+		// tokens issued for other services that share our keys can't be
+		// used here
+		if !claims.VerifyIssuer(env.tokenIssuer(), true) || !claims.VerifyAudience(env.tokenAudience(), true) {
+			sendAuthFail(w)
+			return
+		}
+
+		email, ok := claims["email"].(string)
+		if !ok {
+			sendAuthFail(w)
+			return
+		}
+
+		// and make sure it hasn't been revoked since it was issued
+		jti, ok := claims["jti"].(string)
+		if !ok || jti == "" {
+			sendAuthFail(w)
+			return
+		}
+		ti := &tokenInfo{
+			ID:       jti,
+			Email:    email,
+			IssuedAt: claimTime(claims, "iat"),
+			Expires:  claimTime(claims, "exp"),
+		}
+		ti.MFA, _ = claims["mfa"].(bool)
+		if scope, ok := claims["scope"].(string); ok {
+			ti.Scopes = strings.Fields(scope)
+		}
+		revoked, err := env.revocations.isRevoked(env.db, ti.ID, ti.Email, ti.IssuedAt, ti.Expires, time.Now())
+		if err != nil || revoked {
+			sendAuthFail(w)
+			return
+		}
+
+		// tokens from a session that has since been revoked are no
+		// longer valid either
+		ti.SessionID, _ = claims["sid"].(string)
+		if ti.SessionID != "" {
+			ok, err := env.revocations.isSessionActive(env.db, ti.SessionID, time.Now())
+			if err != nil || !ok {
+				sendAuthFail(w)
+				return
+			}
+		}
+
+		// and likewise for tokens issued to a client that has since been
+		// deleted
+		ti.ClientID, _ = claims["client_id"].(string)
+		if ti.ClientID != "" {
+			ok, err := env.revocations.isClientActive(env.db, ti.ClientID, time.Now())
+			if err != nil || !ok {
 				sendAuthFail(w)
 				return
 			}
@@ -109,10 +646,14 @@ func (env *Env) validateTokenMiddleware(next http.HandlerFunc) http.HandlerFunc
 				IsAdmin: false,
 			}
 		}
+		if !allowUserStatus(w, user) {
+			return
+		}
 
 		// good to go! set context and move on
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, userContextKey(0), user)
+		ctx = context.WithValue(ctx, tokenContextKey(0), ti)
 		next(w, r.WithContext(ctx))
 	})
 }
@@ -8,8 +8,10 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/swinslow/containerapp/api/mailer"
 	"github.com/swinslow/containerapp/api/models"
 )
 
@@ -17,7 +19,6 @@ func TestCanPostCreateTokenHandler(t *testing.T) {
 	rec := httptest.NewRecorder()
 	// send as URL-encoded form data b/c that's what'll happen
 	// in the OAuth token workflow
-	// for now, though, we'll just trust whatever email address they send
 	data := url.Values{}
 	data.Set("email", "janedoe@example.com")
 	req, err := http.NewRequest("POST", "/oauth/getToken", strings.NewReader(data.Encode()))
@@ -28,12 +29,13 @@ func TestCanPostCreateTokenHandler(t *testing.T) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	m := mailer.NewMemoryMailer()
+	env := Env{db: db, keys: newTestKeyring(), mailer: m, loginURL: "http://localhost:3000/verify"}
 	http.HandlerFunc(env.createTokenHandler).ServeHTTP(rec, req)
 
-	// check that we got a 200 (OK)
-	if 200 != rec.Code {
-		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	// check that we got a 202 (Accepted)
+	if 202 != rec.Code {
+		t.Errorf("Expected %d, got %d", 202, rec.Code)
 	}
 
 	// check that content type was application/json
@@ -42,20 +44,63 @@ func TestCanPostCreateTokenHandler(t *testing.T) {
 		t.Errorf("expected %v, got %v", "application/json", header.Get("Content-Type"))
 	}
 
-	// check that a JSON response with a JWT was returned
-	// (we won't currently try to decrypt it, just confirm it exists)
+	// check that a JSON response with a status, and no token, was returned
 	rj := map[string]string{}
 	err = json.Unmarshal([]byte(rec.Body.String()), &rj)
 	if err != nil {
 		t.Fatalf("got non-nil error: %v", err)
 	}
+	if _, ok := rj["status"]; !ok {
+		t.Errorf("expected status, got no status key")
+	}
+	if _, ok := rj["token"]; ok {
+		t.Errorf("expected no token key, got token")
+	}
 
-	if len(rj) != 1 {
-		t.Fatalf("expected len %d, got %d", 1, len(rj))
+	// check that a login code was saved and emailed to the address
+	if len(db.loginCodes) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(db.loginCodes))
+	}
+	msgs := m.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(msgs))
+	}
+	if msgs[0].To != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", msgs[0].To)
+	}
+	code := extractLoginCode(t, msgs[0].Body)
+	lc, ok := db.loginCodes[hashToken(code)]
+	if !ok {
+		t.Fatalf("expected emailed code to match saved code hash")
 	}
+	if lc.email != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", lc.email)
+	}
+}
 
-	if _, ok := rj["token"]; !ok {
-		t.Errorf("expected token, got no token key")
+func TestCreateTokenHandlerNormalizesEmail(t *testing.T) {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("email", "JaneDoe@Example.COM")
+	req := httptest.NewRequest("POST", "/oauth/getToken", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	db := &mockDB{}
+	m := mailer.NewMemoryMailer()
+	env := Env{db: db, keys: newTestKeyring(), mailer: m, loginURL: "http://localhost:3000/verify"}
+	http.HandlerFunc(env.createTokenHandler).ServeHTTP(rec, req)
+	if 202 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 202, rec.Code)
+	}
+
+	// the login code, and so the token, is for the stored form of the email
+	code := extractLoginCode(t, m.Messages()[0].Body)
+	lc, ok := db.loginCodes[hashToken(code)]
+	if !ok {
+		t.Fatalf("expected emailed code to match saved code hash")
+	}
+	if lc.email != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", lc.email)
 	}
 }
 
@@ -67,7 +112,7 @@ func TestCannotGetCreateTokenHandler(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	http.HandlerFunc(env.createTokenHandler).ServeHTTP(rec, req)
 
 	// check that we got a 405
@@ -86,7 +131,7 @@ func TestCannotPostCreateTokenHandlerWithEmptyEmailString(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	http.HandlerFunc(env.createTokenHandler).ServeHTTP(rec, req)
 
 	// check that we got a 400 (Bad Request)
@@ -124,7 +169,7 @@ func TestCannotPostCreateTokenHandlerWithoutEmailValue(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	http.HandlerFunc(env.createTokenHandler).ServeHTTP(rec, req)
 
 	// check that we got a 400 (Bad Request)
@@ -154,6 +199,305 @@ func TestCannotPostCreateTokenHandlerWithoutEmailValue(t *testing.T) {
 	}
 }
 
+// decodeTokenResponse reads a token response from the recorder.
+func decodeTokenResponse(t *testing.T, rec *httptest.ResponseRecorder) *tokenResponse {
+	rj := &tokenResponse{}
+	err := json.Unmarshal([]byte(rec.Body.String()), rj)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if rj.Token == "" {
+		t.Fatalf("expected token, got no token key")
+	}
+	return rj
+}
+
+// parseTestToken parses a token signed with the testing key and returns
+// its claims.
+func parseTestToken(t *testing.T, tokenString string) jwt.MapClaims {
+	token, err := jwt.Parse(tokenString, func(tkn *jwt.Token) (interface{}, error) {
+		return []byte("keyForTesting"), nil
+	})
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return token.Claims.(jwt.MapClaims)
+}
+
+// validClaims returns claims for the given email address that are valid
+// for the next few minutes.
+func validClaims(email string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   defaultTokenIssuer,
+		"aud":   defaultTokenAudience,
+		"email": email,
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"jti":   "jti-" + email,
+	}
+}
+
+// extractLoginCode pulls the login code out of the link in an email body.
+func extractLoginCode(t *testing.T, body string) string {
+	i := strings.Index(body, "?code=")
+	if i == -1 {
+		t.Fatalf("couldn't find login code in %q", body)
+	}
+	code := strings.TrimSpace(body[i+len("?code="):])
+	code, err := url.QueryUnescape(code)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return code
+}
+
+// ===== Route: POST /oauth/verify =====
+
+func TestCanPostVerifyLoginCodeHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "abcdef")
+	req, err := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	db := &mockDB{}
+	db.AddLoginCode(hashToken("abcdef"), "janedoe@example.com", time.Now().Add(time.Minute))
+	env := Env{db: db, keys: newTestKeyring()}
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// check that content type was application/json
+	header := rec.Result().Header
+	if header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected %v, got %v", "application/json", header.Get("Content-Type"))
+	}
+
+	// check that a JSON response with a JWT for the right email was returned
+	rj := decodeTokenResponse(t, rec)
+	claims := parseTestToken(t, rj.Token)
+	if claims["email"] != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", claims["email"])
+	}
+	for _, c := range []string{"exp", "iat", "nbf", "jti"} {
+		if _, ok := claims[c]; !ok {
+			t.Errorf("expected %s claim, got none", c)
+		}
+	}
+
+	// and a refresh token that was saved to the database
+	if rj.RefreshToken == "" {
+		t.Fatalf("expected refresh token, got empty string")
+	}
+	if _, ok := db.refreshTokens[hashToken(rj.RefreshToken)]; !ok {
+		t.Errorf("expected refresh token to be saved, but it wasn't")
+	}
+
+	// and check that the code can't be used again
+	if len(db.loginCodes) != 0 {
+		t.Errorf("expected len %d, got %d", 0, len(db.loginCodes))
+	}
+}
+
+func TestCannotPostVerifyLoginCodeHandlerWithUnknownCode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "wrongcode")
+	req, err := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	db := &mockDB{}
+	db.AddLoginCode(hashToken("abcdef"), "janedoe@example.com", time.Now().Add(time.Minute))
+	env := Env{db: db, keys: newTestKeyring()}
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+
+	// check that we got a 401 (Unauthorized)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+
+	wantBody := `{"error": "Invalid or expired login code"}`
+	if rec.Body.String() != wantBody {
+		t.Errorf("expected %s, got %s", wantBody, rec.Body.String())
+	}
+}
+
+func TestCannotPostVerifyLoginCodeHandlerWithExpiredCode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("code", "abcdef")
+	req, err := http.NewRequest("POST", "/oauth/verify", strings.NewReader(data.Encode()))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	db := &mockDB{}
+	db.AddLoginCode(hashToken("abcdef"), "janedoe@example.com", time.Now().Add(-time.Minute))
+	env := Env{db: db, keys: newTestKeyring()}
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+
+	// check that we got a 401 (Unauthorized)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotPostVerifyLoginCodeHandlerWithoutCode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/oauth/verify", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+
+	// check that we got a 400 (Bad Request)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
+func TestCannotGetVerifyLoginCodeHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/oauth/verify", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	http.HandlerFunc(env.verifyLoginCodeHandler).ServeHTTP(rec, req)
+
+	// check that we got a 405
+	if 405 != rec.Code {
+		t.Errorf("Expected %d, got %d", 405, rec.Code)
+	}
+}
+
+// ===== Route: POST /oauth/refresh =====
+
+func postRefreshToken(env *Env, rtString string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("refresh_token", rtString)
+	req, _ := http.NewRequest("POST", "/oauth/refresh", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(env.refreshTokenHandler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCanPostRefreshTokenHandler(t *testing.T) {
+	db := &mockDB{}
+	db.AddRefreshToken(hashToken("rt1"), "family1", "janedoe@example.com", "", false, time.Now().Add(time.Hour))
+	env := Env{db: db, keys: newTestKeyring()}
+	rec := postRefreshToken(&env, "rt1")
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// check that a new access token and a new refresh token were returned
+	rj := decodeTokenResponse(t, rec)
+	claims := parseTestToken(t, rj.Token)
+	if claims["email"] != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", claims["email"])
+	}
+	if rj.RefreshToken == "" || rj.RefreshToken == "rt1" {
+		t.Fatalf("expected new refresh token, got %q", rj.RefreshToken)
+	}
+
+	// and check that the old one was rotated out within the same family
+	if !db.refreshTokens[hashToken("rt1")].Used {
+		t.Errorf("expected old refresh token to be marked used")
+	}
+	newRT, ok := db.refreshTokens[hashToken(rj.RefreshToken)]
+	if !ok {
+		t.Fatalf("expected new refresh token to be saved, but it wasn't")
+	}
+	if newRT.FamilyID != "family1" {
+		t.Errorf("expected %v, got %v", "family1", newRT.FamilyID)
+	}
+}
+
+func TestCannotReuseRefreshTokenAndFamilyIsRevoked(t *testing.T) {
+	db := &mockDB{}
+	db.AddRefreshToken(hashToken("rt1"), "family1", "janedoe@example.com", "", false, time.Now().Add(time.Hour))
+	db.AddRefreshToken(hashToken("other"), "family2", "johndoe@example.com", "", false, time.Now().Add(time.Hour))
+	env := Env{db: db, keys: newTestKeyring()}
+
+	rec := postRefreshToken(&env, "rt1")
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+	rj := decodeTokenResponse(t, rec)
+
+	// replaying the first refresh token should fail
+	rec = postRefreshToken(&env, "rt1")
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+
+	// and should have revoked the token that replaced it
+	rec = postRefreshToken(&env, rj.RefreshToken)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+
+	// but other families should be unaffected
+	if _, ok := db.refreshTokens[hashToken("other")]; !ok {
+		t.Errorf("expected other family to remain, but it was deleted")
+	}
+}
+
+func TestCannotPostRefreshTokenHandlerWithExpiredToken(t *testing.T) {
+	db := &mockDB{}
+	db.AddRefreshToken(hashToken("rt1"), "family1", "janedoe@example.com", "", false, time.Now().Add(-time.Hour))
+	env := Env{db: db, keys: newTestKeyring()}
+	rec := postRefreshToken(&env, "rt1")
+
+	// check that we got a 401 (Unauthorized)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotPostRefreshTokenHandlerWithUnknownToken(t *testing.T) {
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	rec := postRefreshToken(&env, "unknown")
+
+	// check that we got a 401 (Unauthorized)
+	if 401 != rec.Code {
+		t.Errorf("Expected %d, got %d", 401, rec.Code)
+	}
+}
+
+func TestCannotPostRefreshTokenHandlerWithoutToken(t *testing.T) {
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	rec := postRefreshToken(&env, "")
+
+	// check that we got a 400 (Bad Request)
+	if 400 != rec.Code {
+		t.Errorf("Expected %d, got %d", 400, rec.Code)
+	}
+}
+
 // ===== test middleware =====
 
 // sample handler for testing middleware
@@ -174,9 +518,7 @@ func TestCanValidateTokenMiddleware(t *testing.T) {
 	}
 
 	// create token with testing key and set header
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": "janedoe@example.com",
-	})
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("janedoe@example.com"))
 	tokenString, err := token.SignedString([]byte("keyForTesting"))
 	if err != nil {
 		t.Fatalf("couldn't create token for testing: %v", err)
@@ -184,7 +526,7 @@ func TestCanValidateTokenMiddleware(t *testing.T) {
 	req.Header.Set("Authorization", "Bearer "+tokenString)
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
 	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
 
@@ -213,9 +555,7 @@ func TestCanValidateTokenMiddlewareForUnknownEmailButIDIsZero(t *testing.T) {
 	}
 
 	// create token with testing key and set header
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": "unknown@example.com",
-	})
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("unknown@example.com"))
 	tokenString, err := token.SignedString([]byte("keyForTesting"))
 	if err != nil {
 		t.Fatalf("couldn't create token for testing: %v", err)
@@ -223,7 +563,7 @@ func TestCanValidateTokenMiddlewareForUnknownEmailButIDIsZero(t *testing.T) {
 	req.Header.Set("Authorization", "Bearer "+tokenString)
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
 	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
 
@@ -252,7 +592,7 @@ func TestCannotValidateTokenWithNoAuthHeader(t *testing.T) {
 	}
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
 	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
 
@@ -287,7 +627,7 @@ func TestCannotValidateTokenWithInvalidAuthHeaders(t *testing.T) {
 	req.Header.Set("Authorization", "Bearer BLAHinvalid")
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
 	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
 
@@ -319,9 +659,7 @@ func TestCannotValidateTokenWithNoBearerInHeader(t *testing.T) {
 	}
 
 	// create token with testing key and set header
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": "janedoe@example.com",
-	})
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("janedoe@example.com"))
 	tokenString, err := token.SignedString([]byte("keyForTesting"))
 	if err != nil {
 		t.Fatalf("couldn't create token for testing: %v", err)
@@ -329,7 +667,7 @@ func TestCannotValidateTokenWithNoBearerInHeader(t *testing.T) {
 	req.Header.Set("Authorization", tokenString)
 
 	db := &mockDB{}
-	env := Env{db: db, jwtSecretKey: "keyForTesting"}
+	env := Env{db: db, keys: newTestKeyring()}
 	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
 	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
 
@@ -352,3 +690,194 @@ func TestCannotValidateTokenWithNoBearerInHeader(t *testing.T) {
 		t.Errorf("expected %s, got %s", wantBody, rec.Body.String())
 	}
 }
+
+func TestCannotValidateTokenMiddlewareWithBadTimeClaims(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"expired", jwt.MapClaims{
+			"email": "janedoe@example.com",
+			"nbf":   now.Add(-time.Hour).Unix(),
+			"exp":   now.Add(-time.Minute).Unix(),
+		}},
+		{"not yet valid", jwt.MapClaims{
+			"email": "janedoe@example.com",
+			"nbf":   now.Add(time.Hour).Unix(),
+			"exp":   now.Add(2 * time.Hour).Unix(),
+		}},
+		{"no expiry", jwt.MapClaims{
+			"email": "janedoe@example.com",
+			"nbf":   now.Unix(),
+		}},
+		{"no not-before", jwt.MapClaims{
+			"email": "janedoe@example.com",
+			"exp":   now.Add(time.Hour).Unix(),
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/testRoute", nil)
+			if err != nil {
+				t.Fatalf("got non-nil error: %v", err)
+			}
+
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, tc.claims)
+			tokenString, err := token.SignedString([]byte("keyForTesting"))
+			if err != nil {
+				t.Fatalf("couldn't create token for testing: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tokenString)
+
+			db := &mockDB{}
+			env := Env{db: db, keys: newTestKeyring()}
+			wrappedHandler := env.validateTokenMiddleware(env.testHandler)
+			http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
+
+			confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+		})
+	}
+}
+
+func TestCannotValidateRevokedToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/testRoute", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	claims := validClaims("janedoe@example.com")
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte("keyForTesting"))
+	if err != nil {
+		t.Fatalf("couldn't create token for testing: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+
+	db := &mockDB{}
+	db.AddRevokedToken(claims["jti"].(string), time.Now().Add(time.Hour))
+	env := Env{db: db, keys: newTestKeyring()}
+	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
+	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
+
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+func TestCannotValidateTokenIssuedBeforeUserRevocation(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/testRoute", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("janedoe@example.com"))
+	tokenString, err := token.SignedString([]byte("keyForTesting"))
+	if err != nil {
+		t.Fatalf("couldn't create token for testing: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+
+	db := &mockDB{}
+	db.RevokeTokensForEmail("janedoe@example.com", time.Now())
+	env := Env{db: db, keys: newTestKeyring()}
+	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
+	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
+
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+func TestCannotValidateTokenWithoutID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/testRoute", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	claims := validClaims("janedoe@example.com")
+	delete(claims, "jti")
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte("keyForTesting"))
+	if err != nil {
+		t.Fatalf("couldn't create token for testing: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	wrappedHandler := env.validateTokenMiddleware(env.testHandler)
+	http.HandlerFunc(wrappedHandler).ServeHTTP(rec, req)
+
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+// ===== Route: POST /oauth/logout =====
+
+func TestCanLogoutAndTokenIsRevoked(t *testing.T) {
+	db := &mockDB{}
+	db.AddRefreshToken(hashToken("rt1"), "family1", "janedoe@example.com", "", false, time.Now().Add(time.Hour))
+	env := Env{db: db, keys: newTestKeyring(), revocations: newRevocationCache(time.Minute)}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("janedoe@example.com"))
+	tokenString, err := token.SignedString([]byte("keyForTesting"))
+	if err != nil {
+		t.Fatalf("couldn't create token for testing: %v", err)
+	}
+
+	// check that the token works before logging out, so that a
+	// "not revoked" answer is cached
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/testRoute", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	http.HandlerFunc(env.validateTokenMiddleware(env.testHandler)).ServeHTTP(rec, req)
+	if 200 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 200, rec.Code)
+	}
+
+	// log out, also sending the refresh token
+	rec = httptest.NewRecorder()
+	data := url.Values{}
+	data.Set("refresh_token", "rt1")
+	req, _ = http.NewRequest("POST", "/oauth/logout", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	http.HandlerFunc(env.validateTokenMiddleware(env.logoutHandler)).ServeHTTP(rec, req)
+
+	// check that we got a 200 (OK)
+	if 200 != rec.Code {
+		t.Errorf("Expected %d, got %d", 200, rec.Code)
+	}
+	wantBody := `{"status": "logged out"}`
+	if rec.Body.String() != wantBody {
+		t.Errorf("expected %s, got %s", wantBody, rec.Body.String())
+	}
+
+	// check that the refresh token family was revoked
+	if len(db.refreshTokens) != 0 {
+		t.Errorf("expected len %d, got %d", 0, len(db.refreshTokens))
+	}
+
+	// and that the token no longer works, despite the cached answer
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/testRoute", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	http.HandlerFunc(env.validateTokenMiddleware(env.testHandler)).ServeHTTP(rec, req)
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
+
+func TestCannotLogoutWithoutToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/oauth/logout", nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	db := &mockDB{}
+	env := Env{db: db, keys: newTestKeyring()}
+	// not adding any token to context
+	http.HandlerFunc(env.logoutHandler).ServeHTTP(rec, req)
+
+	confirmRecWasInvalidAuth(t, rec, "Authorization header with valid Bearer token required")
+}
@@ -0,0 +1,16 @@
+// Package mailer defines the interface used to send email messages to
+// users, along with SMTP (production) and in-memory (test) implementations.
+package mailer
+
+// Message describes a single plain-text email message.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer defines the interface to be implemented by mail senders,
+// using either a real mail server (production) or memory (test).
+type Mailer interface {
+	Send(msg *Message) error
+}
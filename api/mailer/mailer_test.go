@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryMailerRecordsSentMessages(t *testing.T) {
+	m := NewMemoryMailer()
+
+	err := m.Send(&Message{To: "janedoe@example.com", Subject: "Hello", Body: "Hi Jane"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	err = m.Send(&Message{To: "johndoe@example.com", Subject: "Hello", Body: "Hi John"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	msgs := m.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(msgs))
+	}
+	if msgs[0].To != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", msgs[0].To)
+	}
+	if msgs[1].Body != "Hi John" {
+		t.Errorf("expected %v, got %v", "Hi John", msgs[1].Body)
+	}
+}
+
+func TestCanFormatMessage(t *testing.T) {
+	msg := &Message{To: "janedoe@example.com", Subject: "Log in", Body: "line 1\nline 2"}
+	body, err := formatMessage("noreply@example.com", msg)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	got := string(body)
+	if !strings.HasPrefix(got, "From: noreply@example.com\r\nTo: janedoe@example.com\r\nSubject: Log in\r\n") {
+		t.Errorf("unexpected headers in %q", got)
+	}
+	if !strings.HasSuffix(got, "\r\n\r\nline 1\r\nline 2") {
+		t.Errorf("unexpected body in %q", got)
+	}
+}
+
+func TestCannotFormatMessageWithNewlineInHeader(t *testing.T) {
+	msg := &Message{To: "janedoe@example.com\r\nBcc: oops@example.com", Subject: "Log in", Body: "hi"}
+	_, err := formatMessage("noreply@example.com", msg)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
@@ -0,0 +1,35 @@
+package mailer
+
+import "sync"
+
+// MemoryMailer keeps sent messages in memory rather than delivering
+// them, so that tests can inspect what would have been sent.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+// NewMemoryMailer returns an empty MemoryMailer.
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{messages: make([]*Message, 0)}
+}
+
+// Send records a copy of the message.
+func (m *MemoryMailer) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sent := *msg
+	m.messages = append(m.messages, &sent)
+	return nil
+}
+
+// Messages returns a slice with all messages sent so far.
+func (m *MemoryMailer) Messages() []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := make([]*Message, len(m.messages))
+	copy(msgs, m.messages)
+	return msgs
+}
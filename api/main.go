@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"syscall"
 
 	gh "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -24,19 +25,32 @@ func main() {
 		log.Panic(err)
 	}
 
+	// reload JWT keys from their files on SIGHUP, for key rotation
+	env.ReloadKeysOnSignal(syscall.SIGHUP)
+
 	// create router and register handlers
 	router := mux.NewRouter()
 
 	env.RegisterHandlers(router)
 
-	// set up CORS
-	headers := []string{"X-Requested-With", "Content-Type", "Authorization"}
-	methods := []string{"GET", "POST", "PUT", "HEAD", "OPTIONS"}
+	// set up CORS; credentials are allowed so that browsers will send
+	// session cookies, which is only safe with an explicit origin list
+	headers := []string{"X-Requested-With", "Content-Type", "Authorization", "X-CSRF-Token"}
+	methods := []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
 	origins := []string{"http://localhost:3000"}
+	if ALLOWEDORIGINS := os.Getenv("ALLOWEDORIGINS"); ALLOWEDORIGINS != "" {
+		origins = handlers.SplitList(ALLOWEDORIGINS)
+		for _, origin := range origins {
+			if origin == "*" {
+				log.Panic("ALLOWEDORIGINS cannot include * when credentials are allowed")
+			}
+		}
+	}
 	cors := gh.CORS(
 		gh.AllowedHeaders(headers),
 		gh.AllowedMethods(methods),
-		gh.AllowedOrigins(origins))
+		gh.AllowedOrigins(origins),
+		gh.AllowCredentials())
 
 	fmt.Println("Listening on :" + WEBPORT)
 	log.Fatal(http.ListenAndServe(":"+WEBPORT, cors(router)))
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// APIKey describes a long-lived key that a user has created for
+// automated access to the API. Only a hash of the key itself is stored.
+// MFA records whether the key was created from a login that passed a
+// second authentication factor. Expires and LastUsed are nil if the key
+// never expires or has never been used.
+type APIKey struct {
+	ID       string     `json:"id"`
+	UserID   uint32     `json:"user_id"`
+	Name     string     `json:"name"`
+	KeyHash  string     `json:"-"`
+	MFA      bool       `json:"mfa"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+// CreateTableAPIKeys creates the apikeys table if it does not already
+// exist.
+func (db *DB) CreateTableAPIKeys() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS apikeys (
+			id TEXT NOT NULL PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			mfa BOOLEAN NOT NULL DEFAULT FALSE,
+			created TIMESTAMP NOT NULL,
+			expires TIMESTAMP,
+			last_used TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// GetAPIKeysForUserID returns a slice with all API keys belonging to the
+// user with the given ID.
+func (db *DB) GetAPIKeysForUserID(userID uint32) ([]*APIKey, error) {
+	rows, err := db.sqldb.Query("SELECT id, user_id, name, mfa, created, expires, last_used FROM apikeys WHERE user_id = $1 ORDER BY created", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*APIKey, 0)
+	for rows.Next() {
+		key := new(APIKey)
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.MFA, &key.Created, &key.Expires, &key.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// AddAPIKey adds an API key to the database.
+func (db *DB) AddAPIKey(key *APIKey) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO apikeys(id, user_id, name, key_hash, mfa, created, expires) VALUES ($1, $2, $3, $4, $5, $6, $7)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(key.ID, key.UserID, key.Name, key.KeyHash, key.MFA, key.Created, key.Expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UseAPIKey looks up the unexpired API key with the given hash, records
+// that it was used now, and returns it. An error is returned if the key
+// is unknown or has expired.
+func (db *DB) UseAPIKey(keyHash string, now time.Time) (*APIKey, error) {
+	key := APIKey{KeyHash: keyHash}
+	err := db.sqldb.QueryRow("UPDATE apikeys SET last_used = $2 WHERE key_hash = $1 AND (expires IS NULL OR expires > $2) RETURNING id, user_id, name, mfa, created, expires, last_used", keyHash, now).
+		Scan(&key.ID, &key.UserID, &key.Name, &key.MFA, &key.Created, &key.Expires, &key.LastUsed)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// DeleteAPIKey deletes the API key with the given ID, if it belongs to
+// the user with the given ID.
+func (db *DB) DeleteAPIKey(userID uint32, id string) error {
+	res, err := db.sqldb.Exec("DELETE FROM apikeys WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("API key %s not found", id)
+	}
+	return nil
+}
+
+// DeleteAPIKeysForUserID deletes every API key belonging to the user
+// with the given ID.
+func (db *DB) DeleteAPIKeysForUserID(userID uint32) error {
+	_, err := db.sqldb.Exec("DELETE FROM apikeys WHERE user_id = $1", userID)
+	return err
+}
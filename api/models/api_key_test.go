@@ -0,0 +1,169 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldGetAPIKeysForUserID(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	expires := created.Add(24 * time.Hour)
+	sentRows := sqlmock.NewRows([]string{"id", "user_id", "name", "mfa", "created", "expires", "last_used"}).
+		AddRow("key1", 8103918, "ci", true, created, expires, nil).
+		AddRow("key2", 8103918, "backup", false, created, nil, created)
+	mock.ExpectQuery(`SELECT id, user_id, name, mfa, created, expires, last_used FROM apikeys WHERE user_id = \$1 ORDER BY created`).
+		WithArgs(8103918).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	keys, err := db.GetAPIKeysForUserID(8103918)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(keys) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(keys))
+	}
+	if keys[0].Name != "ci" {
+		t.Errorf("expected %v, got %v", "ci", keys[0].Name)
+	}
+	if keys[0].Expires == nil || !keys[0].Expires.Equal(expires) {
+		t.Errorf("expected %v, got %v", expires, keys[0].Expires)
+	}
+	if keys[0].LastUsed != nil {
+		t.Errorf("expected nil, got %v", keys[0].LastUsed)
+	}
+	if keys[1].Expires != nil {
+		t.Errorf("expected nil, got %v", keys[1].Expires)
+	}
+}
+
+func TestShouldAddAPIKey(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	regexStmt := `INSERT INTO apikeys\(id, user_id, name, key_hash, mfa, created, expires\)`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("key1", 8103918, "ci", "keyhash", true, created, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddAPIKey(&APIKey{ID: "key1", UserID: 8103918, Name: "ci", KeyHash: "keyhash", MFA: true, Created: created})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldUseAPIKey(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	now := created.Add(time.Hour)
+	sentRows := sqlmock.NewRows([]string{"id", "user_id", "name", "mfa", "created", "expires", "last_used"}).
+		AddRow("key1", 8103918, "ci", true, created, nil, now)
+	mock.ExpectQuery(`UPDATE apikeys SET last_used = \$2 WHERE key_hash = \$1 AND \(expires IS NULL OR expires > \$2\)`).
+		WithArgs("keyhash", now).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	key, err := db.UseAPIKey("keyhash", now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if key.UserID != 8103918 {
+		t.Errorf("expected %v, got %v", 8103918, key.UserID)
+	}
+	if key.LastUsed == nil || !key.LastUsed.Equal(now) {
+		t.Errorf("expected %v, got %v", now, key.LastUsed)
+	}
+}
+
+func TestShouldNotDeleteUnknownAPIKey(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM apikeys WHERE user_id = \$1 AND id = \$2`).
+		WithArgs(8103918, "nokey").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// run the tested function
+	err = db.DeleteAPIKey(8103918, "nokey")
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
+
+func TestShouldDeleteAPIKeysForUserID(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM apikeys WHERE user_id = \$1`).
+		WithArgs(8103918).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// run the tested function
+	err = db.DeleteAPIKeysForUserID(8103918)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
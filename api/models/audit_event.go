@@ -0,0 +1,71 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEvent records a change made to a user's account: who made it
+// (ActorID, which is zero if it wasn't made by a logged-in user), to which
+// user (TargetID), and what the change was.
+type AuditEvent struct {
+	Date     time.Time `json:"date"`
+	ActorID  uint32    `json:"actor_id"`
+	TargetID uint32    `json:"target_id"`
+	Action   string    `json:"action"`
+	Details  string    `json:"details"`
+}
+
+// CreateTableAuditLog creates the auditlog table if it does not already
+// exist.
+func (db *DB) CreateTableAuditLog() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS auditlog (
+			id SERIAL PRIMARY KEY,
+			event_date TIMESTAMP NOT NULL,
+			actor_id INTEGER NOT NULL,
+			target_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			details TEXT NOT NULL
+		)
+	`)
+	return err
+}
+
+// GetAuditEventsForUserID returns a slice with all audit events for
+// changes to the user with the given ID, most recent first.
+func (db *DB) GetAuditEventsForUserID(targetID uint32) ([]*AuditEvent, error) {
+	rows, err := db.sqldb.Query("SELECT event_date, actor_id, target_id, action, details FROM auditlog WHERE target_id = $1 ORDER BY event_date DESC, id DESC", targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*AuditEvent, 0)
+	for rows.Next() {
+		ev := new(AuditEvent)
+		err := rows.Scan(&ev.Date, &ev.ActorID, &ev.TargetID, &ev.Action, &ev.Details)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// AddAuditEvent adds an event to the audit log.
+func (db *DB) AddAuditEvent(ev *AuditEvent) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO auditlog(event_date, actor_id, target_id, action, details) VALUES ($1, $2, $3, $4, $5)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(ev.Date, ev.ActorID, ev.TargetID, ev.Action, ev.Details)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldGetAuditEventsForUserID(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	date := time.Date(2018, time.November, 17, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"event_date", "actor_id", "target_id", "action", "details"}).
+		AddRow(date, 410952, 8103918, "email_changed", "janedoe@example.com to jane@example.com")
+	mock.ExpectQuery(`SELECT event_date, actor_id, target_id, action, details FROM auditlog WHERE target_id = \$1`).
+		WithArgs(8103918).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	events, err := db.GetAuditEventsForUserID(8103918)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(events) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(events))
+	}
+	if events[0].Action != "email_changed" {
+		t.Errorf("expected %v, got %v", "email_changed", events[0].Action)
+	}
+	if events[0].ActorID != 410952 {
+		t.Errorf("expected %v, got %v", 410952, events[0].ActorID)
+	}
+}
+
+func TestShouldAddAuditEvent(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	date := time.Date(2018, time.November, 17, 0, 0, 0, 0, time.UTC)
+	regexStmt := `INSERT INTO auditlog\(event_date, actor_id, target_id, action, details\)`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs(date, 410952, 8103918, "email_changed", "details").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddAuditEvent(&AuditEvent{Date: date, ActorID: 410952, TargetID: 8103918, Action: "email_changed", Details: "details"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Client describes a confidential OAuth2 client, such as another service,
+// that can get tokens with the client_credentials grant. Tokens issued to
+// a client act as the user who registered it, limited to the client's
+// space-separated Scope. Only a hash of the client's secret is stored.
+type Client struct {
+	ID         string    `json:"client_id"`
+	UserID     uint32    `json:"user_id"`
+	Name       string    `json:"name"`
+	SecretHash string    `json:"-"`
+	Scope      string    `json:"scope"`
+	Created    time.Time `json:"created"`
+}
+
+// CreateTableClients creates the oauthclients table if it does not
+// already exist.
+func (db *DB) CreateTableClients() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS oauthclients (
+			id TEXT NOT NULL PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			secret_hash TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			created TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// GetAllClients returns a slice with all registered clients.
+func (db *DB) GetAllClients() ([]*Client, error) {
+	rows, err := db.sqldb.Query("SELECT id, user_id, name, scope, created FROM oauthclients ORDER BY created")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := make([]*Client, 0)
+	for rows.Next() {
+		c := new(Client)
+		err := rows.Scan(&c.ID, &c.UserID, &c.Name, &c.Scope, &c.Created)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// GetClient returns the client with the given ID, including its secret
+// hash.
+func (db *DB) GetClient(id string) (*Client, error) {
+	var c Client
+	err := db.sqldb.QueryRow("SELECT id, user_id, name, secret_hash, scope, created FROM oauthclients WHERE id = $1", id).
+		Scan(&c.ID, &c.UserID, &c.Name, &c.SecretHash, &c.Scope, &c.Created)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// AddClient adds a client to the database.
+func (db *DB) AddClient(c *Client) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO oauthclients(id, user_id, name, secret_hash, scope, created) VALUES ($1, $2, $3, $4, $5, $6)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(c.ID, c.UserID, c.Name, c.SecretHash, c.Scope, c.Created)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteClient deletes the client with the given ID.
+func (db *DB) DeleteClient(id string) error {
+	res, err := db.sqldb.Exec("DELETE FROM oauthclients WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("Client %s not found", id)
+	}
+	return nil
+}
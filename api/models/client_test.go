@@ -0,0 +1,131 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldGetAllClients(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"id", "user_id", "name", "scope", "created"}).
+		AddRow("client1", 914611345, "reports", "history:read", created).
+		AddRow("client2", 914611345, "provisioner", "users:read users:write", created)
+	mock.ExpectQuery(`SELECT id, user_id, name, scope, created FROM oauthclients ORDER BY created`).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	clients, err := db.GetAllClients()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(clients) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(clients))
+	}
+	if clients[1].Scope != "users:read users:write" {
+		t.Errorf("expected %v, got %v", "users:read users:write", clients[1].Scope)
+	}
+}
+
+func TestShouldGetClient(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"id", "user_id", "name", "secret_hash", "scope", "created"}).
+		AddRow("client1", 914611345, "reports", "secrethash", "history:read", created)
+	mock.ExpectQuery(`SELECT id, user_id, name, secret_hash, scope, created FROM oauthclients WHERE id = \$1`).
+		WithArgs("client1").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	c, err := db.GetClient("client1")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if c.SecretHash != "secrethash" {
+		t.Errorf("expected %v, got %v", "secrethash", c.SecretHash)
+	}
+	if c.UserID != 914611345 {
+		t.Errorf("expected %v, got %v", 914611345, c.UserID)
+	}
+}
+
+func TestShouldAddClient(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	regexStmt := `INSERT INTO oauthclients\(id, user_id, name, secret_hash, scope, created\)`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("client1", 914611345, "reports", "secrethash", "history:read", created).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddClient(&Client{ID: "client1", UserID: 914611345, Name: "reports", SecretHash: "secrethash", Scope: "history:read", Created: created})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotDeleteUnknownClient(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM oauthclients WHERE id = \$1`).
+		WithArgs("noclient").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// run the tested function
+	err = db.DeleteClient("noclient")
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
@@ -14,13 +14,98 @@ import (
 type Datastore interface {
 	// Users
 	GetAllUsers() ([]*User, error)
+	QueryUsers(*UserQuery) ([]*User, error)
+	CountUsers(*UserQuery) (int, error)
 	GetUserByID(id uint32) (*User, error)
 	GetUserByEmail(email string) (*User, error)
-	AddUser(uint32, string, string, bool) error
+	GetUsersByEmails([]string) ([]*User, error)
+	AddUser(string, string) (uint32, error)
+	AddUsers([]*User) error
+	UpdateUser(uint32, string, string) error
+	DeleteUser(uint32) error
+	SetUserStatus(uint32, string, time.Time) error
+	GetPasswordHash(string) (string, error)
+	SetPasswordHash(uint32, string) error
+	GetPreferences(uint32) (string, error)
+	UpdateProfile(uint32, string, func(string) (string, error)) error
 	// VisitedPaths
 	GetAllVisitedPaths() ([]*VisitedPath, error)
 	GetAllVisitedPathsForUserID(uint32) ([]*VisitedPath, error)
 	AddVisitedPath(string, time.Time, uint32) error
+	// LoginCodes
+	AddLoginCode(string, string, time.Time) error
+	ConsumeLoginCode(string, time.Time) (string, error)
+	DeleteExpiredLoginCodes(time.Time) error
+	// RefreshTokens
+	AddRefreshToken(string, string, string, string, bool, time.Time) error
+	GetRefreshToken(string) (*RefreshToken, error)
+	UseRefreshToken(string) (*RefreshToken, error)
+	DeleteRefreshTokenFamily(string) error
+	DeleteRefreshTokensForEmail(string) error
+	DeleteExpiredRefreshTokens(time.Time) error
+	// RevokedTokens
+	AddRevokedToken(string, time.Time) error
+	IsTokenRevoked(string) (bool, error)
+	RevokeTokensForEmail(string, time.Time) error
+	GetTokensRevokedBefore(string) (time.Time, error)
+	DeleteExpiredRevocations(time.Time, time.Duration) error
+	// OIDCStates
+	AddOIDCState(string, string, string, string, time.Time) error
+	ConsumeOIDCState(string, time.Time) (*OIDCState, error)
+	DeleteExpiredOIDCStates(time.Time) error
+	// TOTP
+	GetTOTPSecret(uint32) (*TOTPSecret, error)
+	SetTOTPSecret(uint32, string) error
+	ConfirmTOTPSecret(uint32) error
+	UseTOTPStep(uint32, int64) (bool, error)
+	DeleteTOTPSecret(uint32) error
+	SetRecoveryCodes(uint32, []string) error
+	UseRecoveryCode(uint32, string) (bool, error)
+	AddMFAChallenge(string, string, time.Time) error
+	ConsumeMFAChallenge(string, time.Time) (string, error)
+	DeleteExpiredMFAChallenges(time.Time) error
+	// APIKeys
+	GetAPIKeysForUserID(uint32) ([]*APIKey, error)
+	AddAPIKey(*APIKey) error
+	UseAPIKey(string, time.Time) (*APIKey, error)
+	DeleteAPIKey(uint32, string) error
+	DeleteAPIKeysForUserID(uint32) error
+	// AuthFailures
+	RecordAuthFailure(string, time.Time, time.Duration, int, time.Duration) (time.Time, error)
+	GetLockedUntil(string) (time.Time, error)
+	ClearAuthFailures(string) error
+	// Sessions
+	GetSessionsForEmail(string) ([]*Session, error)
+	SetSession(*Session) error
+	TouchSession(string, time.Time) (bool, error)
+	DeleteSession(string, string) error
+	DeleteSessionsForEmail(string) error
+	DeleteExpiredSessions(time.Time) error
+	// Clients
+	GetAllClients() ([]*Client, error)
+	GetClient(string) (*Client, error)
+	AddClient(*Client) error
+	DeleteClient(string) error
+	// Roles
+	GetAllRoles() ([]*Role, error)
+	GetRolesForUserID(uint32) ([]*Role, error)
+	AssignRole(uint32, string) error
+	RevokeRole(uint32, string) error
+	// EmailChanges
+	AddEmailChange(*EmailChange) error
+	ConsumeEmailChange(string, time.Time) (*EmailChange, error)
+	DeleteExpiredEmailChanges(time.Time) error
+	// AuditLog
+	GetAuditEventsForUserID(uint32) ([]*AuditEvent, error)
+	AddAuditEvent(*AuditEvent) error
+	// Invitations
+	GetAllInvitations() ([]*Invitation, error)
+	GetInvitation(string) (*Invitation, error)
+	AddInvitation(*Invitation) error
+	RenewInvitation(string, string, time.Time) error
+	DeleteInvitation(string) error
+	AcceptInvitation(string, string, time.Time) (*Invitation, uint32, error)
+	DeleteExpiredInvitations(time.Time) error
 }
 
 // DB holds the actual database/sql object as well as its related
@@ -56,6 +141,76 @@ func (db *DB) InitDBTables() error {
 		return err
 	}
 
+	err = db.CreateTableLoginCodes()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableRefreshTokens()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableRevokedTokens()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableOIDCStates()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableTOTP()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableRateLimits()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableSessions()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableClients()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableRoles()
+	if err != nil {
+		return err
+	}
+
+	err = db.createInitialAdmin()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableEmailChanges()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableAuditLog()
+	if err != nil {
+		return err
+	}
+
+	err = db.CreateTableInvitations()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
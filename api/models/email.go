@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// InvalidEmailError is returned when an email address can't be
+// normalized.
+type InvalidEmailError struct {
+	Email string
+}
+
+func (e *InvalidEmailError) Error() string {
+	return fmt.Sprintf("Invalid email address %q", e.Email)
+}
+
+// DuplicateEmailError is returned when saving a user whose email address,
+// once normalized, already belongs to another user.
+type DuplicateEmailError struct {
+	Email string
+}
+
+func (e *DuplicateEmailError) Error() string {
+	return fmt.Sprintf("User with email %s already exists", e.Email)
+}
+
+// NormalizeEmail returns the form in which an email address is stored and
+// looked up, so that addresses differing only in case, or in how the
+// domain is written, belong to the same user. The local part is Unicode
+// case folded, and the domain is converted to lowercase ASCII as for a
+// DNS lookup.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", &InvalidEmailError{Email: email}
+	}
+
+	local := norm.NFC.String(cases.Fold().String(email[:at]))
+	domain, err := idna.Lookup.ToASCII(strings.TrimSuffix(email[at+1:], "."))
+	if err != nil || domain == "" {
+		return "", &InvalidEmailError{Email: email}
+	}
+
+	return local + "@" + strings.ToLower(domain), nil
+}
+
+// usersEmailIndex is the unique index on users' normalized emails.
+const usersEmailIndex = "users_email_key"
+
+// checkDuplicateEmail returns a DuplicateEmailError in place of err if it
+// is a violation of usersEmailIndex, or err otherwise.
+func checkDuplicateEmail(err error, email string) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" && pqErr.Constraint == usersEmailIndex {
+		return &DuplicateEmailError{Email: email}
+	}
+	return err
+}
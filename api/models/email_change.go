@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// EmailChange describes a pending change of a user's email address, which
+// only takes effect once the new address is confirmed by following a link
+// sent to it. Only a hash of the link's token is stored. RequestedBy is
+// the ID of the user who asked for the change: the user themselves, or an
+// admin.
+type EmailChange struct {
+	TokenHash   string
+	UserID      uint32
+	NewEmail    string
+	RequestedBy uint32
+	Expires     time.Time
+}
+
+// CreateTableEmailChanges creates the emailchanges table if it does not
+// already exist.
+func (db *DB) CreateTableEmailChanges() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS emailchanges (
+			token_hash TEXT NOT NULL PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			new_email TEXT NOT NULL,
+			requested_by INTEGER NOT NULL,
+			expires TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// AddEmailChange records a pending email change, which can be confirmed
+// until it expires.
+func (db *DB) AddEmailChange(ec *EmailChange) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO emailchanges(token_hash, user_id, new_email, requested_by, expires) VALUES ($1, $2, $3, $4, $5)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(ec.TokenHash, ec.UserID, ec.NewEmail, ec.RequestedBy, ec.Expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConsumeEmailChange removes the pending email change with the given token
+// hash and returns it. As with login codes, it is deleted in the same
+// statement that reads it, so it can only be confirmed once. An error is
+// returned if the change is unknown or has expired as of now.
+func (db *DB) ConsumeEmailChange(tokenHash string, now time.Time) (*EmailChange, error) {
+	ec := EmailChange{TokenHash: tokenHash}
+	err := db.sqldb.QueryRow("DELETE FROM emailchanges WHERE token_hash = $1 RETURNING user_id, new_email, requested_by, expires", tokenHash).
+		Scan(&ec.UserID, &ec.NewEmail, &ec.RequestedBy, &ec.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	if !now.Before(ec.Expires) {
+		return nil, fmt.Errorf("Email change expired at %s", ec.Expires.Format(time.RFC3339))
+	}
+	return &ec, nil
+}
+
+// DeleteExpiredEmailChanges deletes pending email changes that expired
+// as of now without being confirmed.
+func (db *DB) DeleteExpiredEmailChanges(now time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM emailchanges WHERE expires <= $1", now)
+	return err
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldAddEmailChange(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	regexStmt := `INSERT INTO emailchanges\(token_hash, user_id, new_email, requested_by, expires\)`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("abc123hash", 8103918, "jane@example.com", 8103918, expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddEmailChange(&EmailChange{TokenHash: "abc123hash", UserID: 8103918, NewEmail: "jane@example.com", RequestedBy: 8103918, Expires: expires})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldConsumeEmailChange(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"user_id", "new_email", "requested_by", "expires"}).
+		AddRow(8103918, "jane@example.com", 410952, expires)
+	mock.ExpectQuery(`DELETE FROM emailchanges WHERE token_hash = \$1 RETURNING user_id, new_email, requested_by, expires`).
+		WithArgs("abc123hash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	ec, err := db.ConsumeEmailChange("abc123hash", expires.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if ec.NewEmail != "jane@example.com" {
+		t.Errorf("expected %v, got %v", "jane@example.com", ec.NewEmail)
+	}
+	if ec.RequestedBy != 410952 {
+		t.Errorf("expected %v, got %v", 410952, ec.RequestedBy)
+	}
+}
+
+func TestShouldNotConsumeExpiredEmailChange(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"user_id", "new_email", "requested_by", "expires"}).
+		AddRow(8103918, "jane@example.com", 8103918, expires)
+	mock.ExpectQuery(`DELETE FROM emailchanges WHERE token_hash = \$1`).
+		WithArgs("abc123hash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	_, err = db.ConsumeEmailChange("abc123hash", expires)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
+
+func TestShouldDeleteExpiredEmailChanges(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 1, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`DELETE FROM emailchanges WHERE expires <= \$1`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// run the tested function
+	err = db.DeleteExpiredEmailChanges(now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
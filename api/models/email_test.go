@@ -0,0 +1,39 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestCanNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"janedoe@example.com", "janedoe@example.com"},
+		{"  JaneDoe@Example.COM ", "janedoe@example.com"},
+		{"Jane.Doe+Tag@example.com.", "jane.doe+tag@example.com"},
+		{"STRASSE@example.com", "strasse@example.com"},
+		{"ΣΟΦΙΑ@example.com", "σοφια@example.com"},
+		{"user@Bücher.example", "user@xn--bcher-kva.example"},
+		{"user@xn--bcher-kva.example", "user@xn--bcher-kva.example"},
+	}
+	for _, tc := range tests {
+		got, err := NormalizeEmail(tc.email)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %v", tc.email, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expected %v, got %v", tc.want, got)
+		}
+	}
+}
+
+func TestCannotNormalizeInvalidEmail(t *testing.T) {
+	for _, email := range []string{"", "janedoe", "@example.com", "janedoe@", "janedoe@exa mple.com"} {
+		_, err := NormalizeEmail(email)
+		if _, ok := err.(*InvalidEmailError); !ok {
+			t.Errorf("expected InvalidEmailError for %q, got %v", email, err)
+		}
+	}
+}
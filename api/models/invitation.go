@@ -0,0 +1,201 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Invitation describes a pending invitation for someone to become a user,
+// which is accepted by following a link sent to their email address. Only
+// a hash of the link's token is stored. Role is the role that they will
+// be given once they accept, if any, and InvitedBy is the ID of the admin
+// who invited them.
+type Invitation struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role,omitempty"`
+	TokenHash string    `json:"-"`
+	InvitedBy uint32    `json:"invited_by"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// CreateTableInvitations creates the invitations table if it does not
+// already exist.
+func (db *DB) CreateTableInvitations() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS invitations (
+			id TEXT NOT NULL PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			role TEXT NOT NULL DEFAULT '',
+			token_hash TEXT NOT NULL UNIQUE,
+			invited_by INTEGER NOT NULL,
+			created TIMESTAMP NOT NULL,
+			expires TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// GetAllInvitations returns a slice with all pending invitations, whether
+// or not they have expired, oldest first.
+func (db *DB) GetAllInvitations() ([]*Invitation, error) {
+	rows, err := db.sqldb.Query("SELECT id, email, role, invited_by, created, expires FROM invitations ORDER BY created")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invs := make([]*Invitation, 0)
+	for rows.Next() {
+		inv := new(Invitation)
+		err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.Created, &inv.Expires)
+		if err != nil {
+			return nil, err
+		}
+		invs = append(invs, inv)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invs, nil
+}
+
+// GetInvitation returns the pending invitation with the given ID.
+func (db *DB) GetInvitation(id string) (*Invitation, error) {
+	inv := Invitation{ID: id}
+	err := db.sqldb.QueryRow("SELECT email, role, invited_by, created, expires FROM invitations WHERE id = $1", id).
+		Scan(&inv.Email, &inv.Role, &inv.InvitedBy, &inv.Created, &inv.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// AddInvitation adds a pending invitation to the database. Its email
+// should already be normalized; see NormalizeEmail.
+func (db *DB) AddInvitation(inv *Invitation) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO invitations(id, email, role, token_hash, invited_by, created, expires) VALUES ($1, $2, $3, $4, $5, $6, $7)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(inv.ID, inv.Email, inv.Role, inv.TokenHash, inv.InvitedBy, inv.Created, inv.Expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RenewInvitation replaces the token hash and expiry of the pending
+// invitation with the given ID, so that a new link can be sent and any
+// earlier one stops working.
+func (db *DB) RenewInvitation(id string, tokenHash string, expires time.Time) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("UPDATE invitations SET token_hash = $1, expires = $2 WHERE id = $3")
+	if err != nil {
+		return err
+	}
+	res, err := stmt.Exec(tokenHash, expires, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("Invitation %s not found", id)
+	}
+	return nil
+}
+
+// DeleteInvitation deletes the pending invitation with the given ID.
+func (db *DB) DeleteInvitation(id string) error {
+	res, err := db.sqldb.Exec("DELETE FROM invitations WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("Invitation %s not found", id)
+	}
+	return nil
+}
+
+// InvalidInvitationError is returned when accepting an invitation that
+// is unknown or has expired.
+type InvalidInvitationError struct {
+	Reason string
+}
+
+func (e *InvalidInvitationError) Error() string {
+	return e.Reason
+}
+
+// AcceptInvitation removes the pending invitation with the given token
+// hash, and adds a user with the given name for it, with the invitation's
+// role if it has one. This is done in a single transaction, so that the
+// invitation can only be accepted once, but is kept if the user can't be
+// added. The invitation and the new user's ID are returned. An
+// InvalidInvitationError is returned if the invitation is unknown or has
+// expired as of now, and a DuplicateEmailError if a user with its email
+// already exists.
+func (db *DB) AcceptInvitation(tokenHash string, name string, now time.Time) (*Invitation, uint32, error) {
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	inv := Invitation{TokenHash: tokenHash}
+	err = tx.QueryRow("DELETE FROM invitations WHERE token_hash = $1 RETURNING id, email, role, invited_by, created, expires", tokenHash).
+		Scan(&inv.ID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.Created, &inv.Expires)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, 0, &InvalidInvitationError{Reason: "Invitation not found"}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	if !now.Before(inv.Expires) {
+		tx.Rollback()
+		return nil, 0, &InvalidInvitationError{Reason: fmt.Sprintf("Invitation expired at %s", inv.Expires.Format(time.RFC3339))}
+	}
+
+	stmt, err := tx.Prepare(insertUserStmt)
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	id, err := insertUser(stmt, inv.Email, name)
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	if inv.Role != "" {
+		_, err = tx.Exec("INSERT INTO user_roles(user_id, role) VALUES ($1, $2)", id, inv.Role)
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, 0, err
+	}
+	return &inv, id, nil
+}
+
+// DeleteExpiredInvitations deletes invitations that expired at or before
+// the given time without being accepted.
+func (db *DB) DeleteExpiredInvitations(before time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM invitations WHERE expires <= $1", before)
+	return err
+}
@@ -0,0 +1,278 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldGetAllInvitations(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.November, 11, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"id", "email", "role", "invited_by", "created", "expires"}).
+		AddRow("a1b2c3", "steve@example.com", "", 8103918, created, expires).
+		AddRow("d4e5f6", "alice@example.com", "auditor", 8103918, created, expires)
+	mock.ExpectQuery(`SELECT id, email, role, invited_by, created, expires FROM invitations ORDER BY created`).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	invs, err := db.GetAllInvitations()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(invs) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(invs))
+	}
+	if invs[1].Email != "alice@example.com" || invs[1].Role != "auditor" {
+		t.Errorf("expected alice@example.com as auditor, got %v as %v", invs[1].Email, invs[1].Role)
+	}
+}
+
+func TestShouldAddInvitation(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.November, 11, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	regexStmt := `INSERT INTO invitations\(id, email, role, token_hash, invited_by, created, expires\)`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("a1b2c3", "steve@example.com", "auditor", "abc123hash", 8103918, created, expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddInvitation(&Invitation{ID: "a1b2c3", Email: "steve@example.com", Role: "auditor", TokenHash: "abc123hash", InvitedBy: 8103918, Created: created, Expires: expires})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldRenewInvitation(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.November, 25, 0, 0, 0, 0, time.UTC)
+	regexStmt := `UPDATE invitations SET token_hash = \$1, expires = \$2 WHERE id = \$3`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("def456hash", expires, "a1b2c3").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// run the tested function
+	err = db.RenewInvitation("a1b2c3", "def456hash", expires)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotDeleteUnknownInvitation(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM invitations WHERE id = \$1`).
+		WithArgs("a1b2c3").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// run the tested function
+	err = db.DeleteInvitation("a1b2c3")
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldAcceptInvitation(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.November, 11, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"id", "email", "role", "invited_by", "created", "expires"}).
+		AddRow("a1b2c3", "steve@example.com", "auditor", 8103918, created, expires)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`DELETE FROM invitations WHERE token_hash = \$1 RETURNING id, email, role, invited_by, created, expires`).
+		WithArgs("abc123hash").
+		WillReturnRows(sentRows)
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("steve@example.com", "Steve").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec(`INSERT INTO user_roles\(user_id, role\) VALUES \(\$1, \$2\)`).
+		WithArgs(3, "auditor").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// run the tested function
+	inv, id, err := db.AcceptInvitation("abc123hash", "Steve", expires.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if id != 3 {
+		t.Errorf("expected %v, got %v", 3, id)
+	}
+	if inv.Email != "steve@example.com" {
+		t.Errorf("expected %v, got %v", "steve@example.com", inv.Email)
+	}
+	if inv.Role != "auditor" {
+		t.Errorf("expected %v, got %v", "auditor", inv.Role)
+	}
+}
+
+func TestShouldNotAcceptExpiredInvitation(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.November, 11, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"id", "email", "role", "invited_by", "created", "expires"}).
+		AddRow("a1b2c3", "steve@example.com", "", 8103918, created, expires)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`DELETE FROM invitations WHERE token_hash = \$1`).
+		WithArgs("abc123hash").
+		WillReturnRows(sentRows)
+	mock.ExpectRollback()
+
+	// run the tested function
+	_, _, err = db.AcceptInvitation("abc123hash", "Steve", expires)
+	if _, ok := err.(*InvalidInvitationError); !ok {
+		t.Fatalf("expected InvalidInvitationError, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldKeepInvitationIfUserCannotBeAdded(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.November, 11, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 18, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"id", "email", "role", "invited_by", "created", "expires"}).
+		AddRow("a1b2c3", "steve@example.com", "", 8103918, created, expires)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`DELETE FROM invitations WHERE token_hash = \$1`).
+		WithArgs("abc123hash").
+		WillReturnRows(sentRows)
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("steve@example.com", "Steve").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+	mock.ExpectRollback()
+
+	// run the tested function
+	_, _, err = db.AcceptInvitation("abc123hash", "Steve", expires.Add(-time.Hour))
+	if _, ok := err.(*DuplicateEmailError); !ok {
+		t.Fatalf("expected DuplicateEmailError, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldDeleteExpiredInvitations(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 1, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`DELETE FROM invitations WHERE expires <= \$1`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// run the tested function
+	err = db.DeleteExpiredInvitations(now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// CreateTableLoginCodes creates the logincodes table if it does not
+// already exist. Only a hash of each code is stored, never the code
+// itself.
+func (db *DB) CreateTableLoginCodes() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS logincodes (
+			code_hash TEXT NOT NULL PRIMARY KEY,
+			email TEXT NOT NULL,
+			expires TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// AddLoginCode records an outstanding login code for the given email
+// address, which can be used until the expiration time.
+func (db *DB) AddLoginCode(codeHash string, email string, expires time.Time) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO logincodes(code_hash, email, expires) VALUES ($1, $2, $3)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(codeHash, email, expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConsumeLoginCode removes the login code with the given hash and returns
+// the email address it was issued for. Because the code is deleted in the
+// same statement that reads it, it can only ever be consumed once. An
+// error is returned if the code is unknown or has expired as of now.
+func (db *DB) ConsumeLoginCode(codeHash string, now time.Time) (string, error) {
+	var email string
+	var expires time.Time
+	err := db.sqldb.QueryRow("DELETE FROM logincodes WHERE code_hash = $1 RETURNING email, expires", codeHash).
+		Scan(&email, &expires)
+	if err != nil {
+		return "", err
+	}
+
+	if !now.Before(expires) {
+		return "", fmt.Errorf("Login code expired at %s", expires.Format(time.RFC3339))
+	}
+	return email, nil
+}
+
+// DeleteExpiredLoginCodes deletes login codes that have expired as of
+// now without being used.
+func (db *DB) DeleteExpiredLoginCodes(now time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM logincodes WHERE expires <= $1", now)
+	return err
+}
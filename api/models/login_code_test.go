@@ -0,0 +1,130 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldAddLoginCode(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.November, 17, 0, 15, 0, 0, time.UTC)
+
+	regexStmt := `[INSERT INTO logincodes(code_hash, email, expires) VALUES (\$1, \$2, \$3)]`
+	mock.ExpectPrepare(regexStmt)
+	stmt := "INSERT INTO logincodes"
+	mock.ExpectExec(stmt).
+		WithArgs("abc123hash", "janedoe@example.com", expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddLoginCode("abc123hash", "janedoe@example.com", expires)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldConsumeLoginCode(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 17, 0, 15, 0, 0, time.UTC)
+
+	sentRows := sqlmock.NewRows([]string{"email", "expires"}).
+		AddRow("janedoe@example.com", expires)
+	mock.ExpectQuery(`[DELETE FROM logincodes WHERE code_hash = \$1 RETURNING email, expires]`).
+		WithArgs("abc123hash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	email, err := db.ConsumeLoginCode("abc123hash", now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	if email != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", email)
+	}
+}
+
+func TestShouldNotConsumeExpiredLoginCode(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 0, 30, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 17, 0, 15, 0, 0, time.UTC)
+
+	sentRows := sqlmock.NewRows([]string{"email", "expires"}).
+		AddRow("janedoe@example.com", expires)
+	mock.ExpectQuery(`[DELETE FROM logincodes WHERE code_hash = \$1 RETURNING email, expires]`).
+		WithArgs("abc123hash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	email, err := db.ConsumeLoginCode("abc123hash", now)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+	if email != "" {
+		t.Errorf("expected empty email, got %v", email)
+	}
+}
+
+func TestShouldDeleteExpiredLoginCodes(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 1, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`DELETE FROM logincodes WHERE expires <= \$1`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	// run the tested function
+	err = db.DeleteExpiredLoginCodes(now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// OIDCState describes a pending OpenID Connect login, from the redirect
+// to the identity provider until the provider redirects back.
+type OIDCState struct {
+	StateHash    string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	Expires      time.Time
+}
+
+// CreateTableOIDCStates creates the oidcstates table if it does not
+// already exist. Only a hash of each state value is stored.
+func (db *DB) CreateTableOIDCStates() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS oidcstates (
+			state_hash TEXT NOT NULL PRIMARY KEY,
+			provider TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			code_verifier TEXT NOT NULL,
+			expires TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// AddOIDCState records a pending login with the given provider, along with
+// the nonce and PKCE code verifier that go with it.
+func (db *DB) AddOIDCState(stateHash string, provider string, nonce string, codeVerifier string, expires time.Time) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO oidcstates(state_hash, provider, nonce, code_verifier, expires) VALUES ($1, $2, $3, $4, $5)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(stateHash, provider, nonce, codeVerifier, expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConsumeOIDCState removes and returns the pending login with the given
+// state hash, so that each state value can only be used once. An error
+// is returned if the state is unknown or has expired as of now.
+func (db *DB) ConsumeOIDCState(stateHash string, now time.Time) (*OIDCState, error) {
+	st := OIDCState{StateHash: stateHash}
+	err := db.sqldb.QueryRow("DELETE FROM oidcstates WHERE state_hash = $1 RETURNING provider, nonce, code_verifier, expires", stateHash).
+		Scan(&st.Provider, &st.Nonce, &st.CodeVerifier, &st.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	if !now.Before(st.Expires) {
+		return nil, fmt.Errorf("Login state expired at %s", st.Expires.Format(time.RFC3339))
+	}
+	return &st, nil
+}
+
+// DeleteExpiredOIDCStates deletes the state of logins through an identity
+// provider that were started but not finished before expiring.
+func (db *DB) DeleteExpiredOIDCStates(now time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM oidcstates WHERE expires <= $1", now)
+	return err
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldAddOIDCState(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.November, 17, 0, 10, 0, 0, time.UTC)
+
+	regexStmt := `[INSERT INTO oidcstates(state_hash, provider, nonce, code_verifier, expires) VALUES (\$1, \$2, \$3, \$4, \$5)]`
+	mock.ExpectPrepare(regexStmt)
+	stmt := "INSERT INTO oidcstates"
+	mock.ExpectExec(stmt).
+		WithArgs("statehash", "corp", "nonce1", "verifier1", expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddOIDCState("statehash", "corp", "nonce1", "verifier1", expires)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldConsumeOIDCState(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 17, 0, 10, 0, 0, time.UTC)
+
+	sentRows := sqlmock.NewRows([]string{"provider", "nonce", "code_verifier", "expires"}).
+		AddRow("corp", "nonce1", "verifier1", expires)
+	mock.ExpectQuery(`DELETE FROM oidcstates WHERE state_hash = \$1`).
+		WithArgs("statehash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	st, err := db.ConsumeOIDCState("statehash", now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if st.Provider != "corp" {
+		t.Errorf("expected %v, got %v", "corp", st.Provider)
+	}
+	if st.Nonce != "nonce1" {
+		t.Errorf("expected %v, got %v", "nonce1", st.Nonce)
+	}
+	if st.CodeVerifier != "verifier1" {
+		t.Errorf("expected %v, got %v", "verifier1", st.CodeVerifier)
+	}
+}
+
+func TestShouldNotConsumeExpiredOIDCState(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 0, 30, 0, 0, time.UTC)
+	expires := time.Date(2018, time.November, 17, 0, 10, 0, 0, time.UTC)
+
+	sentRows := sqlmock.NewRows([]string{"provider", "nonce", "code_verifier", "expires"}).
+		AddRow("corp", "nonce1", "verifier1", expires)
+	mock.ExpectQuery(`DELETE FROM oidcstates WHERE state_hash = \$1`).
+		WithArgs("statehash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	st, err := db.ConsumeOIDCState("statehash", now)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+	if st != nil {
+		t.Errorf("expected nil state, got %v", st)
+	}
+}
+
+func TestShouldDeleteExpiredOIDCStates(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 1, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`DELETE FROM oidcstates WHERE expires <= \$1`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// run the tested function
+	err = db.DeleteExpiredOIDCStates(now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
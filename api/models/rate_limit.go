@@ -0,0 +1,115 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CreateTableRateLimits creates the ratelimits and authfailures tables if
+// they do not already exist. ratelimits holds a token bucket for each
+// rate-limited key, so that limits hold across several api replicas.
+// authfailures counts recent failed logins for each email address, and
+// records when a lockout triggered by them ends.
+func (db *DB) CreateTableRateLimits() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS ratelimits (
+			key TEXT NOT NULL PRIMARY KEY,
+			tokens DOUBLE PRECISION NOT NULL,
+			allowed BOOLEAN NOT NULL,
+			updated TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS authfailures (
+			email TEXT NOT NULL PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			first_failure TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// TakeRateLimitToken refills the token bucket for key as of now, at
+// perSecond tokens per second up to capacity, and then takes a token from
+// it if there is one. It returns whether a token was taken and how many
+// are left. A new bucket starts full. Because it is a single statement,
+// concurrent callers can't take the same token.
+func (db *DB) TakeRateLimitToken(key string, capacity float64, perSecond float64, now time.Time) (bool, float64, error) {
+	var allowed bool
+	var tokens float64
+	err := db.sqldb.QueryRow(`
+		INSERT INTO ratelimits(key, tokens, allowed, updated) VALUES ($1, $2 - 1, $2 >= 1, $4)
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = CASE
+				WHEN LEAST($2, ratelimits.tokens + GREATEST(0, EXTRACT(EPOCH FROM ($4 - ratelimits.updated))) * $3) >= 1
+				THEN LEAST($2, ratelimits.tokens + GREATEST(0, EXTRACT(EPOCH FROM ($4 - ratelimits.updated))) * $3) - 1
+				ELSE LEAST($2, ratelimits.tokens + GREATEST(0, EXTRACT(EPOCH FROM ($4 - ratelimits.updated))) * $3)
+			END,
+			allowed = LEAST($2, ratelimits.tokens + GREATEST(0, EXTRACT(EPOCH FROM ($4 - ratelimits.updated))) * $3) >= 1,
+			updated = $4
+		RETURNING allowed, tokens
+	`, key, capacity, perSecond, now).Scan(&allowed, &tokens)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+// DeleteStaleRateLimits deletes the token buckets that haven't been used
+// since before the given time.
+func (db *DB) DeleteStaleRateLimits(before time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM ratelimits WHERE updated < $1", before)
+	return err
+}
+
+// RecordAuthFailure records a failed login for the given email address.
+// Failures are counted from the first one in the current window; once
+// maxFailures have been counted, the address is locked out for lockout.
+// It returns the time that any lockout ends, or the zero time if there
+// is none.
+func (db *DB) RecordAuthFailure(email string, now time.Time, window time.Duration, maxFailures int, lockout time.Duration) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := db.sqldb.QueryRow(`
+		INSERT INTO authfailures(email, failures, first_failure, locked_until)
+		VALUES ($1, 1, $2, CASE WHEN $4 <= 1 THEN $2 + $5 * INTERVAL '1 second' END)
+		ON CONFLICT (email) DO UPDATE SET
+			failures = CASE WHEN authfailures.first_failure < $2 - $3 * INTERVAL '1 second' THEN 1 ELSE authfailures.failures + 1 END,
+			first_failure = CASE WHEN authfailures.first_failure < $2 - $3 * INTERVAL '1 second' THEN $2 ELSE authfailures.first_failure END,
+			locked_until = CASE
+				WHEN (CASE WHEN authfailures.first_failure < $2 - $3 * INTERVAL '1 second' THEN 1 ELSE authfailures.failures + 1 END) >= $4
+				THEN $2 + $5 * INTERVAL '1 second'
+				ELSE authfailures.locked_until
+			END
+		RETURNING locked_until
+	`, email, now, window.Seconds(), maxFailures, lockout.Seconds()).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+// GetLockedUntil returns the time that the lockout for the given email
+// address ends, or the zero time if it has never been locked out.
+func (db *DB) GetLockedUntil(email string) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := db.sqldb.QueryRow("SELECT locked_until FROM authfailures WHERE email = $1", email).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+// ClearAuthFailures forgets the failed logins for the given email
+// address, after a successful login.
+func (db *DB) ClearAuthFailures(email string) error {
+	_, err := db.sqldb.Exec("DELETE FROM authfailures WHERE email = $1", email)
+	return err
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldTakeRateLimitToken(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"allowed", "tokens"}).AddRow(true, 4.5)
+	mock.ExpectQuery(`INSERT INTO ratelimits`).
+		WithArgs("ip:1.2.3.4", 10.0, 0.5, now).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	allowed, tokens, err := db.TakeRateLimitToken("ip:1.2.3.4", 10, 0.5, now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if !allowed {
+		t.Errorf("expected %v, got %v", true, allowed)
+	}
+	if tokens != 4.5 {
+		t.Errorf("expected %v, got %v", 4.5, tokens)
+	}
+}
+
+func TestShouldRecordAuthFailure(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	lockedUntil := now.Add(15 * time.Minute)
+	sentRows := sqlmock.NewRows([]string{"locked_until"}).AddRow(lockedUntil)
+	mock.ExpectQuery(`INSERT INTO authfailures`).
+		WithArgs("janedoe@example.com", now, 900.0, 5, 900.0).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	got, err := db.RecordAuthFailure("janedoe@example.com", now, 15*time.Minute, 5, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if !got.Equal(lockedUntil) {
+		t.Errorf("expected %v, got %v", lockedUntil, got)
+	}
+}
+
+func TestShouldGetZeroLockedUntilWhenNoFailures(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"locked_until"})
+	mock.ExpectQuery(`SELECT locked_until FROM authfailures WHERE email = \$1`).
+		WithArgs("janedoe@example.com").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	got, err := db.GetLockedUntil("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected zero time, got %v", got)
+	}
+}
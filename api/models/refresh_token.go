@@ -0,0 +1,112 @@
+package models
+
+import "time"
+
+// RefreshToken describes a long-lived token that can be exchanged once for
+// a new access token and a new refresh token. Tokens that descend from the
+// same login share a FamilyID, so that the whole chain can be revoked if
+// an already-used token is presented again. Scope is the space-separated
+// list of scopes that the family was narrowed to, or empty if it wasn't.
+// MFA records whether the login that started the family passed a second
+// authentication factor.
+type RefreshToken struct {
+	TokenHash string
+	FamilyID  string
+	Email     string
+	Scope     string
+	MFA       bool
+	Expires   time.Time
+	Used      bool
+}
+
+// CreateTableRefreshTokens creates the refreshtokens table if it does not
+// already exist. Only a hash of each token is stored, never the token
+// itself.
+func (db *DB) CreateTableRefreshTokens() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS refreshtokens (
+			token_hash TEXT NOT NULL PRIMARY KEY,
+			family_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			scope TEXT NOT NULL DEFAULT '',
+			mfa BOOLEAN NOT NULL DEFAULT FALSE,
+			expires TIMESTAMP NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT FALSE
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// tables created before two-factor authentication was supported won't
+	// have the mfa column yet
+	_, err = db.sqldb.Exec(`ALTER TABLE refreshtokens ADD COLUMN IF NOT EXISTS mfa BOOLEAN NOT NULL DEFAULT FALSE`)
+	if err != nil {
+		return err
+	}
+
+	// nor will tables created before tokens could be narrowed to scopes
+	_, err = db.sqldb.Exec(`ALTER TABLE refreshtokens ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+// AddRefreshToken records a new, unused refresh token.
+func (db *DB) AddRefreshToken(tokenHash string, familyID string, email string, scope string, mfa bool, expires time.Time) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO refreshtokens(token_hash, family_id, email, scope, mfa, expires) VALUES ($1, $2, $3, $4, $5, $6)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(tokenHash, familyID, email, scope, mfa, expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRefreshToken returns the refresh token with the given hash, whether
+// or not it has been used, or nil if not found.
+func (db *DB) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+	var rt RefreshToken
+	err := db.sqldb.QueryRow("SELECT token_hash, family_id, email, scope, mfa, expires, used FROM refreshtokens WHERE token_hash = $1", tokenHash).
+		Scan(&rt.TokenHash, &rt.FamilyID, &rt.Email, &rt.Scope, &rt.MFA, &rt.Expires, &rt.Used)
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// UseRefreshToken marks the unused refresh token with the given hash as
+// used, and returns it. Because the check and the update happen in one
+// statement, only one caller can ever use a given token; any other caller
+// gets an error, as does a caller presenting an unknown token.
+func (db *DB) UseRefreshToken(tokenHash string) (*RefreshToken, error) {
+	rt := RefreshToken{TokenHash: tokenHash, Used: true}
+	err := db.sqldb.QueryRow("UPDATE refreshtokens SET used = TRUE WHERE token_hash = $1 AND used = FALSE RETURNING family_id, email, scope, mfa, expires", tokenHash).
+		Scan(&rt.FamilyID, &rt.Email, &rt.Scope, &rt.MFA, &rt.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// DeleteRefreshTokenFamily deletes every refresh token in the given family.
+func (db *DB) DeleteRefreshTokenFamily(familyID string) error {
+	_, err := db.sqldb.Exec("DELETE FROM refreshtokens WHERE family_id = $1", familyID)
+	return err
+}
+
+// DeleteRefreshTokensForEmail deletes every refresh token issued to the
+// given email address.
+func (db *DB) DeleteRefreshTokensForEmail(email string) error {
+	_, err := db.sqldb.Exec("DELETE FROM refreshtokens WHERE email = $1", email)
+	return err
+}
+
+// DeleteExpiredRefreshTokens deletes the refresh tokens in families where
+// every token has expired as of now. Used tokens in a family that is
+// still live are kept, so that presenting one again can still be caught.
+func (db *DB) DeleteExpiredRefreshTokens(now time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM refreshtokens WHERE family_id NOT IN (SELECT family_id FROM refreshtokens WHERE expires > $1)", now)
+	return err
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldAddRefreshToken(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+
+	regexStmt := `[INSERT INTO refreshtokens(token_hash, family_id, email, scope, mfa, expires) VALUES (\$1, \$2, \$3, \$4, \$5, \$6)]`
+	mock.ExpectPrepare(regexStmt)
+	stmt := "INSERT INTO refreshtokens"
+	mock.ExpectExec(stmt).
+		WithArgs("rthash", "family1", "janedoe@example.com", "history:read", true, expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddRefreshToken("rthash", "family1", "janedoe@example.com", "history:read", true, expires)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldGetRefreshToken(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+
+	sentRows := sqlmock.NewRows([]string{"token_hash", "family_id", "email", "scope", "mfa", "expires", "used"}).
+		AddRow("rthash", "family1", "janedoe@example.com", "", false, expires, true)
+	mock.ExpectQuery(`[SELECT token_hash, family_id, email, scope, mfa, expires, used FROM refreshtokens WHERE token_hash = \$1]`).
+		WithArgs("rthash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	rt, err := db.GetRefreshToken("rthash")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if rt.FamilyID != "family1" {
+		t.Errorf("expected %v, got %v", "family1", rt.FamilyID)
+	}
+	if rt.Email != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", rt.Email)
+	}
+	if rt.Expires != expires {
+		t.Errorf("expected %v, got %v", expires, rt.Expires)
+	}
+	if rt.Used != true {
+		t.Errorf("expected %v, got %v", true, rt.Used)
+	}
+}
+
+func TestShouldUseRefreshToken(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+
+	sentRows := sqlmock.NewRows([]string{"family_id", "email", "scope", "mfa", "expires"}).
+		AddRow("family1", "janedoe@example.com", "history:read", true, expires)
+	mock.ExpectQuery(`UPDATE refreshtokens SET used = TRUE WHERE token_hash = \$1 AND used = FALSE`).
+		WithArgs("rthash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	rt, err := db.UseRefreshToken("rthash")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if rt.TokenHash != "rthash" {
+		t.Errorf("expected %v, got %v", "rthash", rt.TokenHash)
+	}
+	if rt.FamilyID != "family1" {
+		t.Errorf("expected %v, got %v", "family1", rt.FamilyID)
+	}
+	if rt.Email != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", rt.Email)
+	}
+	if rt.Scope != "history:read" {
+		t.Errorf("expected %v, got %v", "history:read", rt.Scope)
+	}
+	if rt.MFA != true {
+		t.Errorf("expected %v, got %v", true, rt.MFA)
+	}
+}
+
+func TestShouldNotUseAlreadyUsedRefreshToken(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	// no rows are updated if the token was already used
+	mock.ExpectQuery(`UPDATE refreshtokens SET used = TRUE WHERE token_hash = \$1 AND used = FALSE`).
+		WithArgs("rthash").
+		WillReturnError(sql.ErrNoRows)
+
+	// run the tested function
+	rt, err := db.UseRefreshToken("rthash")
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+	if rt != nil {
+		t.Errorf("expected nil refresh token, got %v", rt)
+	}
+}
+
+func TestShouldDeleteRefreshTokenFamily(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM refreshtokens WHERE family_id = \$1`).
+		WithArgs("family1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	// run the tested function
+	err = db.DeleteRefreshTokenFamily("family1")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldDeleteRefreshTokensForEmail(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM refreshtokens WHERE email = \$1`).
+		WithArgs("janedoe@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// run the tested function
+	err = db.DeleteRefreshTokensForEmail("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldDeleteExpiredRefreshTokens(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 1, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`DELETE FROM refreshtokens WHERE family_id NOT IN \(SELECT family_id FROM refreshtokens WHERE expires > \$1\)`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	// run the tested function
+	err = db.DeleteExpiredRefreshTokens(now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
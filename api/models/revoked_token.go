@@ -0,0 +1,90 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CreateTableRevokedTokens creates the revokedtokens and userrevocations
+// tables if they do not already exist. revokedtokens holds the IDs (jti)
+// of individual tokens that were revoked before they expired.
+// userrevocations holds, for each email address, a time before which all
+// tokens issued to that address are revoked.
+func (db *DB) CreateTableRevokedTokens() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS revokedtokens (
+			jti TEXT NOT NULL PRIMARY KEY,
+			expires TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS userrevocations (
+			email TEXT NOT NULL PRIMARY KEY,
+			revoked_before TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// AddRevokedToken records that the token with the given ID is revoked.
+// expires is the token's own expiration time, after which the record is
+// no longer needed.
+func (db *DB) AddRevokedToken(jti string, expires time.Time) error {
+	_, err := db.sqldb.Exec("INSERT INTO revokedtokens(jti, expires) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING", jti, expires)
+	return err
+}
+
+// IsTokenRevoked returns whether the token with the given ID is revoked.
+func (db *DB) IsTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := db.sqldb.QueryRow("SELECT EXISTS(SELECT 1 FROM revokedtokens WHERE jti = $1)", jti).Scan(&revoked)
+	if err != nil {
+		return false, err
+	}
+	return revoked, nil
+}
+
+// RevokeTokensForEmail revokes every token that was issued to the given
+// email address at or before the given time. An earlier cutoff never
+// replaces a later one.
+func (db *DB) RevokeTokensForEmail(email string, before time.Time) error {
+	_, err := db.sqldb.Exec(`
+		INSERT INTO userrevocations(email, revoked_before) VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE
+		SET revoked_before = GREATEST(userrevocations.revoked_before, EXCLUDED.revoked_before)
+	`, email, before)
+	return err
+}
+
+// GetTokensRevokedBefore returns the time at or before which all tokens
+// issued to the given email address are revoked, or the zero time if
+// there is none.
+func (db *DB) GetTokensRevokedBefore(email string) (time.Time, error) {
+	var before time.Time
+	err := db.sqldb.QueryRow("SELECT revoked_before FROM userrevocations WHERE email = $1", email).Scan(&before)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return before, nil
+}
+
+// DeleteExpiredRevocations removes revocation records that can no longer
+// matter as of now: revoked tokens that have expired, and per-address
+// cutoffs older than maxTokenAge, since any token issued before then has
+// expired as well.
+func (db *DB) DeleteExpiredRevocations(now time.Time, maxTokenAge time.Duration) error {
+	_, err := db.sqldb.Exec("DELETE FROM revokedtokens WHERE expires < $1", now)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sqldb.Exec("DELETE FROM userrevocations WHERE revoked_before < $1", now.Add(-maxTokenAge))
+	return err
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldAddRevokedToken(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	expires := time.Date(2018, time.November, 17, 0, 15, 0, 0, time.UTC)
+
+	mock.ExpectExec(`INSERT INTO revokedtokens`).
+		WithArgs("jti1", expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AddRevokedToken("jti1", expires)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldCheckIsTokenRevoked(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"exists"}).AddRow(true)
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM revokedtokens WHERE jti = \$1\)`).
+		WithArgs("jti1").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	revoked, err := db.IsTokenRevoked("jti1")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	if revoked != true {
+		t.Errorf("expected %v, got %v", true, revoked)
+	}
+}
+
+func TestShouldRevokeTokensForEmail(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	before := time.Date(2018, time.November, 17, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`INSERT INTO userrevocations`).
+		WithArgs("janedoe@example.com", before).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.RevokeTokensForEmail("janedoe@example.com", before)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldGetTokensRevokedBefore(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	before := time.Date(2018, time.November, 17, 0, 0, 0, 0, time.UTC)
+
+	sentRows := sqlmock.NewRows([]string{"revoked_before"}).AddRow(before)
+	mock.ExpectQuery(`SELECT revoked_before FROM userrevocations WHERE email = \$1`).
+		WithArgs("janedoe@example.com").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	got, err := db.GetTokensRevokedBefore("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	if got != before {
+		t.Errorf("expected %v, got %v", before, got)
+	}
+}
+
+func TestShouldGetZeroTimeIfNoTokensRevokedForEmail(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectQuery(`SELECT revoked_before FROM userrevocations WHERE email = \$1`).
+		WithArgs("janedoe@example.com").
+		WillReturnError(sql.ErrNoRows)
+
+	// run the tested function
+	got, err := db.GetTokensRevokedBefore("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected zero time, got %v", got)
+	}
+}
+
+func TestShouldDeleteExpiredRevocations(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 1, 0, 0, 0, time.UTC)
+	cutoff := time.Date(2018, time.November, 17, 0, 45, 0, 0, time.UTC)
+
+	mock.ExpectExec(`DELETE FROM revokedtokens WHERE expires < \$1`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM userrevocations WHERE revoked_before < \$1`).
+		WithArgs(cutoff).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// run the tested function
+	err = db.DeleteExpiredRevocations(now, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
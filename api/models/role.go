@@ -0,0 +1,221 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Role describes a named set of permissions that can be assigned to
+// users. Permissions is a space-separated list of the scopes that a user
+// holding the role may be granted.
+type Role struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Permissions string `json:"permissions"`
+}
+
+// RoleSuperadmin is the role with every admin permission. Users who hold
+// it are the ones flagged IsAdmin.
+const RoleSuperadmin = "superadmin"
+
+// LastAdminError is returned when a change would leave no active user
+// holding the superadmin role.
+type LastAdminError struct {
+	ID uint32
+}
+
+func (e *LastAdminError) Error() string {
+	return fmt.Sprintf("User %d is the last admin", e.ID)
+}
+
+// refuseLastAdmin returns a LastAdminError if the user with the given ID
+// is the only active admin. It is called within a transaction that is
+// about to stop them from being one, and locks every active admin's rows
+// until that transaction ends, so that two admins removed at the same time
+// can't each see the other as still being there.
+func refuseLastAdmin(tx *sql.Tx, id uint32) error {
+	rows, err := tx.Query("SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = $1 AND users.status = $2 FOR UPDATE", RoleSuperadmin, UserActive)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	admins := 0
+	isAdmin := false
+	for rows.Next() {
+		var adminID uint32
+		err := rows.Scan(&adminID)
+		if err != nil {
+			return err
+		}
+		admins++
+		if adminID == id {
+			isAdmin = true
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if isAdmin && admins <= 1 {
+		return &LastAdminError{ID: id}
+	}
+	return nil
+}
+
+// BuiltinRoles lists the roles that InitDBTables creates, and keeps up to
+// date, in the roles table.
+var BuiltinRoles = []*Role{
+	{
+		Name:        "viewer",
+		Description: "Can list users",
+		Permissions: "users:read",
+	},
+	{
+		Name:        "auditor",
+		Description: "Can read users, visit history, signing keys and clients",
+		Permissions: "history:read users:read keys:read clients:read",
+	},
+	{
+		Name:        "user-manager",
+		Description: "Can read and manage users",
+		Permissions: "users:read users:write",
+	},
+	{
+		Name:        RoleSuperadmin,
+		Description: "Has every admin permission",
+		Permissions: "history:read users:read users:write keys:read keys:write clients:read clients:write",
+	},
+}
+
+// CreateTableRoles creates the roles and user_roles tables if they do not
+// already exist, and adds the built-in roles. Users flagged is_admin before
+// roles existed are given the superadmin role.
+func (db *DB) CreateTableRoles() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS roles (
+			name TEXT NOT NULL PRIMARY KEY,
+			description TEXT NOT NULL,
+			permissions TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS user_roles (
+			user_id INTEGER NOT NULL,
+			role TEXT NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+			PRIMARY KEY (user_id, role)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range BuiltinRoles {
+		_, err = db.sqldb.Exec(`INSERT INTO roles(name, description, permissions) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description, permissions = EXCLUDED.permissions`,
+			role.Name, role.Description, role.Permissions)
+		if err != nil {
+			return err
+		}
+	}
+
+	// from here on, holding the superadmin role is what makes a user an
+	// admin, so is_admin is cleared once it has been copied over
+	_, err = db.sqldb.Exec(`INSERT INTO user_roles(user_id, role) SELECT id, $1 FROM users WHERE is_admin
+		ON CONFLICT (user_id, role) DO NOTHING`, RoleSuperadmin)
+	if err != nil {
+		return err
+	}
+	_, err = db.sqldb.Exec(`UPDATE users SET is_admin = FALSE WHERE is_admin`)
+	return err
+}
+
+// GetAllRoles returns a slice with all roles.
+func (db *DB) GetAllRoles() ([]*Role, error) {
+	rows, err := db.sqldb.Query("SELECT name, description, permissions FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRoles(rows)
+}
+
+// GetRolesForUserID returns a slice with the roles held by the user with
+// the given ID.
+func (db *DB) GetRolesForUserID(userID uint32) ([]*Role, error) {
+	rows, err := db.sqldb.Query(`SELECT roles.name, roles.description, roles.permissions FROM roles
+		JOIN user_roles ON user_roles.role = roles.name WHERE user_roles.user_id = $1 ORDER BY roles.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRoles(rows)
+}
+
+func scanRoles(rows *sql.Rows) ([]*Role, error) {
+	roles := make([]*Role, 0)
+	for rows.Next() {
+		role := new(Role)
+		err := rows.Scan(&role.Name, &role.Description, &role.Permissions)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AssignRole gives the named role to the user with the given ID. Assigning
+// a role that the user already holds does nothing.
+func (db *DB) AssignRole(userID uint32, role string) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO user_roles(user_id, role) VALUES ($1, $2) ON CONFLICT (user_id, role) DO NOTHING")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(userID, role)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeRole takes the named role away from the user with the given ID.
+// A LastAdminError is returned if it is the superadmin role and they are
+// the only active admin.
+func (db *DB) RevokeRole(userID uint32, role string) error {
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	if role == RoleSuperadmin {
+		err = refuseLastAdmin(tx, userID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	res, err := tx.Exec("DELETE FROM user_roles WHERE user_id = $1 AND role = $2", userID, role)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("User %d does not have role %s", userID, role)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldGetRolesForUserID(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"name", "description", "permissions"}).
+		AddRow("auditor", "Can read things", "history:read users:read").
+		AddRow("user-manager", "Can manage users", "users:read users:write")
+	mock.ExpectQuery(`SELECT roles.name, roles.description, roles.permissions FROM roles\s+JOIN user_roles ON user_roles.role = roles.name WHERE user_roles.user_id = \$1`).
+		WithArgs(91461).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	roles, err := db.GetRolesForUserID(91461)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(roles) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(roles))
+	}
+	if roles[1].Permissions != "users:read users:write" {
+		t.Errorf("expected %v, got %v", "users:read users:write", roles[1].Permissions)
+	}
+}
+
+func TestShouldAssignRole(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	regexStmt := `INSERT INTO user_roles\(user_id, role\) VALUES \(\$1, \$2\) ON CONFLICT \(user_id, role\) DO NOTHING`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs(91461, "superadmin").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.AssignRole(91461, "superadmin")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotRevokeRoleNotHeld(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM user_roles WHERE user_id = \$1 AND role = \$2`).
+		WithArgs(91461, "auditor").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	// run the tested function
+	err = db.RevokeRole(91461, "auditor")
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldRevokeSuperadminRoleFromOneOfTwoAdmins(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(91461).AddRow(914611345))
+	mock.ExpectExec(`DELETE FROM user_roles WHERE user_id = \$1 AND role = \$2`).
+		WithArgs(91461, "superadmin").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// run the tested function
+	err = db.RevokeRole(91461, "superadmin")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotRevokeSuperadminRoleFromLastAdmin(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(91461))
+	mock.ExpectRollback()
+
+	// run the tested function
+	err = db.RevokeRole(91461, "superadmin")
+	if _, ok := err.(*LastAdminError); !ok {
+		t.Fatalf("expected LastAdminError, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldMigrateAdminsToSuperadminRole(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS roles`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS user_roles`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, role := range BuiltinRoles {
+		mock.ExpectExec(`INSERT INTO roles\(name, description, permissions\)`).
+			WithArgs(role.Name, role.Description, role.Permissions).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(`INSERT INTO user_roles\(user_id, role\) SELECT id, \$1 FROM users WHERE is_admin`).
+		WithArgs("superadmin").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE users SET is_admin = FALSE WHERE is_admin`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// run the tested function
+	err = db.CreateTableRoles()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Session describes one login by a user, from a particular device. The
+// ID is the family ID shared by the refresh tokens issued for the login,
+// and is carried in the sid claim of its access tokens. LastSeen is
+// updated when one of those tokens is used, though no more often than the
+// api's revocation cache checks the session again.
+type Session struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"-"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+}
+
+// CreateTableSessions creates the sessions table if it does not already
+// exist.
+func (db *DB) CreateTableSessions() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT NOT NULL PRIMARY KEY,
+			email TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			created TIMESTAMP NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			expires TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// GetSessionsForEmail returns a slice with all sessions for the given
+// email address, most recently seen first.
+func (db *DB) GetSessionsForEmail(email string) ([]*Session, error) {
+	rows, err := db.sqldb.Query("SELECT id, email, user_agent, ip, created, last_seen, expires FROM sessions WHERE email = $1 ORDER BY last_seen DESC", email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*Session, 0)
+	for rows.Next() {
+		s := new(Session)
+		err := rows.Scan(&s.ID, &s.Email, &s.UserAgent, &s.IP, &s.Created, &s.LastSeen, &s.Expires)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// SetSession records a new session, or if a session with the same ID
+// already exists (because its refresh token has been rotated), updates
+// where it was last seen from and when it expires.
+func (db *DB) SetSession(s *Session) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare(`INSERT INTO sessions(id, email, user_agent, ip, created, last_seen, expires) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET user_agent = EXCLUDED.user_agent, ip = EXCLUDED.ip, last_seen = EXCLUDED.last_seen, expires = EXCLUDED.expires`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(s.ID, s.Email, s.UserAgent, s.IP, s.Created, s.LastSeen, s.Expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TouchSession records that the session with the given ID was seen now,
+// and reports whether it still exists and has not expired.
+func (db *DB) TouchSession(id string, now time.Time) (bool, error) {
+	res, err := db.sqldb.Exec("UPDATE sessions SET last_seen = $2 WHERE id = $1 AND expires > $2", id, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteSession deletes the session with the given ID, if it belongs to
+// the given email address.
+func (db *DB) DeleteSession(email string, id string) error {
+	res, err := db.sqldb.Exec("DELETE FROM sessions WHERE email = $1 AND id = $2", email, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("Session %s not found", id)
+	}
+	return nil
+}
+
+// DeleteSessionsForEmail deletes every session for the given email
+// address.
+func (db *DB) DeleteSessionsForEmail(email string) error {
+	_, err := db.sqldb.Exec("DELETE FROM sessions WHERE email = $1", email)
+	return err
+}
+
+// DeleteExpiredSessions deletes sessions whose refresh tokens have all
+// expired as of now.
+func (db *DB) DeleteExpiredSessions(now time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM sessions WHERE expires <= $1", now)
+	return err
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldGetSessionsForEmail(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	expires := created.Add(24 * time.Hour)
+	sentRows := sqlmock.NewRows([]string{"id", "email", "user_agent", "ip", "created", "last_seen", "expires"}).
+		AddRow("fam1", "johndoe@example.com", "Firefox", "192.0.2.1", created, created.Add(time.Hour), expires).
+		AddRow("fam2", "johndoe@example.com", "curl", "192.0.2.2", created, created, expires)
+	mock.ExpectQuery(`SELECT id, email, user_agent, ip, created, last_seen, expires FROM sessions WHERE email = \$1 ORDER BY last_seen DESC`).
+		WithArgs("johndoe@example.com").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	sessions, err := db.GetSessionsForEmail("johndoe@example.com")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(sessions) != 2 {
+		t.Fatalf("expected len %d, got %d", 2, len(sessions))
+	}
+	if sessions[0].UserAgent != "Firefox" {
+		t.Errorf("expected %v, got %v", "Firefox", sessions[0].UserAgent)
+	}
+	if sessions[1].IP != "192.0.2.2" {
+		t.Errorf("expected %v, got %v", "192.0.2.2", sessions[1].IP)
+	}
+}
+
+func TestShouldSetSession(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	created := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	expires := created.Add(24 * time.Hour)
+	regexStmt := `INSERT INTO sessions\(id, email, user_agent, ip, created, last_seen, expires\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6, \$7\)\s+ON CONFLICT \(id\) DO UPDATE`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("fam1", "johndoe@example.com", "Firefox", "192.0.2.1", created, created, expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.SetSession(&Session{
+		ID:        "fam1",
+		Email:     "johndoe@example.com",
+		UserAgent: "Firefox",
+		IP:        "192.0.2.1",
+		Created:   created,
+		LastSeen:  created,
+		Expires:   expires,
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldTouchSession(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec(`UPDATE sessions SET last_seen = \$2 WHERE id = \$1 AND expires > \$2`).
+		WithArgs("fam1", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE sessions SET last_seen = \$2 WHERE id = \$1 AND expires > \$2`).
+		WithArgs("gone", now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// run the tested function
+	ok, err := db.TouchSession("fam1", now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !ok {
+		t.Errorf("expected true, got false")
+	}
+	ok, err = db.TouchSession("gone", now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if ok {
+		t.Errorf("expected false, got true")
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotDeleteUnknownSession(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM sessions WHERE email = \$1 AND id = \$2`).
+		WithArgs("johndoe@example.com", "nosession").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// run the tested function
+	err = db.DeleteSession("johndoe@example.com", "nosession")
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
@@ -0,0 +1,204 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TOTPSecret describes a user's enrollment in TOTP two-factor
+// authentication. An enrollment is not used to protect logins until the
+// user has Confirmed it by entering a code from their authenticator app.
+// LastStep is the most recent time step whose code has been accepted, so
+// that no code can be used twice.
+type TOTPSecret struct {
+	UserID    uint32
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+}
+
+// CreateTableTOTP creates the totpsecrets, recoverycodes and mfachallenges
+// tables if they do not already exist. Only hashes of recovery codes and
+// challenge tokens are stored.
+func (db *DB) CreateTableTOTP() error {
+	_, err := db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS totpsecrets (
+			user_id INTEGER NOT NULL PRIMARY KEY,
+			secret TEXT NOT NULL,
+			confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+			last_step BIGINT NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS recoverycodes (
+			code_hash TEXT NOT NULL PRIMARY KEY,
+			user_id INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sqldb.Exec(`
+		CREATE TABLE IF NOT EXISTS mfachallenges (
+			token_hash TEXT NOT NULL PRIMARY KEY,
+			email TEXT NOT NULL,
+			expires TIMESTAMP NOT NULL
+		)
+	`)
+	return err
+}
+
+// GetTOTPSecret returns the TOTP enrollment for the user with the given
+// ID, or nil if the user has not enrolled.
+func (db *DB) GetTOTPSecret(userID uint32) (*TOTPSecret, error) {
+	ts := TOTPSecret{UserID: userID}
+	err := db.sqldb.QueryRow("SELECT secret, confirmed, last_step FROM totpsecrets WHERE user_id = $1", userID).
+		Scan(&ts.Secret, &ts.Confirmed, &ts.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ts, nil
+}
+
+// SetTOTPSecret starts a new, unconfirmed TOTP enrollment for the user
+// with the given ID, replacing any earlier one.
+func (db *DB) SetTOTPSecret(userID uint32, secret string) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare(`
+		INSERT INTO totpsecrets(user_id, secret, confirmed, last_step) VALUES ($1, $2, FALSE, 0)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = FALSE, last_step = 0
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(userID, secret)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConfirmTOTPSecret marks the user's TOTP enrollment as confirmed.
+func (db *DB) ConfirmTOTPSecret(userID uint32) error {
+	_, err := db.sqldb.Exec("UPDATE totpsecrets SET confirmed = TRUE WHERE user_id = $1", userID)
+	return err
+}
+
+// UseTOTPStep records that the code for the given time step has been
+// accepted for the user. It returns false if that step, or a later one,
+// was already used; because the check and the update happen in one
+// statement, a code can only ever be accepted once.
+func (db *DB) UseTOTPStep(userID uint32, step int64) (bool, error) {
+	res, err := db.sqldb.Exec("UPDATE totpsecrets SET last_step = $2 WHERE user_id = $1 AND last_step < $2", userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// DeleteTOTPSecret removes the user's TOTP enrollment and recovery codes.
+func (db *DB) DeleteTOTPSecret(userID uint32) error {
+	_, err := db.sqldb.Exec("DELETE FROM totpsecrets WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	_, err = db.sqldb.Exec("DELETE FROM recoverycodes WHERE user_id = $1", userID)
+	return err
+}
+
+// SetRecoveryCodes replaces the user's recovery codes with the ones with
+// the given hashes.
+func (db *DB) SetRecoveryCodes(userID uint32, codeHashes []string) error {
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recoverycodes WHERE user_id = $1", userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO recoverycodes(code_hash, user_id) VALUES ($1, $2)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, h := range codeHashes {
+		_, err = stmt.Exec(h, userID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode removes the user's recovery code with the given hash,
+// so that it can only be used once. It returns false if the user has no
+// such code.
+func (db *DB) UseRecoveryCode(userID uint32, codeHash string) (bool, error) {
+	res, err := db.sqldb.Exec("DELETE FROM recoverycodes WHERE user_id = $1 AND code_hash = $2", userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// AddMFAChallenge records that the user with the given email address has
+// passed the first step of logging in, and may complete it with a second
+// factor until the expiration time.
+func (db *DB) AddMFAChallenge(tokenHash string, email string, expires time.Time) error {
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("INSERT INTO mfachallenges(token_hash, email, expires) VALUES ($1, $2, $3)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(tokenHash, email, expires)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConsumeMFAChallenge removes the challenge with the given hash and
+// returns the email address it was issued for, so that each challenge
+// allows only one attempt at the second factor. An error is returned if
+// the challenge is unknown or has expired as of now.
+func (db *DB) ConsumeMFAChallenge(tokenHash string, now time.Time) (string, error) {
+	var email string
+	var expires time.Time
+	err := db.sqldb.QueryRow("DELETE FROM mfachallenges WHERE token_hash = $1 RETURNING email, expires", tokenHash).
+		Scan(&email, &expires)
+	if err != nil {
+		return "", err
+	}
+
+	if !now.Before(expires) {
+		return "", fmt.Errorf("MFA challenge expired at %s", expires.Format(time.RFC3339))
+	}
+	return email, nil
+}
+
+// DeleteExpiredMFAChallenges deletes challenges that expired as of now
+// without the second factor being given.
+func (db *DB) DeleteExpiredMFAChallenges(now time.Time) error {
+	_, err := db.sqldb.Exec("DELETE FROM mfachallenges WHERE expires <= $1", now)
+	return err
+}
@@ -0,0 +1,285 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestShouldGetTOTPSecret(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"secret", "confirmed", "last_step"}).
+		AddRow("JBSWY3DPEHPK3PXP", true, 51234567)
+	mock.ExpectQuery(`SELECT secret, confirmed, last_step FROM totpsecrets WHERE user_id = \$1`).
+		WithArgs(8103918).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	ts, err := db.GetTOTPSecret(8103918)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if ts.Secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("expected %v, got %v", "JBSWY3DPEHPK3PXP", ts.Secret)
+	}
+	if ts.Confirmed != true {
+		t.Errorf("expected %v, got %v", true, ts.Confirmed)
+	}
+	if ts.LastStep != 51234567 {
+		t.Errorf("expected %v, got %v", 51234567, ts.LastStep)
+	}
+}
+
+func TestShouldGetNilTOTPSecretWhenNotEnrolled(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"secret", "confirmed", "last_step"})
+	mock.ExpectQuery(`SELECT secret, confirmed, last_step FROM totpsecrets WHERE user_id = \$1`).
+		WithArgs(8103918).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	ts, err := db.GetTOTPSecret(8103918)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if ts != nil {
+		t.Errorf("expected nil, got %v", ts)
+	}
+}
+
+func TestShouldSetTOTPSecret(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectPrepare("INSERT INTO totpsecrets")
+	mock.ExpectExec("INSERT INTO totpsecrets").
+		WithArgs(8103918, "JBSWY3DPEHPK3PXP").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// run the tested function
+	err = db.SetTOTPSecret(8103918, "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldUseTOTPStepOnlyOnce(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	stmt := `UPDATE totpsecrets SET last_step = \$2 WHERE user_id = \$1 AND last_step < \$2`
+	mock.ExpectExec(stmt).
+		WithArgs(8103918, 51234567).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(stmt).
+		WithArgs(8103918, 51234567).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// run the tested function
+	ok, err := db.UseTOTPStep(8103918, 51234567)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+	ok, err = db.UseTOTPStep(8103918, 51234567)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldSetRecoveryCodes(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM recoverycodes WHERE user_id = \$1`).
+		WithArgs(8103918).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectPrepare("INSERT INTO recoverycodes")
+	mock.ExpectExec("INSERT INTO recoverycodes").
+		WithArgs("hash1", 8103918).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO recoverycodes").
+		WithArgs("hash2", 8103918).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// run the tested function
+	err = db.SetRecoveryCodes(8103918, []string{"hash1", "hash2"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldUseRecoveryCode(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectExec(`DELETE FROM recoverycodes WHERE user_id = \$1 AND code_hash = \$2`).
+		WithArgs(8103918, "hash1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// run the tested function
+	ok, err := db.UseRecoveryCode(8103918, "hash1")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldConsumeMFAChallenge(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"email", "expires"}).
+		AddRow("janedoe@example.com", now.Add(time.Minute))
+	mock.ExpectQuery(`DELETE FROM mfachallenges WHERE token_hash = \$1`).
+		WithArgs("mfahash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	email, err := db.ConsumeMFAChallenge("mfahash", now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if email != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", email)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotConsumeExpiredMFAChallenge(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	sentRows := sqlmock.NewRows([]string{"email", "expires"}).
+		AddRow("janedoe@example.com", now.Add(-time.Minute))
+	mock.ExpectQuery(`DELETE FROM mfachallenges WHERE token_hash = \$1`).
+		WithArgs("mfahash").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	_, err = db.ConsumeMFAChallenge("mfahash", now)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
+
+func TestShouldDeleteExpiredMFAChallenges(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	now := time.Date(2018, time.November, 17, 1, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`DELETE FROM mfachallenges WHERE expires <= \$1`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// run the tested function
+	err = db.DeleteExpiredMFAChallenges(now)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -1,16 +1,58 @@
 package models
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
-// User describes a registered user of the platform.
+// User describes a registered user of the platform. Users start out
+// active; suspended users can't use the API until they are reactivated,
+// and deactivated users are also hidden from GetAllUsers, but their rows
+// are kept so that their visit history stays attributable to them.
 type User struct {
-	ID      uint32 `json:"id"`
-	Email   string `json:"email"`
-	Name    string `json:"name"`
-	IsAdmin bool   `json:"is_admin"`
+	ID            uint32     `json:"id"`
+	Email         string     `json:"email"`
+	Name          string     `json:"name"`
+	IsAdmin       bool       `json:"is_admin"`
+	Status        string     `json:"status"`
+	SuspendedAt   *time.Time `json:"suspended_at,omitempty"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+}
+
+// statuses that a user can have
+const (
+	UserActive      = "active"
+	UserSuspended   = "suspended"
+	UserDeactivated = "deactivated"
+)
+
+// isAdminExpr is true for users who hold the superadmin role, which is
+// what makes a user an admin.
+const isAdminExpr = "EXISTS (SELECT 1 FROM user_roles WHERE user_id = users.id AND role = '" + RoleSuperadmin + "')"
+
+// userColumns lists the columns that are scanned into a User by scanUser.
+const userColumns = "id, email, name, " + isAdminExpr + " AS is_admin, status, suspended_at, deactivated_at"
+
+// scanUser scans a row of userColumns into a new User.
+func scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	user := new(User)
+	var suspendedAt, deactivatedAt sql.NullTime
+	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.IsAdmin, &user.Status, &suspendedAt, &deactivatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if suspendedAt.Valid {
+		user.SuspendedAt = &suspendedAt.Time
+	}
+	if deactivatedAt.Valid {
+		user.DeactivatedAt = &deactivatedAt.Time
+	}
+	return user, nil
 }
 
 // CreateTableUsers creates the users table if it does not already exist.
@@ -20,41 +62,307 @@ func (db *DB) CreateTableUsers() error {
 			id INTEGER NOT NULL PRIMARY KEY,
 			email TEXT NOT NULL,
 			name TEXT NOT NULL,
-			is_admin BOOLEAN NOT NULL
+			is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+			password_hash TEXT,
+			preferences TEXT NOT NULL DEFAULT '{}',
+			status TEXT NOT NULL DEFAULT 'active',
+			suspended_at TIMESTAMP,
+			deactivated_at TIMESTAMP
 		)
 	`)
 	if err != nil {
 		return err
 	}
 
-	// if there are no users yet, and if INITIALADMINEMAIL env var
-	// is also set, we'll create an initial administrative user
-	// with ID 1
-	users, err := db.GetAllUsers()
-	if err == nil && len(users) == 0 {
-		INITIALADMINEMAIL := os.Getenv("INITIALADMINEMAIL")
-		if INITIALADMINEMAIL != "" {
-			err = db.AddUser(1, INITIALADMINEMAIL, "", true)
-		}
+	// tables created before passwords were supported won't have the
+	// password_hash column yet
+	_, err = db.sqldb.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT`)
+	if err != nil {
+		return err
+	}
+
+	// nor will tables created before users could be suspended or
+	// deactivated have the status columns
+	_, err = db.sqldb.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active',
+		ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP, ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP`)
+	if err != nil {
+		return err
+	}
+
+	// or the preferences column, from before users could edit their
+	// own profiles
+	_, err = db.sqldb.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS preferences TEXT NOT NULL DEFAULT '{}'`)
+	if err != nil {
+		return err
+	}
+
+	// is_admin is only read once, by CreateTableRoles, to give the
+	// superadmin role to admins from before roles existed; new users
+	// aren't given a value for it
+	_, err = db.sqldb.Exec(`ALTER TABLE users ALTER COLUMN is_admin SET DEFAULT FALSE`)
+	if err != nil {
+		return err
+	}
+
+	// new users are given the next ID from a sequence. users from before
+	// then have random IDs, which the sequence may eventually reach, so
+	// AddUser skips over any IDs that are already taken
+	_, err = db.sqldb.Exec(`CREATE SEQUENCE IF NOT EXISTS users_id_seq AS INTEGER OWNED BY users.id`)
+	if err != nil {
+		return err
+	}
+	_, err = db.sqldb.Exec(`ALTER TABLE users ALTER COLUMN id SET DEFAULT nextval('users_id_seq')`)
+	if err != nil {
+		return err
 	}
 
+	// emails are stored normalized and must be unique, but those saved
+	// before that was enforced may need normalizing first
+	err = db.normalizeEmails()
+	if err != nil {
+		return err
+	}
+	_, err = db.sqldb.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + usersEmailIndex + ` ON users (email)`)
 	return err
 }
 
-// GetAllUsers returns a slice with all registered users.
+// createInitialAdmin creates an initial administrative user, who will get
+// the first ID and the superadmin role, if there are no users yet,
+// deactivated or not, and if the INITIALADMINEMAIL env var is set. The
+// users and roles tables must already exist.
+func (db *DB) createInitialAdmin() error {
+	INITIALADMINEMAIL := os.Getenv("INITIALADMINEMAIL")
+	if INITIALADMINEMAIL == "" {
+		return nil
+	}
+	normalized, err := NormalizeEmail(INITIALADMINEMAIL)
+	if err != nil {
+		return err
+	}
+
+	var n int
+	err = db.sqldb.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	// add the user and their role together, so that a failure can't
+	// leave behind a first user who isn't an admin
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(insertUserStmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id, err := insertUser(stmt, normalized, "")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO user_roles(user_id, role) VALUES ($1, $2)", id, RoleSuperadmin)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// normalizeEmails normalizes the email of every user whose email isn't
+// normalized yet. It fails without changing anything if two users would
+// end up with the same email, since one of them has to be changed or
+// removed by hand first.
+func (db *DB) normalizeEmails() error {
+	rows, err := db.sqldb.Query("SELECT id, email FROM users ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]uint32)
+	updates := make(map[uint32]string)
+	for rows.Next() {
+		var id uint32
+		var email string
+		err := rows.Scan(&id, &email)
+		if err != nil {
+			return err
+		}
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			// can't be looked up anyway, so leave it for an admin to fix
+			normalized = email
+		}
+		if other, ok := owners[normalized]; ok {
+			return fmt.Errorf("Users %d and %d both have email %s once normalized", other, id, normalized)
+		}
+		owners[normalized] = id
+		if normalized != email {
+			updates[id] = normalized
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, email := range updates {
+		_, err = db.sqldb.Exec("UPDATE users SET email = $1 WHERE id = $2", email, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAllUsers returns a slice with all registered users, other than those
+// who have been deactivated.
 func (db *DB) GetAllUsers() ([]*User, error) {
-	rows, err := db.sqldb.Query("SELECT id, email, name, is_admin FROM users ORDER BY id")
+	return db.queryUsers("SELECT "+userColumns+" FROM users WHERE status <> $1 ORDER BY id", UserDeactivated)
+}
+
+// orders in which QueryUsers can sort users
+const (
+	UserSortID    = "id"
+	UserSortName  = "name"
+	UserSortEmail = "email"
+)
+
+// UserQuery describes which users QueryUsers and CountUsers should find.
+// Status limits them to users with that status; if it is empty,
+// deactivated users are left out, as in GetAllUsers. IsAdmin, if set,
+// limits them to admins or to non-admins, and Search to users whose name
+// or email contains it, ignoring case.
+//
+// Users are sorted by Sort, which is one of the UserSort values, and then
+// by ID so that the order is always the same; Desc reverses it. An empty
+// Sort sorts by ID alone. QueryUsers returns at most Limit users, if it
+// is more than zero, starting with the first one after After, if set.
+type UserQuery struct {
+	Status  string
+	IsAdmin *bool
+	Search  string
+	Sort    string
+	Desc    bool
+	After   *UserCursor
+	Limit   int
+}
+
+// UserCursor marks a position among users sorted by a UserQuery: that of
+// the user with the given ID, and with the given value in the column being
+// sorted by. The value is unused when sorting by ID.
+type UserCursor struct {
+	Value string `json:"v,omitempty"`
+	ID    uint32 `json:"id"`
+}
+
+// CursorFor returns the position of the given user among the users sorted
+// by the query.
+func (q *UserQuery) CursorFor(user *User) *UserCursor {
+	switch q.Sort {
+	case UserSortName:
+		return &UserCursor{Value: user.Name, ID: user.ID}
+	case UserSortEmail:
+		return &UserCursor{Value: user.Email, ID: user.ID}
+	default:
+		return &UserCursor{ID: user.ID}
+	}
+}
+
+// likeEscaper escapes the characters that are special in a LIKE pattern,
+// using LIKE's default escape character of backslash.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// filter returns the WHERE clause for the query's filters, not including
+// its cursor, and appends its arguments to args.
+func (q *UserQuery) filter(args *[]interface{}) string {
+	arg := func(v interface{}) string {
+		*args = append(*args, v)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+
+	var conds []string
+	if q.Status == "" {
+		conds = append(conds, "status <> "+arg(UserDeactivated))
+	} else {
+		conds = append(conds, "status = "+arg(q.Status))
+	}
+	if q.IsAdmin != nil {
+		conds = append(conds, isAdminExpr+" = "+arg(*q.IsAdmin))
+	}
+	if q.Search != "" {
+		pattern := arg("%" + likeEscaper.Replace(q.Search) + "%")
+		conds = append(conds, "(name ILIKE "+pattern+" OR email ILIKE "+pattern+")")
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// QueryUsers returns a slice with the registered users who match the
+// query, sorted as it asks; see UserQuery. The filtering, sorting and
+// paging is all done by the database.
+func (db *DB) QueryUsers(q *UserQuery) ([]*User, error) {
+	var col string
+	switch q.Sort {
+	case "":
+		col = UserSortID
+	case UserSortID, UserSortName, UserSortEmail:
+		col = q.Sort
+	default:
+		return nil, fmt.Errorf("Can't sort users by %s", q.Sort)
+	}
+	op, dir := ">", ""
+	if q.Desc {
+		op, dir = "<", " DESC"
+	}
+
+	args := make([]interface{}, 0)
+	query := "SELECT " + userColumns + " FROM users" + q.filter(&args)
+	if q.After != nil {
+		// compare (column, id) as a row so that users with the same
+		// value in the sorted column are neither skipped nor repeated
+		if col == UserSortID {
+			args = append(args, q.After.ID)
+			query += fmt.Sprintf(" AND id %s $%d", op, len(args))
+		} else {
+			args = append(args, q.After.Value, q.After.ID)
+			query += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", col, op, len(args)-1, len(args))
+		}
+	}
+	if col == UserSortID {
+		query += " ORDER BY id" + dir
+	} else {
+		query += " ORDER BY " + col + dir + ", id" + dir
+	}
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	return db.queryUsers(query, args...)
+}
+
+// CountUsers returns how many registered users match the query's filters,
+// across all pages of results.
+func (db *DB) CountUsers(q *UserQuery) (int, error) {
+	args := make([]interface{}, 0)
+	var n int
+	err := db.sqldb.QueryRow("SELECT COUNT(*) FROM users"+q.filter(&args), args...).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (db *DB) queryUsers(query string, args ...interface{}) ([]*User, error) {
+	rows, err := db.sqldb.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// or []*User{}?
 	users := make([]*User, 0)
 	for rows.Next() {
-		// or &User{}?
-		user := new(User)
-		err := rows.Scan(&user.ID, &user.Email, &user.Name, &user.IsAdmin)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -68,49 +376,309 @@ func (db *DB) GetAllUsers() ([]*User, error) {
 }
 
 // GetUserByID returns the registered user with the given ID, or nil if
-// not found.
+// not found. Deactivated users are still returned.
 func (db *DB) GetUserByID(id uint32) (*User, error) {
-	var user User
-	err := db.sqldb.QueryRow("SELECT id, email, name, is_admin FROM users WHERE id = $1", id).
-		Scan(&user.ID, &user.Email, &user.Name, &user.IsAdmin)
+	return scanUser(db.sqldb.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
+// GetUserByEmail returns the registered user with the given email, or nil
+// if not found. The email is normalized first, so it need not match the
+// saved one exactly. Deactivated users are still returned.
+func (db *DB) GetUserByEmail(email string) (*User, error) {
+	normalized, err := NormalizeEmail(email)
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+	return scanUser(db.sqldb.QueryRow("SELECT "+userColumns+" FROM users WHERE email = $1", normalized))
 }
 
-// GetUserByEmail returns the registered user with the given ID, or nil if
-// not found.
-func (db *DB) GetUserByEmail(email string) (*User, error) {
-	var user User
-	err := db.sqldb.QueryRow("SELECT id, email, name, is_admin FROM users WHERE email = $1", email).
-		Scan(&user.ID, &user.Email, &user.Name, &user.IsAdmin)
+// GetUsersByEmails returns a slice with the registered users who have any
+// of the given emails, which must already be normalized. Deactivated users
+// are still returned.
+func (db *DB) GetUsersByEmails(emails []string) ([]*User, error) {
+	return db.queryUsers("SELECT "+userColumns+" FROM users WHERE email = ANY($1) ORDER BY id", pq.Array(emails))
+}
+
+// AddUser adds a user to the database, with their email normalized, and
+// returns the ID that they were given. If another user already has that
+// email, a DuplicateEmailError is returned. New users hold no roles, so
+// they aren't admins until they are given the superadmin role.
+func (db *DB) AddUser(email string, name string) (uint32, error) {
+	normalized, err := NormalizeEmail(email)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare(insertUserStmt)
+	if err != nil {
+		return 0, err
+	}
+	return insertUser(stmt, normalized, name)
+}
+
+// AddUsers adds the given users to the database in a single transaction,
+// so that either all of them are added or none are. As for AddUser, their
+// emails are normalized; both these and their new IDs are set on the
+// given Users. Their IsAdmin is ignored, since new users hold no roles.
+func (db *DB) AddUsers(users []*User) error {
+	normalized := make([]string, len(users))
+	for i, user := range users {
+		email, err := NormalizeEmail(user.Email)
+		if err != nil {
+			return err
+		}
+		normalized[i] = email
+	}
+
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(insertUserStmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	ids := make([]uint32, len(users))
+	for i, user := range users {
+		ids[i], err = insertUser(stmt, normalized[i], user.Name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for i, user := range users {
+		user.ID = ids[i]
+		user.Email = normalized[i]
+		user.Status = UserActive
+	}
+	return nil
+}
+
+const insertUserStmt = "INSERT INTO users(email, name) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING RETURNING id"
+
+// insertUser runs insertUserStmt, prepared as stmt, for a user with an
+// already-normalized email, and returns their new ID.
+func insertUser(stmt *sql.Stmt, email string, name string) (uint32, error) {
+	for {
+		var id uint32
+		err := stmt.QueryRow(email, name).Scan(&id)
+		if err == sql.ErrNoRows {
+			// the ID from the sequence was already taken by a user
+			// from before IDs were allocated this way, so try the
+			// next one
+			continue
+		}
+		if err != nil {
+			return 0, checkDuplicateEmail(err, email)
+		}
+		return id, nil
+	}
+}
+
+// UpdateUser sets the email and name of the user with the given ID. As
+// for AddUser, the email is normalized, and a DuplicateEmailError is
+// returned if another user already has it. Whether the user is an admin
+// is changed by assigning or revoking the superadmin role instead.
+func (db *DB) UpdateUser(id uint32, email string, name string) error {
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+
+	// move out into one-time-prepared statement?
+	stmt, err := db.sqldb.Prepare("UPDATE users SET email = $1, name = $2 WHERE id = $3")
+	if err != nil {
+		return err
+	}
+	res, err := stmt.Exec(normalized, name, id)
+	if err != nil {
+		return checkDuplicateEmail(err, normalized)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("User %d not found", id)
+	}
+	return nil
+}
+
+// DeleteUser deletes the user with the given ID, along with their roles,
+// second factors, API keys and OAuth2 clients, so that none of these can
+// be picked up by a new user who is later given the same ID. This is done
+// in a single transaction, so either all of them are deleted or none are.
+// A LastAdminError is returned if the user is the only active admin.
+func (db *DB) DeleteUser(id uint32) error {
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	err = refuseLastAdmin(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("User %d not found", id)
+	}
+
+	for _, table := range []string{"user_roles", "totpsecrets", "recoverycodes", "apikeys", "oauthclients"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE user_id = $1", id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetUserStatus sets the status of the user with the given ID, recording
+// the given time as when they were suspended or deactivated. Making a
+// user active again clears both times. A LastAdminError is returned if
+// the user is the only active admin and wouldn't be active any more.
+func (db *DB) SetUserStatus(id uint32, status string, at time.Time) error {
+	var query string
+	var args []interface{}
+	switch status {
+	case UserActive:
+		query, args = "UPDATE users SET status = $1, suspended_at = NULL, deactivated_at = NULL WHERE id = $2", []interface{}{status, id}
+	case UserSuspended:
+		query, args = "UPDATE users SET status = $1, suspended_at = $2 WHERE id = $3", []interface{}{status, at, id}
+	case UserDeactivated:
+		query, args = "UPDATE users SET status = $1, deactivated_at = $2 WHERE id = $3", []interface{}{status, at, id}
+	default:
+		return fmt.Errorf("Unknown user status %s", status)
+	}
+
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	if status != UserActive {
+		err = refuseLastAdmin(tx, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	return &user, nil
+	if n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("User %d not found", id)
+	}
+	return tx.Commit()
 }
 
-// AddUser adds a user to the database.
-// Due to PostgreSQL limits on integer size, id must be less than 2147483647.
-// It should typically be created via math/rand's Int31() function and then
-// cast to uint32.
-func (db *DB) AddUser(id uint32, email string, name string, isAdmin bool) error {
-	var maxUserID uint32
-	maxUserID = 2147483647
+// GetPreferences returns the preferences for the user with the given ID,
+// as a JSON object.
+func (db *DB) GetPreferences(id uint32) (string, error) {
+	var prefs string
+	err := db.sqldb.QueryRow("SELECT preferences FROM users WHERE id = $1", id).Scan(&prefs)
+	if err != nil {
+		return "", err
+	}
+	return prefs, nil
+}
 
-	if id > maxUserID {
-		return fmt.Errorf("User id cannot be greater than %d; received %d", maxUserID, id)
+// UpdateProfile sets the name of the user with the given ID and, if
+// update isn't nil, replaces their preferences with what update returns
+// when given the current ones. This is all done in a single transaction
+// that locks the user's row, so that either both are saved or neither is,
+// and so that updates made at the same time are applied one after the
+// other rather than one undoing the other. If update returns an error,
+// nothing is saved and that error is returned.
+func (db *DB) UpdateProfile(id uint32, name string, update func(prefs string) (string, error)) error {
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	var prefs string
+	err = tx.QueryRow("SELECT preferences FROM users WHERE id = $1 FOR UPDATE", id).Scan(&prefs)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("User %d not found", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if update != nil {
+		prefs, err = update(prefs)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
+	_, err = tx.Exec("UPDATE users SET name = $1, preferences = $2 WHERE id = $3", name, prefs, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPasswordHash returns the password hash for the registered user with
+// the given email, or an empty string if that user has no password set.
+// An error is returned if the user is not found.
+func (db *DB) GetPasswordHash(email string) (string, error) {
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return "", err
+	}
+	var hash sql.NullString
+	err = db.sqldb.QueryRow("SELECT password_hash FROM users WHERE email = $1", normalized).Scan(&hash)
+	if err != nil {
+		return "", err
+	}
+	return hash.String, nil
+}
 
+// SetPasswordHash sets the password hash for the user with the given ID.
+// An empty hash removes the user's password.
+func (db *DB) SetPasswordHash(id uint32, hash string) error {
 	// move out into one-time-prepared statement?
-	stmt, err := db.sqldb.Prepare("INSERT INTO users(id, email, name, is_admin) VALUES ($1, $2, $3, $4)")
+	stmt, err := db.sqldb.Prepare("UPDATE users SET password_hash = $1 WHERE id = $2")
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(id, email, name, isAdmin)
+	res, err := stmt.Exec(sql.NullString{String: hash, Valid: hash != ""}, id)
 	if err != nil {
 		return err
 	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("User %d not found", id)
+	}
 	return nil
 }
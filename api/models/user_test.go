@@ -2,9 +2,12 @@ package models
 
 import (
 	"encoding/json"
-	"strings"
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/lib/pq"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
@@ -17,10 +20,12 @@ func TestShouldGetAllUsers(t *testing.T) {
 	defer sqldb.Close()
 	db := DB{sqldb: sqldb}
 
-	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin"}).
-		AddRow(410952, "johndoe@example.com", "John Doe", false).
-		AddRow(8103918, "janedoe@example.com", "Jane Doe", true)
-	mock.ExpectQuery("SELECT id, email, name, is_admin FROM users ORDER BY id").WillReturnRows(sentRows)
+	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin", "status", "suspended_at", "deactivated_at"}).
+		AddRow(410952, "johndoe@example.com", "John Doe", false, "active", nil, nil).
+		AddRow(8103918, "janedoe@example.com", "Jane Doe", true, "active", nil, nil)
+	mock.ExpectQuery(`SELECT id, email, name, EXISTS \(SELECT 1 FROM user_roles WHERE user_id = users.id AND role = 'superadmin'\) AS is_admin, status, suspended_at, deactivated_at FROM users WHERE status <> \$1 ORDER BY id`).
+		WithArgs("deactivated").
+		WillReturnRows(sentRows)
 
 	// run the tested function
 	gotRows, err := db.GetAllUsers()
@@ -63,9 +68,9 @@ func TestShouldGetUserByID(t *testing.T) {
 	defer sqldb.Close()
 	db := DB{sqldb: sqldb}
 
-	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin"}).
-		AddRow(8103918, "janedoe@example.com", "Jane Doe", true)
-	mock.ExpectQuery(`[SELECT id, email, name, is_admin FROM users WHERE id = \$1]`).
+	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin", "status", "suspended_at", "deactivated_at"}).
+		AddRow(8103918, "janedoe@example.com", "Jane Doe", true, "active", nil, nil)
+	mock.ExpectQuery(`SELECT id, email, name, EXISTS \(SELECT 1 FROM user_roles WHERE user_id = users.id AND role = 'superadmin'\) AS is_admin, status, suspended_at, deactivated_at FROM users WHERE id = \$1`).
 		WithArgs(8103918).
 		WillReturnRows(sentRows)
 
@@ -106,14 +111,14 @@ func TestShouldGetUserByEmail(t *testing.T) {
 	defer sqldb.Close()
 	db := DB{sqldb: sqldb}
 
-	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin"}).
-		AddRow(8103918, "janedoe@example.com", "Jane Doe", true)
-	mock.ExpectQuery(`[SELECT id, email, name, is_admin FROM users WHERE email = \$1]`).
+	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin", "status", "suspended_at", "deactivated_at"}).
+		AddRow(8103918, "janedoe@example.com", "Jane Doe", true, "active", nil, nil)
+	mock.ExpectQuery(`SELECT id, email, name, EXISTS \(SELECT 1 FROM user_roles WHERE user_id = users.id AND role = 'superadmin'\) AS is_admin, status, suspended_at, deactivated_at FROM users WHERE email = \$1`).
 		WithArgs("janedoe@example.com").
 		WillReturnRows(sentRows)
 
-	// run the tested function
-	user, err := db.GetUserByEmail("janedoe@example.com")
+	// run the tested function, which normalizes the email first
+	user, err := db.GetUserByEmail("JaneDoe@Example.com")
 	if err != nil {
 		t.Fatalf("expected nil error, got %v", err)
 	}
@@ -140,7 +145,7 @@ func TestShouldGetUserByEmail(t *testing.T) {
 
 }
 
-func TestShouldAddUser(t *testing.T) {
+func TestShouldGetUsersByEmails(t *testing.T) {
 	// set up mock
 	sqldb, mock, err := sqlmock.New()
 	if err != nil {
@@ -149,15 +154,95 @@ func TestShouldAddUser(t *testing.T) {
 	defer sqldb.Close()
 	db := DB{sqldb: sqldb}
 
-	regexStmt := `[INSERT INTO users(id, email, name, is_admin) VALUES (\$1, \$2, \$3, \$4)]`
-	mock.ExpectPrepare(regexStmt)
-	stmt := "INSERT INTO users"
-	mock.ExpectExec(stmt).
-		WithArgs(192304, "johndoe@example.com", "John Doe", false).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin", "status", "suspended_at", "deactivated_at"}).
+		AddRow(8103918, "janedoe@example.com", "Jane Doe", true, "active", nil, nil)
+	mock.ExpectQuery(`SELECT id, email, name, EXISTS \(SELECT 1 FROM user_roles WHERE user_id = users.id AND role = 'superadmin'\) AS is_admin, status, suspended_at, deactivated_at FROM users WHERE email = ANY\(\$1\) ORDER BY id`).
+		WithArgs(pq.Array([]string{"janedoe@example.com", "nobody@example.com"})).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	users, err := db.GetUsersByEmails([]string{"janedoe@example.com", "nobody@example.com"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(users) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(users))
+	}
+	if users[0].Email != "janedoe@example.com" {
+		t.Errorf("expected %v, got %v", "janedoe@example.com", users[0].Email)
+	}
+}
+
+func TestShouldQueryUsersWithFiltersAfterCursor(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin", "status", "suspended_at", "deactivated_at"}).
+		AddRow(410952, "johndoe@example.com", "John Doe", false, "active", nil, nil)
+	mock.ExpectQuery(`SELECT id, email, name, EXISTS \(SELECT 1 FROM user_roles WHERE user_id = users.id AND role = 'superadmin'\) AS is_admin, status, suspended_at, deactivated_at FROM users WHERE status <> \$1 AND EXISTS \(SELECT 1 FROM user_roles WHERE user_id = users.id AND role = 'superadmin'\) = \$2 AND \(name ILIKE \$3 OR email ILIKE \$3\) AND \(name, id\) < \(\$4, \$5\) ORDER BY name DESC, id DESC LIMIT \$6`).
+		WithArgs("deactivated", false, `%doe\_%`, "Steve", 8103918, 10).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	isAdmin := false
+	q := &UserQuery{
+		IsAdmin: &isAdmin,
+		Search:  "doe_",
+		Sort:    UserSortName,
+		Desc:    true,
+		After:   &UserCursor{Value: "Steve", ID: 8103918},
+		Limit:   10,
+	}
+	gotRows, err := db.QueryUsers(q)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if len(gotRows) != 1 {
+		t.Fatalf("expected len %d, got %d", 1, len(gotRows))
+	}
+	cursor := q.CursorFor(gotRows[0])
+	if cursor.Value != "John Doe" || cursor.ID != 410952 {
+		t.Errorf("expected cursor at John Doe, 410952, got %v, %v", cursor.Value, cursor.ID)
+	}
+}
+
+func TestShouldQueryUsersByIDWithStatus(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"id", "email", "name", "is_admin", "status", "suspended_at", "deactivated_at"})
+	mock.ExpectQuery(`SELECT id, email, name, EXISTS \(SELECT 1 FROM user_roles WHERE user_id = users.id AND role = 'superadmin'\) AS is_admin, status, suspended_at, deactivated_at FROM users WHERE status = \$1 AND id > \$2 ORDER BY id$`).
+		WithArgs("suspended", 410952).
+		WillReturnRows(sentRows)
 
 	// run the tested function
-	err = db.AddUser(192304, "johndoe@example.com", "John Doe", false)
+	_, err = db.QueryUsers(&UserQuery{Status: UserSuspended, After: &UserCursor{ID: 410952}})
 	if err != nil {
 		t.Fatalf("expected nil error, got %v", err)
 	}
@@ -169,9 +254,9 @@ func TestShouldAddUser(t *testing.T) {
 	}
 }
 
-func TestShouldNotAddUserWithGreaterThanMaxID(t *testing.T) {
+func TestShouldNotQueryUsersWithUnknownSort(t *testing.T) {
 	// set up mock
-	sqldb, _, err := sqlmock.New()
+	sqldb, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("got error when creating db mock: %v", err)
 	}
@@ -179,17 +264,771 @@ func TestShouldNotAddUserWithGreaterThanMaxID(t *testing.T) {
 	db := DB{sqldb: sqldb}
 
 	// run the tested function
-	err = db.AddUser(2147483648, "oops@example.com", "OOPS", false)
+	_, err = db.QueryUsers(&UserQuery{Sort: "password_hash"})
 	if err == nil {
 		t.Fatalf("expected non-nil error, got nil")
 	}
-	// a non-nil error that's related to sqlmock errors is still wrong
-	if err != nil && strings.Contains(err.Error(), "all expectations were already fulfilled, call to Prepare") {
-		t.Fatalf("didn't expect sqlmock error: %v", err)
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldCountUsersIgnoringCursor(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"count"}).AddRow(42)
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM users WHERE status <> \$1 AND \(name ILIKE \$2 OR email ILIKE \$2\)$`).
+		WithArgs("deactivated", "%100\\%%").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	n, err := db.CountUsers(&UserQuery{Search: `100%`, After: &UserCursor{ID: 410952}, Limit: 10})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if n != 42 {
+		t.Errorf("expected %v, got %v", 42, n)
+	}
+}
+
+func TestShouldAddUser(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	regexStmt := `INSERT INTO users\(email, name\) VALUES \(\$1, \$2\) ON CONFLICT \(id\) DO NOTHING RETURNING id`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectQuery(regexStmt).
+		WithArgs("johndoe@example.com", "John Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(192304))
+
+	// run the tested function
+	id, err := db.AddUser("johndoe@example.com", "John Doe")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if id != 192304 {
+		t.Errorf("expected %v, got %v", 192304, id)
+	}
+}
+
+func TestShouldAddUserWithNormalizedEmail(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("johndoe@example.com", "John Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(192304))
+
+	// run the tested function
+	_, err = db.AddUser("JohnDoe@Example.COM", "John Doe")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldAddUserSkippingTakenID(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	// the first ID from the sequence conflicts, so nothing is returned
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("johndoe@example.com", "John Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("johndoe@example.com", "John Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+
+	// run the tested function
+	id, err := db.AddUser("johndoe@example.com", "John Doe")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if id != 8 {
+		t.Errorf("expected %v, got %v", 8, id)
+	}
+}
+
+func TestShouldNotAddUserWithDuplicateEmail(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("johndoe@example.com", "John Doe").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+
+	// run the tested function
+	_, err = db.AddUser("johndoe@example.com", "John Doe")
+	dupErr, ok := err.(*DuplicateEmailError)
+	if !ok {
+		t.Fatalf("expected DuplicateEmailError, got %v", err)
+	}
+	if dupErr.Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", dupErr.Email)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldCreateInitialAdminWithSuperadminRole(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	prev := os.Getenv("INITIALADMINEMAIL")
+	os.Setenv("INITIALADMINEMAIL", "Admin@Example.com")
+	defer os.Setenv("INITIALADMINEMAIL", prev)
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM users$`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("admin@example.com", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO user_roles\(user_id, role\) VALUES \(\$1, \$2\)`).
+		WithArgs(1, "superadmin").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// run the tested function
+	err = db.createInitialAdmin()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldAddUsersInTransaction(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("johndoe@example.com", "John Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("steve@example.com", "Steve").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectCommit()
+
+	// run the tested function
+	users := []*User{
+		{Email: "JohnDoe@example.com", Name: "John Doe"},
+		{Email: "steve@example.com", Name: "Steve"},
+	}
+	err = db.AddUsers(users)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if users[0].ID != 8 || users[1].ID != 9 {
+		t.Errorf("expected IDs 8 and 9, got %v and %v", users[0].ID, users[1].ID)
+	}
+	if users[0].Email != "johndoe@example.com" {
+		t.Errorf("expected %v, got %v", "johndoe@example.com", users[0].Email)
+	}
+}
+
+func TestShouldRollBackAddUsersWithDuplicateEmail(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO users")
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("steve@example.com", "Steve").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("johndoe@example.com", "John Doe").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+	mock.ExpectRollback()
+
+	// run the tested function
+	users := []*User{
+		{Email: "steve@example.com", Name: "Steve"},
+		{Email: "johndoe@example.com", Name: "John Doe"},
+	}
+	err = db.AddUsers(users)
+	if _, ok := err.(*DuplicateEmailError); !ok {
+		t.Fatalf("expected DuplicateEmailError, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and no IDs were set, since nothing was added
+	if users[0].ID != 0 {
+		t.Errorf("expected %v, got %v", 0, users[0].ID)
+	}
+}
+
+func TestShouldGetPasswordHash(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"password_hash"}).AddRow("$2a$10$abcdef")
+	mock.ExpectQuery(`SELECT password_hash FROM users WHERE email = \$1`).
+		WithArgs("janedoe@example.com").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	hash, err := db.GetPasswordHash("janedoe@example.com")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if hash != "$2a$10$abcdef" {
+		t.Errorf("expected %v, got %v", "$2a$10$abcdef", hash)
+	}
+}
+
+func TestShouldGetEmptyPasswordHashWhenNotSet(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"password_hash"}).AddRow(nil)
+	mock.ExpectQuery(`SELECT password_hash FROM users WHERE email = \$1`).
+		WithArgs("johndoe@example.com").
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	hash, err := db.GetPasswordHash("johndoe@example.com")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if hash != "" {
+		t.Errorf("expected empty string, got %v", hash)
+	}
+}
+
+func TestShouldSetPasswordHash(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	regexStmt := `UPDATE users SET password_hash = \$1 WHERE id = \$2`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("$2a$10$abcdef", 8103918).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// run the tested function
+	err = db.SetPasswordHash(8103918, "$2a$10$abcdef")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotSetPasswordHashForUnknownUser(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	regexStmt := `UPDATE users SET password_hash = \$1 WHERE id = \$2`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("$2a$10$abcdef", 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// run the tested function
+	err = db.SetPasswordHash(5, "$2a$10$abcdef")
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
+
+// ===== JSON marshalling and unmarshalling =====
+func TestShouldUpdateUser(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	regexStmt := `UPDATE users SET email = \$1, name = \$2 WHERE id = \$3`
+	mock.ExpectPrepare(regexStmt)
+	mock.ExpectExec(regexStmt).
+		WithArgs("janedoe@example.com", "Jane Q. Doe", 8103918).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// run the tested function
+	err = db.UpdateUser(8103918, "janedoe@example.com", "Jane Q. Doe")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldDeleteUserAndTheirRows(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(914611345))
+	mock.ExpectExec(`DELETE FROM users WHERE id = \$1`).
+		WithArgs(8103918).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, table := range []string{"user_roles", "totpsecrets", "recoverycodes", "apikeys", "oauthclients"} {
+		mock.ExpectExec(`DELETE FROM ` + table + ` WHERE user_id = \$1`).
+			WithArgs(8103918).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	// run the tested function
+	err = db.DeleteUser(8103918)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotDeleteUnknownUser(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(914611345))
+	mock.ExpectExec(`DELETE FROM users WHERE id = \$1`).
+		WithArgs(8103918).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	// run the tested function
+	err = db.DeleteUser(8103918)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldRollBackDeleteUserOnError(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(914611345))
+	mock.ExpectExec(`DELETE FROM users WHERE id = \$1`).
+		WithArgs(8103918).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM user_roles WHERE user_id = \$1`).
+		WithArgs(8103918).
+		WillReturnError(fmt.Errorf("connection reset"))
+	mock.ExpectRollback()
+
+	// run the tested function
+	err = db.DeleteUser(8103918)
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotDeleteLastAdmin(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(914611345))
+	mock.ExpectRollback()
+
+	// run the tested function
+	err = db.DeleteUser(914611345)
+	if _, ok := err.(*LastAdminError); !ok {
+		t.Fatalf("expected LastAdminError, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotSuspendLastAdmin(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(914611345))
+	mock.ExpectRollback()
+
+	// run the tested function
+	err = db.SetUserStatus(914611345, UserSuspended, time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC))
+	if _, ok := err.(*LastAdminError); !ok {
+		t.Fatalf("expected LastAdminError, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldSuspendUser(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	suspended := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_roles.user_id FROM user_roles JOIN users ON users.id = user_roles.user_id WHERE user_roles.role = \$1 AND users.status = \$2 FOR UPDATE`).
+		WithArgs("superadmin", "active").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(914611345))
+	mock.ExpectExec(`UPDATE users SET status = \$1, suspended_at = \$2 WHERE id = \$3`).
+		WithArgs("suspended", suspended, 8103918).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// run the tested function
+	err = db.SetUserStatus(8103918, UserSuspended, suspended)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldReactivateUser(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE users SET status = \$1, suspended_at = NULL, deactivated_at = NULL WHERE id = \$2`).
+		WithArgs("active", 8103918).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// run the tested function
+	err = db.SetUserStatus(8103918, UserActive, time.Now())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestShouldNotSetUnknownUserStatus(t *testing.T) {
+	db := DB{}
+
+	err := db.SetUserStatus(8103918, "banished", time.Now())
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+}
+
+func TestShouldGetPreferences(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	sentRows := sqlmock.NewRows([]string{"preferences"}).AddRow(`{"theme":"dark"}`)
+	mock.ExpectQuery(`SELECT preferences FROM users WHERE id = \$1`).
+		WithArgs(8103918).
+		WillReturnRows(sentRows)
+
+	// run the tested function
+	prefs, err := db.GetPreferences(8103918)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check returned values
+	if prefs != `{"theme":"dark"}` {
+		t.Errorf("expected %v, got %v", `{"theme":"dark"}`, prefs)
+	}
+}
+
+func TestShouldUpdateProfileInOneTransaction(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT preferences FROM users WHERE id = \$1 FOR UPDATE`).
+		WithArgs(8103918).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow(`{"theme":"light"}`))
+	mock.ExpectExec(`UPDATE users SET name = \$1, preferences = \$2 WHERE id = \$3`).
+		WithArgs("Johnny", `{"theme":"dark"}`, 8103918).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// run the tested function
+	var got string
+	err = db.UpdateProfile(8103918, "Johnny", func(prefs string) (string, error) {
+		got = prefs
+		return `{"theme":"dark"}`, nil
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// and check that update was given the current preferences
+	if got != `{"theme":"light"}` {
+		t.Errorf("expected %v, got %v", `{"theme":"light"}`, got)
+	}
+}
+
+func TestShouldRollBackUpdateProfileIfUpdateFails(t *testing.T) {
+	// set up mock
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("got error when creating db mock: %v", err)
+	}
+	defer sqldb.Close()
+	db := DB{sqldb: sqldb}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT preferences FROM users WHERE id = \$1 FOR UPDATE`).
+		WithArgs(8103918).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow(`{}`))
+	mock.ExpectRollback()
+
+	// run the tested function
+	err = db.UpdateProfile(8103918, "Johnny", func(prefs string) (string, error) {
+		return "", fmt.Errorf("too long")
+	})
+	if err == nil {
+		t.Fatalf("expected non-nil error, got nil")
+	}
+
+	// check sqlmock expectations
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
 	}
 }
 
-// ===== JSON marshalling and unmarshalling =====
 func TestCanMarshalAdminUserToJSON(t *testing.T) {
 	user := &User{
 		ID:      85010942,
@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryLimiter is a Limiter that keeps its buckets in memory, so limits
+// only apply within a single process.
+type MemoryLimiter struct {
+	rate    Rate
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewMemoryLimiter creates and returns a new MemoryLimiter for the given
+// rate.
+func NewMemoryLimiter(rate Rate) *MemoryLimiter {
+	return &MemoryLimiter{rate: rate, buckets: make(map[string]*bucket)}
+}
+
+// refill returns the tokens in the bucket as of now.
+func (ml *MemoryLimiter) refill(b *bucket, now time.Time) float64 {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(ml.rate.Limit), b.tokens+elapsed*ml.rate.perSecond())
+}
+
+// Allow takes a token from the bucket for key, if there is one.
+func (ml *MemoryLimiter) Allow(key string, now time.Time) (*Result, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	b, ok := ml.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(ml.rate.Limit), updated: now}
+		ml.buckets[key] = b
+	}
+	b.tokens = ml.refill(b, now)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return newResult(ml.rate, allowed, b.tokens), nil
+}
+
+// Prune forgets buckets that have refilled completely.
+func (ml *MemoryLimiter) Prune(now time.Time) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	for key, b := range ml.buckets {
+		if ml.refill(b, now) >= float64(ml.rate.Limit) {
+			delete(ml.buckets, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package ratelimit defines the interface used to limit how often
+// callers may make requests, using token buckets, along with in-memory
+// (single replica) and shared-store (several replicas) implementations.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate describes a token bucket that holds up to Limit tokens and refills
+// at Limit tokens per Period. Each request takes one token, so callers
+// can make bursts of up to Limit requests, and Limit requests per Period
+// on average.
+type Rate struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRate parses a rate written as "limit/period", such as "10/1m".
+func ParseRate(s string) (Rate, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Rate{}, fmt.Errorf("Rate %q must be of the form limit/period, such as 10/1m", s)
+	}
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit <= 0 {
+		return Rate{}, fmt.Errorf("Rate %q must have a positive limit", s)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return Rate{}, fmt.Errorf("Rate %q must have a positive period", s)
+	}
+	return Rate{Limit: limit, Period: period}, nil
+}
+
+// perSecond returns how many tokens are added to the bucket each second.
+func (rate Rate) perSecond() float64 {
+	return float64(rate.Limit) / rate.Period.Seconds()
+}
+
+// Result describes the outcome of a request to a Limiter, with the
+// details needed for RateLimit-* and Retry-After response headers.
+type Result struct {
+	Allowed bool
+	Limit   int
+	// requests that could still be made right now
+	Remaining int
+	// time until the bucket is full again
+	Reset time.Duration
+	// time until the next request would be allowed, if this one wasn't
+	RetryAfter time.Duration
+}
+
+// newResult works out a Result from the tokens left in a bucket.
+func newResult(rate Rate, allowed bool, tokens float64) *Result {
+	res := &Result{
+		Allowed:   allowed,
+		Limit:     rate.Limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(rate.Limit) - tokens) / rate.perSecond() * float64(time.Second)),
+	}
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / rate.perSecond() * float64(time.Second))
+	}
+	return res
+}
+
+// Limiter defines the interface to be implemented by rate limiters,
+// using either memory (single replica) or a shared store (several
+// replicas).
+type Limiter interface {
+	// Allow takes a token from the bucket for key, if there is one.
+	Allow(key string, now time.Time) (*Result, error)
+	// Prune forgets buckets that have been full for a while, since
+	// they're the same as buckets that were never used.
+	Prune(now time.Time) error
+}
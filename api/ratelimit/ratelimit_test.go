@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCanParseRate(t *testing.T) {
+	rate, err := ParseRate("10/1m")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if rate.Limit != 10 {
+		t.Errorf("expected %v, got %v", 10, rate.Limit)
+	}
+	if rate.Period != time.Minute {
+		t.Errorf("expected %v, got %v", time.Minute, rate.Period)
+	}
+
+	for _, s := range []string{"", "10", "0/1m", "10/0s", "ten/1m", "10/soon"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("%q: expected non-nil error, got nil", s)
+		}
+	}
+}
+
+func TestMemoryLimiterAllowsBurstThenRefills(t *testing.T) {
+	ml := NewMemoryLimiter(Rate{Limit: 3, Period: 30 * time.Second})
+	now := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		res, err := ml.Allow("1.2.3.4", now)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if !res.Allowed {
+			t.Fatalf("request %d: expected to be allowed, but it wasn't", i)
+		}
+		if res.Remaining != 2-i {
+			t.Errorf("expected %v, got %v", 2-i, res.Remaining)
+		}
+	}
+
+	res, _ := ml.Allow("1.2.3.4", now)
+	if res.Allowed {
+		t.Fatalf("expected to be denied, but it wasn't")
+	}
+	if res.RetryAfter != 10*time.Second {
+		t.Errorf("expected %v, got %v", 10*time.Second, res.RetryAfter)
+	}
+	if res.Reset != 30*time.Second {
+		t.Errorf("expected %v, got %v", 30*time.Second, res.Reset)
+	}
+
+	// other keys have their own buckets
+	if res, _ := ml.Allow("5.6.7.8", now); !res.Allowed {
+		t.Errorf("expected to be allowed, but it wasn't")
+	}
+
+	// one token comes back every ten seconds
+	if res, _ := ml.Allow("1.2.3.4", now.Add(10*time.Second)); !res.Allowed {
+		t.Errorf("expected to be allowed, but it wasn't")
+	}
+	if res, _ := ml.Allow("1.2.3.4", now.Add(10*time.Second)); res.Allowed {
+		t.Errorf("expected to be denied, but it wasn't")
+	}
+}
+
+func TestMemoryLimiterPrunesFullBuckets(t *testing.T) {
+	ml := NewMemoryLimiter(Rate{Limit: 3, Period: 30 * time.Second})
+	now := time.Date(2018, time.December, 17, 0, 0, 0, 0, time.UTC)
+	ml.Allow("1.2.3.4", now)
+	ml.Allow("5.6.7.8", now.Add(25*time.Second))
+
+	ml.Prune(now.Add(30 * time.Second))
+	if len(ml.buckets) != 1 {
+		t.Errorf("expected len %d, got %d", 1, len(ml.buckets))
+	}
+	if _, ok := ml.buckets["5.6.7.8"]; !ok {
+		t.Errorf("expected bucket for 5.6.7.8 to be kept, but it wasn't")
+	}
+}
+
+type testStore struct {
+	keys []string
+}
+
+func (ts *testStore) TakeRateLimitToken(key string, capacity float64, perSecond float64, now time.Time) (bool, float64, error) {
+	ts.keys = append(ts.keys, key)
+	return false, 0.5, nil
+}
+
+func (ts *testStore) DeleteStaleRateLimits(before time.Time) error {
+	return nil
+}
+
+func TestStoreLimiterUsesPrefixedKeys(t *testing.T) {
+	ts := &testStore{}
+	sl := NewStoreLimiter(ts, Rate{Limit: 6, Period: time.Minute}, "ip:")
+
+	res, err := sl.Allow("1.2.3.4", time.Now())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(ts.keys) != 1 || ts.keys[0] != "ip:1.2.3.4" {
+		t.Errorf("expected %v, got %v", []string{"ip:1.2.3.4"}, ts.keys)
+	}
+	if res.Allowed {
+		t.Errorf("expected to be denied, but it wasn't")
+	}
+	if res.RetryAfter != 5*time.Second {
+		t.Errorf("expected %v, got %v", 5*time.Second, res.RetryAfter)
+	}
+}
@@ -0,0 +1,43 @@
+package ratelimit
+
+import "time"
+
+// TokenStore defines the interface to be implemented by shared stores of
+// token buckets, such as a database table. TakeRateLimitToken must refill
+// the bucket for key to as of now, and then take one token from it if
+// there is one, as a single atomic operation. It returns whether a token
+// was taken, and how many are left.
+type TokenStore interface {
+	TakeRateLimitToken(key string, capacity float64, perSecond float64, now time.Time) (bool, float64, error)
+	DeleteStaleRateLimits(before time.Time) error
+}
+
+// StoreLimiter is a Limiter that keeps its buckets in a TokenStore, so
+// that limits hold across every process sharing the store.
+type StoreLimiter struct {
+	rate   Rate
+	store  TokenStore
+	prefix string
+}
+
+// NewStoreLimiter creates and returns a new StoreLimiter for the given
+// rate. The prefix is added to every key, so that limiters with
+// different rates can share a store.
+func NewStoreLimiter(store TokenStore, rate Rate, prefix string) *StoreLimiter {
+	return &StoreLimiter{rate: rate, store: store, prefix: prefix}
+}
+
+// Allow takes a token from the bucket for key, if there is one.
+func (sl *StoreLimiter) Allow(key string, now time.Time) (*Result, error) {
+	allowed, tokens, err := sl.store.TakeRateLimitToken(sl.prefix+key, float64(sl.rate.Limit), sl.rate.perSecond(), now)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(sl.rate, allowed, tokens), nil
+}
+
+// Prune deletes buckets that haven't been used for long enough to have
+// refilled completely.
+func (sl *StoreLimiter) Prune(now time.Time) error {
+	return sl.store.DeleteStaleRateLimits(now.Add(-sl.rate.Period))
+}
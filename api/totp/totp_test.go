@@ -0,0 +1,73 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test vectors, for the SHA-1 seed
+func TestHOTPMatchesRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range vectors {
+		got := hotp(key, uint64(Step(time.Unix(unix, 0))), 8)
+		if got != want {
+			t.Errorf("at %d: expected %v, got %v", unix, want, got)
+		}
+	}
+}
+
+func TestCanValidateCodeWithinSkew(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	now := time.Unix(1500000000, 0)
+
+	code, err := Code(secret, Step(now)-1)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	step, ok := Validate(secret, code, now, 1)
+	if !ok {
+		t.Fatalf("expected code to be valid, but it wasn't")
+	}
+	if step != Step(now)-1 {
+		t.Errorf("expected %v, got %v", Step(now)-1, step)
+	}
+
+	// but not outside it
+	if _, ok := Validate(secret, code, now.Add(2*Period), 1); ok {
+		t.Errorf("expected code to be invalid, but it wasn't")
+	}
+}
+
+func TestCannotValidateMalformedCode(t *testing.T) {
+	secret, _ := GenerateSecret()
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(secret, code, time.Now(), 1); ok {
+			t.Errorf("%q: expected code to be invalid, but it wasn't", code)
+		}
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("containerapp", "janedoe@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/containerapp:janedoe@example.com?") {
+		t.Errorf("unexpected URI prefix: %s", uri)
+	}
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("expected secret in URI, got %s", uri)
+	}
+	if !strings.Contains(uri, "issuer=containerapp") {
+		t.Errorf("expected issuer in URI, got %s", uri)
+	}
+}
@@ -1,6 +1,5 @@
 import React, { Component } from 'react';
-import { BrowserRouter as Router, Route, Switch } from "react-router-dom";
-import axios from 'axios';
+import { BrowserRouter as Router, Redirect, Route, Switch } from "react-router-dom";
 import 'semantic-ui-css/semantic.min.css';
 
 import LoginPane from './LoginPane.js';
@@ -19,12 +18,14 @@ class App extends Component {
       history: null,
       users: null,
       emailInputContents: "",
+      mfaCodeContents: "",
+      mfaToken: null,
       pathInputContents: "",
       newUserName: "",
       newUserEmail: "",
       newUserIsAdmin: false,
       lastPathResponse: null,
-      jwtToken: null,
+      loggedIn: false,
       myself: {
         isKnownUser: false,
         name: "",
@@ -40,7 +41,8 @@ class App extends Component {
     this.handleNewUserSubmit = this.handleNewUserSubmit.bind(this)
     this.handleLogout = this.handleLogout.bind(this)
     this.isLoggedIn = this.isLoggedIn.bind(this)
-    this.setToken = this.setToken.bind(this)
+    this.setLoggedIn = this.setLoggedIn.bind(this)
+    this.setMFAToken = this.setMFAToken.bind(this)
     this.resetMyself = this.resetMyself.bind(this)
     this.setMyself = this.setMyself.bind(this)
     this.refreshHistory = this.refreshHistory.bind(this)
@@ -49,13 +51,16 @@ class App extends Component {
   }
 
   componentDidMount() {
-    // create token manager and fetch token
-    this.tokenManager = new TokenManager(APIROOT, this.setToken, this.setMyself)
+    // create token manager, which keeps the session in cookies
+    this.tokenManager = new TokenManager(APIROOT, this.setLoggedIn, this.setMyself, this.setMFAToken)
 
-    // load token from local storage if it's already there
-    const checkToken = localStorage.getItem("apitoken")
-    if (checkToken) {
-      this.setToken(checkToken)
+    // tokens used to be kept in local storage, where any script could
+    // read them; make sure none are left behind
+    localStorage.removeItem("apitoken")
+
+    // pick up the session if we're already logged in
+    if (this.tokenManager.hasSession()) {
+      this.setLoggedIn(true)
     }
   }
 
@@ -63,7 +68,7 @@ class App extends Component {
     if (this.state === undefined) {
       return false;
     }
-    return this.state.jwtToken !== null && this.state.jwtToken !== undefined
+    return this.state.loggedIn
   }
 
   handlePathInputChange = (e) => {
@@ -73,14 +78,8 @@ class App extends Component {
   handlePathInputSubmit = (e) => {
     e.preventDefault();
     // call to retrieve JSON and update state
-    const requestedEndpoint = APIROOT + '/' + this.state.pathInputContents;
-    const config = {
-      headers: {
-          "Authorization": "Bearer " + this.state.jwtToken,
-          "Content-Type": "application/json"
-      }
-    }
-    axios.get(requestedEndpoint, config)
+    const requestedEndpoint = '/' + this.state.pathInputContents;
+    this.tokenManager.client.get(requestedEndpoint)
       .then(res => {
         this.setState({
           lastPathResponse: res.data,
@@ -114,7 +113,7 @@ class App extends Component {
   handleNewUserSubmit = (e) => {
     e.preventDefault();
     // call to retrieve JSON and update state
-    const requestedEndpoint = APIROOT + '/admin/users';
+    const requestedEndpoint = '/admin/users';
     const data = {
       name: this.state.newUserName,
       email: this.state.newUserEmail,
@@ -123,11 +122,10 @@ class App extends Component {
     const config = {
       headers: {
           'X-Requested-With': 'XMLHttpRequest',
-          "Authorization": "Bearer " + this.state.jwtToken,
           "Content-Type": "application/json"
       }
     }
-    axios.post(requestedEndpoint, data, config)
+    this.tokenManager.client.post(requestedEndpoint, data, config)
       .then(res => {
         this.setState({
           newUserName: "",
@@ -143,16 +141,19 @@ class App extends Component {
       });
   }
 
-  setToken = (token) => {
-    this.setState({jwtToken: token});
-    if (token === null) {
-      localStorage.removeItem("apitoken");
+  setLoggedIn = (loggedIn) => {
+    this.setState({loggedIn});
+    if (loggedIn) {
+      this.tokenManager.fetchLoginInfo();
     } else {
-      localStorage.setItem("apitoken", token);
-      this.tokenManager.fetchLoginInfo(token);
+      this.resetMyself();
     }
   }
 
+  setMFAToken = (mfaToken) => {
+    this.setState({mfaToken, mfaCodeContents: ""});
+  }
+
   resetMyself = () => {
     this.setState({myself: {
       isKnownUser: false,
@@ -172,14 +173,7 @@ class App extends Component {
 
   refreshHistory() {
     // call to retrieve JSON and update state
-    const historyEndpoint = APIROOT + '/admin/history';
-    const config = {
-      headers: {
-          "Authorization": "Bearer " + this.state.jwtToken,
-          "Content-Type": "application/json"
-      }
-    }
-    axios.get(historyEndpoint, config)
+    this.tokenManager.client.get('/admin/history')
       .then(res => {
         const history = res.data;
         this.setState({history});
@@ -192,14 +186,7 @@ class App extends Component {
 
   refreshUsers() {
     // call to retrieve JSON and update state
-    const usersEndpoint = APIROOT + '/admin/users';
-    const config = {
-      headers: {
-          "Authorization": "Bearer " + this.state.jwtToken,
-          "Content-Type": "application/json"
-      }
-    }
-    axios.get(usersEndpoint, config)
+    this.tokenManager.client.get('/admin/users')
       .then(res => {
         const users = res.data;
         this.setState({users});
@@ -220,15 +207,22 @@ class App extends Component {
   }
 
   handleEmailInputSubmit = (e) => {
-    this.tokenManager.fetchToken(this.state.emailInputContents);
+    this.tokenManager.requestLoginCode(this.state.emailInputContents);
     this.setState({emailInputContents: ""});
   }
 
+  handleMFACodeChange = (e) => {
+    this.setState({mfaCodeContents: e.target.value});
+  }
+
+  handleMFACodeSubmit = (e) => {
+    this.tokenManager.submitMFACode(this.state.mfaToken, this.state.mfaCodeContents);
+  }
+
   handleLogout = (e) => {
     e.preventDefault();
     this.setState({lastPathResponse: null});
-    this.resetMyself();
-    this.setToken(null);
+    this.tokenManager.logout();
   }
 
   render() {
@@ -241,8 +235,19 @@ class App extends Component {
                   emailInputValue={this.state.emailInputContents}
                   onChange={this.handleEmailInputChange}
                   onSubmit={this.handleEmailInputSubmit}
+                  mfaToken={this.state.mfaToken}
+                  mfaCodeValue={this.state.mfaCodeContents}
+                  onMFACodeChange={this.handleMFACodeChange}
+                  onMFACodeSubmit={this.handleMFACodeSubmit}
                 />
               }/>
+            <Route path="/verify" render={(props) => {
+                const code = new URLSearchParams(props.location.search).get("code");
+                if (code !== null && !this.isLoggedIn()) {
+                  this.tokenManager.fetchToken(code);
+                }
+                return <Redirect to='/' />
+              }}/>
             <Route path="/app">
               <div className="App">
                 <header className="App-header">
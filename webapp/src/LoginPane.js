@@ -7,6 +7,28 @@ function LoginPane(props) {
         return <Redirect to='/app' />
     }
 
+    // users with two-factor authentication have one more step
+    if (props.mfaToken !== null) {
+        return (
+            <div className="App">
+                <header className="App-header">
+                    <div>
+                        <Form onSubmit={props.onMFACodeSubmit}>
+                            <Form.Field>
+                                <Label>Authentication code or recovery code</Label>
+                                <Form.Input type="text"
+                                            autoComplete="one-time-code"
+                                            value={props.mfaCodeValue}
+                                            onChange={props.onMFACodeChange} />
+                                <Form.Button icon="arrow right" />
+                            </Form.Field>
+                        </Form>
+                    </div>
+                </header>
+            </div>
+        );
+    }
+
     return (
         <div className="App">
             <header className="App-header">
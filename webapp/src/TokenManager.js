@@ -1,49 +1,141 @@
 import axios from 'axios';
 
+// the API is run in session mode, where it keeps tokens in HttpOnly
+// cookies that scripts can't read, along with a readable CSRF token
+// that has to be echoed back in a header on requests that change state
+const CSRF_COOKIE = "csrf_token";
+const CSRF_HEADER = "X-CSRF-Token";
+
+// readCookie returns the value of the named cookie, or null if it isn't set.
+function readCookie(name) {
+    const prefix = name + "=";
+    const found = document.cookie.split(";")
+        .map(c => c.trim())
+        .find(c => c.startsWith(prefix));
+    return (found === undefined) ? null : decodeURIComponent(found.substring(prefix.length));
+}
+
+function isSafeMethod(method) {
+    return ["GET", "HEAD", "OPTIONS"].includes(method.toUpperCase());
+}
+
 class TokenManager {
-    constructor(apiroot, onFetchToken, onFetchLoginInfo) {
+    constructor(apiroot, onLogin, onFetchLoginInfo, onMFARequired) {
         this.apiroot = apiroot;
-        this.onFetchToken = onFetchToken;
+        this.onLogin = onLogin;
         this.onFetchLoginInfo = onFetchLoginInfo;
+        this.onMFARequired = onMFARequired;
+
+        // all calls to the API go through this client, so that the
+        // browser sends the session cookies and the CSRF header is set
+        this.client = axios.create({
+            baseURL: apiroot,
+            withCredentials: true
+        });
+        this.client.interceptors.request.use(config => {
+            if (!isSafeMethod(config.method || "get")) {
+                const csrfToken = readCookie(CSRF_COOKIE);
+                if (csrfToken !== null) {
+                    config.headers[CSRF_HEADER] = csrfToken;
+                }
+            }
+            return config;
+        });
+
+        // access tokens only last a few minutes, so when one is turned
+        // down, use the refresh token cookie to get a new one and then try
+        // the request again, once. Logins and refreshes themselves aren't
+        // retried, but logging out is, so that the session is still ended
+        this.refreshing = null;
+        this.client.interceptors.response.use(null, err => {
+            const config = err.config;
+            const isLogin = config.url.includes("/oauth/") && !config.url.endsWith("/oauth/logout");
+            if (err.response === undefined || err.response.status !== 401 ||
+                config.retried || isLogin) {
+                return Promise.reject(err);
+            }
+            config.retried = true;
+            return this.refresh().then(() => this.client(config));
+        });
 
         // bind handlers
+        this.hasSession = this.hasSession.bind(this);
+        this.requestLoginCode = this.requestLoginCode.bind(this);
         this.fetchToken = this.fetchToken.bind(this);
+        this.submitMFACode = this.submitMFACode.bind(this);
         this.fetchLoginInfo = this.fetchLoginInfo.bind(this);
+        this.refresh = this.refresh.bind(this);
+        this.logout = this.logout.bind(this);
+    }
+
+    hasSession() {
+        // the CSRF cookie lasts as long as the session does
+        return readCookie(CSRF_COOKIE) !== null;
     }
 
-    fetchToken(email) {
+    requestLoginCode(email) {
         // need to send request as form encoded data, not as JSON
+        // the API emails a login link rather than returning a token
         var params = new URLSearchParams();
         params.append('email', email);
-        axios.post(this.apiroot + "/oauth/getToken", params)
+        this.client.post("/oauth/getToken", params)
+        .catch(err => {
+            console.log("error: " + err);
+        });
+    }
+
+    fetchToken(code) {
+        // exchange the code from the emailed login link for a session;
+        // the tokens come back as cookies rather than in the response,
+        // unless the user has two-factor authentication and still has to
+        // enter an authentication code
+        var params = new URLSearchParams();
+        params.append('code', code);
+        this.client.post("/oauth/verify", params)
         .then(res => {
-            const token = res.data.token;
-            this.onFetchToken(token);
+            if (res.data.mfa_required) {
+                this.onMFARequired(res.data.mfa_token);
+            } else {
+                this.onLogin(true);
+            }
         })
         .catch(err => {
             // FIXME should probably take a callback from
             // FIXME caller for what to do on error
-            this.onFetchToken(null);
+            this.onLogin(false);
             console.log("error: " + err);
         });
     }
 
-    fetchLoginInfo(token) {
-        if (token === null) {
-            this.onFetchLoginInfo(null);
+    submitMFACode(mfaToken, code) {
+        // codes from an authenticator app are six digits; anything else
+        // is taken to be one of the user's recovery codes
+        var params = new URLSearchParams();
+        params.append('mfa_token', mfaToken);
+        code = code.trim();
+        if (/^[0-9]{6}$/.test(code)) {
+            params.append('code', code);
+        } else {
+            params.append('recovery_code', code);
         }
+        this.client.post("/oauth/mfa", params)
+        .then(res => {
+            this.onMFARequired(null);
+            this.onLogin(true);
+        })
+        .catch(err => {
+            // each MFA token only allows one attempt, so a wrong code
+            // means starting the login over
+            this.onMFARequired(null);
+            this.onLogin(false);
+            console.log("error: " + err);
+        });
+    }
 
-        const url = this.apiroot + "/landing";
-        const config = {
-            headers: {
-                "Authorization": "Bearer " + token,
-                "Content-Type": "application/json"
-            }
-        }
-        
+    fetchLoginInfo() {
         // FIXME should also check for "unauthorized" returns,
         // FIXME e.g. if token is invalid or indicates caller is not logged in
-        axios.get(url, config)
+        this.client.get("/landing")
         .then(res => {
             if (res.status === 200) {
                 let myself = {
@@ -63,6 +155,36 @@ class TokenManager {
             console.log("error: " + err)
         });
     }
+
+    refresh() {
+        // several requests can fail together when the access token
+        // expires, but they all wait on the same refresh
+        if (this.refreshing === null) {
+            this.refreshing = this.client.post("/oauth/refresh", new URLSearchParams())
+            .then(res => {
+                this.refreshing = null;
+            })
+            .catch(err => {
+                // the session has ended, so we'll need to log in again
+                this.refreshing = null;
+                this.onLogin(false);
+                throw err;
+            });
+        }
+        return this.refreshing;
+    }
+
+    logout() {
+        // the API revokes the session and clears its cookies; either way
+        // we're logged out here
+        this.client.post("/oauth/logout")
+        .catch(err => {
+            console.log("error: " + err);
+        })
+        .then(() => {
+            this.onLogin(false);
+        });
+    }
 }
 
 export default TokenManager;